@@ -4,21 +4,104 @@
 package api
 
 import (
+    "context"
+    "crypto/rand"
+    "fmt"
     "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/auth"
+    "github.com/yaoweihua/wallet-service/config"
+    "github.com/yaoweihua/wallet-service/events"
     "github.com/yaoweihua/wallet-service/handler"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/policy"
+    "github.com/yaoweihua/wallet-service/repository"
     "github.com/yaoweihua/wallet-service/service"
+    "github.com/yaoweihua/wallet-service/utils"
     "github.com/jmoiron/sqlx"
     "github.com/go-redis/redis/v8"
 )
 
 // SetupRoutes sets up the Gin routes.
-func SetupRoutes(r *gin.Engine, dbConn *sqlx.DB, redisClient *redis.Client) {
+// Background workers started here run until ctx is cancelled. It returns an error if the configuration cannot be used,
+// and the service must not start then.
+func SetupRoutes(ctx context.Context, r *gin.Engine, cfg *config.Config, dbConn *sqlx.DB, redisClient *redis.Client) error {
+    // All money-moving services share one locker, so that they serialise on the same user balance locks.
+    locker := newLocker(cfg, dbConn, redisClient)
+    switchFencingBackend(ctx, cfg, dbConn)
+    mode := service.ConcurrencyMode(cfg.ConcurrencyMode)
+    fees, err := newFeeSchedule(cfg)
+    if err != nil {
+        return err
+    }
+    methods := newPaymentMethods(cfg)
+    rates := newRateProvider(cfg)
+    limits, err := newLimitSchedule(cfg, rates)
+    if err != nil {
+        return err
+    }
+
     // Initialize the Service layer and pass the redisClient.
-    depositService := service.NewDepositService(dbConn, redisClient)
-    withdrawService := service.NewWithdrawService(dbConn, redisClient)
-    transferService := service.NewTransferService(dbConn, redisClient)
+    depositService := service.NewDepositService(dbConn, redisClient, locker, mode, fees, methods)
+    withdrawService := service.NewWithdrawService(dbConn, redisClient, locker, mode, fees, methods, limits)
+    transferService := service.NewTransferService(dbConn, redisClient, locker, mode, fees, limits)
     balanceService := service.NewBalanceService(dbConn, redisClient)
     transactionService := service.NewTransactionService(dbConn)
+    ledgerService := service.NewLedgerService(dbConn)
+    userService := service.NewUserService(dbConn, redisClient)
+    fxService := service.NewFXService(dbConn, rates, cfg.FXQuoteTTL)
+    settlementService := service.NewSettlementService(dbConn, redisClient, locker, mode)
+    holdService := service.NewHoldService(dbConn, redisClient, locker, mode, cfg.HoldTTL, limits)
+    refundService := service.NewRefundService(dbConn, redisClient, locker, mode, newRefundPolicy(cfg), rates)
+    statementService := service.NewStatementService(dbConn)
+    apiKeyService := service.NewAPIKeyService(dbConn, redisClient, cfg.APIKeyRotationGrace, cfg.APIKeySignatureTolerance)
+    adjustmentService := service.NewAdjustmentService(dbConn, redisClient, locker, mode)
+    limitService := service.NewLimitService(dbConn, limits)
+    scheduleService := service.NewScheduleService(dbConn, transferService)
+    batchService := service.NewBatchService(dbConn, transferService)
+    webhookService := service.NewWebhookService(dbConn, service.WebhookOptions{
+        Timeout:     cfg.WebhookTimeout,
+        MaxAttempts: cfg.WebhookMaxAttempts,
+        RetryBase:   cfg.WebhookRetryBase,
+        RetryMax:    cfg.WebhookRetryMax,
+    })
+
+    // The policy layer between the handlers and the services, resolving what callers may do from the roles in the database
+    enforcer := policy.NewEnforcer(dbConn, cfg.RBACCacheTTL)
+
+    // Settle asynchronous payouts in the background, unless disabled
+    if cfg.SettlementInterval > 0 {
+        provider, err := newSettlementProvider(cfg)
+        if err != nil {
+            return err
+        }
+        go service.NewSettlementWorker(settlementService, provider, cfg.SettlementInterval).Run(ctx)
+    }
+
+    // Release holds that were neither captured nor voided in time, unless disabled
+    if cfg.HoldExpiryInterval > 0 {
+        go holdService.RunExpiry(ctx, cfg.HoldExpiryInterval)
+    }
+
+    // Make the scheduled transfers that are due, unless disabled
+    if cfg.ScheduleInterval > 0 {
+        go scheduleService.Run(ctx, cfg.ScheduleInterval)
+    }
+
+    // Deliver the events of their wallets to the webhook endpoints of merchants, unless disabled
+    var publishers events.Multi
+    if publisher := newPublisher(cfg, redisClient); publisher != nil {
+        publishers = append(publishers, publisher)
+    }
+    if cfg.WebhookInterval > 0 {
+        publishers = append(publishers, webhookService)
+        go webhookService.Run(ctx, cfg.WebhookInterval)
+    }
+
+    // Publish the domain events written to the outbox, unless disabled
+    if len(publishers) > 0 && cfg.OutboxInterval > 0 {
+        go service.NewOutboxRelay(dbConn, publishers, cfg.OutboxMaxAttempts).Run(ctx, cfg.OutboxInterval)
+    }
 
     // Initialize Handlers
     depositHandler := handler.NewDepositHandler(depositService)
@@ -26,14 +109,276 @@ func SetupRoutes(r *gin.Engine, dbConn *sqlx.DB, redisClient *redis.Client) {
     transferHandler := handler.NewTransferHandler(transferService)
     balanceHandler := handler.NewBalanceHandler(balanceService)
     transactionHandler := handler.NewTransactionHandler(transactionService)
+    reconcileHandler := handler.NewReconcileHandler(ledgerService)
+    userHandler := handler.NewUserHandler(userService)
+    fxHandler := handler.NewFXHandler(fxService)
+    settlementHandler := handler.NewSettlementHandler(settlementService)
+    holdHandler := handler.NewHoldHandler(holdService)
+    refundHandler := handler.NewRefundHandler(refundService)
+    statementHandler := handler.NewStatementHandler(statementService)
+    apiKeyHandler := handler.NewAPIKeyHandler(apiKeyService)
+    adjustmentHandler := handler.NewAdjustmentHandler(adjustmentService)
+    roleHandler := handler.NewRoleHandler(enforcer)
+    limitHandler := handler.NewLimitHandler(limitService)
+    scheduleHandler := handler.NewScheduleHandler(scheduleService)
+    batchHandler := handler.NewBatchHandler(batchService)
+    webhookHandler := handler.NewWebhookHandler(webhookService)
+
+    // Every route but signing up requires a bearer token, the identity headers of a trusted gateway or a signed API key
+    // request, unless authentication is disabled. The roles of the caller are resolved into permissions, which every
+    // route checks; backend services calling with an API key also need the scope of each route.
+    verifier := newVerifier(cfg)
+    if verifier == nil && !cfg.TrustGatewayHeaders && !cfg.AuthDisabled {
+        return fmt.Errorf("no JWT_SECRET or JWT_PUBLIC_KEY_FILE is configured and TRUST_GATEWAY_HEADERS is off, " +
+            "set AUTH_DISABLED=true to run without authentication")
+    }
+    authenticate := handler.Authenticate(verifier, apiKeyService, cfg.TrustGatewayHeaders, cfg.AuthDisabled)
+    authorize := handler.Authorize(enforcer)
+    readWallet := handler.RequirePermission(model.PermissionWalletReadOwn, model.PermissionWalletReadAny)
+    moveMoney := handler.RequirePermission(model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny)
+    readBalance := handler.RequireScope(model.ScopeReadBalance)
+    manageWebhooks := handler.RequirePermission(model.PermissionAccountManageOwn, model.PermissionAccountManageAny)
+    adminScope := handler.RequireScope(model.ScopeAdmin)
 
     // Configure the routes.
-    v1 := r.Group("/v1/wallet")
+    v1 := r.Group("/v1/wallet", authenticate, authorize)
     {
-        v1.POST("/deposit", depositHandler.HandleDeposit)
-        v1.POST("/withdraw", withdrawHandler.HandleWithdraw)
-        v1.POST("/transfer", transferHandler.HandleTransfer)
-        v1.GET("/:user_id/balance", balanceHandler.HandleGetBalance)
-        v1.GET("/:user_id/transactions", transactionHandler.HandleGetTransactions)
+        v1.POST("/deposit", moveMoney, handler.RequireScope(model.ScopeDeposit), depositHandler.HandleDeposit)
+        v1.POST("/withdraw", moveMoney, handler.RequireScope(model.ScopeWithdraw), withdrawHandler.HandleWithdraw)
+        v1.POST("/transfer", moveMoney, handler.RequireScope(model.ScopeTransfer), transferHandler.HandleTransfer)
+        v1.POST("/transfers/batch", moveMoney, handler.RequireScope(model.ScopeTransfer), batchHandler.HandleTransferBatch)
+        v1.GET("/transfers/batch/:batch_id", readWallet, readBalance, batchHandler.HandleGetBatch)
+        v1.POST("/fx/quotes", moveMoney, handler.RequireScope(model.ScopeTransfer), fxHandler.HandleCreateQuote)
+        v1.POST("/holds", moveMoney, handler.RequireScope(model.ScopeWithdraw), holdHandler.HandlePlaceHold)
+        v1.POST("/holds/:hold_id/capture", handler.RequirePermission(model.PermissionHoldManage), holdHandler.HandleCapture)
+        v1.POST("/holds/:hold_id/void", handler.RequirePermission(model.PermissionHoldManage), holdHandler.HandleVoid)
+        v1.POST("/schedules", moveMoney, handler.RequireScope(model.ScopeTransfer), scheduleHandler.HandleCreateSchedule)
+        v1.GET("/schedules/:schedule_id", readWallet, readBalance, scheduleHandler.HandleGetSchedule)
+        v1.POST("/schedules/:schedule_id/cancel", moveMoney, handler.RequireScope(model.ScopeTransfer), scheduleHandler.HandleCancelSchedule)
+        v1.POST("/webhooks", manageWebhooks, adminScope, webhookHandler.HandleRegisterEndpoint)
+        v1.POST("/webhooks/:endpoint_id/disable", manageWebhooks, adminScope, webhookHandler.HandleDisableEndpoint)
+        v1.GET("/webhooks/:endpoint_id/deliveries", manageWebhooks, adminScope, webhookHandler.HandleGetDeliveries)
+        v1.POST("/webhooks/:endpoint_id/deliveries/:delivery_id/retry", manageWebhooks, adminScope, webhookHandler.HandleRetryDelivery)
+        v1.GET("/:user_id/balance", readWallet, readBalance, balanceHandler.HandleGetBalance)
+        v1.GET("/:user_id/transactions", readWallet, readBalance, transactionHandler.HandleGetTransactions)
+        v1.GET("/:user_id/reconcile", readWallet, readBalance, reconcileHandler.HandleReconcile)
+        v1.GET("/:user_id/statement", readWallet, readBalance, statementHandler.HandleGetStatement)
+        v1.GET("/:user_id/limits", readWallet, readBalance, limitHandler.HandleGetLimits)
+        v1.GET("/:user_id/schedules", readWallet, readBalance, scheduleHandler.HandleGetSchedules)
+        v1.GET("/:user_id/webhooks", manageWebhooks, adminScope, webhookHandler.HandleGetEndpoints)
+    }
+
+    transactions := r.Group("/v1/transactions", authenticate, authorize)
+    {
+        transactions.GET("/:transaction_id", readWallet, readBalance, transactionHandler.HandleGetTransaction)
+        transactions.POST("/:transaction_id/refund", handler.RequirePermission(model.PermissionTransactionRefund), refundHandler.HandleRefund)
+    }
+
+    r.POST("/v1/users", userHandler.HandleCreateUser)
+    users := r.Group("/v1/users", authenticate, authorize, handler.RequireScope(model.ScopeAdmin))
+    {
+        manageAccount := handler.RequirePermission(model.PermissionAccountManageOwn, model.PermissionAccountManageAny)
+        users.GET("/:user_id", manageAccount, userHandler.HandleGetUser)
+        users.PATCH("/:user_id", manageAccount, userHandler.HandleUpdateUser)
+        users.DELETE("/:user_id", manageAccount, userHandler.HandleDeleteUser)
+    }
+
+    admin := r.Group("/v1/admin", authenticate, authorize)
+    {
+        manageAccounts := handler.RequirePermission(model.PermissionAccountManageAny)
+        manageAccess := handler.RequirePermission(model.PermissionAccessManage)
+        admin.PUT("/users/:user_id/status", manageAccounts, userHandler.HandleChangeStatus)
+        admin.GET("/users/:user_id/status-changes", manageAccounts, userHandler.HandleGetStatusChanges)
+        admin.PUT("/users/:user_id/kyc-tier", manageAccounts, userHandler.HandleSetKYCTier)
+        admin.GET("/users/:user_id/roles", manageAccess, roleHandler.HandleGetUserRoles)
+        admin.PUT("/users/:user_id/roles", manageAccess, roleHandler.HandleSetUserRoles)
+        admin.GET("/roles", manageAccess, roleHandler.HandleGetRoles)
+        admin.POST("/wallets/:user_id/adjustments", handler.RequirePermission(model.PermissionBalanceAdjust), adjustmentHandler.HandleAdjustBalance)
+        admin.PUT("/transactions/:transaction_id/status", handler.RequirePermission(model.PermissionSettlementManage), settlementHandler.HandleChangeStatus)
+        admin.POST("/api-keys", manageAccess, apiKeyHandler.HandleCreateAPIKey)
+        admin.POST("/api-keys/:key_id/rotate", manageAccess, apiKeyHandler.HandleRotateAPIKey)
+        admin.POST("/api-keys/:key_id/revoke", manageAccess, apiKeyHandler.HandleRevokeAPIKey)
+    }
+    return nil
+}
+
+// newVerifier creates the verifier of the bearer tokens configured by JWT_ALGORITHM, JWT_SECRET or JWT_PUBLIC_KEY_FILE,
+// JWT_ISSUER and JWT_AUDIENCE. Without a secret or a public key it returns nil and bearer tokens are not required, so that
+// the caller is only known where API keys or the gateway identity headers are used, and the service only starts with
+// TRUST_GATEWAY_HEADERS or AUTH_DISABLED. A secret or a public key that cannot
+// be used is logged and no token is accepted, rather than keeping the service from starting or leaving it open.
+func newVerifier(cfg *config.Config) *auth.Verifier {
+    if cfg.JWTSecret == "" && cfg.JWTPublicKeyFile == "" {
+        utils.GetLogger().Warn("Warning: no JWT secret or public key configured, bearer tokens are not required")
+        if cfg.AuthDisabled && !cfg.TrustGatewayHeaders {
+            utils.GetLogger().Warn("Warning: authentication is disabled, anonymous requests may act on every wallet")
+        }
+        return nil
+    }
+
+    opts := auth.DefaultOptions()
+    opts.Issuer = cfg.JWTIssuer
+    opts.Audience = cfg.JWTAudience
+
+    switch cfg.JWTAlgorithm {
+    case auth.HS256:
+        // An empty secret would let anyone sign tokens
+        if cfg.JWTSecret == "" {
+            utils.GetLogger().Error("Error: HS256 tokens need a JWT_SECRET, no bearer token is accepted")
+            return rejectingVerifier(opts)
+        }
+        return auth.NewHS256Verifier([]byte(cfg.JWTSecret), opts)
+    case auth.RS256:
+        publicKey, err := auth.LoadRSAPublicKey(cfg.JWTPublicKeyFile)
+        if err != nil {
+            utils.GetLogger().Errorf("Error: %v, no bearer token is accepted", err)
+            return rejectingVerifier(opts)
+        }
+        return auth.NewRS256Verifier(publicKey, opts)
+    }
+    utils.GetLogger().Errorf("Error: unknown JWT algorithm %q, no bearer token is accepted", cfg.JWTAlgorithm)
+    return rejectingVerifier(opts)
+}
+
+// rejectingVerifier returns a verifier with a random secret nobody knows, which accepts no token.
+func rejectingVerifier(opts auth.Options) *auth.Verifier {
+    secret := make([]byte, 32)
+    _, _ = rand.Read(secret)
+    return auth.NewHS256Verifier(secret, opts)
+}
+
+// newLocker creates the balance locker selected by the LOCK_BACKEND configuration.
+// Redis is the default; the local locker only protects a single instance of the service.
+func newLocker(cfg *config.Config, dbConn *sqlx.DB, redisClient *redis.Client) lock.Locker {
+    opts := lock.DefaultOptions()
+    opts.TTL = cfg.LockTTL
+    opts.WaitTimeout = cfg.LockWaitTimeout
+
+    switch lockBackend(cfg) {
+    case "postgres":
+        return lock.NewPostgresLocker(dbConn, opts)
+    case "local":
+        return lock.NewLocalLocker(opts)
+    default:
+        return lock.NewRedisLocker(redisClient, opts)
+    }
+}
+
+// lockBackend returns the lock backend selected by the LOCK_BACKEND configuration, redis unless it names another one.
+func lockBackend(cfg *config.Config) string {
+    switch cfg.LockBackend {
+    case "postgres", "local":
+        return cfg.LockBackend
+    default:
+        return "redis"
+    }
+}
+
+// switchFencingBackend resets the fencing tokens stored on the users when the service starts with another lock
+// backend than before, since tokens of different backends are not comparable. A failure is only logged; writes
+// may then be rejected as stale until the tokens are reset.
+func switchFencingBackend(ctx context.Context, cfg *config.Config, dbConn *sqlx.DB) {
+    backend := lockBackend(cfg)
+    reset, err := repository.NewWalletRepository(dbConn).SwitchFencingBackend(ctx, dbConn, backend)
+    if err != nil {
+        utils.GetLogger().Errorf("Error: failed to switch fencing tokens to lock backend %s: %v", backend, err)
+        return
+    }
+    if reset > 0 {
+        utils.GetLogger().Infof("Reset the fencing tokens of %d users for lock backend %s", reset, backend)
+    }
+}
+
+// newPublisher creates the publisher of domain events selected by the OUTBOX_PUBLISHER configuration, a Redis stream
+// by default. It returns nil when events are not published; they are then kept in the outbox until a publisher is
+// configured, and a webhook publisher without a URL is logged and treated the same way.
+func newPublisher(cfg *config.Config, redisClient *redis.Client) events.Publisher {
+    switch cfg.OutboxPublisher {
+    case "none":
+        return nil
+    case "webhook":
+        if cfg.OutboxWebhookURL == "" {
+            utils.GetLogger().Error("Error: the webhook publisher needs an OUTBOX_WEBHOOK_URL, events are kept in the outbox")
+            return nil
+        }
+        return events.NewWebhookPublisher(cfg.OutboxWebhookURL, cfg.OutboxWebhookTimeout)
+    default:
+        return events.NewRedisStreamPublisher(redisClient, cfg.OutboxStream, cfg.OutboxStreamMaxLen)
+    }
+}
+
+// newRateProvider loads the static FX rates configured by FX_RATES_FILE.
+// If the file cannot be loaded the service still starts, but no cross-currency quotes can be issued, and callers with a
+// refund limit can only refund in USD, and limited withdrawals and transfers can only be made in USD.
+func newRateProvider(cfg *config.Config) service.FXRateProvider {
+    rates, err := service.LoadStaticRateProvider(cfg.FXRatesFile)
+    if err != nil {
+        utils.GetLogger().Warnf("Warning: no FX rates loaded, cross-currency transfers, and limited refunds, withdrawals and transfers in other currencies than USD, are unavailable: %v", err)
+        return service.NewStaticRateProvider(nil)
+    }
+    return rates
+}
+
+// newFeeSchedule loads the fee rules configured by FEE_RULES_FILE. Without a rules file no fees are charged; a rules
+// file that cannot be loaded is an error, rather than silently charging no fees.
+func newFeeSchedule(cfg *config.Config) (*service.FeeSchedule, error) {
+    if cfg.FeeRulesFile == "" {
+        return nil, nil
+    }
+    fees, err := service.LoadFeeSchedule(cfg.FeeRulesFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load the fee rules of FEE_RULES_FILE: %w", err)
+    }
+    return fees, nil
+}
+
+// newSettlementProvider creates the settlement provider selected by SETTLEMENT_PROVIDER. No provider is used unless one
+// is configured, so the delayed provider, which completes payouts without asking anyone, never settles them by default.
+func newSettlementProvider(cfg *config.Config) (service.SettlementProvider, error) {
+    switch cfg.SettlementProvider {
+    case "delayed":
+        utils.GetLogger().Warnf("Warning: the delayed settlement provider completes every pending payout after %s without asking a payment provider", cfg.SettlementDelay)
+        return service.DelayedSettlementProvider{Delay: cfg.SettlementDelay}, nil
+    case "":
+        return nil, fmt.Errorf("the settlement worker is enabled by SETTLEMENT_INTERVAL, but no SETTLEMENT_PROVIDER is configured")
+    }
+    return nil, fmt.Errorf("unknown SETTLEMENT_PROVIDER %q", cfg.SettlementProvider)
+}
+
+// newRefundPolicy reads the refund policy configured by REFUND_POLICY. An unknown policy is logged and falls back to
+// rejecting refunds the balance does not cover, rather than keeping the service from starting.
+func newRefundPolicy(cfg *config.Config) service.RefundPolicy {
+    policy, err := service.ParseRefundPolicy(cfg.RefundPolicy)
+    if err != nil {
+        utils.GetLogger().Errorf("Error: %v, rejecting refunds the balance does not cover", err)
+        return service.RefundPolicyReject
+    }
+    return policy
+}
+
+// newLimitSchedule loads the transaction limits configured by LIMITS_FILE. Without a limits file no limits apply; a
+// limits file that cannot be loaded is an error, rather than silently leaving withdrawals and transfers unlimited.
+func newLimitSchedule(cfg *config.Config, rates service.FXRateProvider) (*service.LimitSchedule, error) {
+    if cfg.LimitsFile == "" {
+        return nil, nil
+    }
+    limits, err := service.LoadLimitSchedule(cfg.LimitsFile, rates)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load the transaction limits of LIMITS_FILE: %w", err)
+    }
+    return limits, nil
+}
+
+// newPaymentMethods loads the payment methods configured by PAYMENT_METHODS_FILE. Without a file the built-in methods
+// are offered; a file that cannot be loaded is also logged and falls back to them, rather than keeping the service from starting.
+func newPaymentMethods(cfg *config.Config) *service.PaymentMethodRegistry {
+    if cfg.PaymentMethodsFile == "" {
+        return service.DefaultPaymentMethods()
+    }
+    methods, err := service.LoadPaymentMethodRegistry(cfg.PaymentMethodsFile)
+    if err != nil {
+        utils.GetLogger().Errorf("Error: no payment methods loaded, using the built-in methods: %v", err)
+        return service.DefaultPaymentMethods()
     }
+    return methods
 }
@@ -0,0 +1,90 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ErrInvalidSignature is returned when the signature of a request does not match its key, timestamp and body.
+var ErrInvalidSignature = errors.New("invalid request signature")
+
+// ErrStaleSignature is returned when a request was signed too long ago, or too far in the future, to be accepted.
+var ErrStaleSignature = errors.New("request signature timestamp outside the tolerance")
+
+// APIKeyPrefix starts every API key, so that leaked keys are easy to recognise.
+const APIKeyPrefix = "wk_"
+
+// GenerateAPIKey returns a new random API key and its prefix, the public part it is looked up by.
+// Keys look like wk_<12 hex digits>.<43 characters of base64url>.
+func GenerateAPIKey() (key string, prefix string, err error) {
+    id := make([]byte, 6)
+    secret := make([]byte, 32)
+    if _, err := rand.Read(id); err != nil {
+        return "", "", fmt.Errorf("failed to generate API key: %w", err)
+    }
+    if _, err := rand.Read(secret); err != nil {
+        return "", "", fmt.Errorf("failed to generate API key: %w", err)
+    }
+
+    prefix = APIKeyPrefix + hex.EncodeToString(id)
+    return prefix + "." + base64.RawURLEncoding.EncodeToString(secret), prefix, nil
+}
+
+// ParseAPIKey returns the prefix of an API key, and false if the key is malformed.
+func ParseAPIKey(key string) (string, bool) {
+    prefix, secret, ok := strings.Cut(key, ".")
+    if !ok || !strings.HasPrefix(prefix, APIKeyPrefix) || secret == "" {
+        return "", false
+    }
+    return prefix, true
+}
+
+// HashAPIKey returns the hex SHA-256 hash of an API key, as it is stored.
+func HashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// MatchAPIKey reports whether the key has the stored hash, in constant time.
+func MatchAPIKey(key, hash string) bool {
+    return hmac.Equal([]byte(HashAPIKey(key)), []byte(hash))
+}
+
+// SignRequest returns the hex HMAC-SHA256 signature of a request, keyed with the API key, over the Unix timestamp
+// the request was signed at, its method, its path with the query string and its body, separated by newlines.
+func SignRequest(key string, timestamp string, method string, path string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(key))
+    mac.Write([]byte(timestamp + "\n" + method + "\n" + path + "\n"))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRequestSignature checks the signature of a request made with the API key and that it was signed within
+// the tolerance of now. It returns ErrStaleSignature for requests signed outside the tolerance and ErrInvalidSignature otherwise.
+func VerifyRequestSignature(key string, timestamp string, method string, path string, body []byte, signature string, now time.Time, tolerance time.Duration) error {
+    return verifySignature(timestamp, signature, now, tolerance, SignRequest(key, timestamp, method, path, body))
+}
+
+// verifySignature checks that the signature is the expected one, and that its Unix timestamp is within the tolerance of now.
+func verifySignature(timestamp string, signature string, now time.Time, tolerance time.Duration, expected string) error {
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    if err != nil {
+        return fmt.Errorf("%w: malformed timestamp", ErrInvalidSignature)
+    }
+    if skew := now.Sub(time.Unix(seconds, 0)); skew > tolerance || skew < -tolerance {
+        return ErrStaleSignature
+    }
+
+    if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+        return ErrInvalidSignature
+    }
+    return nil
+}
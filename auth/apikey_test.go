@@ -0,0 +1,50 @@
+package auth
+
+import (
+    "strconv"
+    "testing"
+    "time"
+    "github.com/stretchr/testify/require"
+)
+
+// Test that generated API keys are recognised by their prefix and matched by their hash only
+func TestGenerateAPIKey(t *testing.T) {
+    key, prefix, err := GenerateAPIKey()
+    require.NoError(t, err)
+
+    parsed, ok := ParseAPIKey(key)
+    require.True(t, ok)
+    require.Equal(t, prefix, parsed)
+    require.True(t, MatchAPIKey(key, HashAPIKey(key)))
+
+    other, _, err := GenerateAPIKey()
+    require.NoError(t, err)
+    require.NotEqual(t, key, other)
+    require.False(t, MatchAPIKey(other, HashAPIKey(key)))
+
+    _, ok = ParseAPIKey("not-a-key")
+    require.False(t, ok)
+}
+
+// Test that request signatures cover the key, the timestamp, the request line and the body, and expire
+func TestVerifyRequestSignature(t *testing.T) {
+    now := time.Now()
+    timestamp := strconv.FormatInt(now.Unix(), 10)
+    body := []byte(`{"user_id":1,"amount":"10"}`)
+    signature := SignRequest("wk_1.secret", timestamp, "POST", "/v1/wallet/deposit", body)
+
+    err := VerifyRequestSignature("wk_1.secret", timestamp, "POST", "/v1/wallet/deposit", body, signature, now, time.Minute)
+    require.NoError(t, err)
+
+    err = VerifyRequestSignature("wk_1.other", timestamp, "POST", "/v1/wallet/deposit", body, signature, now, time.Minute)
+    require.ErrorIs(t, err, ErrInvalidSignature)
+
+    err = VerifyRequestSignature("wk_1.secret", timestamp, "POST", "/v1/wallet/deposit", []byte(`{"user_id":1,"amount":"1000"}`), signature, now, time.Minute)
+    require.ErrorIs(t, err, ErrInvalidSignature)
+
+    err = VerifyRequestSignature("wk_1.secret", timestamp, "POST", "/v1/wallet/withdraw", body, signature, now, time.Minute)
+    require.ErrorIs(t, err, ErrInvalidSignature)
+
+    err = VerifyRequestSignature("wk_1.secret", timestamp, "POST", "/v1/wallet/deposit", body, signature, now.Add(2*time.Minute), time.Minute)
+    require.ErrorIs(t, err, ErrStaleSignature)
+}
@@ -0,0 +1,244 @@
+// Package auth authenticates the callers of the wallet service. It verifies the JSON Web Tokens presented as
+// bearer tokens, signed either with a shared secret (HS256) or with the private key of an identity provider
+// whose public key the service is configured with (RS256), and extracts the authenticated user and its scopes.
+package auth
+
+import (
+    "crypto"
+    "crypto/hmac"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+)
+
+// ErrInvalidToken is returned when a token is malformed, signed with another algorithm or key, or issued for someone else.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrTokenExpired is returned when a token has expired or is not valid yet.
+var ErrTokenExpired = errors.New("token expired or not yet valid")
+
+// Signing algorithms.
+const (
+    HS256 = "HS256" // HMAC with SHA-256 and a shared secret
+    RS256 = "RS256" // RSASSA-PKCS1-v1_5 with SHA-256 and an RSA key pair
+)
+
+// Claims are the verified claims of a token.
+type Claims struct {
+    Subject   string    // The authenticated user, the sub claim
+    Issuer    string    // Who issued the token, the iss claim
+    Audience  []string  // Who the token is meant for, the aud claim
+    Scopes    []string  // What the token allows, the space-separated scope claim
+    ExpiresAt time.Time // When the token expires, the exp claim
+    NotBefore time.Time // When the token becomes valid, the nbf claim, zero if unset
+}
+
+// HasScope reports whether the token was granted the scope.
+func (c *Claims) HasScope(scope string) bool {
+    for _, s := range c.Scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+// Options configures which tokens a Verifier accepts besides their signature.
+type Options struct {
+    Issuer   string        // The required iss claim, any issuer when empty
+    Audience string        // A required entry of the aud claim, any audience when empty
+    Leeway   time.Duration // How much clock skew is tolerated when checking exp and nbf
+}
+
+// DefaultOptions returns the options used when none are configured.
+func DefaultOptions() Options {
+    return Options{Leeway: 30 * time.Second}
+}
+
+// Verifier verifies tokens signed with a single algorithm and key.
+type Verifier struct {
+    algorithm string
+    secret    []byte
+    publicKey *rsa.PublicKey
+    opts      Options
+    now       func() time.Time
+}
+
+// NewHS256Verifier creates a Verifier of tokens signed with the shared secret.
+func NewHS256Verifier(secret []byte, opts Options) *Verifier {
+    return &Verifier{algorithm: HS256, secret: secret, opts: opts, now: time.Now}
+}
+
+// NewRS256Verifier creates a Verifier of tokens signed with the private key of the public key.
+func NewRS256Verifier(publicKey *rsa.PublicKey, opts Options) *Verifier {
+    return &Verifier{algorithm: RS256, publicKey: publicKey, opts: opts, now: time.Now}
+}
+
+// LoadRSAPublicKey reads a PEM encoded RSA public key, in PKIX ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY") form.
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read public key %s: %w", path, err)
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("no PEM data in public key %s", path)
+    }
+
+    if block.Type == "RSA PUBLIC KEY" {
+        return x509.ParsePKCS1PublicKey(block.Bytes)
+    }
+    key, err := x509.ParsePKIXPublicKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+    }
+    rsaKey, ok := key.(*rsa.PublicKey)
+    if !ok {
+        return nil, fmt.Errorf("public key %s is not an RSA key", path)
+    }
+    return rsaKey, nil
+}
+
+// header is the JOSE header of a token.
+type header struct {
+    Algorithm string `json:"alg"`
+}
+
+// payload is the claims set of a token as it is encoded.
+type payload struct {
+    Subject   string          `json:"sub"`
+    Issuer    string          `json:"iss"`
+    Audience  json.RawMessage `json:"aud"`
+    Scope     string          `json:"scope"`
+    ExpiresAt *float64        `json:"exp"`
+    NotBefore *float64        `json:"nbf"`
+}
+
+// Verify checks the signature, the lifetime, the issuer and the audience of a compact serialised token and returns its claims.
+// Tokens must carry a subject and an expiry, and be signed with the algorithm of the verifier; in particular unsigned
+// tokens are never accepted. It returns ErrTokenExpired for tokens outside their lifetime and ErrInvalidToken otherwise.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+    }
+
+    var h header
+    if err := decodeSegment(parts[0], &h); err != nil {
+        return nil, err
+    }
+    if h.Algorithm != v.algorithm {
+        return nil, fmt.Errorf("%w: expected a %s token, got %q", ErrInvalidToken, v.algorithm, h.Algorithm)
+    }
+
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+    }
+    if err := v.verifySignature(parts[0]+"."+parts[1], signature); err != nil {
+        return nil, err
+    }
+
+    var p payload
+    if err := decodeSegment(parts[1], &p); err != nil {
+        return nil, err
+    }
+    return v.checkClaims(p)
+}
+
+// verifySignature checks the signature of the signing input, the encoded header and payload.
+func (v *Verifier) verifySignature(signingInput string, signature []byte) error {
+    switch v.algorithm {
+    case HS256:
+        mac := hmac.New(sha256.New, v.secret)
+        mac.Write([]byte(signingInput))
+        if !hmac.Equal(mac.Sum(nil), signature) {
+            return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+        }
+    case RS256:
+        digest := sha256.Sum256([]byte(signingInput))
+        if err := rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+            return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+        }
+    default:
+        return fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, v.algorithm)
+    }
+    return nil
+}
+
+// checkClaims checks the registered claims of a token whose signature has been verified.
+func (v *Verifier) checkClaims(p payload) (*Claims, error) {
+    if p.Subject == "" {
+        return nil, fmt.Errorf("%w: missing sub claim", ErrInvalidToken)
+    }
+    if p.ExpiresAt == nil {
+        return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+    }
+
+    claims := &Claims{
+        Subject:   p.Subject,
+        Issuer:    p.Issuer,
+        Scopes:    strings.Fields(p.Scope),
+        ExpiresAt: numericDate(*p.ExpiresAt),
+    }
+    if p.NotBefore != nil {
+        claims.NotBefore = numericDate(*p.NotBefore)
+    }
+
+    // The aud claim is either a single string or an array of strings
+    if len(p.Audience) > 0 {
+        var audience string
+        if err := json.Unmarshal(p.Audience, &audience); err == nil {
+            claims.Audience = []string{audience}
+        } else if err := json.Unmarshal(p.Audience, &claims.Audience); err != nil {
+            return nil, fmt.Errorf("%w: malformed aud claim", ErrInvalidToken)
+        }
+    }
+
+    now := v.now()
+    if !now.Before(claims.ExpiresAt.Add(v.opts.Leeway)) || now.Add(v.opts.Leeway).Before(claims.NotBefore) {
+        return nil, ErrTokenExpired
+    }
+    if v.opts.Issuer != "" && claims.Issuer != v.opts.Issuer {
+        return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+    }
+    if v.opts.Audience != "" && !contains(claims.Audience, v.opts.Audience) {
+        return nil, fmt.Errorf("%w: token is not meant for %q", ErrInvalidToken, v.opts.Audience)
+    }
+    return claims, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+    }
+    return nil
+}
+
+// numericDate converts a JWT NumericDate, seconds since the epoch, to a time.
+func numericDate(seconds float64) time.Time {
+    return time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+}
+
+// contains reports whether the value is one of the values.
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
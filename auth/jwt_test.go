@@ -0,0 +1,104 @@
+package auth
+
+import (
+    "crypto"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "testing"
+    "time"
+    "github.com/stretchr/testify/require"
+)
+
+// sign builds a token of the claims, signed by the sign function with the algorithm
+func sign(t *testing.T, algorithm string, claims map[string]interface{}, sign func(signingInput []byte) []byte) string {
+    header, err := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT"})
+    require.NoError(t, err)
+    payload, err := json.Marshal(claims)
+    require.NoError(t, err)
+
+    signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signingInput)))
+}
+
+// signHS256 builds a token of the claims signed with the secret
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+    return sign(t, HS256, claims, func(signingInput []byte) []byte {
+        mac := hmac.New(sha256.New, []byte(secret))
+        mac.Write(signingInput)
+        return mac.Sum(nil)
+    })
+}
+
+// Test that HS256 tokens are accepted with the right secret only, and their claims extracted
+func TestVerifier_HS256(t *testing.T) {
+    verifier := NewHS256Verifier([]byte("secret"), DefaultOptions())
+    exp := time.Now().Add(time.Hour).Unix()
+
+    claims, err := verifier.Verify(signHS256(t, "secret", map[string]interface{}{"sub": "1", "exp": exp, "scope": "wallet admin"}))
+    require.NoError(t, err)
+    require.Equal(t, "1", claims.Subject)
+    require.True(t, claims.HasScope("admin"))
+    require.Equal(t, exp, claims.ExpiresAt.Unix())
+
+    _, err = verifier.Verify(signHS256(t, "other secret", map[string]interface{}{"sub": "1", "exp": exp}))
+    require.ErrorIs(t, err, ErrInvalidToken)
+
+    // Unsigned tokens are never accepted
+    _, err = verifier.Verify(sign(t, "none", map[string]interface{}{"sub": "1", "exp": exp}, func([]byte) []byte { return nil }))
+    require.ErrorIs(t, err, ErrInvalidToken)
+
+    _, err = verifier.Verify("not.a-token")
+    require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+// Test that tokens are checked for their lifetime, issuer, audience and subject
+func TestVerifier_Claims(t *testing.T) {
+    opts := DefaultOptions()
+    opts.Issuer = "https://id.example.com"
+    opts.Audience = "wallet"
+    verifier := NewHS256Verifier([]byte("secret"), opts)
+    exp := time.Now().Add(time.Hour).Unix()
+
+    _, err := verifier.Verify(signHS256(t, "secret", map[string]interface{}{"sub": "1", "exp": exp, "iss": "https://id.example.com", "aud": []string{"other", "wallet"}}))
+    require.NoError(t, err)
+
+    _, err = verifier.Verify(signHS256(t, "secret", map[string]interface{}{"sub": "1", "exp": exp, "iss": "https://id.example.com", "aud": "other"}))
+    require.ErrorIs(t, err, ErrInvalidToken)
+
+    _, err = verifier.Verify(signHS256(t, "secret", map[string]interface{}{"sub": "1", "exp": exp, "iss": "https://evil.example.com", "aud": "wallet"}))
+    require.ErrorIs(t, err, ErrInvalidToken)
+
+    _, err = verifier.Verify(signHS256(t, "secret", map[string]interface{}{"exp": exp, "iss": "https://id.example.com", "aud": "wallet"}))
+    require.ErrorIs(t, err, ErrInvalidToken)
+
+    _, err = verifier.Verify(signHS256(t, "secret", map[string]interface{}{"sub": "1", "exp": time.Now().Add(-time.Minute).Unix(), "iss": "https://id.example.com", "aud": "wallet"}))
+    require.ErrorIs(t, err, ErrTokenExpired)
+
+    _, err = verifier.Verify(signHS256(t, "secret", map[string]interface{}{"sub": "1", "exp": exp, "nbf": time.Now().Add(time.Minute).Unix(), "iss": "https://id.example.com", "aud": "wallet"}))
+    require.ErrorIs(t, err, ErrTokenExpired)
+}
+
+// Test that RS256 tokens are verified with the public key, and that HS256 tokens are not accepted in their place
+func TestVerifier_RS256(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    require.NoError(t, err)
+    verifier := NewRS256Verifier(&key.PublicKey, DefaultOptions())
+    claims := map[string]interface{}{"sub": "2", "exp": time.Now().Add(time.Hour).Unix()}
+
+    token := sign(t, RS256, claims, func(signingInput []byte) []byte {
+        digest := sha256.Sum256(signingInput)
+        signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+        require.NoError(t, err)
+        return signature
+    })
+    verified, err := verifier.Verify(token)
+    require.NoError(t, err)
+    require.Equal(t, "2", verified.Subject)
+
+    _, err = verifier.Verify(signHS256(t, "secret", claims))
+    require.ErrorIs(t, err, ErrInvalidToken)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "time"
+)
+
+// WebhookSecretPrefix starts every webhook signing secret, so that leaked secrets are easy to recognise.
+const WebhookSecretPrefix = "whsec_"
+
+// GenerateWebhookSecret returns a new random secret to sign the requests to a webhook endpoint with.
+// Secrets look like whsec_<43 characters of base64url>.
+func GenerateWebhookSecret() (string, error) {
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+    }
+    return WebhookSecretPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 signature of a webhook request, keyed with the secret of the endpoint,
+// over the Unix timestamp the request was signed at and its body, separated by a newline.
+func SignWebhook(secret string, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "\n"))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the signature of a webhook request as its endpoint would, and that it was signed within
+// the tolerance of now. It returns ErrStaleSignature for requests signed outside the tolerance and ErrInvalidSignature otherwise.
+func VerifyWebhookSignature(secret string, timestamp string, body []byte, signature string, now time.Time, tolerance time.Duration) error {
+    return verifySignature(timestamp, signature, now, tolerance, SignWebhook(secret, timestamp, body))
+}
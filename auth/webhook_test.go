@@ -0,0 +1,35 @@
+package auth
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    "github.com/stretchr/testify/require"
+)
+
+// Test that webhook signatures cover the secret, the timestamp and the body, and expire
+func TestVerifyWebhookSignature(t *testing.T) {
+    secret, err := GenerateWebhookSecret()
+    require.NoError(t, err)
+    require.True(t, strings.HasPrefix(secret, WebhookSecretPrefix))
+
+    now := time.Now()
+    timestamp := strconv.FormatInt(now.Unix(), 10)
+    body := []byte(`{"id":3,"type":"transaction.completed"}`)
+    signature := SignWebhook(secret, timestamp, body)
+
+    require.NoError(t, VerifyWebhookSignature(secret, timestamp, body, signature, now, time.Minute))
+
+    err = VerifyWebhookSignature("whsec_other", timestamp, body, signature, now, time.Minute)
+    require.ErrorIs(t, err, ErrInvalidSignature)
+
+    err = VerifyWebhookSignature(secret, timestamp, []byte(`{"id":3,"type":"transaction.failed"}`), signature, now, time.Minute)
+    require.ErrorIs(t, err, ErrInvalidSignature)
+
+    err = VerifyWebhookSignature(secret, strconv.FormatInt(now.Unix()+1, 10), body, signature, now, time.Minute)
+    require.ErrorIs(t, err, ErrInvalidSignature)
+
+    err = VerifyWebhookSignature(secret, timestamp, body, signature, now.Add(2*time.Minute), time.Minute)
+    require.ErrorIs(t, err, ErrStaleSignature)
+}
@@ -0,0 +1,182 @@
+// Package cron parses the cron expressions recurring scheduled transfers are repeated on, and finds their next
+// occurrence in a time zone. Expressions have the five standard fields, minute, hour, day of month, month and day of
+// week, each a "*", a value, a range "a-b" or a comma-separated list of them, optionally stepped with "/n".
+// Months and days of week may also be given by their three-letter English names, and Sunday is both 0 and 7.
+package cron
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ErrInvalidExpression is returned when a cron expression cannot be parsed.
+var ErrInvalidExpression = errors.New("invalid cron expression")
+
+// maxSearch is how far ahead Next looks for an occurrence, so expressions that never match, such as "0 0 30 2 *", end.
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// field describes the values one field of an expression can take.
+type field struct {
+    name     string
+    min, max int
+    names    []string // Names of the values from min on, nil if the field has none
+}
+
+var (
+    minuteField = field{name: "minute", min: 0, max: 59}
+    hourField   = field{name: "hour", min: 0, max: 23}
+    domField    = field{name: "day of month", min: 1, max: 31}
+    monthField  = field{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+    dowField    = field{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// Schedule is a parsed cron expression. Each field is a bit set of the values it matches.
+type Schedule struct {
+    minute, hour, dom, month, dow uint64
+    // The day of month and the day of week fields combine like in cron: when both are restricted, that is do not
+    // start with "*", a day matching either of them matches
+    domAny, dowAny bool
+}
+
+// Parse parses a five-field cron expression.
+func Parse(expr string) (*Schedule, error) {
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("%w: %q has %d fields, expected 5", ErrInvalidExpression, expr, len(fields))
+    }
+
+    var s Schedule
+    var err error
+    if s.minute, err = minuteField.parse(fields[0]); err != nil {
+        return nil, err
+    }
+    if s.hour, err = hourField.parse(fields[1]); err != nil {
+        return nil, err
+    }
+    if s.dom, err = domField.parse(fields[2]); err != nil {
+        return nil, err
+    }
+    if s.month, err = monthField.parse(fields[3]); err != nil {
+        return nil, err
+    }
+    if s.dow, err = dowField.parse(fields[4]); err != nil {
+        return nil, err
+    }
+    // Sunday is matched as 0
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1
+    }
+    s.domAny = strings.HasPrefix(fields[2], "*") || fields[2] == "?"
+    s.dowAny = strings.HasPrefix(fields[4], "*") || fields[4] == "?"
+    return &s, nil
+}
+
+// parse parses one field of an expression into the bit set of the values it matches.
+func (f field) parse(text string) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(text, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("%w: invalid step in %s field %q", ErrInvalidExpression, f.name, text)
+            }
+            step = n
+            part = part[:i]
+        }
+
+        low, high := f.min, f.max
+        switch {
+        case part == "*" || part == "?":
+        case strings.Contains(part, "-"):
+            bounds := strings.SplitN(part, "-", 2)
+            var err error
+            if low, err = f.value(bounds[0]); err != nil {
+                return 0, err
+            }
+            if high, err = f.value(bounds[1]); err != nil {
+                return 0, err
+            }
+            if low > high {
+                return 0, fmt.Errorf("%w: %s range %q ends before it starts", ErrInvalidExpression, f.name, part)
+            }
+        default:
+            var err error
+            if low, err = f.value(part); err != nil {
+                return 0, err
+            }
+            // A single value with a step runs to the end of the field, like in cron
+            high = low
+            if step > 1 {
+                high = f.max
+            }
+        }
+
+        for v := low; v <= high; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+// value parses a single value of the field, a number or a name.
+func (f field) value(text string) (int, error) {
+    for i, name := range f.names {
+        if strings.EqualFold(text, name) {
+            return f.min + i, nil
+        }
+    }
+    v, err := strconv.Atoi(text)
+    if err != nil || v < f.min || v > f.max {
+        return 0, fmt.Errorf("%w: %s %q is not between %d and %d", ErrInvalidExpression, f.name, text, f.min, f.max)
+    }
+    return v, nil
+}
+
+// has reports whether the bit set contains the value.
+func has(bits uint64, v int) bool {
+    return bits&(1<<uint(v)) != 0
+}
+
+// dayMatches reports whether the day of t matches the day of month and day of week fields.
+func (s *Schedule) dayMatches(t time.Time) bool {
+    dom, dow := has(s.dom, t.Day()), has(s.dow, int(t.Weekday()))
+    if s.domAny || s.dowAny {
+        return dom && dow
+    }
+    return dom || dow
+}
+
+// Next returns the first time after the given one that the schedule matches, on the wall clock of loc.
+// Times skipped when the clocks go forward are not matched, and wall clock times repeated when they go back are only
+// matched the first time. It returns the zero time if the schedule does not match within the next five years.
+func (s *Schedule) Next(after time.Time, loc *time.Location) time.Time {
+    after = after.In(loc)
+    t := after.Truncate(time.Second).Add(time.Duration(60-after.Second()) * time.Second)
+    limit := after.Add(maxSearch)
+
+    for t.Before(limit) {
+        switch {
+        case !has(s.month, int(t.Month())):
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+        case !s.dayMatches(t):
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+        case !has(s.hour, t.Hour()):
+            // Hours and minutes are stepped in elapsed time, which always moves forward across clock changes
+            t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+        case !has(s.minute, t.Minute()), !wallClock(t).After(wallClock(after)):
+            t = t.Add(time.Minute)
+        default:
+            return t
+        }
+    }
+    return time.Time{}
+}
+
+// wallClock returns the date and time t shows on the clock of its location, to the minute, as if it was UTC.
+func wallClock(t time.Time) time.Time {
+    return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
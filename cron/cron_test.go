@@ -0,0 +1,73 @@
+package cron
+
+import (
+    "testing"
+    "time"
+    "github.com/stretchr/testify/require"
+)
+
+func TestParse_Invalid(t *testing.T) {
+    for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+        _, err := Parse(expr)
+        require.ErrorIs(t, err, ErrInvalidExpression, expr)
+    }
+}
+
+func TestSchedule_Next(t *testing.T) {
+    utc := time.UTC
+    start := time.Date(2024, 11, 12, 18, 35, 41, 0, utc)
+
+    tests := []struct {
+        expr string
+        want time.Time
+    }{
+        {"* * * * *", time.Date(2024, 11, 12, 18, 36, 0, 0, utc)},
+        {"*/15 * * * *", time.Date(2024, 11, 12, 18, 45, 0, 0, utc)},
+        {"0 9 * * *", time.Date(2024, 11, 13, 9, 0, 0, 0, utc)},
+        {"0 9 1 * *", time.Date(2024, 12, 1, 9, 0, 0, 0, utc)},
+        {"30 8 * * mon-fri", time.Date(2024, 11, 13, 8, 30, 0, 0, utc)},
+        {"0 0 * * 7", time.Date(2024, 11, 17, 0, 0, 0, 0, utc)},
+        {"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, utc)},
+        // Both days restricted, either matches: the 15th or the next Friday
+        {"0 12 15 * 5", time.Date(2024, 11, 15, 12, 0, 0, 0, utc)},
+        {"0 0 1,15 * *", time.Date(2024, 11, 15, 0, 0, 0, 0, utc)},
+    }
+    for _, tt := range tests {
+        s, err := Parse(tt.expr)
+        require.NoError(t, err, tt.expr)
+        require.Equal(t, tt.want, s.Next(start, utc), tt.expr)
+    }
+
+    // An occurrence is strictly after the given time
+    s, err := Parse("0 9 * * *")
+    require.NoError(t, err)
+    require.Equal(t, time.Date(2024, 11, 14, 9, 0, 0, 0, utc), s.Next(time.Date(2024, 11, 13, 9, 0, 0, 0, utc), utc))
+
+    // Never matching
+    s, err = Parse("0 0 30 2 *")
+    require.NoError(t, err)
+    require.True(t, s.Next(start, utc).IsZero())
+}
+
+func TestSchedule_Next_TimeZone(t *testing.T) {
+    berlin, err := time.LoadLocation("Europe/Berlin")
+    if err != nil {
+        t.Skip("no time zone database")
+    }
+
+    // 9:00 in Berlin is 8:00 UTC in winter
+    s, err := Parse("0 9 * * *")
+    require.NoError(t, err)
+    require.Equal(t, time.Date(2024, 11, 13, 8, 0, 0, 0, time.UTC), s.Next(time.Date(2024, 11, 12, 12, 0, 0, 0, time.UTC), berlin).UTC())
+
+    // 2:30 does not exist when the clocks go forward on 31 March 2024, so that day is skipped
+    s, err = Parse("30 2 * * *")
+    require.NoError(t, err)
+    next := s.Next(time.Date(2024, 3, 30, 3, 0, 0, 0, berlin), berlin)
+    require.Equal(t, time.Date(2024, 4, 1, 2, 30, 0, 0, berlin), next)
+
+    // 2:30 happens twice when the clocks go back on 27 October 2024, and only runs the first time
+    first := s.Next(time.Date(2024, 10, 27, 0, 0, 0, 0, berlin), berlin)
+    require.Equal(t, time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC), first.UTC())
+    require.Equal(t, time.Date(2024, 10, 28, 2, 30, 0, 0, berlin), s.Next(first, berlin))
+}
@@ -3,35 +3,412 @@
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    email VARCHAR(255) UNIQUE NOT NULL,
-    phone VARCHAR(20) UNIQUE NOT NULL,
-    balance DECIMAL(10, 2) DEFAULT 0.00,
+    email VARCHAR(255) NOT NULL,
+    phone VARCHAR(20) NOT NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    status VARCHAR(20) NOT NULL CHECK (status IN ('active', 'inactive', 'suspended'))
+    status VARCHAR(20) NOT NULL CHECK (status IN ('active', 'inactive', 'suspended')),
+    kyc_tier VARCHAR(20) NOT NULL DEFAULT 'basic' CHECK (kyc_tier IN ('basic', 'verified', 'premium')),  -- How far the identity has been verified, selecting the transaction limits of the user
+    fence_token BIGINT NOT NULL DEFAULT 0,  -- The newest fencing token of a balance lock that wrote this row, older tokens are rejected
+    deleted_at TIMESTAMP WITH TIME ZONE  -- When the account was closed, NULL while it is open
 );
 
-INSERT INTO users (id, name, email, phone, balance, status) 
-VALUES (1, 'Alice', 'alice@example.com', '13300000001', 10.05, 'active');
-INSERT INTO users (id, name, email, phone, balance, status) 
-VALUES (2, 'Bob', 'bob@example.com', '13300000002', 50.35, 'active');
-INSERT INTO users (id, name, email, phone, balance, status) 
-VALUES (3, 'John', 'john@example.com', '13300000003', 70.55, 'active');
+-- Emails and phone numbers are unique among open accounts, so they can be reused once an account is closed
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (email) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_phone_idx ON users (phone) WHERE deleted_at IS NULL;
+
+-- Audit trail of administrators changing the status of user accounts
+CREATE TABLE IF NOT EXISTS user_status_changes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    old_status VARCHAR(20) NOT NULL,  -- The status before the change
+    new_status VARCHAR(20) NOT NULL,  -- The status after the change
+    reason TEXT NOT NULL,  -- Why the status was changed
+    changed_by VARCHAR(255),  -- Who changed the status, NULL if unknown
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS user_status_changes_user_idx ON user_status_changes (user_id, created_at);
+
+-- Fencing tokens handed out by the PostgreSQL advisory lock backend
+CREATE SEQUENCE IF NOT EXISTS lock_fencing_seq;
+
+-- The lock backend that issued the fencing tokens stored in users.fence_token. Tokens of different backends are not
+-- comparable, so the service resets them when it starts with another backend
+CREATE TABLE IF NOT EXISTS fencing_state (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),  -- There is only ever one row
+    lock_backend VARCHAR(20) NOT NULL  -- The LOCK_BACKEND the service last started with
+);
+
+INSERT INTO users (id, name, email, phone, status) 
+VALUES (1, 'Alice', 'alice@example.com', '13300000001', 'active');
+INSERT INTO users (id, name, email, phone, status) 
+VALUES (2, 'Bob', 'bob@example.com', '13300000002', 'active');
+INSERT INTO users (id, name, email, phone, status) 
+VALUES (3, 'John', 'john@example.com', '13300000003', 'active');
+
+-- The sample users were inserted with explicit IDs, move the sequence past them for users signing up through the API
+SELECT setval('users_id_seq', (SELECT MAX(id) FROM users));
+
+-- A user holds one wallet per ISO 4217 currency. Balances are stored with enough scale for every supported currency,
+-- the number of decimals an amount may have in a given currency is enforced by the service.
+CREATE TABLE IF NOT EXISTS wallets (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    currency CHAR(3) NOT NULL,  -- The ISO 4217 currency code, such as USD, EUR or JPY
+    balance DECIMAL(20, 8) NOT NULL DEFAULT 0,
+    held DECIMAL(20, 8) NOT NULL DEFAULT 0 CHECK (held >= 0),  -- The part of the balance held for pending withdrawals and active holds, only the rest can be spent
+    version BIGINT NOT NULL DEFAULT 0,  -- Bumped on every balance update, used for optimistic concurrency control
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, currency)
+);
+
+INSERT INTO wallets (user_id, currency, balance)
+VALUES (1, 'USD', 10.05), (2, 'USD', 50.35), (3, 'USD', 70.55);
 
 CREATE TABLE IF NOT EXISTS transactions (
     id SERIAL PRIMARY KEY,
     from_user_id INT NOT NULL,  -- The user ID of the transaction initiator
     to_user_id INT,  -- The user ID of the recipient of the transaction (0 for deposits and withdrawals)
     amount DECIMAL(20, 8) NOT NULL,  -- The transaction amount, using DECIMAL type to avoid floating-point precision issues
-    transaction_type VARCHAR(50) NOT NULL CHECK (transaction_type IN ('deposit', 'withdraw', 'transfer')),  -- The transaction type, restricted to deposit, withdraw, and transfer
-    transaction_status VARCHAR(50) NOT NULL CHECK (transaction_status IN ('completed', 'failed')),  -- The transaction status, currently supporting completed and failed, with potential for additional intermediate statuses in the future.
-    transaction_fee DECIMAL(20, 8) DEFAULT 0.00,  -- The transaction status, currently supporting completed and failed, with potential for additional intermediate statuses in the future.
-    payment_method VARCHAR(50) NOT NULL,  -- The payment method, such as credit_card, bank_transfer, paypal, etc.
+    currency CHAR(3) NOT NULL DEFAULT 'USD',  -- The ISO 4217 currency of the amount
+    transaction_type VARCHAR(50) NOT NULL CHECK (transaction_type IN ('deposit', 'withdraw', 'transfer', 'capture', 'refund', 'adjustment')),  -- The transaction type, restricted to deposit, withdraw, transfer, capture of a hold, refund, and manual balance adjustment
+    transaction_status VARCHAR(50) NOT NULL CHECK (transaction_status IN ('pending', 'processing', 'completed', 'failed', 'reversed', 'cancelled')),  -- The transaction status, pending and processing until an asynchronous payout settles
+    transaction_fee DECIMAL(20, 8) DEFAULT 0.00,  -- The fee charged on top of the amount, or deducted from it for deposits, booked to the fee revenue account
+    payment_method VARCHAR(50) NOT NULL,  -- The payment method, such as credit_card, bank_transfer or paypal, and wallet for transfers
+    payment_metadata JSONB,  -- The payment instrument of a deposit or withdrawal, such as the masked card or the bank reference, NULL if none was given
+    idempotency_key VARCHAR(255),  -- The Idempotency-Key header sent by the client, NULL if the request was not idempotent
+    request_hash VARCHAR(64),  -- The SHA-256 fingerprint of the request payload the idempotency key was first used with
+    failure_reason VARCHAR(50),  -- Why a failed transaction was rejected, such as insufficient_balance or unknown_recipient, NULL otherwise
+    target_amount DECIMAL(20, 8),  -- The amount credited to the recipient of a cross-currency transfer, NULL otherwise
+    target_currency CHAR(3),  -- The ISO 4217 currency credited to the recipient of a cross-currency transfer, NULL otherwise
+    fx_rate DECIMAL(20, 10),  -- Units of the target currency per unit of currency the transfer was converted at, NULL otherwise
+    fx_quote_id INT,  -- The FX quote executed by a cross-currency transfer, NULL otherwise
+    refund_of INT REFERENCES transactions(id),  -- The transaction a refund gives money back for, NULL for other transactions
+    refunded_amount DECIMAL(20, 8) NOT NULL DEFAULT 0 CHECK (refunded_amount >= 0),  -- The total refunded so far, never more than the refundable amount
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- An idempotency key can only ever be attached to one transaction of the user who sent it. Keys are scoped per user,
+-- so two users choosing the same key never collide and the key of one user reveals nothing to another
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_idempotency_key_idx ON transactions (from_user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+
+-- The transaction history of a user is paged by (created_at, id), through the transactions sent and received
+CREATE INDEX IF NOT EXISTS transactions_from_user_history_idx ON transactions (from_user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS transactions_to_user_history_idx ON transactions (to_user_id, created_at, id);
+
 INSERT INTO transactions (from_user_id, to_user_id, amount, transaction_type, transaction_status, transaction_fee, payment_method) 
 VALUES (1, 2, 150.75, 'transfer', 'completed', 0.00, 'bank_transfer');
 INSERT INTO transactions (from_user_id, to_user_id, amount, transaction_type, transaction_status, transaction_fee, payment_method) 
-VALUES (1, 0, 100.00, 'deposit', 'completed', 0.00, 'credit_card');
\ No newline at end of file
+VALUES (1, 0, 100.00, 'deposit', 'completed', 0.00, 'credit_card');
+
+-- FX quotes fix the rate and both amounts of a cross-currency transfer for a short while.
+-- A quote belongs to the user it was issued to and is executed by at most one transfer.
+CREATE TABLE IF NOT EXISTS fx_quotes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),  -- The user the quote was issued to
+    source_currency CHAR(3) NOT NULL,  -- The ISO 4217 currency debited from the sender
+    target_currency CHAR(3) NOT NULL CHECK (target_currency <> source_currency),  -- The ISO 4217 currency credited to the recipient
+    source_amount DECIMAL(20, 8) NOT NULL CHECK (source_amount > 0),
+    target_amount DECIMAL(20, 8) NOT NULL CHECK (target_amount > 0),  -- Rounded down to the minor unit of the target currency
+    rate DECIMAL(20, 10) NOT NULL CHECK (rate > 0),  -- Units of the target currency per unit of the source currency
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,  -- When the quote was executed, NULL while it is open
+    transaction_id INT REFERENCES transactions(id),  -- The transfer that executed the quote
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Holds reserve part of a wallet balance, card-style, until they are captured, voided or expire.
+-- The amount of an active hold is counted in wallets.held.
+CREATE TABLE IF NOT EXISTS holds (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),  -- The user whose balance is held
+    currency CHAR(3) NOT NULL,  -- The ISO 4217 currency of the held wallet
+    amount DECIMAL(20, 8) NOT NULL CHECK (amount > 0),  -- The amount reserved
+    captured_amount DECIMAL(20, 8) NOT NULL DEFAULT 0 CHECK (captured_amount >= 0 AND captured_amount <= amount),  -- The amount captured, the rest was released
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'captured', 'voided', 'expired')),
+    description VARCHAR(255) NOT NULL DEFAULT '',  -- What the hold is for, such as the merchant or the order
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,  -- When an active hold is released automatically
+    transaction_id INT REFERENCES transactions(id),  -- The capture transaction, NULL unless the hold was captured
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The expiry worker looks for active holds past their expiry
+CREATE INDEX IF NOT EXISTS holds_active_expires_at_idx ON holds (expires_at) WHERE status = 'active';
+
+-- Role-based access control. Roles grant permissions, and users are granted roles on top of customer, which every user has.
+-- The own permissions allow acting on the caller's own wallet or account, the any permissions on every user's.
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    refund_limit DECIMAL(20, 8) CHECK (refund_limit >= 0),  -- The largest refund the role may issue, in USD, NULL for no limit
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    name VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    permission VARCHAR(50) NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL REFERENCES users(id),
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    granted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role)
+);
+
+INSERT INTO permissions (name, description) VALUES
+    ('wallet:read:own', 'Read the own balances, history and statements'),
+    ('wallet:read:any', 'Read every user''s balances, history and statements'),
+    ('wallet:move:own', 'Deposit, withdraw, transfer and hold money of the own wallet'),
+    ('wallet:move:any', 'Move money of every user''s wallet'),
+    ('account:manage:own', 'Read, update and delete the own account'),
+    ('account:manage:any', 'Manage every account, including its status'),
+    ('transaction:refund', 'Refund transactions, up to the refund limit of the role'),
+    ('hold:manage', 'Capture and void holds'),
+    ('settlement:manage', 'Settle withdrawals'),
+    ('balance:adjust', 'Adjust balances by hand'),
+    ('access:manage', 'Manage API keys and the roles of users');
+
+INSERT INTO roles (name, description, refund_limit) VALUES
+    ('customer', 'Uses their own wallet and account', NULL),
+    ('support', 'Reads every wallet and issues refunds up to the refund limit', 100.00),
+    ('admin', 'Administers the wallet service', NULL);
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('customer', 'wallet:read:own'), ('customer', 'wallet:move:own'), ('customer', 'account:manage:own'),
+    ('support', 'wallet:read:any'), ('support', 'transaction:refund');
+INSERT INTO role_permissions (role, permission) SELECT 'admin', name FROM permissions;
+
+-- Usage counters aggregate the withdrawals and transfers of each user in every currency, valued in USD, over hourly,
+-- daily and monthly windows in UTC, so that transaction limits are checked against them inside the transaction moving
+-- the money, and cannot be multiplied by spreading movements over currencies.
+CREATE TABLE IF NOT EXISTS usage_counters (
+    user_id INT NOT NULL REFERENCES users(id),
+    transaction_type VARCHAR(50) NOT NULL CHECK (transaction_type IN ('withdraw', 'transfer')),
+    period VARCHAR(10) NOT NULL CHECK (period IN ('hour', 'day', 'month')),
+    period_start TIMESTAMP WITH TIME ZONE NOT NULL,  -- When the window started
+    amount DECIMAL(20, 8) NOT NULL DEFAULT 0,  -- The total amount moved in the window in USD, without fees
+    count INT NOT NULL DEFAULT 0,  -- The number of movements in the window
+    PRIMARY KEY (user_id, transaction_type, period, period_start)
+);
+
+-- Transfer schedules make a transfer later, once at start_at or repeatedly on an interval or a cron expression
+-- evaluated in the schedule's time zone. The schedule worker executes the active schedules whose next_run_at has passed.
+CREATE TABLE IF NOT EXISTS transfer_schedules (
+    id SERIAL PRIMARY KEY,
+    from_user_id INT NOT NULL REFERENCES users(id),  -- The user paying the transfers
+    to_user_id INT NOT NULL REFERENCES users(id),  -- The user receiving the transfers
+    amount DECIMAL(20, 8) NOT NULL CHECK (amount > 0),  -- The amount of each transfer
+    currency CHAR(3) NOT NULL,  -- The ISO 4217 currency of the transfers
+    description VARCHAR(255) NOT NULL DEFAULT '',  -- What the transfers are for
+    repeat_interval VARCHAR(32) NOT NULL DEFAULT '',  -- How often the transfer repeats from start_at, such as 168h, empty otherwise
+    cron_expression VARCHAR(100) NOT NULL DEFAULT '',  -- The cron expression the transfer repeats on, empty otherwise
+    time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',  -- The IANA time zone the cron expression is evaluated in
+    start_at TIMESTAMP WITH TIME ZONE NOT NULL,  -- The first occurrence, or when the cron expression starts to apply
+    end_at TIMESTAMP WITH TIME ZONE,  -- No transfers are made after this time, NULL to repeat until cancelled
+    next_run_at TIMESTAMP WITH TIME ZONE,  -- When the next transfer falls due, NULL once the schedule has ended
+    last_run_at TIMESTAMP WITH TIME ZONE,  -- When the last transfer was made or attempted
+    run_count INT NOT NULL DEFAULT 0,  -- The number of runs so far, successful or not
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'completed', 'cancelled')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (repeat_interval = '' OR cron_expression = '')
+);
+
+-- The schedule worker looks for active schedules that are due, and users list the schedules they pay
+CREATE INDEX IF NOT EXISTS transfer_schedules_due_idx ON transfer_schedules (next_run_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS transfer_schedules_from_user_idx ON transfer_schedules (from_user_id, created_at);
+
+-- Every execution of an occurrence of a schedule is recorded with its outcome, at most once per occurrence.
+CREATE TABLE IF NOT EXISTS transfer_schedule_runs (
+    id SERIAL PRIMARY KEY,
+    schedule_id INT NOT NULL REFERENCES transfer_schedules(id),
+    scheduled_for TIMESTAMP WITH TIME ZONE NOT NULL,  -- The occurrence executed
+    status VARCHAR(20) NOT NULL CHECK (status IN ('succeeded', 'failed')),
+    transaction_id INT REFERENCES transactions(id),  -- The transfer made, NULL if the run failed
+    failure_reason VARCHAR(50) NOT NULL DEFAULT '',  -- Why a failed transfer was rejected, such as insufficient_balance
+    error VARCHAR(255) NOT NULL DEFAULT '',  -- The error a failed run ended with
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (schedule_id, scheduled_for)
+);
+
+-- Transfer batches pay many users from one wallet in a single request. Every item paid is an ordinary transfer,
+-- and the items keep the result of each payment, so the batch can be polled by its ID.
+CREATE TABLE IF NOT EXISTS transfer_batches (
+    id SERIAL PRIMARY KEY,
+    from_user_id INT NOT NULL REFERENCES users(id),  -- The user paying every item
+    currency CHAR(3) NOT NULL,  -- The ISO 4217 currency of every item
+    mode VARCHAR(20) NOT NULL CHECK (mode IN ('atomic', 'best_effort')),  -- Pay every item or none, or every item that can be paid
+    status VARCHAR(20) NOT NULL CHECK (status IN ('processing', 'completed', 'partially_completed', 'failed')),
+    total_amount DECIMAL(20, 8) NOT NULL,  -- The sum of the amounts of the items, without fees
+    item_count INT NOT NULL,
+    succeeded_count INT NOT NULL DEFAULT 0,
+    failed_count INT NOT NULL DEFAULT 0,
+    idempotency_key VARCHAR(255),  -- The Idempotency-Key header sent by the client, NULL if the request was not idempotent
+    request_hash VARCHAR(64),  -- The SHA-256 fingerprint of the request payload the idempotency key was first used with
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Idempotency keys of batches are scoped per paying user, like those of transactions
+CREATE UNIQUE INDEX IF NOT EXISTS transfer_batches_idempotency_key_idx ON transfer_batches (from_user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS transfer_batch_items (
+    batch_id INT NOT NULL REFERENCES transfer_batches(id),
+    position INT NOT NULL,  -- The index of the item in the request, from 0
+    to_user_id INT NOT NULL,  -- The user paid, unknown users fail the item rather than the batch
+    amount DECIMAL(20, 8) NOT NULL CHECK (amount > 0),
+    fee DECIMAL(20, 8) NOT NULL DEFAULT 0,  -- The transfer fee charged to the payer on top of the amount
+    reference VARCHAR(100) NOT NULL DEFAULT '',  -- The caller's reference of the item, such as a payslip number
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+    transaction_id INT REFERENCES transactions(id),  -- The transfer paying the item, NULL unless it succeeded
+    failure_reason VARCHAR(50) NOT NULL DEFAULT '',  -- Why the item failed, such as unknown_recipient or batch_aborted
+    error VARCHAR(255) NOT NULL DEFAULT '',  -- The error the item failed with
+    PRIMARY KEY (batch_id, position)
+);
+
+-- The outbox holds the domain events of money movements. An event is written in the database transaction of the
+-- movement it describes, so it exists if and only if the movement was committed, and the outbox relay publishes
+-- the events to downstream systems in ID order afterwards.
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(50) NOT NULL,  -- Such as transaction.completed or balance.changed
+    aggregate_type VARCHAR(20) NOT NULL,  -- The kind of record the event is about: transaction or wallet
+    aggregate_id VARCHAR(50) NOT NULL,  -- The transaction ID, or the user ID and currency of a wallet such as 1:USD
+    payload JSONB NOT NULL,  -- The transaction, or the balance of the wallet after the movement
+    attempts INT NOT NULL DEFAULT 0,  -- The number of failed attempts to publish the event
+    last_error VARCHAR(255) NOT NULL DEFAULT '',  -- The error of the last failed attempt
+    claimed_until TIMESTAMP WITH TIME ZONE,  -- Until when a relay is publishing the event, or a failed event waits to be retried
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP WITH TIME ZONE,  -- When the event was published, NULL until then
+    dead_at TIMESTAMP WITH TIME ZONE  -- When the event was parked after its last attempt failed, NULL while it is retried
+);
+
+-- The relay claims the events neither published nor dead in ID order
+CREATE INDEX IF NOT EXISTS outbox_events_unpublished_idx ON outbox_events (id) WHERE published_at IS NULL AND dead_at IS NULL;
+
+-- Webhook endpoints receive the events of a user's wallets, such as a merchant's callbacks. The secret is kept as it is,
+-- because every request is signed with it; it is only shown once, when the endpoint is registered.
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),  -- The user whose events are posted
+    url VARCHAR(2048) NOT NULL,  -- The https URL the events are posted to
+    secret VARCHAR(64) NOT NULL,  -- The key of the HMAC-SHA256 signature of every request
+    event_types TEXT[] NOT NULL CHECK (event_types <@ ARRAY['transaction.completed', 'transaction.failed', 'balance.changed']),
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'disabled')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_endpoints_user_id_idx ON webhook_endpoints (user_id) WHERE status = 'active';
+
+-- Every event is delivered to each endpoint subscribed to it once, retried with a growing delay until the endpoint
+-- acknowledges it or the attempts run out and the delivery is dead. The row is also the delivery log of the endpoint.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    endpoint_id INT NOT NULL REFERENCES webhook_endpoints(id),
+    event_id BIGINT NOT NULL REFERENCES outbox_events(id),  -- The event delivered
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,  -- The JSON body posted to the endpoint
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,  -- The number of attempts so far
+    next_attempt_at TIMESTAMP WITH TIME ZONE,  -- When a pending delivery is attempted next, NULL otherwise
+    last_status_code INT,  -- The HTTP status of the last attempt, NULL if it got no response
+    last_error VARCHAR(255) NOT NULL DEFAULT '',  -- Why the last attempt failed
+    delivered_at TIMESTAMP WITH TIME ZONE,  -- When the endpoint acknowledged the event
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (endpoint_id, event_id)  -- An event published again by the outbox relay is not delivered twice
+);
+
+-- The delivery worker reads the pending deliveries that are due, the delivery log is read by endpoint newest first
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_endpoint_id_idx ON webhook_deliveries (endpoint_id, id);
+
+-- API keys authenticate the backend services calling the wallet service directly. Only the SHA-256 hash of a key
+-- is stored, the key itself is shown once when it is created or rotated. A rotated key keeps working until expires_at.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,  -- Which service the key belongs to
+    key_prefix VARCHAR(32) NOT NULL UNIQUE,  -- The public part of the key it is looked up by, such as wk_1a2b3c4d5e6f
+    key_hash CHAR(64) NOT NULL,  -- The hex SHA-256 hash of the whole key
+    scopes TEXT[] NOT NULL CHECK (scopes <@ ARRAY['read-balance', 'deposit', 'withdraw', 'transfer', 'admin']),
+    expires_at TIMESTAMP WITH TIME ZONE,  -- When a rotated key stops working, NULL if it does not expire
+    revoked_at TIMESTAMP WITH TIME ZONE,  -- When the key was revoked, NULL while it is not
+    rotated_from INT REFERENCES api_keys(id),  -- The key this one replaced
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Double-entry ledger. Every money movement is recorded as a journal entry whose postings sum to zero,
+-- so wallet balances can always be proven from history. External parties are modelled as system accounts.
+-- Every account holds a single currency, user:<id>:<currency> for wallets and system:<name>:<currency> for system accounts.
+CREATE TABLE IF NOT EXISTS ledger_accounts (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(100) UNIQUE NOT NULL,  -- The account code, such as user:1:USD or system:external_funding:USD
+    user_id INT REFERENCES users(id),  -- The owning user, NULL for system accounts
+    account_type VARCHAR(20) NOT NULL CHECK (account_type IN ('user', 'system')),
+    currency CHAR(3) NOT NULL,  -- The ISO 4217 currency of the account
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INT REFERENCES transactions(id),  -- The transaction the entry belongs to, NULL for opening balances
+    description VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS postings (
+    id SERIAL PRIMARY KEY,
+    journal_entry_id INT NOT NULL REFERENCES journal_entries(id),
+    account_id INT NOT NULL REFERENCES ledger_accounts(id),
+    amount DECIMAL(20, 8) NOT NULL CHECK (amount <> 0)  -- Signed amount, positive increases the account balance
+);
+
+CREATE INDEX IF NOT EXISTS postings_account_id_idx ON postings (account_id);
+
+-- Reject any journal entry whose postings do not sum to zero in every currency when the transaction commits
+CREATE OR REPLACE FUNCTION check_journal_entry_balanced() RETURNS TRIGGER AS $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM postings p JOIN ledger_accounts a ON a.id = p.account_id
+        WHERE p.journal_entry_id = NEW.journal_entry_id
+        GROUP BY a.currency
+        HAVING SUM(p.amount) <> 0
+    ) THEN
+        RAISE EXCEPTION 'journal entry % is not balanced', NEW.journal_entry_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER postings_balanced
+    AFTER INSERT ON postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_journal_entry_balanced();
+
+INSERT INTO ledger_accounts (code, account_type, currency)
+VALUES ('system:external_funding:USD', 'system', 'USD'), ('system:external_payout:USD', 'system', 'USD'), ('system:opening_balance:USD', 'system', 'USD');
+INSERT INTO ledger_accounts (code, user_id, account_type, currency)
+SELECT 'user:' || user_id || ':' || currency, user_id, 'user', currency FROM wallets;
+
+-- Post the balances of the initial wallets as opening balances
+WITH entry AS (
+    INSERT INTO journal_entries (description) VALUES ('opening balance') RETURNING id
+)
+INSERT INTO postings (journal_entry_id, account_id, amount)
+SELECT entry.id, a.id, w.balance FROM entry, wallets w JOIN ledger_accounts a ON a.user_id = w.user_id AND a.currency = w.currency WHERE w.balance <> 0
+UNION ALL
+SELECT entry.id, o.id, -(SELECT SUM(balance) FROM wallets WHERE currency = 'USD') FROM entry, ledger_accounts o WHERE o.code = 'system:opening_balance:USD';
@@ -55,19 +55,35 @@ func resetDatabase(dbConn *sqlx.DB) error {
         return err
     }
 
-    // Reset the user balances
-    _, err = dbConn.Exec("UPDATE users SET balance = 10.05 WHERE id = 1;")
+    // Reset the balances of the users' USD wallets
+    _, err = dbConn.Exec("UPDATE wallets SET balance = 10.05, held = 0 WHERE user_id = 1 AND currency = 'USD';")
     if err != nil {
         log.Println("Error updating balance for user_id = 1:", err)
         return err
     }
 
-    _, err = dbConn.Exec("UPDATE users SET balance = 50.35 WHERE id = 2;")
+    _, err = dbConn.Exec("UPDATE wallets SET balance = 50.35, held = 0 WHERE user_id = 2 AND currency = 'USD';")
     if err != nil {
         log.Println("Error updating balance for user_id = 2:", err)
         return err
     }
 
+    // Post the reset balances as opening balances, so that the ledger reconciles with wallets.balance again
+    _, err = dbConn.Exec(`
+        WITH entry AS (
+            INSERT INTO journal_entries (description) VALUES ('opening balance') RETURNING id
+        )
+        INSERT INTO postings (journal_entry_id, account_id, amount)
+        SELECT entry.id, a.id, w.balance FROM entry, wallets w JOIN ledger_accounts a ON a.user_id = w.user_id AND a.currency = w.currency
+        WHERE w.currency = 'USD' AND w.balance <> 0
+        UNION ALL
+        SELECT entry.id, o.id, -(SELECT SUM(balance) FROM wallets WHERE currency = 'USD') FROM entry, ledger_accounts o WHERE o.code = 'system:opening_balance:USD';
+    `)
+    if err != nil {
+        log.Println("Error posting opening balances:", err)
+        return err
+    }
+
     log.Println("Database reset complete!")
     return nil
 }
@@ -95,7 +111,7 @@ func TestDepositSuccess(t *testing.T) {
 
     expected := `{
         "status": 200,
-        "data": "",
+        "data": {"transaction_id": 1, "amount": "100.05", "currency": "USD", "fee": "0", "status": "completed"},
         "errmsg": "Deposit successful"
     }`
 
@@ -185,7 +201,7 @@ func TestWithdrawSuccess(t *testing.T) {
 
     expected := `{
         "status": 200,
-        "data": "",
+        "data": {"transaction_id": 2, "amount": "1.5", "currency": "USD", "fee": "0", "status": "completed"},
         "errmsg": "Withdraw successful"
     }`
 
@@ -306,7 +322,7 @@ func TestTransferSuccess(t *testing.T) {
 
     expected := `{
         "status": 200,
-        "data": "",
+        "data": {"transaction_id": 3, "amount": "2.05", "currency": "USD", "fee": "0", "status": "completed"},
         "errmsg": "Transfer successful"
     }`
 
@@ -427,7 +443,9 @@ func TestBalanceQuery(t *testing.T) {
         "status": 200,
         "data": {
             "user_id": 1,
-            "balance": "106.55"
+            "balances": [
+                {"currency": "USD", "balance": "106.55", "available": "106.55", "held": "0"}
+            ]
         },
         "errmsg": ""
     }`
@@ -489,7 +507,7 @@ func TestTransactionsQuery(t *testing.T) {
                     TransactionType:   "transfer",
                     TransactionStatus: "completed",
                     TransactionFee:    "0",
-                    PaymentMethod:     "",
+                    PaymentMethod:     "wallet",
                 },
                 {
                     ID:                2,
@@ -498,7 +516,7 @@ func TestTransactionsQuery(t *testing.T) {
                     TransactionType:   "withdraw",
                     TransactionStatus: "completed",
                     TransactionFee:    "0",
-                    PaymentMethod:     "",
+                    PaymentMethod:     "credit_card",
                 },
                 {
                     ID:                1,
@@ -507,7 +525,7 @@ func TestTransactionsQuery(t *testing.T) {
                     TransactionType:   "deposit",
                     TransactionStatus: "completed",
                     TransactionFee:    "0",
-                    PaymentMethod:     "",
+                    PaymentMethod:     "credit_card",
                 },
             },
         },
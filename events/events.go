@@ -0,0 +1,35 @@
+// Package events publishes the domain events of the wallet service to downstream systems, such as notifications,
+// analytics and accounting. It defines a pluggable Publisher interface with an in-memory implementation, a Redis
+// Streams implementation and a webhook implementation. The events come from the transactional outbox: they are
+// written in the database transaction of the change they describe and handed to a Publisher by the outbox relay,
+// at least once and mostly in order: an event that failed to publish is retried after the events written after it,
+// and is dropped once it has failed too often. Consumers should therefore deduplicate events by their ID and order
+// them by it, such as by ignoring a balance.changed event of a wallet older than the last one applied.
+package events
+
+import (
+    "context"
+    "errors"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// Publisher delivers domain events to downstream systems.
+type Publisher interface {
+    // Publish delivers the event. An error leaves the event in the outbox, it is published again later.
+    Publish(ctx context.Context, event model.OutboxEvent) error
+}
+
+// Multi is a Publisher delivering every event to each of its publishers in turn. An event that one of them fails to
+// publish is published to all of them again, so each must tolerate duplicates.
+type Multi []Publisher
+
+// Publish delivers the event to every publisher, and returns the errors of those that failed.
+func (m Multi) Publish(ctx context.Context, event model.OutboxEvent) error {
+    var errs []error
+    for _, publisher := range m {
+        if err := publisher.Publish(ctx, event); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
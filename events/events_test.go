@@ -0,0 +1,55 @@
+package events
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "testing"
+    "time"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// testEvent is the transaction.completed event of transaction 14
+func testEvent() model.OutboxEvent {
+    return model.OutboxEvent{
+        ID:            3,
+        EventType:     "transaction.completed",
+        AggregateType: model.AggregateTransaction,
+        AggregateID:   "14",
+        Payload:       json.RawMessage(`{"id":14,"amount":"50"}`),
+        CreatedAt:     time.Date(2024, 11, 12, 18, 35, 41, 0, time.UTC),
+    }
+}
+
+// failingPublisher fails to publish every event
+type failingPublisher struct{}
+
+func (failingPublisher) Publish(context.Context, model.OutboxEvent) error {
+    return errors.New("unreachable")
+}
+
+func TestMemoryPublisher(t *testing.T) {
+    publisher := NewMemoryPublisher()
+    var received []int64
+    publisher.Subscribe(func(event model.OutboxEvent) {
+        received = append(received, event.ID)
+    })
+
+    require.NoError(t, publisher.Publish(context.Background(), testEvent()))
+    require.Equal(t, []model.OutboxEvent{testEvent()}, publisher.Events())
+    require.Equal(t, []int64{3}, received)
+}
+
+// Test that every publisher gets the event, and that the failure of one of them is reported
+func TestMulti(t *testing.T) {
+    first, second := NewMemoryPublisher(), NewMemoryPublisher()
+
+    require.NoError(t, Multi{first, second}.Publish(context.Background(), testEvent()))
+    require.Len(t, first.Events(), 1)
+    require.Len(t, second.Events(), 1)
+
+    err := Multi{first, failingPublisher{}, second}.Publish(context.Background(), testEvent())
+    require.ErrorContains(t, err, "unreachable")
+    require.Len(t, second.Events(), 2)
+}
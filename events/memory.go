@@ -0,0 +1,45 @@
+package events
+
+import (
+    "context"
+    "sync"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// MemoryPublisher is a Publisher keeping the events in memory, and handing them to the functions subscribed in the
+// same process. It suits tests and a single instance of the service; the events are lost when the process stops.
+type MemoryPublisher struct {
+    mu          sync.Mutex
+    events      []model.OutboxEvent
+    subscribers []func(model.OutboxEvent)
+}
+
+// NewMemoryPublisher creates a new in-memory Publisher.
+func NewMemoryPublisher() *MemoryPublisher {
+    return &MemoryPublisher{}
+}
+
+// Subscribe calls fn with every event published from now on, in order. fn runs while the event is published, so it should return quickly.
+func (p *MemoryPublisher) Subscribe(fn func(model.OutboxEvent)) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.subscribers = append(p.subscribers, fn)
+}
+
+// Publish keeps the event and hands it to the subscribers.
+func (p *MemoryPublisher) Publish(_ context.Context, event model.OutboxEvent) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.events = append(p.events, event)
+    for _, fn := range p.subscribers {
+        fn(event)
+    }
+    return nil
+}
+
+// Events returns the events published so far, in order.
+func (p *MemoryPublisher) Events() []model.OutboxEvent {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return append([]model.OutboxEvent(nil), p.events...)
+}
@@ -0,0 +1,55 @@
+package events
+
+import (
+    "context"
+    "fmt"
+    "strconv"
+    "time"
+    "github.com/go-redis/redis/v8"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// DefaultStream is the Redis stream events are added to when none is configured.
+const DefaultStream = "wallet:events"
+
+// RedisStreamPublisher is a Publisher adding every event as an entry to a Redis stream, which any number of consumer
+// groups can read at their own pace. The entry carries the event ID, so consumers can skip an event added twice.
+type RedisStreamPublisher struct {
+    client *redis.Client
+    stream string
+    maxLen int64
+}
+
+// NewRedisStreamPublisher creates a new Publisher adding events to the stream. The stream is trimmed to about maxLen
+// entries, the oldest first; 0 keeps every entry.
+func NewRedisStreamPublisher(client *redis.Client, stream string, maxLen int64) *RedisStreamPublisher {
+    return &RedisStreamPublisher{
+        client: client,
+        stream: stream,
+        maxLen: maxLen,
+    }
+}
+
+// Publish adds the event to the stream.
+func (p *RedisStreamPublisher) Publish(ctx context.Context, event model.OutboxEvent) error {
+    args := &redis.XAddArgs{
+        Stream: p.stream,
+        Values: []interface{}{
+            "id", strconv.FormatInt(event.ID, 10),
+            "type", event.EventType,
+            "aggregate_type", event.AggregateType,
+            "aggregate_id", event.AggregateID,
+            "payload", string(event.Payload),
+            "created_at", event.CreatedAt.Format(time.RFC3339Nano),
+        },
+    }
+    if p.maxLen > 0 {
+        args.MaxLen = p.maxLen
+        args.Approx = true
+    }
+
+    if err := p.client.XAdd(ctx, args).Err(); err != nil {
+        return fmt.Errorf("failed to add event %d to stream %s: %w", event.ID, p.stream, err)
+    }
+    return nil
+}
@@ -0,0 +1,32 @@
+package events
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "github.com/go-redis/redis/v8"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/stretchr/testify/require"
+)
+
+func TestRedisStreamPublisher_Publish(t *testing.T) {
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    values := []interface{}{
+        "id", "3",
+        "type", "transaction.completed",
+        "aggregate_type", "transaction",
+        "aggregate_id", "14",
+        "payload", `{"id":14,"amount":"50"}`,
+        "created_at", "2024-11-12T18:35:41Z",
+    }
+    mockRedis.ExpectXAdd(&redis.XAddArgs{Stream: DefaultStream, MaxLen: 1000, Approx: true, Values: values}).SetVal("1731436541000-0")
+    mockRedis.ExpectXAdd(&redis.XAddArgs{Stream: DefaultStream, MaxLen: 1000, Approx: true, Values: values}).SetErr(errors.New("connection refused"))
+
+    publisher := NewRedisStreamPublisher(redisClient, DefaultStream, 1000)
+    require.NoError(t, publisher.Publish(context.Background(), testEvent()))
+    require.ErrorContains(t, publisher.Publish(context.Background(), testEvent()), "connection refused")
+
+    require.NoError(t, mockRedis.ExpectationsWereMet())
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// Headers of the requests the webhook publisher makes.
+const (
+    EventIDHeader   = "X-Event-ID"   // The ID of the event, to deduplicate events delivered twice
+    EventTypeHeader = "X-Event-Type" // The type of the event, such as transaction.completed
+)
+
+// WebhookPublisher is a Publisher posting every event as JSON to one URL, such as the ingestion endpoint of an internal
+// system. Any 2xx response acknowledges the event; other responses and network errors leave it to be published again.
+type WebhookPublisher struct {
+    url    string
+    client *http.Client
+}
+
+// NewWebhookPublisher creates a new Publisher posting events to the URL, giving up on a request after the timeout.
+func NewWebhookPublisher(url string, timeout time.Duration) *WebhookPublisher {
+    return &WebhookPublisher{
+        url:    url,
+        client: &http.Client{Timeout: timeout},
+    }
+}
+
+// Publish posts the event to the URL.
+func (p *WebhookPublisher) Publish(ctx context.Context, event model.OutboxEvent) error {
+    body, err := json.Marshal(event)
+    if err != nil {
+        return fmt.Errorf("failed to encode event %d: %w", event.ID, err)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+    if err != nil {
+        return fmt.Errorf("failed to build request for event %d: %w", event.ID, err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(EventIDHeader, strconv.FormatInt(event.ID, 10))
+    req.Header.Set(EventTypeHeader, event.EventType)
+
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return fmt.Errorf("failed to post event %d: %w", event.ID, err)
+    }
+    defer resp.Body.Close() // nolint:errcheck
+    _, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("failed to post event %d: %s answered %s", event.ID, p.url, resp.Status)
+    }
+    return nil
+}
@@ -0,0 +1,33 @@
+package events
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+func TestWebhookPublisher_Publish(t *testing.T) {
+    status := http.StatusNoContent
+    var received model.OutboxEvent
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        require.Equal(t, "3", r.Header.Get(EventIDHeader))
+        require.Equal(t, "transaction.completed", r.Header.Get(EventTypeHeader))
+        require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+        w.WriteHeader(status)
+    }))
+    defer server.Close()
+
+    publisher := NewWebhookPublisher(server.URL, time.Second)
+    require.NoError(t, publisher.Publish(context.Background(), testEvent()))
+    require.Equal(t, "14", received.AggregateID)
+    require.JSONEq(t, `{"id":14,"amount":"50"}`, string(received.Payload))
+
+    // Responses other than 2xx leave the event to be published again
+    status = http.StatusServiceUnavailable
+    require.ErrorContains(t, publisher.Publish(context.Background(), testEvent()), "503")
+}
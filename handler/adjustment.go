@@ -0,0 +1,67 @@
+package handler
+
+import (
+    "fmt"
+    "net/http"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/shopspring/decimal"
+)
+
+// AdjustmentHandler handles the administrator requests correcting wallet balances by hand.
+type AdjustmentHandler struct {
+    adjustmentService *service.AdjustmentService
+}
+
+// NewAdjustmentHandler creates a new instance of AdjustmentHandler with the provided AdjustmentService.
+func NewAdjustmentHandler(adjustmentService *service.AdjustmentService) *AdjustmentHandler {
+    return &AdjustmentHandler{adjustmentService: adjustmentService}
+}
+
+// HandleAdjustBalance handles the administrator request to credit or debit a user's wallet by hand.
+// A positive amount is credited and a negative one debited, and a reason is required.
+func (h *AdjustmentHandler) HandleAdjustBalance(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+
+    var req struct {
+        Currency string          `json:"currency"` // ISO 4217 code, defaults to USD when omitted
+        Amount   decimal.Decimal `json:"amount"`   // Positive to credit the wallet, negative to debit it
+        Reason   string          `json:"reason"`   // Why the balance is adjusted, kept in the ledger
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    idempotencyKey, ok := getIdempotencyKey(c)
+    if !ok {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid Idempotency-Key header")
+        return
+    }
+
+    txn, replayed, err := h.adjustmentService.Adjust(c, userID, req.Currency, req.Amount, req.Reason, callerName(c), idempotencyKey)
+    if err != nil {
+        sendMovementError(c, err)
+        return
+    }
+
+    markReplayed(c, replayed)
+    sendResponse(c, http.StatusOK, newMovementResponse(txn), "Adjustment successful")
+}
+
+// callerName describes the caller of the request for audit records, such as user 7 or api key 3,
+// and is empty for anonymous requests.
+func callerName(c *gin.Context) string {
+    caller, ok := GetCaller(c)
+    switch {
+    case !ok:
+        return ""
+    case caller.IsService():
+        return fmt.Sprintf("api key %d", caller.APIKeyID)
+    }
+    return fmt.Sprintf("user %d", caller.UserID)
+}
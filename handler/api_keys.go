@@ -0,0 +1,96 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+)
+
+// APIKeyHandler handles the administrator requests creating, rotating and revoking the API keys of backend services.
+type APIKeyHandler struct {
+    apiKeyService *service.APIKeyService
+}
+
+// NewAPIKeyHandler creates a new instance of APIKeyHandler with the provided APIKeyService.
+func NewAPIKeyHandler(apiKeyService *service.APIKeyService) *APIKeyHandler {
+    return &APIKeyHandler{apiKeyService: apiKeyService}
+}
+
+// IssuedAPIKeyResponse is a newly created or rotated API key together with the key itself, which is only ever returned here.
+type IssuedAPIKeyResponse struct {
+    APIKey *model.APIKey `json:"api_key"`
+    Key    string        `json:"key"`
+}
+
+// HandleCreateAPIKey handles the administrator request to create an API key with a name and scopes.
+func (h *APIKeyHandler) HandleCreateAPIKey(c *gin.Context) {
+    var req struct {
+        Name   string   `json:"name"`   // Which service the key is for
+        Scopes []string `json:"scopes"` // Some of read-balance, deposit, withdraw, transfer and admin
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    apiKey, key, err := h.apiKeyService.CreateAPIKey(c, req.Name, req.Scopes)
+    if err != nil {
+        sendAPIKeyError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusCreated, IssuedAPIKeyResponse{APIKey: apiKey, Key: key}, "")
+}
+
+// HandleRotateAPIKey handles the administrator request to replace an API key with a new one.
+// The old key keeps working for the rotation grace period.
+func (h *APIKeyHandler) HandleRotateAPIKey(c *gin.Context) {
+    keyID, err := strconv.Atoi(c.Param("key_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid API key ID")
+        return
+    }
+
+    apiKey, key, err := h.apiKeyService.RotateAPIKey(c, keyID)
+    if err != nil {
+        sendAPIKeyError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusCreated, IssuedAPIKeyResponse{APIKey: apiKey, Key: key}, "")
+}
+
+// HandleRevokeAPIKey handles the administrator request to revoke an API key right away.
+func (h *APIKeyHandler) HandleRevokeAPIKey(c *gin.Context) {
+    keyID, err := strconv.Atoi(c.Param("key_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid API key ID")
+        return
+    }
+
+    apiKey, err := h.apiKeyService.RevokeAPIKey(c, keyID)
+    if err != nil {
+        sendAPIKeyError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, apiKey, "")
+}
+
+// sendAPIKeyError answers a failed API key management request with the status code matching the error.
+func sendAPIKeyError(c *gin.Context, err error) {
+    status := http.StatusInternalServerError
+    switch {
+    case errors.Is(err, service.ErrInvalidAPIKeyRequest):
+        status = http.StatusBadRequest
+    case errors.Is(err, repository.ErrAPIKeyNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, service.ErrAPIKeyInactive):
+        status = http.StatusConflict
+    }
+    sendResponse(c, status, "", err.Error())
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/shopspring/decimal"
+)
+
+// BatchHandler handles HTTP requests paying many users in one batch, and polling the status of a batch.
+type BatchHandler struct {
+    batchService *service.BatchService
+}
+
+// NewBatchHandler creates a new instance of BatchHandler with the provided BatchService.
+func NewBatchHandler(batchService *service.BatchService) *BatchHandler {
+    return &BatchHandler{batchService: batchService}
+}
+
+// HandleTransferBatch handles the HTTP request to transfer funds from one user to many. The batch is answered with
+// 200 OK and the result of every item once it has been processed, also when some or all of its items failed.
+func (h *BatchHandler) HandleTransferBatch(c *gin.Context) {
+    var req struct {
+        FromUserID int    `json:"from_user_id"`
+        Currency   string `json:"currency"` // ISO 4217 code of every item, defaults to USD when omitted
+        Mode       string `json:"mode"`     // atomic to pay every item or none, the default, or best_effort to pay every item that can be paid
+        Items      []struct {
+            ToUserID  int             `json:"to_user_id"`
+            Amount    decimal.Decimal `json:"amount"`
+            Reference string          `json:"reference"` // The caller's reference of the item, such as a payslip number
+        } `json:"items"`
+    }
+
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    // Act on the caller's own wallet unless another user is named, which needs the wallet:move:any permission
+    req.FromUserID = actingUserID(c, req.FromUserID)
+    if !authorizeUser(c, req.FromUserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        return
+    }
+
+    idempotencyKey, ok := getIdempotencyKey(c)
+    if !ok {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid Idempotency-Key header")
+        return
+    }
+
+    items := make([]service.BatchItem, 0, len(req.Items))
+    for _, item := range req.Items {
+        items = append(items, service.BatchItem{ToUserID: item.ToUserID, Amount: item.Amount, Reference: item.Reference})
+    }
+
+    batch, replayed, err := h.batchService.TransferBatch(c, req.FromUserID, req.Currency, req.Mode, items, idempotencyKey)
+    if err != nil {
+        sendBatchError(c, err)
+        return
+    }
+
+    markReplayed(c, replayed)
+    sendResponse(c, http.StatusOK, batch, "")
+}
+
+// HandleGetBatch handles the HTTP request to get a transfer batch with the result of its items.
+func (h *BatchHandler) HandleGetBatch(c *gin.Context) {
+    batchID, err := strconv.Atoi(c.Param("batch_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid batch ID")
+        return
+    }
+
+    batch, err := h.batchService.GetBatch(c, batchID)
+    if err == nil && !mayActOnOwner(c, batch.FromUserID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        err = repository.ErrBatchNotFound
+    }
+    if err != nil {
+        sendBatchError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, batch, "")
+}
+
+// sendBatchError answers a failed transfer batch request with the status code matching the error.
+func sendBatchError(c *gin.Context, err error) {
+    status := http.StatusBadRequest
+    switch {
+    case errors.Is(err, repository.ErrBatchNotFound), errors.Is(err, repository.ErrUserNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, service.ErrIdempotencyKeyConflict), errors.Is(err, service.ErrBalanceBusy):
+        status = http.StatusConflict
+    }
+    sendResponse(c, status, "", err.Error())
+}
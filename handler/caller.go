@@ -0,0 +1,286 @@
+package handler
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/auth"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/policy"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// Identity headers set by the authenticating gateway in front of the service, when the service does not verify tokens itself.
+// They are only trusted when the gateway is configured as trusted, otherwise anyone could claim any identity with them.
+const (
+    CallerUserIDHeader = "X-User-ID"    // The ID of the authenticated user
+    CallerRolesHeader  = "X-User-Roles" // The comma-separated roles of the authenticated user, such as admin
+)
+
+// Headers of the requests backend services make with an API key.
+const (
+    APIKeyHeader             = "X-API-Key"             // The API key
+    SignatureHeader          = "X-Signature"           // The hex HMAC-SHA256 signature of the request, see auth.SignRequest
+    SignatureTimestampHeader = "X-Signature-Timestamp" // The Unix time the request was signed at
+)
+
+// maxSignedBodySize is the largest request body read to check its signature.
+const maxSignedBodySize = 1 << 20
+
+// callerKey is the gin context key the authenticated caller is stored under.
+const callerKey = "caller"
+
+// authorizedKey is the gin context key set once the permissions of the caller have been resolved.
+const authorizedKey = "caller_authorized"
+
+// authDisabledKey is the gin context key set on requests that are anonymous because authentication is disabled.
+const authDisabledKey = "auth_disabled"
+
+// SetCaller stores the authenticated caller of the request, for the handlers to authorise it.
+func SetCaller(c *gin.Context, caller model.Caller) {
+    c.Set(callerKey, caller)
+}
+
+// GetCaller returns the authenticated caller of the request, and false if the request is anonymous.
+func GetCaller(c *gin.Context) (model.Caller, bool) {
+    value, ok := c.Get(callerKey)
+    if !ok {
+        return model.Caller{}, false
+    }
+    caller, ok := value.(model.Caller)
+    return caller, ok
+}
+
+// Authenticate identifies the caller of every request. Requests with an API key are made by backend services: the key
+// and the signature of the request are checked, and the caller gets the scopes of the key as its roles. Other requests
+// must carry a bearer token, whose user becomes the caller with the scopes of the token as its roles, so that a token
+// with the admin scope acts as an administrator. Without a verifier, the caller is read from the identity headers of
+// the gateway in front of the service if it is trusted; the identity headers are ignored otherwise. Requests without
+// an API key then stay anonymous only if authentication is disabled. Requests that cannot be authenticated are
+// answered with 401 Unauthorized.
+func Authenticate(verifier *auth.Verifier, apiKeys *service.APIKeyService, trustGateway, disabled bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if key := c.GetHeader(APIKeyHeader); key != "" {
+            authenticateAPIKey(c, apiKeys, key)
+            return
+        }
+        if verifier == nil {
+            switch {
+            case trustGateway:
+                authenticateGateway(c)
+            case disabled:
+                c.Set(authDisabledKey, true)
+                c.Next()
+            default:
+                sendResponse(c, http.StatusUnauthorized, "", "Authentication is not configured")
+                c.Abort()
+            }
+            return
+        }
+
+        token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+        if !ok || token == "" {
+            c.Header("WWW-Authenticate", "Bearer")
+            sendResponse(c, http.StatusUnauthorized, "", "Missing bearer token")
+            c.Abort()
+            return
+        }
+
+        claims, err := verifier.Verify(strings.TrimSpace(token))
+        if err != nil {
+            msg := "Invalid bearer token"
+            if errors.Is(err, auth.ErrTokenExpired) {
+                msg = "Expired bearer token"
+            }
+            c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+            sendResponse(c, http.StatusUnauthorized, "", msg)
+            c.Abort()
+            return
+        }
+
+        userID, err := strconv.Atoi(claims.Subject)
+        if err != nil || userID <= 0 {
+            sendResponse(c, http.StatusUnauthorized, "", "Bearer token is not issued to a wallet user")
+            c.Abort()
+            return
+        }
+
+        SetCaller(c, model.Caller{UserID: userID, Roles: claims.Scopes})
+        c.Next()
+    }
+}
+
+// authenticateGateway identifies the caller from the identity headers set by the trusted gateway in front of the service.
+// Requests without a valid user ID are answered with 401 Unauthorized, the gateway sets it on every authenticated request.
+func authenticateGateway(c *gin.Context) {
+    userID, err := strconv.Atoi(c.GetHeader(CallerUserIDHeader))
+    if err != nil || userID <= 0 {
+        sendResponse(c, http.StatusUnauthorized, "", "Missing or invalid caller identity")
+        c.Abort()
+        return
+    }
+
+    caller := model.Caller{UserID: userID}
+    for _, role := range strings.Split(c.GetHeader(CallerRolesHeader), ",") {
+        if role = strings.TrimSpace(role); role != "" {
+            caller.Roles = append(caller.Roles, role)
+        }
+    }
+    SetCaller(c, caller)
+    c.Next()
+}
+
+// authenticateAPIKey authenticates a backend service by its API key and the signature of the request.
+// The body is read to check the signature and put back for the handler.
+func authenticateAPIKey(c *gin.Context, apiKeys *service.APIKeyService, key string) {
+    var body []byte
+    if c.Request.Body != nil {
+        var err error
+        body, err = io.ReadAll(io.LimitReader(c.Request.Body, maxSignedBodySize+1))
+        if err != nil {
+            sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+            c.Abort()
+            return
+        }
+        if len(body) > maxSignedBodySize {
+            sendResponse(c, http.StatusRequestEntityTooLarge, "", "Request body too large")
+            c.Abort()
+            return
+        }
+        c.Request.Body = io.NopCloser(bytes.NewReader(body))
+    }
+
+    apiKey, err := apiKeys.Authenticate(c, key, service.SignedRequest{
+        Method:    c.Request.Method,
+        Path:      c.Request.URL.RequestURI(),
+        Body:      body,
+        Timestamp: c.GetHeader(SignatureTimestampHeader),
+        Signature: c.GetHeader(SignatureHeader),
+    })
+    if err != nil {
+        switch {
+        case errors.Is(err, service.ErrInvalidAPIKey):
+            sendResponse(c, http.StatusUnauthorized, "", "Invalid API key")
+        case errors.Is(err, auth.ErrInvalidSignature), errors.Is(err, auth.ErrStaleSignature), errors.Is(err, service.ErrRequestReplayed):
+            sendResponse(c, http.StatusUnauthorized, "", err.Error())
+        default:
+            utils.GetLogger().Errorf("Error authenticating API key: %v", err)
+            sendResponse(c, http.StatusInternalServerError, "", "Could not authenticate the request")
+        }
+        c.Abort()
+        return
+    }
+
+    SetCaller(c, model.Caller{Roles: apiKey.Scopes, APIKeyID: apiKey.ID})
+    c.Next()
+}
+
+// Authorize resolves the roles of the authenticated caller into permissions and a refund limit, see policy.Enforcer.
+// It runs after Authenticate and resolves every caller once. Anonymous requests are left as they are.
+func Authorize(enforcer *policy.Enforcer) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        caller, ok := GetCaller(c)
+        if !ok || c.GetBool(authorizedKey) {
+            c.Next()
+            return
+        }
+
+        caller, err := enforcer.Resolve(c, caller)
+        if err != nil {
+            utils.GetLogger().Errorf("Error resolving the permissions of the caller: %v", err)
+            sendResponse(c, http.StatusInternalServerError, "", "Could not authorize the request")
+            c.Abort()
+            return
+        }
+        SetCaller(c, caller)
+        c.Set(authorizedKey, true)
+        c.Next()
+    }
+}
+
+// RequirePermission answers requests of callers granted none of the permissions with 403 Forbidden.
+// Anonymous requests are answered with 401 Unauthorized, unless authentication is disabled.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        caller, ok := GetCaller(c)
+        if !ok && !authDisabled(c) {
+            sendUnauthenticated(c)
+            c.Abort()
+            return
+        }
+        if ok && !policy.HasAnyPermission(caller, permissions...) {
+            sendResponse(c, http.StatusForbidden, "", fmt.Sprintf("The %s permission is required", strings.Join(permissions, " or ")))
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+}
+
+// RequireScope answers requests of backend services whose API key lacks the scope, or the admin scope, with 403 Forbidden.
+// Users are let through, what they may do is decided by whose wallet or account they act on.
+func RequireScope(scope string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if caller, ok := GetCaller(c); ok && caller.IsService() && !caller.HasRole(scope) && !caller.HasRole(model.ScopeAdmin) {
+            sendResponse(c, http.StatusForbidden, "", fmt.Sprintf("The API key lacks the %s scope", scope))
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+}
+
+// actingUserID returns the user a request acts on: the requested user, or the caller when the request names none.
+func actingUserID(c *gin.Context, requested int) int {
+    if caller, ok := GetCaller(c); ok && requested == 0 {
+        return caller.UserID
+    }
+    return requested
+}
+
+// authorizeUser checks that the caller may act on the user's wallet or account: with the own permission on itself,
+// and with the any permission on every user, see policy.CanActOn.
+// Otherwise the request is answered with 403 Forbidden and false is returned.
+// Anonymous requests are answered with 401 Unauthorized, unless authentication is disabled.
+func authorizeUser(c *gin.Context, userID int, own, any string) bool {
+    caller, ok := GetCaller(c)
+    if !ok {
+        if authDisabled(c) {
+            return true
+        }
+        sendUnauthenticated(c)
+        return false
+    }
+    if policy.CanActOn(caller, userID, own, any) {
+        return true
+    }
+    sendResponse(c, http.StatusForbidden, "", fmt.Sprintf("Caller may not act on user %d", userID))
+    return false
+}
+
+// mayActOnOwner reports whether the caller may act on a resource owned by the user, like on the user's wallet.
+// Handlers answer requests for resources of others as not found, so their existence is not revealed.
+// Anonymous requests may not act on any resource, unless authentication is disabled.
+func mayActOnOwner(c *gin.Context, ownerID int, own, any string) bool {
+    caller, ok := GetCaller(c)
+    if !ok {
+        return authDisabled(c)
+    }
+    return policy.CanActOn(caller, ownerID, own, any)
+}
+
+// authDisabled reports whether the request is anonymous because authentication is disabled.
+func authDisabled(c *gin.Context) bool {
+    return c.GetBool(authDisabledKey)
+}
+
+// sendUnauthenticated answers a request that reached a protected route without an authenticated caller.
+func sendUnauthenticated(c *gin.Context) {
+    sendResponse(c, http.StatusUnauthorized, "", "Authentication is required")
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/auth"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// serveAuthenticated runs a request with the headers through Authenticate, with authentication enabled, and returns the
+// response and the caller it identified, nil for an anonymous request or one that was refused
+func serveAuthenticated(t *testing.T, verifier *auth.Verifier, trustGateway bool, headers map[string]string) (*httptest.ResponseRecorder, *model.Caller) {
+    return serve(t, gin.HandlersChain{Authenticate(verifier, nil, trustGateway, false)}, headers)
+}
+
+// serve runs a request with the headers through the handlers, and returns the response and the caller the handlers
+// identified, nil for an anonymous request or one that was refused
+func serve(t *testing.T, handlers gin.HandlersChain, headers map[string]string) (*httptest.ResponseRecorder, *model.Caller) {
+    gin.SetMode(gin.TestMode)
+
+    var identified *model.Caller
+    router := gin.New()
+    handlers = append(handlers, func(c *gin.Context) {
+        if caller, ok := GetCaller(c); ok {
+            identified = &caller
+        }
+        c.Status(http.StatusOK)
+    })
+    router.GET("/v1/transactions/:transaction_id", handlers...)
+
+    req := httptest.NewRequest(http.MethodGet, "/v1/transactions/6", nil)
+    for name, value := range headers {
+        req.Header.Set(name, value)
+    }
+    recorder := httptest.NewRecorder()
+    router.ServeHTTP(recorder, req)
+    return recorder, identified
+}
+
+// Test that identity headers sent by a client are not taken as the caller, whether tokens are verified or not
+func TestAuthenticate_SpoofedIdentityHeaders(t *testing.T) {
+    spoofed := map[string]string{CallerUserIDHeader: "1", CallerRolesHeader: "admin"}
+
+    recorder, caller := serveAuthenticated(t, auth.NewHS256Verifier([]byte("secret"), auth.DefaultOptions()), false, spoofed)
+    require.Equal(t, http.StatusUnauthorized, recorder.Code)
+    require.Nil(t, caller)
+
+    // Even with a trusted gateway, tokens take precedence over the headers once they are verified
+    recorder, caller = serveAuthenticated(t, auth.NewHS256Verifier([]byte("secret"), auth.DefaultOptions()), true, spoofed)
+    require.Equal(t, http.StatusUnauthorized, recorder.Code)
+    require.Nil(t, caller)
+
+    // Without a trusted gateway the headers are ignored, and the request is refused while authentication is enabled
+    recorder, caller = serveAuthenticated(t, nil, false, spoofed)
+    require.Equal(t, http.StatusUnauthorized, recorder.Code)
+    require.Nil(t, caller)
+
+    // or stays anonymous once it is disabled
+    recorder, caller = serve(t, gin.HandlersChain{Authenticate(nil, nil, false, true)}, spoofed)
+    require.Equal(t, http.StatusOK, recorder.Code)
+    require.Nil(t, caller)
+}
+
+// Test that routes refuse requests without a caller with 401 Unauthorized, unless authentication is disabled
+func TestRequirePermission_Anonymous(t *testing.T) {
+    recorder, _ := serve(t, gin.HandlersChain{RequirePermission(model.PermissionWalletReadOwn)}, nil)
+    require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+    recorder, _ = serve(t, gin.HandlersChain{Authenticate(nil, nil, false, true), RequirePermission(model.PermissionWalletReadOwn)}, nil)
+    require.Equal(t, http.StatusOK, recorder.Code)
+
+    // The handlers checking whose wallet is acted on refuse anonymous callers too
+    acting := func(c *gin.Context) {
+        if !authorizeUser(c, 1, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+            c.Abort()
+            return
+        }
+        require.True(t, mayActOnOwner(c, 1, model.PermissionWalletReadOwn, model.PermissionWalletReadAny))
+    }
+    recorder, _ = serve(t, gin.HandlersChain{acting}, nil)
+    require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+    recorder, _ = serve(t, gin.HandlersChain{Authenticate(nil, nil, false, true), acting}, nil)
+    require.Equal(t, http.StatusOK, recorder.Code)
+}
+
+// Test that the caller is read from the identity headers of a trusted gateway, which must name a user
+func TestAuthenticate_TrustedGateway(t *testing.T) {
+    recorder, caller := serveAuthenticated(t, nil, true, map[string]string{CallerUserIDHeader: "1", CallerRolesHeader: "admin, support"})
+    require.Equal(t, http.StatusOK, recorder.Code)
+    require.NotNil(t, caller)
+    require.Equal(t, 1, caller.UserID)
+    require.Equal(t, []string{"admin", "support"}, caller.Roles)
+
+    recorder, caller = serveAuthenticated(t, nil, true, nil)
+    require.Equal(t, http.StatusUnauthorized, recorder.Code)
+    require.Nil(t, caller)
+
+    recorder, caller = serveAuthenticated(t, nil, true, map[string]string{CallerUserIDHeader: "-1"})
+    require.Equal(t, http.StatusUnauthorized, recorder.Code)
+    require.Nil(t, caller)
+}
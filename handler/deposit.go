@@ -7,6 +7,7 @@ package handler
 import (
     "net/http"
     "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/service"
     "github.com/shopspring/decimal"
 )
@@ -24,8 +25,11 @@ func NewDepositHandler(depositService *service.DepositService) *DepositHandler {
 // HandleDeposit handles the deposit HTTP request
 func (h *DepositHandler) HandleDeposit(c *gin.Context) {
     var req struct {
-        UserID int             `json:"user_id"`
-        Amount decimal.Decimal `json:"amount"`
+        UserID         int                    `json:"user_id"`
+        Currency       string                 `json:"currency"`        // ISO 4217 code, defaults to USD when omitted
+        Amount         decimal.Decimal        `json:"amount"`
+        PaymentMethod  string                 `json:"payment_method"`  // Such as credit_card or bank_transfer, defaults to credit_card when omitted
+        PaymentDetails service.PaymentDetails `json:"payment_details"` // The optional card, bank or PayPal details of the payment
     }
 
     // Bind the request parameters
@@ -34,14 +38,25 @@ func (h *DepositHandler) HandleDeposit(c *gin.Context) {
         return
     }
 
+    // Act on the caller's own wallet unless another user is named, which needs the wallet:move:any permission
+    req.UserID = actingUserID(c, req.UserID)
+    if !authorizeUser(c, req.UserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        return
+    }
+
+    idempotencyKey, ok := getIdempotencyKey(c)
+    if !ok {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid Idempotency-Key header")
+        return
+    }
+
     // Call the service layer to handle the deposit logic
-    err := h.depositService.Deposit(req.UserID, req.Amount)
+    txn, replayed, err := h.depositService.Deposit(req.UserID, req.Currency, req.Amount, service.Payment{Method: req.PaymentMethod, Details: req.PaymentDetails}, idempotencyKey)
     if err != nil {
-        // Return the specific error message
-        sendResponse(c, http.StatusBadRequest, "", err.Error())
+        sendMovementError(c, err)
         return
     }
 
-    // Return a response on success
-    sendResponse(c, http.StatusOK, "", "Deposit successful")
+    markReplayed(c, replayed)
+    sendResponse(c, http.StatusOK, newMovementResponse(txn), "Deposit successful")
 }
@@ -0,0 +1,55 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/shopspring/decimal"
+)
+
+// FXHandler handles HTTP requests for quoting cross-currency transfers.
+type FXHandler struct {
+    fxService *service.FXService
+}
+
+// NewFXHandler creates a new instance of FXHandler with the provided FXService.
+func NewFXHandler(fxService *service.FXService) *FXHandler {
+    return &FXHandler{fxService: fxService}
+}
+
+// HandleCreateQuote handles the HTTP request to quote the conversion of an amount into another currency.
+// The returned quote ID is passed as quote_id to the transfer endpoint to execute the transfer at the quoted rate.
+func (h *FXHandler) HandleCreateQuote(c *gin.Context) {
+    var req struct {
+        UserID         int             `json:"user_id"`
+        SourceCurrency string          `json:"source_currency"` // ISO 4217 code debited from the sender, defaults to USD when omitted
+        TargetCurrency string          `json:"target_currency"` // ISO 4217 code credited to the recipient
+        Amount         decimal.Decimal `json:"amount"`          // The amount in the source currency
+    }
+
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    // Act on the caller's own wallet unless another user is named, which needs the wallet:move:any permission
+    req.UserID = actingUserID(c, req.UserID)
+    if !authorizeUser(c, req.UserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        return
+    }
+
+    quote, err := h.fxService.CreateQuote(c, req.UserID, req.SourceCurrency, req.TargetCurrency, req.Amount)
+    if err != nil {
+        if errors.Is(err, repository.ErrUserNotFound) {
+            sendResponse(c, http.StatusNotFound, "", err.Error())
+            return
+        }
+        sendResponse(c, http.StatusBadRequest, "", err.Error())
+        return
+    }
+
+    sendResponse(c, http.StatusCreated, quote, "")
+}
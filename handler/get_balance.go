@@ -5,6 +5,7 @@ package handler
 import (
     "net/http"
     "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/service"
     //"github.com/shopspring/decimal"
     "strconv"
@@ -45,11 +46,20 @@ type BalanceHandler struct {
     balanceService *service.BalanceService
 }
 
-// BalanceResponse represents the structure of the response for a user's balance.
-// It includes the user ID and the current balance of the user as a string.
+// BalanceResponse represents the structure of the response for a user's balances.
+// It includes the user ID and the current balance of each of the user's wallets.
 type BalanceResponse struct {
-    UserID  int     `json:"user_id"`
-    Balance string `json:"balance"`
+    UserID   int               `json:"user_id"`
+    Balances []CurrencyBalance `json:"balances"`
+}
+
+// CurrencyBalance is the balance of a single wallet, as strings so that no precision is lost.
+// The available part of the balance is what can be spent, the held part is reserved by holds and pending withdrawals.
+type CurrencyBalance struct {
+    Currency  string `json:"currency"`
+    Balance   string `json:"balance"`
+    Available string `json:"available"`
+    Held      string `json:"held"`
 }
 
 // NewBalanceHandler creates a new instance of BalanceHandler with the given BalanceService.
@@ -58,8 +68,8 @@ func NewBalanceHandler(balanceService *service.BalanceService) *BalanceHandler {
     return &BalanceHandler{balanceService: balanceService}
 }
 
-// HandleGetBalance handles the HTTP request to get the balance of a user.
-// It extracts the user ID from the context, retrieves the balance from the service,
+// HandleGetBalance handles the HTTP request to get the balances of a user in all currencies.
+// It extracts the user ID from the context, retrieves the balances from the service,
 // and sends the response back to the client. If there is an error, it sends an appropriate error message.
 func (h *BalanceHandler) HandleGetBalance(c *gin.Context) {
     userID, err := getUserIDFromContext(c)
@@ -67,16 +77,27 @@ func (h *BalanceHandler) HandleGetBalance(c *gin.Context) {
         sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
         return
     }
+    if !authorizeUser(c, userID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        return
+    }
 
-    balance, err := h.balanceService.GetBalance(c, userID)
+    wallets, err := h.balanceService.GetBalances(c, userID)
     if err != nil {
         sendResponse(c, http.StatusInternalServerError, nil, err.Error())
         return
     }
 
     data := BalanceResponse{
-        UserID:  userID,
-        Balance: balance.String(),
+        UserID:   userID,
+        Balances: make([]CurrencyBalance, 0, len(wallets)),
+    }
+    for _, wallet := range wallets {
+        data.Balances = append(data.Balances, CurrencyBalance{
+            Currency:  wallet.Currency,
+            Balance:   wallet.Balance.String(),
+            Available: wallet.Available().String(),
+            Held:      wallet.Held.String(),
+        })
     }
 
     sendResponse(c, http.StatusOK, data, "")
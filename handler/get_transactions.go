@@ -1,11 +1,16 @@
 package handler
 
 import (
+    "errors"
+    "fmt"
     "net/http"
     "strconv"
+    "time"
     "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/repository"
     "github.com/yaoweihua/wallet-service/service"
     "github.com/yaoweihua/wallet-service/model"
+    "github.com/shopspring/decimal"
 )
 
 // TransactionHandler handles HTTP requests related to transactions.
@@ -22,17 +27,22 @@ func NewTransactionHandler(transactionService *service.TransactionService) *Tran
     }
 }
 
-// TransactionsResponse represents the structure of the response that contains a user's transaction records.
-// It includes the user ID and a list of transactions associated with that user.
+// TransactionsResponse represents the structure of the response that contains a page of a user's transaction records.
+// It includes the user ID, a list of transactions associated with that user, and the cursor of the next page,
+// which is omitted on the last page.
 type TransactionsResponse struct {
     UserID       int     `json:"user_id"`
     Transactions []model.Transaction `json:"transactions"`
+    NextCursor   string  `json:"next_cursor,omitempty"`
 }
 
-// HandleGetTransactions handles the HTTP request to retrieve a user's transaction records.
-// It extracts the user ID from the URL parameters, retrieves the transactions from the service layer,
+// HandleGetTransactions handles the HTTP request to retrieve a page of a user's transaction records.
+// It extracts the user ID from the URL parameters and the filters from the query string, retrieves the transactions from the service layer,
 // and sends the response back to the client. If there is an error or no transactions are found,
 // it returns an appropriate error message or an empty transaction list.
+//
+// The query string may hold type, status, counterparty_id, min_amount, max_amount, from and to (RFC 3339 times),
+// order (asc or desc), limit and cursor, the next_cursor of the previous page.
 func (h *TransactionHandler) HandleGetTransactions(c *gin.Context) {
     // Retrieve the userID from the URL parameters
     userIDStr := c.Param("user_id")
@@ -41,22 +51,106 @@ func (h *TransactionHandler) HandleGetTransactions(c *gin.Context) {
         sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
         return
     }
+    if !authorizeUser(c, userID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        return
+    }
+
+    filter, err := parseTransactionFilter(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, err.Error())
+        return
+    }
 
     // Call the service layer's GetTransactions method to retrieve the transaction records
-    transactions, err := h.transactionService.GetTransactions(c, userID)
+    page, err := h.transactionService.GetTransactions(c, userID, filter)
     if err != nil {
+        if errors.Is(err, service.ErrInvalidTransactionFilter) {
+            sendResponse(c, http.StatusBadRequest, nil, err.Error())
+            return
+        }
         sendResponse(c, http.StatusInternalServerError, nil, err.Error())
         return
     }
 
+    transactions := page.Transactions
     if len(transactions) == 0 {
         transactions = []model.Transaction{}
     }
 
     data := TransactionsResponse{
-        UserID:  userID,
+        UserID:       userID,
         Transactions: transactions,
+        NextCursor:   page.NextCursor,
     }
 
     sendResponse(c, http.StatusOK, data, "")
 }
+
+// HandleGetTransaction handles the HTTP request to retrieve a single transaction by its ID.
+// Only its participants and administrators can see a transaction, it is not found for anyone else.
+func (h *TransactionHandler) HandleGetTransaction(c *gin.Context) {
+    transactionID, err := strconv.Atoi(c.Param("transaction_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid transaction ID")
+        return
+    }
+
+    // Anonymous requests only get this far when authentication is disabled, and see every transaction like the other routes
+    var caller *model.Caller
+    if authenticated, ok := GetCaller(c); ok {
+        caller = &authenticated
+    }
+
+    txn, err := h.transactionService.GetTransaction(c, transactionID, caller)
+    if err != nil {
+        if errors.Is(err, repository.ErrTransactionNotFound) {
+            sendResponse(c, http.StatusNotFound, nil, err.Error())
+            return
+        }
+        sendResponse(c, http.StatusInternalServerError, nil, err.Error())
+        return
+    }
+
+    sendResponse(c, http.StatusOK, txn, "")
+}
+
+// parseTransactionFilter reads the filters of the transaction history from the query string.
+func parseTransactionFilter(c *gin.Context) (service.TransactionFilter, error) {
+    filter := service.TransactionFilter{
+        Type:   c.Query("type"),
+        Status: c.Query("status"),
+        Order:  c.Query("order"),
+        Cursor: c.Query("cursor"),
+    }
+
+    var err error
+    if value := c.Query("counterparty_id"); value != "" {
+        if filter.CounterpartyID, err = strconv.Atoi(value); err != nil {
+            return filter, fmt.Errorf("Invalid counterparty_id")
+        }
+    }
+    if value := c.Query("limit"); value != "" {
+        if filter.Limit, err = strconv.Atoi(value); err != nil {
+            return filter, fmt.Errorf("Invalid limit")
+        }
+    }
+    for name, amount := range map[string]**decimal.Decimal{"min_amount": &filter.MinAmount, "max_amount": &filter.MaxAmount} {
+        if value := c.Query(name); value != "" {
+            parsed, err := decimal.NewFromString(value)
+            if err != nil {
+                return filter, fmt.Errorf("Invalid %s", name)
+            }
+            *amount = &parsed
+        }
+    }
+    for name, at := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+        if value := c.Query(name); value != "" {
+            parsed, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                return filter, fmt.Errorf("Invalid %s, expected an RFC 3339 time", name)
+            }
+            *at = &parsed
+        }
+    }
+    return filter, nil
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/shopspring/decimal"
+)
+
+// HoldHandler handles HTTP requests placing, capturing and voiding holds on wallet balances.
+type HoldHandler struct {
+    holdService *service.HoldService
+}
+
+// NewHoldHandler creates a new instance of HoldHandler with the provided HoldService.
+func NewHoldHandler(holdService *service.HoldService) *HoldHandler {
+    return &HoldHandler{holdService: holdService}
+}
+
+// CaptureResponse is the captured hold together with the capture transaction debiting the wallet.
+type CaptureResponse struct {
+    Hold        *model.Hold      `json:"hold"`
+    Transaction MovementResponse `json:"transaction"`
+}
+
+// HandlePlaceHold handles the HTTP request to reserve part of a user's available balance.
+func (h *HoldHandler) HandlePlaceHold(c *gin.Context) {
+    var req struct {
+        UserID      int             `json:"user_id"`
+        Currency    string          `json:"currency"`    // ISO 4217 code, defaults to USD when omitted
+        Amount      decimal.Decimal `json:"amount"`
+        Description string          `json:"description"` // What the hold is for, such as the merchant or the order
+    }
+
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    // Act on the caller's own wallet unless another user is named, which needs the wallet:move:any permission
+    req.UserID = actingUserID(c, req.UserID)
+    if !authorizeUser(c, req.UserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        return
+    }
+
+    hold, err := h.holdService.PlaceHold(c, req.UserID, req.Currency, req.Amount, req.Description)
+    if err != nil {
+        sendHoldError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusCreated, hold, "")
+}
+
+// HandleCapture handles the HTTP request to capture an active hold, in full or, when an amount is given, in part.
+func (h *HoldHandler) HandleCapture(c *gin.Context) {
+    holdID, err := strconv.Atoi(c.Param("hold_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid hold ID")
+        return
+    }
+
+    var req struct {
+        Amount decimal.Decimal `json:"amount"` // The amount to capture, the whole hold when omitted
+    }
+    if c.Request.ContentLength != 0 {
+        if err := c.ShouldBindJSON(&req); err != nil {
+            sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+            return
+        }
+    }
+
+    hold, txn, err := h.holdService.Capture(c, holdID, req.Amount)
+    if err != nil {
+        sendHoldError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, CaptureResponse{Hold: hold, Transaction: newMovementResponse(txn)}, "")
+}
+
+// HandleVoid handles the HTTP request to cancel an active hold and release its amount.
+func (h *HoldHandler) HandleVoid(c *gin.Context) {
+    holdID, err := strconv.Atoi(c.Param("hold_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid hold ID")
+        return
+    }
+
+    hold, err := h.holdService.Void(c, holdID)
+    if err != nil {
+        sendHoldError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, hold, "")
+}
+
+// sendHoldError answers a failed hold request with the status code matching the error.
+func sendHoldError(c *gin.Context, err error) {
+    status := http.StatusBadRequest
+    switch {
+    case errors.Is(err, repository.ErrHoldNotFound), errors.Is(err, repository.ErrUserNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, service.ErrHoldClosed), errors.Is(err, service.ErrHoldExpired), errors.Is(err, service.ErrBalanceBusy):
+        status = http.StatusConflict
+    case errors.Is(err, service.ErrAccountSuspended), errors.Is(err, service.ErrAccountInactive), errors.Is(err, service.ErrLimitExceeded):
+        status = http.StatusForbidden
+    }
+    sendResponse(c, status, "", err.Error())
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+)
+
+// IdempotencyKeyHeader is the request header clients send to make deposits, withdrawals and transfers safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on responses that were served from an earlier request with the same idempotency key.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength matches the size of the idempotency_key column.
+const maxIdempotencyKeyLength = 255
+
+// getIdempotencyKey reads the optional idempotency key from the request headers.
+// It returns false if the key is present but longer than the database column allows, or if it is one of the keys
+// the service reserves for its own movements, see service.InternalIdempotencyKeyPrefix.
+func getIdempotencyKey(c *gin.Context) (string, bool) {
+    key := strings.TrimSpace(c.GetHeader(IdempotencyKeyHeader))
+    if len(key) > maxIdempotencyKeyLength || strings.HasPrefix(key, service.InternalIdempotencyKeyPrefix) {
+        return "", false
+    }
+    return key, true
+}
+
+// sendMovementError maps an error returned by a money movement service to an HTTP response.
+// Reusing an idempotency key for a different request and a balance locked by another request
+// are conflicts, a movement the account status does not allow is forbidden, everything else is a bad request.
+// An unknown FX quote is not found, and a used or expired one is a conflict as well.
+func sendMovementError(c *gin.Context, err error) {
+    if errors.Is(err, repository.ErrQuoteNotFound) {
+        sendResponse(c, http.StatusNotFound, "", err.Error())
+        return
+    }
+    if errors.Is(err, service.ErrIdempotencyKeyConflict) || errors.Is(err, service.ErrBalanceBusy) ||
+        errors.Is(err, repository.ErrQuoteUsed) || errors.Is(err, service.ErrQuoteExpired) {
+        sendResponse(c, http.StatusConflict, "", err.Error())
+        return
+    }
+    if errors.Is(err, service.ErrAccountSuspended) || errors.Is(err, service.ErrAccountInactive) || errors.Is(err, service.ErrLimitExceeded) {
+        sendResponse(c, http.StatusForbidden, "", err.Error())
+        return
+    }
+    sendResponse(c, http.StatusBadRequest, "", err.Error())
+}
+
+// markReplayed flags the response as a replay of an earlier request.
+func markReplayed(c *gin.Context, replayed bool) {
+    if replayed {
+        c.Header(IdempotentReplayedHeader, "true")
+    }
+}
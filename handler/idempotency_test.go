@@ -0,0 +1,39 @@
+package handler
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/stretchr/testify/require"
+)
+
+// Test that idempotency keys are read from the header, and that overlong and reserved keys are refused
+func TestGetIdempotencyKey(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+
+    read := func(key string) (string, bool) {
+        c, _ := gin.CreateTestContext(httptest.NewRecorder())
+        c.Request = httptest.NewRequest(http.MethodPost, "/v1/wallet/transfer", nil)
+        if key != "" {
+            c.Request.Header.Set(IdempotencyKeyHeader, key)
+        }
+        return getIdempotencyKey(c)
+    }
+
+    key, ok := read(" transfer-1 ")
+    require.True(t, ok)
+    require.Equal(t, "transfer-1", key)
+
+    key, ok = read("")
+    require.True(t, ok)
+    require.Empty(t, key)
+
+    _, ok = read(strings.Repeat("k", maxIdempotencyKeyLength+1))
+    require.False(t, ok)
+
+    // Scheduled transfers are made with internal keys, a client must not be able to claim them first
+    _, ok = read("internal:schedule:3:1731436541")
+    require.False(t, ok)
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// LimitHandler handles the requests for the transaction limits of a user.
+type LimitHandler struct {
+    limitService *service.LimitService
+}
+
+// NewLimitHandler creates a new instance of LimitHandler with the provided LimitService.
+func NewLimitHandler(limitService *service.LimitService) *LimitHandler {
+    return &LimitHandler{limitService: limitService}
+}
+
+// LimitsResponse represents the withdrawal and transfer limits of a user across all currencies, and what is left of them.
+type LimitsResponse struct {
+    UserID int                       `json:"user_id"`
+    Limits []service.RemainingLimits `json:"limits"`
+}
+
+// HandleGetLimits handles the HTTP request to get the limits of a user's withdrawals and transfers, in USD, with what
+// the user can still move in all currencies together before they reset.
+func (h *LimitHandler) HandleGetLimits(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        return
+    }
+
+    limits, err := h.limitService.Remaining(c, userID)
+    if err != nil {
+        switch {
+        case errors.Is(err, repository.ErrUserNotFound):
+            sendResponse(c, http.StatusNotFound, "", err.Error())
+        default:
+            utils.GetLogger().Errorf("Error getting the limits of user %d: %v", userID, err)
+            sendResponse(c, http.StatusInternalServerError, "", "Failed to get limits")
+        }
+        return
+    }
+
+    sendResponse(c, http.StatusOK, LimitsResponse{UserID: userID, Limits: limits}, "")
+}
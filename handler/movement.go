@@ -0,0 +1,27 @@
+package handler
+
+import (
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/shopspring/decimal"
+)
+
+// MovementResponse describes the outcome of a deposit, withdrawal or transfer, including the fee that was charged
+// and the status, which is pending for a withdrawal that settles asynchronously.
+type MovementResponse struct {
+    TransactionID int             `json:"transaction_id"`
+    Amount        decimal.Decimal `json:"amount"`
+    Currency      string          `json:"currency"`
+    Fee           decimal.Decimal `json:"fee"`
+    Status        string          `json:"status"`
+}
+
+// newMovementResponse builds the response of a money movement from its recorded transaction.
+func newMovementResponse(txn *model.Transaction) MovementResponse {
+    return MovementResponse{
+        TransactionID: txn.ID,
+        Amount:        txn.Amount,
+        Currency:      txn.Currency,
+        Fee:           txn.TransactionFee,
+        Status:        txn.TransactionStatus,
+    }
+}
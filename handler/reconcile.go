@@ -0,0 +1,70 @@
+package handler
+
+import (
+    "net/http"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/service"
+)
+
+// ReconcileHandler handles HTTP requests that check a user's stored balance against the ledger.
+type ReconcileHandler struct {
+    ledgerService *service.LedgerService
+}
+
+// ReconcileResponse represents the result of reconciling a user's wallets.
+// Balanced is only true if every wallet agrees with the ledger.
+type ReconcileResponse struct {
+    UserID   int                    `json:"user_id"`
+    Wallets  []WalletReconciliation `json:"wallets"`
+    Balanced bool                   `json:"balanced"`
+}
+
+// WalletReconciliation represents the result of reconciling a single wallet.
+// Balances are returned as strings like in BalanceResponse.
+type WalletReconciliation struct {
+    Currency      string `json:"currency"`
+    StoredBalance string `json:"stored_balance"`
+    LedgerBalance string `json:"ledger_balance"`
+    Balanced      bool   `json:"balanced"`
+}
+
+// NewReconcileHandler creates a new instance of ReconcileHandler with the given LedgerService.
+func NewReconcileHandler(ledgerService *service.LedgerService) *ReconcileHandler {
+    return &ReconcileHandler{ledgerService: ledgerService}
+}
+
+// HandleReconcile handles the HTTP request to reconcile the stored balances of a user's wallets with the sum of the ledger postings.
+func (h *ReconcileHandler) HandleReconcile(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        return
+    }
+
+    results, err := h.ledgerService.Reconcile(c, userID)
+    if err != nil {
+        sendResponse(c, http.StatusInternalServerError, nil, err.Error())
+        return
+    }
+
+    data := ReconcileResponse{
+        UserID:   userID,
+        Wallets:  make([]WalletReconciliation, 0, len(results)),
+        Balanced: true,
+    }
+    for _, result := range results {
+        data.Wallets = append(data.Wallets, WalletReconciliation{
+            Currency:      result.Currency,
+            StoredBalance: result.StoredBalance.String(),
+            LedgerBalance: result.LedgerBalance.String(),
+            Balanced:      result.Balanced,
+        })
+        data.Balanced = data.Balanced && result.Balanced
+    }
+
+    sendResponse(c, http.StatusOK, data, "")
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/shopspring/decimal"
+)
+
+// RefundHandler handles the requests refunding completed transactions.
+type RefundHandler struct {
+    refundService *service.RefundService
+}
+
+// NewRefundHandler creates a new instance of RefundHandler with the provided RefundService.
+func NewRefundHandler(refundService *service.RefundService) *RefundHandler {
+    return &RefundHandler{refundService: refundService}
+}
+
+// HandleRefund handles the request to refund a deposit, transfer or capture, in full or in part.
+// The refund transaction is returned, linked to the original through refund_of. Callers whose roles have a refund limit,
+// such as support agents, cannot refund more than it at once.
+func (h *RefundHandler) HandleRefund(c *gin.Context) {
+    transactionID, err := strconv.Atoi(c.Param("transaction_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid transaction ID")
+        return
+    }
+
+    var req struct {
+        Amount decimal.Decimal `json:"amount"` // The amount to refund, all that is left to refund when omitted
+    }
+    if c.Request.ContentLength != 0 {
+        if err := c.ShouldBindJSON(&req); err != nil {
+            sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+            return
+        }
+    }
+
+    idempotencyKey, ok := getIdempotencyKey(c)
+    if !ok {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid Idempotency-Key header")
+        return
+    }
+
+    // Callers may only refund up to the limit of their roles, anonymous requests only get here without authentication
+    var limit *decimal.Decimal
+    if caller, ok := GetCaller(c); ok {
+        limit = caller.RefundLimit
+    }
+
+    txn, replayed, err := h.refundService.Refund(c, transactionID, req.Amount, idempotencyKey, limit)
+    if err != nil {
+        sendRefundError(c, err)
+        return
+    }
+
+    markReplayed(c, replayed)
+    sendResponse(c, http.StatusOK, txn, "Refund successful")
+}
+
+// sendRefundError answers a failed refund request with the status code matching the error.
+func sendRefundError(c *gin.Context, err error) {
+    status := http.StatusBadRequest
+    switch {
+    case errors.Is(err, repository.ErrTransactionNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, service.ErrRefundNotAllowed), errors.Is(err, service.ErrIdempotencyKeyConflict), errors.Is(err, service.ErrBalanceBusy):
+        status = http.StatusConflict
+    case errors.Is(err, service.ErrRefundLimitExceeded):
+        status = http.StatusForbidden
+    }
+    sendResponse(c, status, "", err.Error())
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/policy"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// RoleHandler handles the administrator requests listing the roles and granting them to users.
+type RoleHandler struct {
+    enforcer *policy.Enforcer
+}
+
+// NewRoleHandler creates a new instance of RoleHandler with the provided policy enforcer.
+func NewRoleHandler(enforcer *policy.Enforcer) *RoleHandler {
+    return &RoleHandler{enforcer: enforcer}
+}
+
+// UserRolesResponse represents the roles granted to a user, besides the customer role every user has.
+type UserRolesResponse struct {
+    UserID int      `json:"user_id"`
+    Roles  []string `json:"roles"`
+}
+
+// HandleGetRoles handles the administrator request to list every role with its permissions and refund limit.
+func (h *RoleHandler) HandleGetRoles(c *gin.Context) {
+    roles, err := h.enforcer.Roles(c)
+    if err != nil {
+        utils.GetLogger().Errorf("Error getting roles: %v", err)
+        sendResponse(c, http.StatusInternalServerError, "", "Failed to get roles")
+        return
+    }
+
+    sendResponse(c, http.StatusOK, roles, "")
+}
+
+// HandleGetUserRoles handles the administrator request to list the roles granted to a user.
+func (h *RoleHandler) HandleGetUserRoles(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+
+    roles, err := h.enforcer.UserRoles(c, userID)
+    if err != nil {
+        utils.GetLogger().Errorf("Error getting the roles of user %d: %v", userID, err)
+        sendResponse(c, http.StatusInternalServerError, "", "Failed to get roles")
+        return
+    }
+
+    sendResponse(c, http.StatusOK, UserRolesResponse{UserID: userID, Roles: roles}, "")
+}
+
+// HandleSetUserRoles handles the administrator request to replace the roles granted to a user.
+// The change takes effect on the user's next request.
+func (h *RoleHandler) HandleSetUserRoles(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+
+    var req struct {
+        Roles []string `json:"roles"` // Such as support or admin, an empty list leaves the user a customer only
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    roles, err := h.enforcer.SetUserRoles(c, userID, req.Roles)
+    if err != nil {
+        switch {
+        case errors.Is(err, repository.ErrUserNotFound):
+            sendResponse(c, http.StatusNotFound, "", err.Error())
+        case errors.Is(err, repository.ErrRoleNotFound):
+            sendResponse(c, http.StatusBadRequest, "", err.Error())
+        default:
+            utils.GetLogger().Errorf("Error setting the roles of user %d: %v", userID, err)
+            sendResponse(c, http.StatusInternalServerError, "", "Failed to set roles")
+        }
+        return
+    }
+
+    sendResponse(c, http.StatusOK, UserRolesResponse{UserID: userID, Roles: roles}, "")
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/shopspring/decimal"
+)
+
+// ScheduleHandler handles HTTP requests creating, listing and cancelling scheduled and recurring transfers.
+type ScheduleHandler struct {
+    scheduleService *service.ScheduleService
+}
+
+// NewScheduleHandler creates a new instance of ScheduleHandler with the provided ScheduleService.
+func NewScheduleHandler(scheduleService *service.ScheduleService) *ScheduleHandler {
+    return &ScheduleHandler{scheduleService: scheduleService}
+}
+
+// ScheduleResponse is a transfer schedule together with its latest runs, newest first.
+type ScheduleResponse struct {
+    Schedule *model.TransferSchedule `json:"schedule"`
+    Runs     []model.ScheduleRun     `json:"runs"`
+}
+
+// HandleCreateSchedule handles the HTTP request to schedule a transfer, once or recurring.
+func (h *ScheduleHandler) HandleCreateSchedule(c *gin.Context) {
+    var req struct {
+        FromUserID  int             `json:"from_user_id"`
+        ToUserID    int             `json:"to_user_id"`
+        Currency    string          `json:"currency"`    // ISO 4217 code, defaults to USD when omitted
+        Amount      decimal.Decimal `json:"amount"`
+        Description string          `json:"description"` // What the transfers are for, such as the rent
+        Interval    string          `json:"interval"`    // Repeat every interval from start_at, such as 168h
+        Cron        string          `json:"cron"`        // Or repeat whenever the cron expression matches, such as 0 9 1 * *
+        TimeZone    string          `json:"time_zone"`   // The IANA time zone of the cron expression, UTC when omitted
+        StartAt     *time.Time      `json:"start_at"`    // The first transfer, now when omitted
+        EndAt       *time.Time      `json:"end_at"`      // No transfers after this time, repeat until cancelled when omitted
+    }
+
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    // Act on the caller's own wallet unless another user is named, which needs the wallet:move:any permission
+    req.FromUserID = actingUserID(c, req.FromUserID)
+    if !authorizeUser(c, req.FromUserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        return
+    }
+
+    schedule := &model.TransferSchedule{
+        FromUserID:  req.FromUserID,
+        ToUserID:    req.ToUserID,
+        Amount:      req.Amount,
+        Currency:    req.Currency,
+        Description: req.Description,
+        Interval:    req.Interval,
+        Cron:        req.Cron,
+        TimeZone:    req.TimeZone,
+        EndAt:       req.EndAt,
+    }
+    if req.StartAt != nil {
+        schedule.StartAt = *req.StartAt
+    }
+
+    if err := h.scheduleService.CreateSchedule(c, schedule); err != nil {
+        sendScheduleError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusCreated, schedule, "")
+}
+
+// HandleGetSchedules handles the HTTP request to list the transfer schedules paid by a user.
+func (h *ScheduleHandler) HandleGetSchedules(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        return
+    }
+
+    schedules, err := h.scheduleService.GetSchedules(c, userID)
+    if err != nil {
+        sendScheduleError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, schedules, "")
+}
+
+// HandleGetSchedule handles the HTTP request to get a transfer schedule with the record of its latest runs.
+func (h *ScheduleHandler) HandleGetSchedule(c *gin.Context) {
+    scheduleID, err := strconv.Atoi(c.Param("schedule_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid schedule ID")
+        return
+    }
+
+    schedule, runs, err := h.scheduleService.GetSchedule(c, scheduleID)
+    if err == nil && !mayActOnOwner(c, schedule.FromUserID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        err = repository.ErrScheduleNotFound
+    }
+    if err != nil {
+        sendScheduleError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, ScheduleResponse{Schedule: schedule, Runs: runs}, "")
+}
+
+// HandleCancelSchedule handles the HTTP request to cancel an active transfer schedule.
+func (h *ScheduleHandler) HandleCancelSchedule(c *gin.Context) {
+    scheduleID, err := strconv.Atoi(c.Param("schedule_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid schedule ID")
+        return
+    }
+
+    schedule, _, err := h.scheduleService.GetSchedule(c, scheduleID)
+    if err == nil && !mayActOnOwner(c, schedule.FromUserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        err = repository.ErrScheduleNotFound
+    }
+    if err == nil {
+        schedule, err = h.scheduleService.CancelSchedule(c, scheduleID)
+    }
+    if err != nil {
+        sendScheduleError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, schedule, "")
+}
+
+// sendScheduleError answers a failed transfer schedule request with the status code matching the error.
+func sendScheduleError(c *gin.Context, err error) {
+    status := http.StatusBadRequest
+    switch {
+    case errors.Is(err, repository.ErrScheduleNotFound), errors.Is(err, repository.ErrUserNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, service.ErrScheduleClosed):
+        status = http.StatusConflict
+    }
+    sendResponse(c, status, "", err.Error())
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+)
+
+// SettlementHandler handles the administrator requests settling asynchronous withdrawals.
+type SettlementHandler struct {
+    settlementService *service.SettlementService
+}
+
+// NewSettlementHandler creates a new instance of SettlementHandler with the provided SettlementService.
+func NewSettlementHandler(settlementService *service.SettlementService) *SettlementHandler {
+    return &SettlementHandler{settlementService: settlementService}
+}
+
+// HandleChangeStatus handles the administrator request to move a withdrawal to another settlement status,
+// such as completing or failing a pending payout, cancelling it, or reversing a completed one.
+func (h *SettlementHandler) HandleChangeStatus(c *gin.Context) {
+    transactionID, err := strconv.Atoi(c.Param("transaction_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid transaction ID")
+        return
+    }
+
+    var req struct {
+        Status        string `json:"status"`         // processing, completed, failed, cancelled or reversed
+        FailureReason string `json:"failure_reason"` // A machine-readable reason, defaults to settlement_failed for failed payouts
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    txn, err := h.settlementService.Settle(c, transactionID, req.Status, req.FailureReason)
+    if err != nil {
+        sendSettlementError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, txn, "")
+}
+
+// sendSettlementError answers a failed settlement request with the status code matching the error.
+func sendSettlementError(c *gin.Context, err error) {
+    status := http.StatusInternalServerError
+    switch {
+    case errors.Is(err, repository.ErrTransactionNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, service.ErrInvalidTransition), errors.Is(err, repository.ErrStatusChanged), errors.Is(err, service.ErrBalanceBusy):
+        status = http.StatusConflict
+    }
+    sendResponse(c, status, "", err.Error())
+}
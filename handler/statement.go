@@ -0,0 +1,108 @@
+package handler
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/service"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// StatementHandler handles HTTP requests that export the account statement of a user's wallet.
+type StatementHandler struct {
+    statementService *service.StatementService
+}
+
+// NewStatementHandler creates a new instance of StatementHandler with the given StatementService.
+func NewStatementHandler(statementService *service.StatementService) *StatementHandler {
+    return &StatementHandler{statementService: statementService}
+}
+
+// HandleGetStatement handles the HTTP request to export the statement of a user's wallet over a period.
+// The query string may hold currency, format (csv, jsonl or txt), and from and to, either RFC 3339 times or
+// dates; a to date includes the whole day. The statement is streamed to the client as it is read, so errors
+// found before it starts are answered as usual, while errors after that can only cut the statement short.
+func (h *StatementHandler) HandleGetStatement(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionWalletReadOwn, model.PermissionWalletReadAny) {
+        return
+    }
+
+    req := service.StatementRequest{
+        Currency: c.Query("currency"),
+        Format:   c.Query("format"),
+    }
+    if req.From, err = parseStatementTime(c.Query("from"), false); err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid from, expected an RFC 3339 time or a date")
+        return
+    }
+    if req.To, err = parseStatementTime(c.Query("to"), true); err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid to, expected an RFC 3339 time or a date")
+        return
+    }
+    if req, err = req.Validate(time.Now()); err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, err.Error())
+        return
+    }
+
+    w := &statementResponseWriter{c: c, userID: userID, req: req}
+    if err := h.statementService.WriteStatement(c, userID, req, w); err != nil {
+        if !w.started {
+            if errors.Is(err, service.ErrInvalidStatement) {
+                sendResponse(c, http.StatusBadRequest, nil, err.Error())
+                return
+            }
+            sendResponse(c, http.StatusInternalServerError, nil, err.Error())
+            return
+        }
+        utils.GetLogger().Errorf("Statement of user %d cut short: %v", userID, err)
+    }
+}
+
+// parseStatementTime parses a from or to query parameter, nil when it is empty.
+// A date stands for its start, or for the start of the next day when it ends the period.
+func parseStatementTime(value string, end bool) (*time.Time, error) {
+    if value == "" {
+        return nil, nil
+    }
+    if at, err := time.Parse(time.RFC3339, value); err == nil {
+        return &at, nil
+    }
+    at, err := time.Parse("2006-01-02", value)
+    if err != nil {
+        return nil, err
+    }
+    if end {
+        at = at.AddDate(0, 0, 1)
+    }
+    return &at, nil
+}
+
+// statementResponseWriter writes a statement to the response, sending the statement headers with its first bytes,
+// so that a statement that fails before it starts can still be answered with an error response.
+type statementResponseWriter struct {
+    c       *gin.Context
+    userID  int
+    req     service.StatementRequest
+    started bool
+}
+
+func (w *statementResponseWriter) Write(p []byte) (int, error) {
+    if !w.started {
+        w.started = true
+        filename := fmt.Sprintf("statement-%d-%s-%s.%s", w.userID, w.req.Currency, w.req.From.UTC().Format("20060102"), w.req.Format)
+        w.c.Header("Content-Type", service.StatementContentType(w.req.Format))
+        w.c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+        w.c.Status(http.StatusOK)
+    }
+    n, err := w.c.Writer.Write(p)
+    w.c.Writer.Flush()
+    return n, err
+}
@@ -5,6 +5,7 @@ package handler
 import (
     "net/http"
     "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/service"
     "github.com/shopspring/decimal"
 )
@@ -28,7 +29,9 @@ func (h *TransferHandler) HandleTransfer(c *gin.Context) {
     var req struct {
         FromUserID int             `json:"from_user_id"`
         ToUserID   int             `json:"to_user_id"`
+        Currency   string          `json:"currency"` // ISO 4217 code, defaults to USD when omitted
         Amount     decimal.Decimal `json:"amount"`
+        QuoteID    int             `json:"quote_id"` // An FX quote to execute instead of currency and amount, for transfers between currencies
     }
 
     if err := c.ShouldBindJSON(&req); err != nil {
@@ -36,12 +39,32 @@ func (h *TransferHandler) HandleTransfer(c *gin.Context) {
         return
     }
 
+    // Act on the caller's own wallet unless another user is named, which needs the wallet:move:any permission
+    req.FromUserID = actingUserID(c, req.FromUserID)
+    if !authorizeUser(c, req.FromUserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        return
+    }
+
+    idempotencyKey, ok := getIdempotencyKey(c)
+    if !ok {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid Idempotency-Key header")
+        return
+    }
+
     // Call the service layer to execute the transfer logic
-    err := h.transferService.Transfer(req.FromUserID, req.ToUserID, req.Amount)
+    var txn *model.Transaction
+    var replayed bool
+    var err error
+    if req.QuoteID != 0 {
+        txn, replayed, err = h.transferService.TransferQuoted(req.FromUserID, req.ToUserID, req.QuoteID, idempotencyKey)
+    } else {
+        txn, replayed, err = h.transferService.Transfer(req.FromUserID, req.ToUserID, req.Currency, req.Amount, idempotencyKey)
+    }
     if err != nil {
-        sendResponse(c, http.StatusBadRequest, "", err.Error())
+        sendMovementError(c, err)
         return
     }
 
-    sendResponse(c, http.StatusOK, "", "Transfer successful")
+    markReplayed(c, replayed)
+    sendResponse(c, http.StatusOK, newMovementResponse(txn), "Transfer successful")
 }
@@ -0,0 +1,212 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+)
+
+// UserHandler handles HTTP requests for managing user accounts.
+type UserHandler struct {
+    userService *service.UserService
+}
+
+// NewUserHandler creates a new instance of UserHandler with the given UserService.
+func NewUserHandler(userService *service.UserService) *UserHandler {
+    return &UserHandler{userService: userService}
+}
+
+// HandleCreateUser handles the HTTP request to sign up a new user, opening their wallet.
+func (h *UserHandler) HandleCreateUser(c *gin.Context) {
+    var req struct {
+        Name  string `json:"name"`
+        Email string `json:"email"`
+        Phone string `json:"phone"`
+    }
+
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    user, err := h.userService.CreateUser(c, req.Name, req.Email, req.Phone)
+    if err != nil {
+        sendUserError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusCreated, user, "")
+}
+
+// HandleGetUser handles the HTTP request to retrieve a user account.
+func (h *UserHandler) HandleGetUser(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionAccountManageOwn, model.PermissionAccountManageAny) {
+        return
+    }
+
+    user, err := h.userService.GetUser(c, userID)
+    if err != nil {
+        sendUserError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, user, "")
+}
+
+// HandleUpdateUser handles the HTTP request to change the name, email or phone of a user account.
+// Fields missing from the request body are left unchanged.
+func (h *UserHandler) HandleUpdateUser(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionAccountManageOwn, model.PermissionAccountManageAny) {
+        return
+    }
+
+    var req struct {
+        Name  *string `json:"name"`
+        Email *string `json:"email"`
+        Phone *string `json:"phone"`
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    user, err := h.userService.UpdateUser(c, userID, service.UserUpdate{
+        Name:  req.Name,
+        Email: req.Email,
+        Phone: req.Phone,
+    })
+    if err != nil {
+        sendUserError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, user, "")
+}
+
+// HandleDeleteUser handles the HTTP request to delete a user account. The account is soft deleted,
+// keeping its transaction history, and only once its balance is zero.
+func (h *UserHandler) HandleDeleteUser(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionAccountManageOwn, model.PermissionAccountManageAny) {
+        return
+    }
+
+    if err := h.userService.DeleteUser(c, userID); err != nil {
+        sendUserError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, "", "User deleted")
+}
+
+// HandleChangeStatus handles the administrator request to change the status of a user account.
+// A reason is required, and the change is recorded in the account's audit trail.
+func (h *UserHandler) HandleChangeStatus(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+
+    var req struct {
+        Status    string `json:"status"`
+        Reason    string `json:"reason"`
+        ChangedBy string `json:"changed_by"`
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    change, err := h.userService.ChangeStatus(c, userID, req.Status, req.Reason, req.ChangedBy)
+    if err != nil {
+        sendUserError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, change, "")
+}
+
+// HandleSetKYCTier handles the administrator request to move a user account to another KYC tier,
+// which selects the transaction limits that apply to the user.
+func (h *UserHandler) HandleSetKYCTier(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+
+    var req struct {
+        KYCTier string `json:"kyc_tier"` // One of basic, verified or premium
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    user, err := h.userService.SetKYCTier(c, userID, req.KYCTier)
+    if err != nil {
+        sendUserError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, user, "")
+}
+
+// StatusChangesResponse represents the audit trail of status changes of a user account.
+type StatusChangesResponse struct {
+    UserID  int                  `json:"user_id"`
+    Changes []model.StatusChange `json:"changes"`
+}
+
+// HandleGetStatusChanges handles the administrator request to retrieve the audit trail of status changes of a user account.
+func (h *UserHandler) HandleGetStatusChanges(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+
+    changes, err := h.userService.GetStatusChanges(c, userID)
+    if err != nil {
+        sendUserError(c, err)
+        return
+    }
+
+    if len(changes) == 0 {
+        changes = []model.StatusChange{}
+    }
+
+    sendResponse(c, http.StatusOK, StatusChangesResponse{UserID: userID, Changes: changes}, "")
+}
+
+// sendUserError answers a failed user account request with the status code matching the error.
+func sendUserError(c *gin.Context, err error) {
+    status := http.StatusInternalServerError
+    switch {
+    case errors.Is(err, service.ErrInvalidUser), errors.Is(err, service.ErrInvalidStatusChange), errors.Is(err, service.ErrInvalidKYCTier):
+        status = http.StatusBadRequest
+    case errors.Is(err, repository.ErrUserNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, repository.ErrDuplicateEmail), errors.Is(err, repository.ErrDuplicatePhone), errors.Is(err, service.ErrUserHasBalance):
+        status = http.StatusConflict
+    }
+    sendResponse(c, status, "", err.Error())
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/service"
+)
+
+// WebhookHandler handles HTTP requests registering and disabling webhook endpoints, and reading and retrying their deliveries.
+type WebhookHandler struct {
+    webhookService *service.WebhookService
+}
+
+// NewWebhookHandler creates a new instance of WebhookHandler with the provided WebhookService.
+func NewWebhookHandler(webhookService *service.WebhookService) *WebhookHandler {
+    return &WebhookHandler{webhookService: webhookService}
+}
+
+// RegisteredWebhookResponse is a newly registered webhook endpoint together with its signing secret, which is only ever returned here.
+type RegisteredWebhookResponse struct {
+    Endpoint *model.WebhookEndpoint `json:"endpoint"`
+    Secret   string                 `json:"secret"`
+}
+
+// HandleRegisterEndpoint handles the HTTP request to register a webhook endpoint receiving the events of a user's wallets.
+func (h *WebhookHandler) HandleRegisterEndpoint(c *gin.Context) {
+    var req struct {
+        UserID     int      `json:"user_id"`
+        URL        string   `json:"url"`         // The https URL the events are posted to
+        EventTypes []string `json:"event_types"` // Some of transaction.completed, transaction.failed and balance.changed, all when omitted
+    }
+    if err := c.ShouldBindJSON(&req); err != nil {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid request")
+        return
+    }
+
+    // Register for the caller unless another user is named, which needs the account:manage:any permission
+    req.UserID = actingUserID(c, req.UserID)
+    if !authorizeUser(c, req.UserID, model.PermissionAccountManageOwn, model.PermissionAccountManageAny) {
+        return
+    }
+
+    endpoint, secret, err := h.webhookService.RegisterEndpoint(c, req.UserID, req.URL, req.EventTypes)
+    if err != nil {
+        sendWebhookError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusCreated, RegisteredWebhookResponse{Endpoint: endpoint, Secret: secret}, "")
+}
+
+// HandleGetEndpoints handles the HTTP request to list the webhook endpoints of a user.
+func (h *WebhookHandler) HandleGetEndpoints(c *gin.Context) {
+    userID, err := getUserIDFromContext(c)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid user ID")
+        return
+    }
+    if !authorizeUser(c, userID, model.PermissionAccountManageOwn, model.PermissionAccountManageAny) {
+        return
+    }
+
+    endpoints, err := h.webhookService.GetEndpoints(c, userID)
+    if err != nil {
+        sendWebhookError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, endpoints, "")
+}
+
+// HandleDisableEndpoint handles the HTTP request to stop posting events to a webhook endpoint.
+func (h *WebhookHandler) HandleDisableEndpoint(c *gin.Context) {
+    endpoint, ok := h.endpointFromPath(c)
+    if !ok {
+        return
+    }
+
+    endpoint, err := h.webhookService.DisableEndpoint(c, endpoint.ID)
+    if err != nil {
+        sendWebhookError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, endpoint, "")
+}
+
+// HandleGetDeliveries handles the HTTP request to read the delivery log of a webhook endpoint, newest first,
+// optionally filtered by status (pending, succeeded or dead) and limited in size.
+func (h *WebhookHandler) HandleGetDeliveries(c *gin.Context) {
+    endpoint, ok := h.endpointFromPath(c)
+    if !ok {
+        return
+    }
+
+    limit := 0
+    if value := c.Query("limit"); value != "" {
+        var err error
+        if limit, err = strconv.Atoi(value); err != nil {
+            sendResponse(c, http.StatusBadRequest, nil, "Invalid limit")
+            return
+        }
+    }
+
+    deliveries, err := h.webhookService.GetDeliveries(c, endpoint.ID, c.Query("status"), limit)
+    if err != nil {
+        sendWebhookError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, deliveries, "")
+}
+
+// HandleRetryDelivery handles the HTTP request to deliver a dead delivery of a webhook endpoint again.
+func (h *WebhookHandler) HandleRetryDelivery(c *gin.Context) {
+    endpoint, ok := h.endpointFromPath(c)
+    if !ok {
+        return
+    }
+    deliveryID, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid delivery ID")
+        return
+    }
+
+    delivery, err := h.webhookService.GetDelivery(c, deliveryID)
+    if err == nil && delivery.EndpointID != endpoint.ID {
+        err = repository.ErrWebhookDeliveryNotFound
+    }
+    if err == nil {
+        delivery, err = h.webhookService.RetryDelivery(c, deliveryID)
+    }
+    if err != nil {
+        sendWebhookError(c, err)
+        return
+    }
+
+    sendResponse(c, http.StatusOK, delivery, "")
+}
+
+// endpointFromPath retrieves the webhook endpoint named in the path, if the caller may manage the account it belongs to.
+// Otherwise the request is answered and false is returned; endpoints of others are not found.
+func (h *WebhookHandler) endpointFromPath(c *gin.Context) (*model.WebhookEndpoint, bool) {
+    endpointID, err := strconv.Atoi(c.Param("endpoint_id"))
+    if err != nil {
+        sendResponse(c, http.StatusBadRequest, nil, "Invalid endpoint ID")
+        return nil, false
+    }
+
+    endpoint, err := h.webhookService.GetEndpoint(c, endpointID)
+    if err == nil && !mayActOnOwner(c, endpoint.UserID, model.PermissionAccountManageOwn, model.PermissionAccountManageAny) {
+        err = repository.ErrWebhookEndpointNotFound
+    }
+    if err != nil {
+        sendWebhookError(c, err)
+        return nil, false
+    }
+    return endpoint, true
+}
+
+// sendWebhookError answers a failed webhook request with the status code matching the error.
+func sendWebhookError(c *gin.Context, err error) {
+    status := http.StatusBadRequest
+    switch {
+    case errors.Is(err, repository.ErrWebhookEndpointNotFound), errors.Is(err, repository.ErrWebhookDeliveryNotFound),
+        errors.Is(err, repository.ErrUserNotFound):
+        status = http.StatusNotFound
+    case errors.Is(err, service.ErrWebhookEndpointDisabled), errors.Is(err, service.ErrWebhookDeliveryNotDead):
+        status = http.StatusConflict
+    }
+    sendResponse(c, status, "", err.Error())
+}
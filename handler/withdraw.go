@@ -3,6 +3,7 @@ package handler
 import (
     "net/http"
     "github.com/gin-gonic/gin"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/service"
     "github.com/shopspring/decimal"
 )
@@ -20,8 +21,11 @@ func NewWithdrawHandler(withdrawService *service.WithdrawService) *WithdrawHandl
 // HandleWithdraw handles the withdrawal HTTP request
 func (h *WithdrawHandler) HandleWithdraw(c *gin.Context) {
     var req struct {
-        UserID int             `json:"user_id"`
-        Amount decimal.Decimal `json:"amount"`
+        UserID         int                    `json:"user_id"`
+        Currency       string                 `json:"currency"`        // ISO 4217 code, defaults to USD when omitted
+        Amount         decimal.Decimal        `json:"amount"`
+        PaymentMethod  string                 `json:"payment_method"`  // Such as credit_card or bank_transfer, defaults to credit_card when omitted
+        PaymentDetails service.PaymentDetails `json:"payment_details"` // The optional card, bank or PayPal details of the payment
     }
 
     if err := c.ShouldBindJSON(&req); err != nil {
@@ -29,12 +33,25 @@ func (h *WithdrawHandler) HandleWithdraw(c *gin.Context) {
         return
     }
 
+    // Act on the caller's own wallet unless another user is named, which needs the wallet:move:any permission
+    req.UserID = actingUserID(c, req.UserID)
+    if !authorizeUser(c, req.UserID, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny) {
+        return
+    }
+
+    idempotencyKey, ok := getIdempotencyKey(c)
+    if !ok {
+        sendResponse(c, http.StatusBadRequest, "", "Invalid Idempotency-Key header")
+        return
+    }
+
     // Call the service layer to handle the withdrawal logic
-    err := h.withdrawService.Withdraw(req.UserID, req.Amount)
+    txn, replayed, err := h.withdrawService.Withdraw(req.UserID, req.Currency, req.Amount, service.Payment{Method: req.PaymentMethod, Details: req.PaymentDetails}, idempotencyKey)
     if err != nil {
-        sendResponse(c, http.StatusBadRequest, "", err.Error())
+        sendMovementError(c, err)
         return
     }
 
-    sendResponse(c, http.StatusOK, "", "Withdraw successful")
+    markReplayed(c, replayed)
+    sendResponse(c, http.StatusOK, newMovementResponse(txn), "Withdraw successful")
 }
@@ -0,0 +1,68 @@
+package lock
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "sync/atomic"
+)
+
+// LocalLocker is a process-local Locker. It only serialises callers inside one process and
+// is meant for tests and single-instance deployments. Its locks never expire on their own,
+// so they cannot be taken over and carry no fencing token.
+type LocalLocker struct {
+    opts  Options
+    slots sync.Map // key -> chan struct{} with a capacity of one, full while the key is locked
+}
+
+// NewLocalLocker creates a new process-local Locker.
+func NewLocalLocker(opts Options) *LocalLocker {
+    return &LocalLocker{
+        opts: opts,
+    }
+}
+
+// Acquire blocks until the lock on key is acquired, the wait timeout elapses or ctx is done.
+func (l *LocalLocker) Acquire(ctx context.Context, key string) (Lock, error) {
+    slot, _ := l.slots.LoadOrStore(key, make(chan struct{}, 1))
+    ch, ok := slot.(chan struct{})
+    if !ok {
+        return nil, fmt.Errorf("failed to assert lock slot for key %s", key)
+    }
+
+    waitCtx, cancel := waitContext(ctx, l.opts)
+    defer cancel()
+
+    select {
+    case ch <- struct{}{}:
+        return &localLock{key: key, slot: ch}, nil
+    case <-waitCtx.Done():
+        return nil, fmt.Errorf("%w %s", ErrLockTimeout, key)
+    }
+}
+
+// localLock is a lock held on a LocalLocker.
+type localLock struct {
+    key      string
+    slot     chan struct{}
+    released int32
+}
+
+// Key returns the locked key.
+func (l *localLock) Key() string {
+    return l.key
+}
+
+// Token returns NoFencingToken, because local locks cannot be lost while they are held.
+func (l *localLock) Token() int64 {
+    return NoFencingToken
+}
+
+// Release releases the lock.
+func (l *localLock) Release(_ context.Context) error {
+    if !atomic.CompareAndSwapInt32(&l.released, 0, 1) {
+        return ErrLockNotHeld
+    }
+    <-l.slot
+    return nil
+}
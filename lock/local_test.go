@@ -0,0 +1,46 @@
+package lock
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+    "github.com/stretchr/testify/require"
+)
+
+func TestLocalLocker_AcquireAndRelease(t *testing.T) {
+    locker := NewLocalLocker(DefaultOptions())
+
+    l, err := locker.Acquire(context.Background(), "user:1")
+    require.NoError(t, err)
+    require.Equal(t, "user:1", l.Key())
+    require.Equal(t, NoFencingToken, l.Token())
+
+    // A different key can be locked at the same time
+    other, err := locker.Acquire(context.Background(), "user:2")
+    require.NoError(t, err)
+
+    require.NoError(t, l.Release(context.Background()))
+    require.NoError(t, other.Release(context.Background()))
+
+    // Releasing twice reports that the lock is no longer held
+    err = l.Release(context.Background())
+    require.True(t, errors.Is(err, ErrLockNotHeld))
+}
+
+func TestLocalLocker_WaitTimeout(t *testing.T) {
+    locker := NewLocalLocker(Options{WaitTimeout: 20 * time.Millisecond, RetryInterval: time.Millisecond})
+
+    l, err := locker.Acquire(context.Background(), "user:1")
+    require.NoError(t, err)
+
+    // The key is held, so a second caller gives up after the wait timeout
+    _, err = locker.Acquire(context.Background(), "user:1")
+    require.True(t, errors.Is(err, ErrLockTimeout))
+
+    // Once released, the key can be locked again
+    require.NoError(t, l.Release(context.Background()))
+    l, err = locker.Acquire(context.Background(), "user:1")
+    require.NoError(t, err)
+    require.NoError(t, l.Release(context.Background()))
+}
@@ -0,0 +1,130 @@
+// Package lock provides per-key mutual exclusion for the money-moving services of the wallet service.
+// It defines a pluggable Locker interface with a Redis-backed implementation, a PostgreSQL
+// advisory-lock implementation and a process-local implementation. Locks from the distributed backends
+// carry a fencing token that increases with each acquisition, so that storage can reject writes from a
+// holder whose lock has already expired and been taken over by someone else.
+package lock
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "time"
+)
+
+// ErrLockTimeout is returned when a lock could not be acquired within the wait timeout.
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// ErrLockNotHeld is returned when releasing a lock that has expired or been taken over by another holder.
+var ErrLockNotHeld = errors.New("lock is no longer held")
+
+// NoFencingToken is the token of locks from backends that cannot lose a lock while it is held.
+// Storage does not need to check it.
+const NoFencingToken int64 = 0
+
+// Lock is a lock held on a single key.
+type Lock interface {
+    // Key returns the locked key.
+    Key() string
+    // Token returns the fencing token of this acquisition. Tokens for the same key strictly increase,
+    // or are NoFencingToken if the backend does not issue them.
+    Token() int64
+    // Release releases the lock. It returns ErrLockNotHeld if the lock was lost in the meantime.
+    Release(ctx context.Context) error
+}
+
+// Locker acquires locks on keys.
+type Locker interface {
+    // Acquire blocks until the lock on key is acquired, the wait timeout elapses or ctx is done.
+    Acquire(ctx context.Context, key string) (Lock, error)
+}
+
+// Options configures how long locks are held and how long callers wait for them.
+type Options struct {
+    TTL           time.Duration // How long a lock is held before it expires on its own, if the backend supports expiry
+    WaitTimeout   time.Duration // How long Acquire waits for a held lock before giving up with ErrLockTimeout
+    RetryInterval time.Duration // How often a held lock is polled while waiting
+}
+
+// DefaultOptions returns the options used when none are configured.
+func DefaultOptions() Options {
+    return Options{
+        TTL:           10 * time.Second,
+        WaitTimeout:   5 * time.Second,
+        RetryInterval: 20 * time.Millisecond,
+    }
+}
+
+// MaxHeld returns how many locks a single caller may hold on the locker at once, or 0 if the locker does not limit it.
+// Lockers whose locks pin a scarce resource, such as the pooled connections of a PostgresLocker, report their limit
+// through a MaxHeld method, so that callers locking many keys can be refused up front instead of starving the pool.
+func MaxHeld(locker Locker) int {
+    if limited, ok := locker.(interface{ MaxHeld() int }); ok {
+        return limited.MaxHeld()
+    }
+    return 0
+}
+
+// UserKey returns the lock key that guards the balance of the given user.
+func UserKey(userID int) string {
+    return fmt.Sprintf("user:%d", userID)
+}
+
+// AcquireAll acquires the locks on all keys in sorted order, so that callers locking overlapping
+// sets of keys can never deadlock. Duplicate keys are locked once. If any lock cannot be acquired,
+// the locks acquired so far are released and the error is returned.
+func AcquireAll(ctx context.Context, locker Locker, keys ...string) ([]Lock, error) {
+    sorted := make([]string, 0, len(keys))
+    seen := make(map[string]bool, len(keys))
+    for _, key := range keys {
+        if !seen[key] {
+            seen[key] = true
+            sorted = append(sorted, key)
+        }
+    }
+    sort.Strings(sorted)
+
+    locks := make([]Lock, 0, len(sorted))
+    for _, key := range sorted {
+        l, err := locker.Acquire(ctx, key)
+        if err != nil {
+            _ = ReleaseAll(ctx, locks)
+            return nil, err
+        }
+        locks = append(locks, l)
+    }
+    return locks, nil
+}
+
+// ReleaseAll releases the given locks in reverse acquisition order and returns the first error encountered.
+func ReleaseAll(ctx context.Context, locks []Lock) error {
+    var firstErr error
+    for i := len(locks) - 1; i >= 0; i-- {
+        if err := locks[i].Release(ctx); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// waitContext derives the context that bounds how long Acquire may wait for a lock.
+func waitContext(ctx context.Context, opts Options) (context.Context, context.CancelFunc) {
+    if opts.WaitTimeout <= 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, opts.WaitTimeout)
+}
+
+// waitRetry sleeps for the retry interval and reports ErrLockTimeout once the wait context is done.
+func waitRetry(ctx context.Context, opts Options, key string) error {
+    timer := time.NewTimer(opts.RetryInterval)
+    defer timer.Stop()
+
+    select {
+    case <-ctx.Done():
+        return fmt.Errorf("%w %s", ErrLockTimeout, key)
+    case <-timer.C:
+        return nil
+    }
+}
@@ -0,0 +1,62 @@
+package lock
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "github.com/stretchr/testify/require"
+)
+
+// recordingLocker records the order in which keys are acquired and can fail on a given key.
+type recordingLocker struct {
+    acquired []string
+    released []string
+    failOn   string
+}
+
+func (l *recordingLocker) Acquire(_ context.Context, key string) (Lock, error) {
+    if key == l.failOn {
+        return nil, ErrLockTimeout
+    }
+    l.acquired = append(l.acquired, key)
+    return &recordedLock{locker: l, key: key}, nil
+}
+
+type recordedLock struct {
+    locker *recordingLocker
+    key    string
+}
+
+func (l *recordedLock) Key() string  { return l.key }
+func (l *recordedLock) Token() int64 { return 1 }
+func (l *recordedLock) Release(_ context.Context) error {
+    l.locker.released = append(l.locker.released, l.key)
+    return nil
+}
+
+func TestAcquireAll_SortsAndDeduplicatesKeys(t *testing.T) {
+    locker := &recordingLocker{}
+
+    locks, err := AcquireAll(context.Background(), locker, UserKey(3), UserKey(1), UserKey(3), UserKey(2))
+    require.NoError(t, err)
+    require.Len(t, locks, 3)
+
+    // Keys are always locked in the same order, whatever order the caller passes them in
+    require.Equal(t, []string{"user:1", "user:2", "user:3"}, locker.acquired)
+
+    // Locks are released in reverse order
+    err = ReleaseAll(context.Background(), locks)
+    require.NoError(t, err)
+    require.Equal(t, []string{"user:3", "user:2", "user:1"}, locker.released)
+}
+
+func TestAcquireAll_ReleasesOnFailure(t *testing.T) {
+    locker := &recordingLocker{failOn: "user:2"}
+
+    locks, err := AcquireAll(context.Background(), locker, UserKey(2), UserKey(1))
+    require.True(t, errors.Is(err, ErrLockTimeout))
+    require.Nil(t, locks)
+
+    // The lock acquired before the failure must have been released again
+    require.Equal(t, []string{"user:1"}, locker.released)
+}
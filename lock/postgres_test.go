@@ -0,0 +1,58 @@
+package lock
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/jmoiron/sqlx"
+    "github.com/stretchr/testify/require"
+)
+
+func TestPostgresLocker_AcquireAndRelease(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    opts := Options{WaitTimeout: time.Second, RetryInterval: time.Millisecond}
+    locker := NewPostgresLocker(sqlx.NewDb(db, "sqlmock"), opts)
+
+    // The first attempt finds the advisory lock held, the second one gets it
+    mock.ExpectQuery("SELECT pg_try_advisory_lock\\(hashtextextended\\(\\$1, 0\\)\\)").
+        WithArgs("user:1").
+        WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+    mock.ExpectQuery("SELECT pg_try_advisory_lock\\(hashtextextended\\(\\$1, 0\\)\\)").
+        WithArgs("user:1").
+        WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+    mock.ExpectQuery("SELECT nextval\\('lock_fencing_seq'\\)").
+        WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(15))
+
+    l, err := locker.Acquire(context.Background(), "user:1")
+    require.NoError(t, err)
+    require.Equal(t, int64(15), l.Token())
+
+    mock.ExpectQuery("SELECT pg_advisory_unlock\\(hashtextextended\\(\\$1, 0\\)\\)").
+        WithArgs("user:1").
+        WillReturnRows(sqlmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+
+    require.NoError(t, l.Release(context.Background()))
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that a caller may hold locks on a quarter of the connection pool, and without limit on an unbounded pool
+func TestPostgresLocker_MaxHeld(t *testing.T) {
+    db, _, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    locker := NewPostgresLocker(sqlx.NewDb(db, "sqlmock"), DefaultOptions())
+    require.Equal(t, 0, MaxHeld(locker))
+
+    db.SetMaxOpenConns(100)
+    require.Equal(t, 25, MaxHeld(locker))
+
+    db.SetMaxOpenConns(2)
+    require.Equal(t, 1, MaxHeld(locker))
+
+    require.Equal(t, 0, MaxHeld(NewLocalLocker(DefaultOptions())))
+}
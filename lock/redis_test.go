@@ -0,0 +1,70 @@
+package lock
+
+import (
+    "context"
+    "errors"
+    "regexp"
+    "testing"
+    "time"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/stretchr/testify/require"
+)
+
+func TestRedisLocker_AcquireAndRelease(t *testing.T) {
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    opts := Options{TTL: 10 * time.Second, WaitTimeout: time.Second, RetryInterval: time.Millisecond}
+    locker := NewRedisLocker(redisClient, opts)
+
+    // The first attempt finds the key locked, the second one succeeds
+    mockRedis.Regexp().ExpectSetNX("lock:user:1", `^[0-9a-f]{32}$`, opts.TTL).SetVal(false)
+    mockRedis.Regexp().ExpectSetNX("lock:user:1", `^[0-9a-f]{32}$`, opts.TTL).SetVal(true)
+    mockRedis.ExpectIncr("lock:fence:user:1").SetVal(42)
+
+    l, err := locker.Acquire(context.Background(), "user:1")
+    require.NoError(t, err)
+    require.Equal(t, int64(42), l.Token())
+
+    // The lock is only deleted if it still holds our value
+    mockRedis.Regexp().ExpectEval(regexp.QuoteMeta(releaseScript), []string{"lock:user:1"}, `^[0-9a-f]{32}$`).SetVal(int64(1))
+    require.NoError(t, l.Release(context.Background()))
+
+    require.NoError(t, mockRedis.ExpectationsWereMet())
+}
+
+func TestRedisLocker_ReleaseExpiredLock(t *testing.T) {
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    opts := Options{TTL: 10 * time.Second, WaitTimeout: time.Second, RetryInterval: time.Millisecond}
+    locker := NewRedisLocker(redisClient, opts)
+
+    mockRedis.Regexp().ExpectSetNX("lock:user:1", `^[0-9a-f]{32}$`, opts.TTL).SetVal(true)
+    mockRedis.ExpectIncr("lock:fence:user:1").SetVal(7)
+
+    l, err := locker.Acquire(context.Background(), "user:1")
+    require.NoError(t, err)
+
+    // The lock expired and was taken over, so nothing is deleted
+    mockRedis.Regexp().ExpectEval(regexp.QuoteMeta(releaseScript), []string{"lock:user:1"}, `^[0-9a-f]{32}$`).SetVal(int64(0))
+    err = l.Release(context.Background())
+    require.True(t, errors.Is(err, ErrLockNotHeld))
+
+    require.NoError(t, mockRedis.ExpectationsWereMet())
+}
+
+func TestRedisLocker_WaitTimeout(t *testing.T) {
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    opts := Options{TTL: 10 * time.Second, WaitTimeout: 15 * time.Millisecond, RetryInterval: 10 * time.Millisecond}
+    locker := NewRedisLocker(redisClient, opts)
+
+    // The key stays locked by someone else
+    mockRedis.Regexp().ExpectSetNX("lock:user:1", `^[0-9a-f]{32}$`, opts.TTL).SetVal(false)
+    mockRedis.Regexp().ExpectSetNX("lock:user:1", `^[0-9a-f]{32}$`, opts.TTL).SetVal(false)
+
+    _, err := locker.Acquire(context.Background(), "user:1")
+    require.True(t, errors.Is(err, ErrLockTimeout))
+}
@@ -7,6 +7,7 @@ import (
     "syscall"
     "time"
     "context"
+    _ "time/tzdata" // Time zones of scheduled transfers, on hosts without a time zone database
     "github.com/gin-gonic/gin"
     "github.com/gin-contrib/cors"
     "github.com/yaoweihua/wallet-service/config"
@@ -41,8 +42,12 @@ func main() {
     // Set up the CORS middleware
     r.Use(cors.Default())
 
-    // Set up the routes
-    api.SetupRoutes(r, dbConn, redisClient)
+    // Set up the routes, the background workers stop when the server shuts down
+    workerCtx, stopWorkers := context.WithCancel(context.Background())
+    defer stopWorkers()
+    if err := api.SetupRoutes(workerCtx, r, cfg, dbConn, redisClient); err != nil {
+        logger.Fatal("Invalid configuration:", err)
+    }
 
     // Get the port configuration
     port := getPort()
@@ -67,6 +72,7 @@ func main() {
     // Wait for the interrupt signal to gracefully shut down the server
     <-quit
     logger.Info("Shutting down server...")
+    stopWorkers()
 
     // Set a timeout to ensure that it doesn't wait too long during shutdown
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
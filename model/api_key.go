@@ -0,0 +1,41 @@
+package model
+
+import (
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// API key scopes. A scope allows a backend service to call the routes of one kind of operation for every user;
+// ScopeAdmin allows everything, like the admin role of a user.
+const (
+    ScopeReadBalance = "read-balance" // Read balances, transaction histories and statements
+    ScopeDeposit     = "deposit"      // Deposit money into wallets
+    ScopeWithdraw    = "withdraw"     // Withdraw money from wallets and hold it
+    ScopeTransfer    = "transfer"     // Transfer money between wallets and quote FX rates
+    ScopeAdmin       = RoleAdmin      // Everything, including account and API key management
+)
+
+// APIKeyScopes are the scopes an API key can be granted.
+var APIKeyScopes = []string{ScopeReadBalance, ScopeDeposit, ScopeWithdraw, ScopeTransfer, ScopeAdmin}
+
+// APIKey is the credential of a backend service calling the wallet service directly.
+// Only a hash of the key is stored; the key itself is handed out once, when it is created or rotated.
+type APIKey struct {
+    ID          int            `json:"id" db:"id"`                                 // API key ID
+    Name        string         `json:"name" db:"name"`                             // Which service the key belongs to
+    Prefix      string         `json:"prefix" db:"key_prefix"`                     // The public part of the key it is looked up by
+    KeyHash     string         `json:"-" db:"key_hash"`                            // The SHA-256 hash of the whole key
+    Scopes      pq.StringArray `json:"scopes" db:"scopes"`                         // What the key allows, some of APIKeyScopes
+    ExpiresAt   *time.Time     `json:"expires_at,omitempty" db:"expires_at"`       // When a rotated key stops working, nil if it does not expire
+    RevokedAt   *time.Time     `json:"revoked_at,omitempty" db:"revoked_at"`       // When the key was revoked, nil while it is not
+    RotatedFrom *int           `json:"rotated_from,omitempty" db:"rotated_from"`   // The key this one replaced, nil for keys that were created
+    LastUsedAt  *time.Time     `json:"last_used_at,omitempty" db:"last_used_at"`   // When the key last authenticated a request
+    CreatedAt   time.Time      `json:"created_at" db:"created_at"`                 // Creation time
+    UpdatedAt   time.Time      `json:"updated_at" db:"updated_at"`                 // Update time
+}
+
+// Active reports whether the key can still authenticate requests at the given time.
+func (k *APIKey) Active(now time.Time) bool {
+    return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
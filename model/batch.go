@@ -0,0 +1,65 @@
+package model
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Batch modes. An atomic batch pays every item or none of them, a best-effort batch pays every item it can.
+const (
+    BatchModeAtomic     = "atomic"
+    BatchModeBestEffort = "best_effort"
+)
+
+// Transfer batch statuses. A batch is processing until each of its items has succeeded or failed.
+const (
+    BatchStatusProcessing         = "processing"          // The items are being paid
+    BatchStatusCompleted          = "completed"           // Every item was paid
+    BatchStatusPartiallyCompleted = "partially_completed" // Some items of a best-effort batch were paid, the others failed
+    BatchStatusFailed             = "failed"              // No item was paid
+)
+
+// Transfer batch item statuses.
+const (
+    BatchItemPending   = "pending"   // Not paid yet
+    BatchItemSucceeded = "succeeded" // Paid by the transfer of the item
+    BatchItemFailed    = "failed"    // Not paid, see the failure reason
+)
+
+// FailureReasonBatchAborted is the failure reason of the items of an atomic batch that were not paid because
+// another item of the batch failed.
+const FailureReasonBatchAborted = "batch_aborted"
+
+// TransferBatch pays many users from one wallet in a single request, such as a payroll run.
+// Every item that is paid is an ordinary transfer, with its own transaction and fee.
+type TransferBatch struct {
+    ID             int                 `json:"id" db:"id"`                           // Batch ID, to poll the status of the batch with
+    FromUserID     int                 `json:"from_user_id" db:"from_user_id"`       // The user paying every item
+    Currency       string              `json:"currency" db:"currency"`               // The ISO 4217 currency of every item
+    Mode           string              `json:"mode" db:"mode"`                       // One of the BatchMode constants
+    Status         string              `json:"status" db:"status"`                   // One of the BatchStatus constants
+    TotalAmount    decimal.Decimal     `json:"total_amount" db:"total_amount"`       // The sum of the amounts of the items, without fees
+    ItemCount      int                 `json:"item_count" db:"item_count"`           // The number of items
+    SucceededCount int                 `json:"succeeded_count" db:"succeeded_count"` // The number of items paid so far
+    FailedCount    int                 `json:"failed_count" db:"failed_count"`       // The number of items that failed so far
+    IdempotencyKey string              `json:"-" db:"idempotency_key"`               // The client supplied Idempotency-Key header, empty if none was sent
+    RequestHash    string              `json:"-" db:"request_hash"`                  // The fingerprint of the request payload the idempotency key was first used with
+    Items          []TransferBatchItem `json:"items" db:"-"`                         // The items in request order
+    CreatedAt      time.Time           `json:"created_at" db:"created_at"`           // Creation time
+    UpdatedAt      time.Time           `json:"updated_at" db:"updated_at"`           // Update time
+}
+
+// TransferBatchItem is one payment of a transfer batch, and its result.
+type TransferBatchItem struct {
+    BatchID       int             `json:"-" db:"batch_id"`                              // The batch the item belongs to
+    Position      int             `json:"position" db:"position"`                       // The index of the item in the request, from 0
+    ToUserID      int             `json:"to_user_id" db:"to_user_id"`                   // The user paid
+    Amount        decimal.Decimal `json:"amount" db:"amount"`                           // The amount paid
+    Fee           decimal.Decimal `json:"fee" db:"fee"`                                 // The transfer fee charged to the payer on top of the amount
+    Reference     string          `json:"reference,omitempty" db:"reference"`           // The caller's reference of the item, such as a payslip number
+    Status        string          `json:"status" db:"status"`                           // One of the BatchItem constants
+    TransactionID *int            `json:"transaction_id,omitempty" db:"transaction_id"` // The transfer paying the item, nil unless it succeeded
+    FailureReason string          `json:"failure_reason,omitempty" db:"failure_reason"` // Why the item failed, such as unknown_recipient or batch_aborted
+    Error         string          `json:"error,omitempty" db:"error"`                   // The error the item failed with
+}
@@ -0,0 +1,50 @@
+package model
+
+import "github.com/shopspring/decimal"
+
+// RoleAdmin is the role of the administrators, who may see and act on every account.
+const RoleAdmin = "admin"
+
+// Caller is the authenticated user a request is made on behalf of, or the backend service making it with an API key.
+// Its permissions and refund limit are resolved from its roles by the policy layer.
+type Caller struct {
+    UserID      int              // The calling user, 0 for backend services
+    Roles       []string         // The roles granted to the caller, such as RoleAdmin, or the scopes of the API key of a backend service
+    APIKeyID    int              // The API key a backend service authenticated with, 0 for users
+    Permissions []string         // The permissions granted by the roles, such as PermissionWalletReadOwn
+    RefundLimit *decimal.Decimal // The largest refund the caller may issue in USD, nil for no limit
+}
+
+// IsService reports whether the caller is a backend service authenticated with an API key, rather than a user.
+func (c Caller) IsService() bool {
+    return c.APIKeyID != 0
+}
+
+// HasRole reports whether the caller was granted the role.
+func (c Caller) HasRole(role string) bool {
+    for _, r := range c.Roles {
+        if r == role {
+            return true
+        }
+    }
+    return false
+}
+
+// HasPermission reports whether the roles of the caller grant the permission.
+func (c Caller) HasPermission(permission string) bool {
+    for _, p := range c.Permissions {
+        if p == permission {
+            return true
+        }
+    }
+    return false
+}
+
+// CanSee reports whether the caller may see the transaction: administrators and callers who may read every wallet
+// see every transaction, other users only those they sent or received.
+func (c Caller) CanSee(txn *Transaction) bool {
+    if c.HasRole(RoleAdmin) || c.HasPermission(PermissionWalletReadAny) {
+        return true
+    }
+    return c.UserID != 0 && (c.UserID == txn.FromUserID || c.UserID == txn.ToUserID)
+}
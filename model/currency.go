@@ -0,0 +1,27 @@
+package model
+
+// DefaultCurrency is the currency of money movements that do not name one, and of the wallet opened when a user signs up.
+const DefaultCurrency = "USD"
+
+// currencyScales maps the supported ISO 4217 currency codes to their number of minor unit decimals.
+var currencyScales = map[string]int32{
+    "AUD": 2,
+    "CAD": 2,
+    "CHF": 2,
+    "CNY": 2,
+    "EUR": 2,
+    "GBP": 2,
+    "HKD": 2,
+    "JPY": 0,
+    "KRW": 0,
+    "KWD": 3,
+    "SGD": 2,
+    "USD": 2,
+}
+
+// CurrencyScale returns the number of decimals amounts in the given currency may have,
+// and whether the currency is supported at all.
+func CurrencyScale(currency string) (int32, bool) {
+    scale, ok := currencyScales[currency]
+    return scale, ok
+}
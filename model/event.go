@@ -0,0 +1,51 @@
+package model
+
+import (
+    "encoding/json"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Domain event types. Every recorded money movement raises the event of its transaction status, such as
+// transaction.completed or transaction.pending, and balance.changed for every wallet balance it changed.
+const (
+    EventTransactionPrefix = "transaction."
+    EventBalanceChanged    = "balance.changed"
+)
+
+// Aggregate types, the kind of record a domain event is about.
+const (
+    AggregateTransaction = "transaction"
+    AggregateWallet      = "wallet"
+)
+
+// TransactionEventType returns the type of the event raised when a transaction reaches the status, such as transaction.failed.
+func TransactionEventType(status string) string {
+    return EventTransactionPrefix + status
+}
+
+// OutboxEvent is a domain event written to the outbox in the database transaction of the change it describes,
+// and published to downstream systems by the outbox relay afterwards. Events are published in ID order, at least
+// once, except that an event that failed to publish is retried after later ones: consumers should deduplicate them by
+// ID, and order the events of an aggregate by ID.
+type OutboxEvent struct {
+    ID            int64           `json:"id" db:"id"`                         // Event ID, increasing in the order the events were written
+    EventType     string          `json:"type" db:"event_type"`               // Such as transaction.completed or balance.changed
+    AggregateType string          `json:"aggregate_type" db:"aggregate_type"` // One of the Aggregate constants
+    AggregateID   string          `json:"aggregate_id" db:"aggregate_id"`     // The transaction ID, or the user ID and currency of a wallet such as 1:USD
+    Payload       json.RawMessage `json:"payload" db:"payload"`               // The transaction, or the BalanceChange of a wallet, as JSON
+    CreatedAt     time.Time       `json:"created_at" db:"created_at"`         // When the change was committed
+    PublishedAt   *time.Time      `json:"-" db:"published_at"`                // When the event was published, nil until then
+    Attempts      int             `json:"-" db:"attempts"`                    // The number of failed attempts to publish the event
+    LastError     string          `json:"-" db:"last_error"`                  // The error of the last failed attempt
+}
+
+// BalanceChange is the payload of a balance.changed event: the balance of a wallet after a money movement.
+type BalanceChange struct {
+    UserID        int             `json:"user_id"`
+    Currency      string          `json:"currency"`
+    Balance       decimal.Decimal `json:"balance"`        // The balance after the movement
+    Delta         decimal.Decimal `json:"delta"`          // How much the movement changed the balance by, negative when money left the wallet
+    TransactionID int             `json:"transaction_id"` // The transaction that changed the balance
+}
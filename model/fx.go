@@ -0,0 +1,33 @@
+package model
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// SystemAccountFXClearing is the system ledger account that takes the other side of both legs of a currency conversion.
+// A conversion moves the source amount into the clearing account of the source currency and pays the target amount out of
+// the clearing account of the target currency, so every currency in the journal entry still sums to zero.
+const SystemAccountFXClearing = "system:fx_clearing"
+
+// FXQuote is a quoted conversion of an amount from one currency into another at a fixed rate.
+// A quote belongs to the user who requested it, can be executed by a single transfer and expires after a short while.
+type FXQuote struct {
+    ID             int             `json:"id" db:"id"`                                           // Quote ID
+    UserID         int             `json:"user_id" db:"user_id"`                                 // The user the quote was issued to, the only one who may execute it
+    SourceCurrency string          `json:"source_currency" db:"source_currency"`                 // The ISO 4217 currency debited from the sender
+    TargetCurrency string          `json:"target_currency" db:"target_currency"`                 // The ISO 4217 currency credited to the recipient
+    SourceAmount   decimal.Decimal `json:"source_amount" db:"source_amount"`                     // The amount debited from the sender
+    TargetAmount   decimal.Decimal `json:"target_amount" db:"target_amount"`                     // The amount credited to the recipient, rounded down to the target currency
+    Rate           decimal.Decimal `json:"rate" db:"rate"`                                       // Units of the target currency per unit of the source currency
+    ExpiresAt      time.Time       `json:"expires_at" db:"expires_at"`                           // After this time the quote can no longer be executed
+    UsedAt         *time.Time      `json:"used_at,omitempty" db:"used_at"`                       // When the quote was executed, nil while it is still open
+    TransactionID  *int            `json:"transaction_id,omitempty" db:"transaction_id"`         // The transfer that executed the quote
+    CreatedAt      time.Time       `json:"created_at" db:"created_at"`                           // Creation time
+}
+
+// Expired reports whether the quote can no longer be executed at the given time.
+func (q *FXQuote) Expired(now time.Time) bool {
+    return !now.Before(q.ExpiresAt)
+}
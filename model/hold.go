@@ -0,0 +1,36 @@
+package model
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Hold statuses. An active hold reserves part of a wallet balance until it is captured, voided or expires.
+const (
+    HoldStatusActive   = "active"   // The amount is held and can no longer be spent
+    HoldStatusCaptured = "captured" // The captured amount was debited, any remainder released
+    HoldStatusVoided   = "voided"   // The hold was cancelled and its amount released
+    HoldStatusExpired  = "expired"  // The hold was neither captured nor voided in time and its amount released
+)
+
+// Hold is a card-style authorisation: part of a wallet balance reserved for a later capture.
+// The held amount stays in the balance but is no longer available, until the hold is captured, voided or expires.
+type Hold struct {
+    ID             int             `json:"id" db:"id"`                                   // Hold ID
+    UserID         int             `json:"user_id" db:"user_id"`                         // The user whose balance is held
+    Currency       string          `json:"currency" db:"currency"`                       // The ISO 4217 currency of the held wallet
+    Amount         decimal.Decimal `json:"amount" db:"amount"`                           // The amount reserved
+    CapturedAmount decimal.Decimal `json:"captured_amount" db:"captured_amount"`         // The amount captured, zero unless the hold was captured
+    Status         string          `json:"status" db:"status"`                           // One of the HoldStatus constants
+    Description    string          `json:"description,omitempty" db:"description"`       // What the hold is for, such as the merchant or the order
+    ExpiresAt      time.Time       `json:"expires_at" db:"expires_at"`                   // After this time the hold is released if it is still active
+    TransactionID  *int            `json:"transaction_id,omitempty" db:"transaction_id"` // The capture transaction, nil unless the hold was captured
+    CreatedAt      time.Time       `json:"created_at" db:"created_at"`                   // Creation time
+    UpdatedAt      time.Time       `json:"updated_at" db:"updated_at"`                   // Update time
+}
+
+// Expired reports whether the hold can no longer be captured at the given time.
+func (h *Hold) Expired(now time.Time) bool {
+    return !now.Before(h.ExpiresAt)
+}
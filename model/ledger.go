@@ -0,0 +1,76 @@
+package model
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Ledger account types. User accounts hold a user's wallet balance, system accounts
+// represent the outside world (external funding, payouts, opening balances) and the service's own revenue.
+const (
+    AccountTypeUser   = "user"
+    AccountTypeSystem = "system"
+)
+
+// Names of the system ledger accounts that take the other side of money entering or leaving the wallet service.
+// There is one system account per name and currency, see SystemAccountCode.
+const (
+    SystemAccountExternalFunding = "system:external_funding" // Money deposited into wallets from outside
+    SystemAccountExternalPayout  = "system:external_payout"  // Money withdrawn from wallets to the outside
+    SystemAccountOpeningBalance  = "system:opening_balance"  // Balances that existed before the ledger was introduced
+    SystemAccountFeeRevenue      = "system:fee_revenue"      // Fees charged on money movements
+    SystemAccountAdjustments     = "system:adjustments"      // Balances corrected by hand
+)
+
+// UserAccountCode returns the ledger account code of the given user's wallet in the given currency.
+func UserAccountCode(userID int, currency string) string {
+    return fmt.Sprintf("user:%d:%s", userID, currency)
+}
+
+// SystemAccountCode returns the ledger account code of the named system account in the given currency.
+func SystemAccountCode(name, currency string) string {
+    return fmt.Sprintf("%s:%s", name, currency)
+}
+
+// LedgerAccount represents an account in the double-entry ledger.
+// Every user wallet has one user account, and external parties are modelled as system accounts.
+// An account holds a single currency.
+type LedgerAccount struct {
+    ID          int       `json:"id" db:"id"`                     // Account ID
+    Code        string    `json:"code" db:"code"`                 // Unique account code, such as user:1:USD or system:external_funding:USD
+    UserID      *int      `json:"user_id,omitempty" db:"user_id"` // The owning user, nil for system accounts
+    AccountType string    `json:"account_type" db:"account_type"` // The account type, such as user or system
+    Currency    string    `json:"currency" db:"currency"`         // The ISO 4217 currency of the account
+    CreatedAt   time.Time `json:"created_at" db:"created_at"`     // Creation time
+}
+
+// JournalEntry groups the postings of a single money movement.
+// The amounts of its postings always sum to zero in every currency.
+type JournalEntry struct {
+    ID            int       `json:"id" db:"id"`                                 // Journal entry ID
+    TransactionID int       `json:"transaction_id,omitempty" db:"transaction_id"` // The transaction the entry belongs to
+    Description   string    `json:"description" db:"description"`               // Human readable description, such as deposit or transfer
+    Postings      []Posting `json:"postings" db:"-"`                            // The postings of the entry
+    CreatedAt     time.Time `json:"created_at" db:"created_at"`                 // Creation time
+}
+
+// Posting is a single signed change to a ledger account.
+// Positive amounts increase the account balance and negative amounts decrease it.
+type Posting struct {
+    ID             int             `json:"id" db:"id"`                             // Posting ID
+    JournalEntryID int             `json:"journal_entry_id" db:"journal_entry_id"` // The journal entry the posting belongs to
+    AccountID      int             `json:"account_id" db:"account_id"`             // The ledger account the posting applies to
+    Amount         decimal.Decimal `json:"amount" db:"amount"`                     // The signed posting amount
+    Currency       string          `json:"currency,omitempty" db:"-"`              // The currency of the account, used to check that each currency of an entry balances
+}
+
+// Reconciliation compares the balance stored in a wallet with the balance derived from the ledger postings.
+type Reconciliation struct {
+    UserID        int             `json:"user_id"`        // User ID
+    Currency      string          `json:"currency"`       // The currency of the wallet
+    StoredBalance decimal.Decimal `json:"stored_balance"` // The balance stored in wallets.balance
+    LedgerBalance decimal.Decimal `json:"ledger_balance"` // The sum of the postings on the user's ledger account
+    Balanced      bool            `json:"balanced"`       // Whether both balances agree
+}
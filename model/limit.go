@@ -0,0 +1,26 @@
+package model
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Windows the usage of a user is counted over for the transaction limits. Windows are calendar periods in UTC,
+// a new one starts at the top of every hour, at midnight and on the first day of every month.
+const (
+    LimitPeriodHour  = "hour"
+    LimitPeriodDay   = "day"
+    LimitPeriodMonth = "month"
+)
+
+// UsageCounter aggregates the withdrawals or transfers of a user in every currency over one window, valued in DefaultCurrency,
+// so that the cumulative limits are checked without summing the transaction history.
+type UsageCounter struct {
+    UserID          int             `json:"user_id" db:"user_id"`                   // The user whose usage is counted
+    TransactionType string          `json:"transaction_type" db:"transaction_type"` // withdraw or transfer
+    Period          string          `json:"period" db:"period"`                     // One of the LimitPeriod constants
+    PeriodStart     time.Time       `json:"period_start" db:"period_start"`         // When the window started
+    Amount          decimal.Decimal `json:"amount" db:"amount"`                     // The total amount moved in the window in DefaultCurrency, without fees
+    Count           int             `json:"count" db:"count"`                       // The number of movements in the window
+}
@@ -0,0 +1,46 @@
+package model
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+)
+
+// Payment methods known to the wallet service. Deposits and withdrawals name one of the methods
+// enabled in the payment method registry, transfers between wallets are recorded with PaymentMethodWallet.
+const (
+    PaymentMethodCreditCard   = "credit_card"
+    PaymentMethodDebitCard    = "debit_card"
+    PaymentMethodBankTransfer = "bank_transfer"
+    PaymentMethodPayPal       = "paypal"
+    PaymentMethodWallet       = "wallet"
+    PaymentMethodManual       = "manual" // Balance adjustments made by hand
+)
+
+// DefaultPaymentMethod is the payment method of deposits and withdrawals that do not name one.
+const DefaultPaymentMethod = PaymentMethodCreditCard
+
+// PaymentMetadata describes the payment instrument of a deposit or withdrawal, as stored with the transaction.
+// Card numbers are never stored in full, only masked down to their last four digits.
+type PaymentMetadata struct {
+    MaskedCard    string `json:"masked_card,omitempty"`    // The masked card number, such as **** 4242
+    BankReference string `json:"bank_reference,omitempty"` // The reference of the bank transfer
+    PayPalEmail   string `json:"paypal_email,omitempty"`   // The PayPal account the money came from or went to
+}
+
+// Value stores the metadata as JSON in the payment_metadata column.
+func (m PaymentMetadata) Value() (driver.Value, error) {
+    return json.Marshal(m)
+}
+
+// Scan reads the metadata from the JSON of the payment_metadata column.
+func (m *PaymentMetadata) Scan(src interface{}) error {
+    switch data := src.(type) {
+    case []byte:
+        return json.Unmarshal(data, m)
+    case string:
+        return json.Unmarshal([]byte(data), m)
+    default:
+        return fmt.Errorf("cannot scan %T into payment metadata", src)
+    }
+}
@@ -0,0 +1,33 @@
+package model
+
+import "github.com/shopspring/decimal"
+
+// Roles seeded in the database. Every user is a customer, support agents and administrators are granted their role.
+const (
+    RoleCustomer = "customer" // May use their own wallet and account
+    RoleSupport  = "support"  // May read every wallet and issue refunds up to the refund limit of the role
+)
+
+// Permissions granted to roles. The own permissions allow acting on the caller's own wallet or account,
+// the any permissions on every user's.
+const (
+    PermissionWalletReadOwn     = "wallet:read:own"     // Read the own balances, history and statements
+    PermissionWalletReadAny     = "wallet:read:any"     // Read every user's balances, history and statements
+    PermissionWalletMoveOwn     = "wallet:move:own"     // Deposit, withdraw, transfer and hold money of the own wallet
+    PermissionWalletMoveAny     = "wallet:move:any"     // Move money of every user's wallet
+    PermissionAccountManageOwn  = "account:manage:own"  // Read, update and delete the own account
+    PermissionAccountManageAny  = "account:manage:any"  // Manage every account, including its status
+    PermissionTransactionRefund = "transaction:refund"  // Refund transactions, up to the refund limit of the role
+    PermissionHoldManage        = "hold:manage"         // Capture and void holds
+    PermissionSettlementManage  = "settlement:manage"   // Settle withdrawals
+    PermissionBalanceAdjust     = "balance:adjust"      // Adjust balances by hand
+    PermissionAccessManage      = "access:manage"       // Manage API keys and the roles of users
+)
+
+// Role is a named set of permissions stored in the database.
+type Role struct {
+    Name        string           `json:"name" db:"name"`                           // Role name, such as customer, support or admin
+    Description string           `json:"description" db:"description"`             // What the role is for
+    RefundLimit *decimal.Decimal `json:"refund_limit,omitempty" db:"refund_limit"` // The largest refund the role may issue in USD, nil for no limit
+    Permissions []string         `json:"permissions" db:"-"`                       // The permissions granted to the role
+}
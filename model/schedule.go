@@ -0,0 +1,55 @@
+package model
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Transfer schedule statuses. An active schedule is executed whenever it falls due, until it is cancelled
+// or has no occurrence left.
+const (
+    ScheduleStatusActive    = "active"    // Executed when it falls due
+    ScheduleStatusCompleted = "completed" // Every occurrence has been executed, or the next one is after its end
+    ScheduleStatusCancelled = "cancelled" // Cancelled by the user, no further transfers are made
+)
+
+// Outcomes of the runs of a transfer schedule.
+const (
+    ScheduleRunSucceeded = "succeeded" // The transfer was made
+    ScheduleRunFailed    = "failed"    // The transfer was rejected or could not be made, the schedule goes on
+)
+
+// TransferSchedule is a transfer made later, once or repeatedly: every Interval, or whenever the Cron expression
+// matches on the wall clock of TimeZone. A schedule with neither is executed once, at StartAt.
+type TransferSchedule struct {
+    ID          int             `json:"id" db:"id"`                                  // Schedule ID
+    FromUserID  int             `json:"from_user_id" db:"from_user_id"`              // The user paying the transfers
+    ToUserID    int             `json:"to_user_id" db:"to_user_id"`                  // The user receiving the transfers
+    Amount      decimal.Decimal `json:"amount" db:"amount"`                          // The amount of each transfer
+    Currency    string          `json:"currency" db:"currency"`                      // The ISO 4217 currency of the transfers
+    Description string          `json:"description,omitempty" db:"description"`      // What the transfers are for, such as the rent
+    Interval    string          `json:"interval,omitempty" db:"repeat_interval"`     // How often the transfer repeats from StartAt, such as 168h, empty otherwise
+    Cron        string          `json:"cron,omitempty" db:"cron_expression"`         // The five-field cron expression the transfer repeats on, empty otherwise
+    TimeZone    string          `json:"time_zone" db:"time_zone"`                    // The IANA time zone the cron expression is evaluated in
+    StartAt     time.Time       `json:"start_at" db:"start_at"`                      // The first occurrence, or when the cron expression starts to apply
+    EndAt       *time.Time      `json:"end_at,omitempty" db:"end_at"`                // No transfers are made after this time, nil to repeat until cancelled
+    NextRunAt   *time.Time      `json:"next_run_at,omitempty" db:"next_run_at"`      // When the next transfer falls due, nil once the schedule has ended
+    LastRunAt   *time.Time      `json:"last_run_at,omitempty" db:"last_run_at"`      // When the last transfer was made or attempted, nil before the first
+    RunCount    int             `json:"run_count" db:"run_count"`                    // The number of runs so far, successful or not
+    Status      string          `json:"status" db:"status"`                          // One of the ScheduleStatus constants
+    CreatedAt   time.Time       `json:"created_at" db:"created_at"`                  // Creation time
+    UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`                  // Update time
+}
+
+// ScheduleRun records the execution of one occurrence of a transfer schedule.
+type ScheduleRun struct {
+    ID            int       `json:"id" db:"id"`                                      // Run ID
+    ScheduleID    int       `json:"schedule_id" db:"schedule_id"`                    // The schedule the run belongs to
+    ScheduledFor  time.Time `json:"scheduled_for" db:"scheduled_for"`                // The occurrence executed, which may be earlier than the run
+    Status        string    `json:"status" db:"status"`                              // One of the ScheduleRun constants
+    TransactionID *int      `json:"transaction_id,omitempty" db:"transaction_id"`    // The transfer made, nil if the run failed
+    FailureReason string    `json:"failure_reason,omitempty" db:"failure_reason"`    // Why a failed transfer was rejected, such as insufficient_balance, empty otherwise
+    Error         string    `json:"error,omitempty" db:"error"`                      // The error a failed run ended with
+    CreatedAt     time.Time `json:"created_at" db:"created_at"`                      // When the run happened
+}
@@ -0,0 +1,19 @@
+package model
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// StatementLine is one change of a wallet balance on an account statement: a journal entry posted to the user's ledger account,
+// with the transaction it belongs to and the balance after it.
+type StatementLine struct {
+    EntryID         int             `json:"entry_id" db:"entry_id"`                         // The journal entry that changed the balance
+    TransactionID   *int            `json:"transaction_id,omitempty" db:"transaction_id"`   // The transaction of the entry, nil for opening balances
+    TransactionType string          `json:"transaction_type,omitempty" db:"transaction_type"` // The type of the transaction, such as deposit or transfer
+    Description     string          `json:"description" db:"description"`                   // What the entry books, such as deposit, fee or refund
+    Amount          decimal.Decimal `json:"amount" db:"amount"`                             // The signed change of the balance, negative for money leaving the wallet
+    Balance         decimal.Decimal `json:"balance" db:"-"`                                 // The running balance after the entry
+    CreatedAt       time.Time       `json:"created_at" db:"created_at"`                     // When the entry was posted
+}
@@ -10,16 +10,53 @@ import (
 
 // Transaction represents a financial transaction between users,
 // including details such as the transaction ID, type, amount, status,
-// and payment method. It supports deposit, withdrawal, and transfer types.
+// and payment method. It supports deposit, withdrawal, transfer, capture, refund and adjustment types.
 type Transaction struct {
     ID               int             `json:"id" db:"id"`                                // Transaction ID
     FromUserID       int             `json:"from_user_id" db:"from_user_id"`            // The user ID of the transaction initiator
     ToUserID         int             `json:"to_user_id,omitempty" db:"to_user_id"`      // The user ID of the transaction recipient, 0 for deposits and withdrawals, used only for transfers
-    Amount           decimal.Decimal `json:"amount" db:"amount"`                        // The transaction amount
+    Amount           decimal.Decimal `json:"amount" db:"amount"`                        // The transaction amount, negative for adjustments debiting the wallet
+    Currency         string          `json:"currency" db:"currency"`                    // The ISO 4217 currency of the amount
     TransactionType  string          `json:"transaction_type" db:"transaction_type"`    // The transaction type, such as deposit, withdraw, transfer
-    TransactionStatus string         `json:"transaction_status" db:"transaction_status"` // The transaction status, such as completed, failed
-    TransactionFee   decimal.Decimal `json:"transaction_fee,omitempty" db:"transaction_fee"` // The transaction fee, currently set to 0.0, with potential for future expansion
-    PaymentMethod    string          `json:"payment_method" db:"payment_method"`        // The payment method, such as credit_card, bank_transfer, paypal, etc.
+    TransactionStatus string         `json:"transaction_status" db:"transaction_status"` // The transaction status, one of the TransactionStatus constants
+    TransactionFee   decimal.Decimal `json:"transaction_fee,omitempty" db:"transaction_fee"` // The fee charged on top of the amount, or deducted from it for deposits, see service.FeeSchedule
+    PaymentMethod    string          `json:"payment_method" db:"payment_method"`        // The payment method, such as credit_card, bank_transfer, paypal, or wallet for transfers
+    PaymentMetadata  *PaymentMetadata `json:"payment_metadata,omitempty" db:"payment_metadata"` // The masked payment instrument of a deposit or withdrawal, nil if none was given
+    IdempotencyKey   string          `json:"-" db:"idempotency_key"`                    // The client supplied Idempotency-Key header, empty if none was sent
+    RequestHash      string          `json:"-" db:"request_hash"`                       // The fingerprint of the request payload the idempotency key was first used with
+    FailureReason    string          `json:"failure_reason,omitempty" db:"failure_reason"` // Why a failed transaction was rejected, such as insufficient_balance, empty otherwise
+    TargetAmount     *decimal.Decimal `json:"target_amount,omitempty" db:"target_amount"` // The amount credited to the recipient of a cross-currency transfer, nil otherwise
+    TargetCurrency   string          `json:"target_currency,omitempty" db:"target_currency"` // The ISO 4217 currency credited to the recipient of a cross-currency transfer
+    FXRate           *decimal.Decimal `json:"fx_rate,omitempty" db:"fx_rate"`            // The conversion rate of a cross-currency transfer, units of the target currency per unit of Currency
+    FXQuoteID        *int            `json:"fx_quote_id,omitempty" db:"fx_quote_id"`     // The FX quote executed by a cross-currency transfer
+    RefundOf         *int            `json:"refund_of,omitempty" db:"refund_of"`         // The transaction a refund gives money back for, nil for other transactions
+    RefundedAmount   decimal.Decimal `json:"refunded_amount" db:"refunded_amount"`       // The total refunded so far by the refunds of this transaction
     CreatedAt        time.Time       `json:"created_at" db:"created_at"`                // Creation time
     UpdatedAt        time.Time       `json:"updated_at" db:"updated_at"`                // Update time
 }
+
+// Transaction statuses. Deposits and transfers are completed or failed right away. A withdrawal paid out through
+// a method that settles asynchronously starts pending, with its funds held, and is settled later:
+//
+//    pending -> processing -> completed -> reversed
+//       |           |
+//       |           +-------> failed
+//       +-> cancelled, failed
+const (
+    TransactionStatusPending    = "pending"    // Accepted, the funds are held until the payout settles
+    TransactionStatusProcessing = "processing" // Handed over to the payment provider, the funds stay held
+    TransactionStatusCompleted  = "completed"  // Settled, the money has left or entered the wallet
+    TransactionStatusFailed     = "failed"     // Rejected, or the payout failed to settle and the held funds were released
+    TransactionStatusReversed   = "reversed"   // A completed payout was returned and the money credited back
+    TransactionStatusCancelled  = "cancelled"  // Withdrawn before it was processed, the held funds were released
+)
+
+// Machine-readable reasons recorded on failed transactions.
+const (
+    FailureReasonInsufficientBalance = "insufficient_balance" // The payer's balance does not cover the amount
+    FailureReasonUnknownRecipient    = "unknown_recipient"    // The receiving user of a transfer does not exist
+    FailureReasonAccountSuspended    = "account_suspended"    // The paying account is suspended and cannot send money
+    FailureReasonAccountInactive     = "account_inactive"     // The receiving account is inactive and cannot receive money
+    FailureReasonSettlementFailed    = "settlement_failed"    // The payment provider did not settle the payout
+    FailureReasonLimitExceeded       = "limit_exceeded"       // The movement exceeds a transaction limit of the payer's KYC tier
+)
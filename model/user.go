@@ -1,21 +1,44 @@
 // Package model contains the data structures and functions related to users in the wallet system.
-// It includes the User struct and methods for managing user-related operations such as balance, status, and contact information.
+// It includes the User struct and methods for managing user-related operations such as status and contact information.
 package model
 
 import (
     "time"
-    "github.com/shopspring/decimal"
 )
 
-// User represents a system user with personal details such as name, email, phone, balance, and account status.
-// It also contains timestamps for creation and last update.
+// User represents a system user with personal details such as name, email, phone, and account status.
+// It also contains timestamps for creation and last update. The user's balances are held in their wallets.
 type User struct {
-    ID        int             `json:"id" db:"id"`                   // User ID
-    Name      string          `json:"name" db:"name"`               // User name
-    Email     string          `json:"email" db:"email"`             // User email
-    Phone     string          `json:"phone" db:"phone"`             // User Phone
-    Balance   decimal.Decimal `json:"balance" db:"balance"`         // User balance
-    CreatedAt time.Time       `json:"created_at" db:"created_at"`   // Creation time
-    UpdatedAt time.Time       `json:"updated_at" db:"updated_at"`   // Update time
-    Status    string          `json:"status" db:"status"`           // User status, such as active, inactive, suspended
-}
\ No newline at end of file
+    ID        int       `json:"id" db:"id"`                 // User ID
+    Name      string    `json:"name" db:"name"`             // User name
+    Email     string    `json:"email" db:"email"`           // User email
+    Phone     string    `json:"phone" db:"phone"`           // User Phone
+    CreatedAt time.Time `json:"created_at" db:"created_at"` // Creation time
+    UpdatedAt time.Time `json:"updated_at" db:"updated_at"` // Update time
+    Status    string    `json:"status" db:"status"`         // User status, such as active, inactive, suspended
+    KYCTier   string    `json:"kyc_tier" db:"kyc_tier"`     // How far the user's identity has been verified, one of the KYCTier constants
+}
+// User statuses. Suspended users cannot send money, inactive users cannot receive money.
+const (
+    UserStatusActive    = "active"
+    UserStatusInactive  = "inactive"
+    UserStatusSuspended = "suspended"
+)
+
+// KYC tiers. The tier of a user selects the transaction limits that apply to them, see service.LimitSchedule.
+const (
+    KYCTierBasic    = "basic"    // Signed up, identity not verified yet
+    KYCTierVerified = "verified" // Identity verified
+    KYCTierPremium  = "premium"  // Identity and source of funds verified
+)
+
+// StatusChange is an audit record of an administrator changing the status of a user account.
+type StatusChange struct {
+    ID        int       `json:"id" db:"id"`                 // Status change ID
+    UserID    int       `json:"user_id" db:"user_id"`       // The user whose status was changed
+    OldStatus string    `json:"old_status" db:"old_status"` // The status before the change
+    NewStatus string    `json:"new_status" db:"new_status"` // The status after the change
+    Reason    string    `json:"reason" db:"reason"`         // Why the status was changed
+    ChangedBy string    `json:"changed_by" db:"changed_by"` // Who changed the status, empty if unknown
+    CreatedAt time.Time `json:"created_at" db:"created_at"` // When the status was changed
+}
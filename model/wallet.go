@@ -0,0 +1,26 @@
+package model
+
+import (
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+// Wallet holds the balance of a user in a single currency. A user has at most one wallet per currency.
+type Wallet struct {
+    ID         int             `json:"id" db:"id"`                 // Wallet ID
+    UserID     int             `json:"user_id" db:"user_id"`       // The owning user
+    Currency   string          `json:"currency" db:"currency"`     // The ISO 4217 currency code, such as USD or JPY
+    Balance    decimal.Decimal `json:"balance" db:"balance"`       // The wallet balance
+    Held       decimal.Decimal `json:"-" db:"held"`                // The part of the balance held for pending withdrawals
+    Version    int64           `json:"-" db:"version"`             // Incremented on every balance update, used for optimistic concurrency control
+    UserStatus string          `json:"-" db:"user_status"`         // The status of the owning user, loaded together with the balance
+    UserTier   string          `json:"-" db:"user_tier"`           // The KYC tier of the owning user, loaded together with the balance
+    CreatedAt  time.Time       `json:"created_at" db:"created_at"` // Creation time
+    UpdatedAt  time.Time       `json:"updated_at" db:"updated_at"` // Update time
+}
+
+// Available returns the part of the balance that is not held and can be spent.
+func (w *Wallet) Available() decimal.Decimal {
+    return w.Balance.Sub(w.Held)
+}
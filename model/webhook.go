@@ -0,0 +1,55 @@
+package model
+
+import (
+    "encoding/json"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// WebhookEventTypes are the domain events merchants can receive through webhooks.
+var WebhookEventTypes = []string{TransactionEventType(TransactionStatusCompleted), TransactionEventType(TransactionStatusFailed), EventBalanceChanged}
+
+// Webhook endpoint statuses.
+const (
+    WebhookEndpointActive   = "active"   // Receives the events it subscribed to
+    WebhookEndpointDisabled = "disabled" // Disabled by its user, receives no further events
+)
+
+// Webhook delivery statuses. A pending delivery is attempted until the endpoint acknowledges it, with a growing delay
+// between attempts; once every attempt has failed it is dead, and only delivered again if it is retried by hand.
+const (
+    WebhookDeliveryPending   = "pending"   // Waiting for its next attempt
+    WebhookDeliverySucceeded = "succeeded" // Acknowledged by the endpoint with a 2xx response
+    WebhookDeliveryDead      = "dead"      // Every attempt failed, dead-lettered until it is retried by hand
+)
+
+// WebhookEndpoint is a URL a user, such as a merchant, receives the events of their wallets at. The events are posted
+// as JSON and signed with the secret of the endpoint, which is only handed out when the endpoint is registered.
+type WebhookEndpoint struct {
+    ID         int            `json:"id" db:"id"`                   // Endpoint ID
+    UserID     int            `json:"user_id" db:"user_id"`         // The user whose events are posted
+    URL        string         `json:"url" db:"url"`                 // The https URL the events are posted to
+    Secret     string         `json:"-" db:"secret"`                // The key of the HMAC-SHA256 signature of every request
+    EventTypes pq.StringArray `json:"event_types" db:"event_types"` // The events posted, some of WebhookEventTypes
+    Status     string         `json:"status" db:"status"`           // One of the WebhookEndpoint constants
+    CreatedAt  time.Time      `json:"created_at" db:"created_at"`   // Creation time
+    UpdatedAt  time.Time      `json:"updated_at" db:"updated_at"`   // Update time
+}
+
+// WebhookDelivery is the delivery of one event to one webhook endpoint, and the log of its attempts.
+type WebhookDelivery struct {
+    ID             int64           `json:"id" db:"id"`                                         // Delivery ID
+    EndpointID     int             `json:"endpoint_id" db:"endpoint_id"`                       // The endpoint the event is posted to
+    EventID        int64           `json:"event_id" db:"event_id"`                             // The outbox event delivered
+    EventType      string          `json:"event_type" db:"event_type"`                         // Such as transaction.completed
+    Payload        json.RawMessage `json:"payload" db:"payload"`                               // The JSON body posted to the endpoint
+    Status         string          `json:"status" db:"status"`                                 // One of the WebhookDelivery constants
+    Attempts       int             `json:"attempts" db:"attempts"`                             // The number of attempts so far
+    NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty" db:"next_attempt_at"`     // When a pending delivery is attempted next
+    LastStatusCode *int            `json:"last_status_code,omitempty" db:"last_status_code"`   // The HTTP status of the last attempt, nil if it got no response
+    LastError      string          `json:"last_error,omitempty" db:"last_error"`               // Why the last attempt failed
+    DeliveredAt    *time.Time      `json:"delivered_at,omitempty" db:"delivered_at"`           // When the endpoint acknowledged the event
+    CreatedAt      time.Time       `json:"created_at" db:"created_at"`                         // Creation time
+    UpdatedAt      time.Time       `json:"updated_at" db:"updated_at"`                         // Update time
+}
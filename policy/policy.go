@@ -0,0 +1,200 @@
+// Package policy decides what the callers of the wallet service may do. It sits between the handlers, which know who
+// is calling, and the services, which move the money: the roles of a caller are resolved into permissions from the
+// roles, permissions and role grants stored in the database, and the permissions are checked against each operation.
+package policy
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+)
+
+// scopePermissions are the permissions granted by the scopes of API keys that are not roles themselves.
+// The admin scope is the admin role, and grants its permissions.
+var scopePermissions = map[string][]string{
+    model.ScopeReadBalance: {model.PermissionWalletReadAny},
+    model.ScopeDeposit:     {model.PermissionWalletMoveAny},
+    model.ScopeWithdraw:    {model.PermissionWalletMoveAny},
+    model.ScopeTransfer:    {model.PermissionWalletMoveAny},
+}
+
+// Enforcer resolves the permissions of callers from the roles stored in the database.
+// The roles and their permissions change rarely and are cached for the cache TTL; the roles granted to a user are read
+// on every request, so that revoking a role takes effect right away.
+type Enforcer struct {
+    roleRepo *repository.RoleRepository
+    dbConn   *sqlx.DB
+    ttl      time.Duration
+
+    mu       sync.Mutex
+    roles    map[string]model.Role
+    loadedAt time.Time
+}
+
+// NewEnforcer creates a new instance of Enforcer, reloading the roles from the database after the cache TTL.
+func NewEnforcer(dbConn *sqlx.DB, ttl time.Duration) *Enforcer {
+    return &Enforcer{
+        roleRepo: repository.NewRoleRepository(dbConn),
+        dbConn:   dbConn,
+        ttl:      ttl,
+    }
+}
+
+// Resolve fills in the roles, the permissions and the refund limit of the caller. A user has the customer role, the roles
+// granted to them in the database and the roles their credentials carry, such as the admin scope of a token. A backend
+// service has the scopes of its API key. The refund limit is the highest limit of the roles allowed to refund.
+func (e *Enforcer) Resolve(ctx context.Context, caller model.Caller) (model.Caller, error) {
+    roles, err := e.loadRoles(ctx)
+    if err != nil {
+        return caller, err
+    }
+
+    names := caller.Roles
+    if !caller.IsService() {
+        granted, err := e.roleRepo.GetUserRoles(ctx, e.dbConn, caller.UserID)
+        if err != nil {
+            return caller, err
+        }
+        names = union([]string{model.RoleCustomer}, caller.Roles, granted)
+    }
+
+    var permissions []string
+    var refundLimit *decimal.Decimal
+    unlimitedRefunds := false
+    for _, name := range names {
+        permissions = union(permissions, scopePermissions[name])
+
+        role, ok := roles[name]
+        if !ok {
+            continue
+        }
+        permissions = union(permissions, role.Permissions)
+        if contains(role.Permissions, model.PermissionTransactionRefund) {
+            if role.RefundLimit == nil {
+                unlimitedRefunds = true
+            } else if refundLimit == nil || role.RefundLimit.GreaterThan(*refundLimit) {
+                refundLimit = role.RefundLimit
+            }
+        }
+    }
+    sort.Strings(permissions)
+
+    caller.Roles = names
+    caller.Permissions = permissions
+    caller.RefundLimit = refundLimit
+    if unlimitedRefunds {
+        caller.RefundLimit = nil
+    }
+    return caller, nil
+}
+
+// Roles returns every role with its permissions, ordered by name.
+func (e *Enforcer) Roles(ctx context.Context) ([]model.Role, error) {
+    return e.roleRepo.GetRoles(ctx, e.dbConn)
+}
+
+// UserRoles returns the names of the roles granted to the user, ordered by name.
+func (e *Enforcer) UserRoles(ctx context.Context, userID int) ([]string, error) {
+    return e.roleRepo.GetUserRoles(ctx, e.dbConn, userID)
+}
+
+// SetUserRoles replaces the roles granted to the user in one database transaction, and returns them ordered by name.
+// It returns repository.ErrRoleNotFound if one of the roles does not exist, and repository.ErrUserNotFound if the user
+// does not exist.
+func (e *Enforcer) SetUserRoles(ctx context.Context, userID int, roles []string) ([]string, error) {
+    roles = union(roles)
+    sort.Strings(roles)
+
+    tx, err := e.dbConn.Beginx()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    if err := e.roleRepo.SetUserRoles(ctx, tx, userID, roles); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+    if roles == nil {
+        roles = []string{}
+    }
+    return roles, nil
+}
+
+// Invalidate drops the cached roles, so that changed permissions are read again on the next request.
+func (e *Enforcer) Invalidate() {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.roles = nil
+}
+
+// loadRoles returns the roles by name, from the cache while it is fresh.
+func (e *Enforcer) loadRoles(ctx context.Context) (map[string]model.Role, error) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    if e.roles != nil && time.Since(e.loadedAt) < e.ttl {
+        return e.roles, nil
+    }
+
+    roles, err := e.roleRepo.GetRoles(ctx, e.dbConn)
+    if err != nil {
+        return nil, err
+    }
+    e.roles = make(map[string]model.Role, len(roles))
+    for _, role := range roles {
+        e.roles[role.Name] = role
+    }
+    e.loadedAt = time.Now()
+    return e.roles, nil
+}
+
+// CanActOn reports whether the caller may act on the user's wallet or account: on itself with the own permission,
+// and on every user with the any permission.
+func CanActOn(caller model.Caller, userID int, own, any string) bool {
+    if caller.HasPermission(any) {
+        return true
+    }
+    return caller.UserID != 0 && caller.UserID == userID && caller.HasPermission(own)
+}
+
+// HasAnyPermission reports whether the caller was granted at least one of the permissions.
+func HasAnyPermission(caller model.Caller, permissions ...string) bool {
+    for _, permission := range permissions {
+        if caller.HasPermission(permission) {
+            return true
+        }
+    }
+    return false
+}
+
+// union returns the values of all lists, each once, in the order they first appear.
+func union(lists ...[]string) []string {
+    var values []string
+    for _, list := range lists {
+        for _, value := range list {
+            if !contains(values, value) {
+                values = append(values, value)
+            }
+        }
+    }
+    return values
+}
+
+// contains reports whether the value is one of the values.
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
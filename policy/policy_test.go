@@ -0,0 +1,73 @@
+package policy
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// expectRoles expects the seeded roles to be read
+func expectRoles(mock sqlmock.Sqlmock) {
+    mock.ExpectQuery("SELECT (.+) FROM roles r LEFT JOIN role_permissions").
+        WillReturnRows(sqlmock.NewRows([]string{"name", "description", "refund_limit", "permissions"}).
+            AddRow("admin", "Administrators", nil, "{access:manage,balance:adjust,transaction:refund,wallet:move:any,wallet:read:any}").
+            AddRow("customer", "Customers", nil, "{wallet:move:own,wallet:read:own}").
+            AddRow("support", "Support agents", decimal.NewFromInt(100), "{transaction:refund,wallet:read:any}"))
+}
+
+// Test that users get the customer role and the roles granted to them, and services the permissions of their scopes
+func TestEnforcer_Resolve(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    enforcer := NewEnforcer(sqlx.NewDb(db, "sqlmock"), time.Minute)
+
+    // A customer may only use their own wallet
+    expectRoles(mock)
+    mock.ExpectQuery("SELECT role FROM user_roles WHERE user_id = \\$1").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}))
+
+    customer, err := enforcer.Resolve(context.Background(), model.Caller{UserID: 1})
+    require.NoError(t, err)
+    require.Equal(t, []string{model.RoleCustomer}, customer.Roles)
+    require.True(t, CanActOn(customer, 1, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny))
+    require.False(t, CanActOn(customer, 2, model.PermissionWalletReadOwn, model.PermissionWalletReadAny))
+    require.False(t, HasAnyPermission(customer, model.PermissionTransactionRefund))
+
+    // A support agent may read every wallet and refund up to the limit of the role, the roles are cached by now
+    mock.ExpectQuery("SELECT role FROM user_roles WHERE user_id = \\$1").WithArgs(2).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("support"))
+
+    agent, err := enforcer.Resolve(context.Background(), model.Caller{UserID: 2})
+    require.NoError(t, err)
+    require.True(t, CanActOn(agent, 1, model.PermissionWalletReadOwn, model.PermissionWalletReadAny))
+    require.False(t, CanActOn(agent, 1, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny))
+    require.Equal(t, "100", agent.RefundLimit.String())
+
+    // An administrator, here by the scope of their token, refunds without a limit and may adjust balances
+    mock.ExpectQuery("SELECT role FROM user_roles WHERE user_id = \\$1").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("support"))
+
+    admin, err := enforcer.Resolve(context.Background(), model.Caller{UserID: 3, Roles: []string{model.RoleAdmin}})
+    require.NoError(t, err)
+    require.Nil(t, admin.RefundLimit)
+    require.True(t, HasAnyPermission(admin, model.PermissionBalanceAdjust))
+
+    // A backend service only gets the permissions of its scopes, and the roles are read again once the cache expired
+    enforcer.Invalidate()
+    expectRoles(mock)
+
+    service, err := enforcer.Resolve(context.Background(), model.Caller{APIKeyID: 4, Roles: []string{model.ScopeReadBalance}})
+    require.NoError(t, err)
+    require.Equal(t, []string{model.PermissionWalletReadAny}, service.Permissions)
+    require.False(t, CanActOn(service, 1, model.PermissionWalletMoveOwn, model.PermissionWalletMoveAny))
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
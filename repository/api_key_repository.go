@@ -0,0 +1,123 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrAPIKeyNotFound is returned when the requested API key does not exist.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// apiKeyColumns are the columns an API key is read from.
+const apiKeyColumns = "id, name, key_prefix, key_hash, scopes, expires_at, revoked_at, rotated_from, last_used_at, created_at, updated_at"
+
+// APIKeyRepository provides database operations related to API keys
+type APIKeyRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewAPIKeyRepository creates a new instance of APIKeyRepository
+func NewAPIKeyRepository(db *sqlx.DB) *APIKeyRepository {
+    logger := utils.GetLogger()
+    return &APIKeyRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// CreateAPIKey stores a new API key and fills in its generated ID and timestamps.
+func (r *APIKeyRepository) CreateAPIKey(ctx context.Context, exec Executor, key *model.APIKey) error {
+    query := `
+        INSERT INTO api_keys (name, key_prefix, key_hash, scopes, expires_at, rotated_from, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+        RETURNING id, created_at, updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, key.Name, key.Prefix, key.KeyHash, key.Scopes, key.ExpiresAt, key.RotatedFrom).
+        Scan(&key.ID, &key.CreatedAt, &key.UpdatedAt)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to create API key %s", key.Name), err)
+        return fmt.Errorf("failed to create API key %s: %w", key.Name, err)
+    }
+    return nil
+}
+
+// GetAPIKey retrieves the API key with the given ID, returning ErrAPIKeyNotFound if it does not exist.
+func (r *APIKeyRepository) GetAPIKey(ctx context.Context, exec Executor, keyID int) (*model.APIKey, error) {
+    query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE id = $1"
+    return r.getAPIKey(ctx, exec, query, keyID)
+}
+
+// LockAPIKey retrieves the API key like GetAPIKey, and locks it until the end of the transaction exec belongs to.
+func (r *APIKeyRepository) LockAPIKey(ctx context.Context, exec Executor, keyID int) (*model.APIKey, error) {
+    query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE id = $1 FOR UPDATE"
+    return r.getAPIKey(ctx, exec, query, keyID)
+}
+
+// GetAPIKeyByPrefix retrieves the API key with the given prefix, returning ErrAPIKeyNotFound if there is none.
+func (r *APIKeyRepository) GetAPIKeyByPrefix(ctx context.Context, exec Executor, prefix string) (*model.APIKey, error) {
+    query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE key_prefix = $1"
+    return r.getAPIKey(ctx, exec, query, prefix)
+}
+
+func (r *APIKeyRepository) getAPIKey(ctx context.Context, exec Executor, query string, arg interface{}) (*model.APIKey, error) {
+    var key model.APIKey
+    err := exec.GetContext(ctx, &key, query, arg)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %v", ErrAPIKeyNotFound, arg)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting API key %v", arg), err)
+        return nil, fmt.Errorf("failed to fetch API key %v: %w", arg, err)
+    }
+    return &key, nil
+}
+
+// RevokeAPIKey marks the API key as revoked at the given time, after which it no longer authenticates requests.
+func (r *APIKeyRepository) RevokeAPIKey(ctx context.Context, exec Executor, keyID int, at time.Time) error {
+    query := `
+        UPDATE api_keys
+        SET revoked_at = $2, updated_at = NOW()
+        WHERE id = $1
+    `
+
+    if _, err := exec.ExecContext(ctx, query, keyID, at); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to revoke API key %d", keyID), err)
+        return fmt.Errorf("failed to revoke API key %d: %w", keyID, err)
+    }
+    return nil
+}
+
+// ExpireAPIKey sets when the API key stops authenticating requests, such as the end of the grace period of a rotated key.
+func (r *APIKeyRepository) ExpireAPIKey(ctx context.Context, exec Executor, keyID int, at time.Time) error {
+    query := `
+        UPDATE api_keys
+        SET expires_at = $2, updated_at = NOW()
+        WHERE id = $1
+    `
+
+    if _, err := exec.ExecContext(ctx, query, keyID, at); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to set the expiry of API key %d", keyID), err)
+        return fmt.Errorf("failed to set the expiry of API key %d: %w", keyID, err)
+    }
+    return nil
+}
+
+// TouchAPIKey records that the API key has just authenticated a request.
+func (r *APIKeyRepository) TouchAPIKey(ctx context.Context, exec Executor, keyID int) error {
+    query := "UPDATE api_keys SET last_used_at = NOW() WHERE id = $1"
+
+    if _, err := exec.ExecContext(ctx, query, keyID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to record the use of API key %d", keyID), err)
+        return fmt.Errorf("failed to record the use of API key %d: %w", keyID, err)
+    }
+    return nil
+}
@@ -0,0 +1,158 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrBatchNotFound is returned when the requested transfer batch does not exist.
+var ErrBatchNotFound = errors.New("transfer batch not found")
+
+// batchColumns are the columns a transfer batch is read from.
+const batchColumns = "id, from_user_id, currency, mode, status, total_amount, item_count, succeeded_count, failed_count, COALESCE(idempotency_key, '') AS idempotency_key, COALESCE(request_hash, '') AS request_hash, created_at, updated_at"
+
+// BatchRepository provides database operations related to transfer batches and their items
+type BatchRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewBatchRepository creates a new instance of BatchRepository
+func NewBatchRepository(db *sqlx.DB) *BatchRepository {
+    logger := utils.GetLogger()
+    return &BatchRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// CreateBatch stores a new transfer batch together with its items, and fills in the generated ID and timestamps.
+// Call it inside a transaction, so a batch is never stored without its items. It returns ErrDuplicateIdempotencyKey
+// if another batch was already stored with the idempotency key, and ErrUserNotFound if the paying user does not exist.
+func (r *BatchRepository) CreateBatch(ctx context.Context, exec Executor, batch *model.TransferBatch) error {
+    query := `
+        INSERT INTO transfer_batches (from_user_id, currency, mode, status, total_amount, item_count, succeeded_count, failed_count, idempotency_key, request_hash, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
+        RETURNING id, created_at, updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, batch.FromUserID, batch.Currency, batch.Mode, batch.Status, batch.TotalAmount, batch.ItemCount,
+        batch.SucceededCount, batch.FailedCount, nullString(batch.IdempotencyKey), nullString(batch.RequestHash)).
+        Scan(&batch.ID, &batch.CreatedAt, &batch.UpdatedAt)
+    if err != nil {
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+            return ErrDuplicateIdempotencyKey
+        }
+        if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+            return fmt.Errorf("%w: %d", ErrUserNotFound, batch.FromUserID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to create transfer batch for user %d", batch.FromUserID), err)
+        return fmt.Errorf("failed to create transfer batch for user %d: %w", batch.FromUserID, err)
+    }
+
+    itemQuery := `
+        INSERT INTO transfer_batch_items (batch_id, position, to_user_id, amount, fee, reference, status)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `
+    for i := range batch.Items {
+        item := &batch.Items[i]
+        item.BatchID = batch.ID
+        if _, err := exec.ExecContext(ctx, itemQuery, item.BatchID, item.Position, item.ToUserID, item.Amount, item.Fee, item.Reference, item.Status); err != nil {
+            r.Logger.Error(fmt.Sprintf("Failed to create item %d of transfer batch %d", item.Position, batch.ID), err)
+            return fmt.Errorf("failed to create item %d of transfer batch %d: %w", item.Position, batch.ID, err)
+        }
+    }
+    return nil
+}
+
+// GetBatch retrieves the transfer batch with the given ID together with its items,
+// returning ErrBatchNotFound if it does not exist.
+func (r *BatchRepository) GetBatch(ctx context.Context, exec Executor, batchID int) (*model.TransferBatch, error) {
+    var batch model.TransferBatch
+
+    query := "SELECT " + batchColumns + " FROM transfer_batches WHERE id = $1"
+
+    err := exec.GetContext(ctx, &batch, query, batchID)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrBatchNotFound, batchID)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting transfer batch %d", batchID), err)
+        return nil, fmt.Errorf("failed to fetch transfer batch %d: %w", batchID, err)
+    }
+    return r.withItems(ctx, exec, &batch)
+}
+
+// GetBatchByIdempotencyKey retrieves the transfer batch the paying user previously stored with the given idempotency key,
+// together with its items. It returns nil without an error if the user has not stored a batch with the key yet.
+func (r *BatchRepository) GetBatchByIdempotencyKey(ctx context.Context, exec Executor, fromUserID int, key string) (*model.TransferBatch, error) {
+    var batch model.TransferBatch
+
+    query := "SELECT " + batchColumns + " FROM transfer_batches WHERE from_user_id = $1 AND idempotency_key = $2"
+
+    err := exec.GetContext(ctx, &batch, query, fromUserID, key)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        r.Logger.Error("Error getting transfer batch by idempotency key", err)
+        return nil, fmt.Errorf("failed to fetch transfer batch by idempotency key: %w", err)
+    }
+    return r.withItems(ctx, exec, &batch)
+}
+
+// withItems reads the items of the batch in request order.
+func (r *BatchRepository) withItems(ctx context.Context, exec Executor, batch *model.TransferBatch) (*model.TransferBatch, error) {
+    batch.Items = []model.TransferBatchItem{}
+
+    query := `
+        SELECT batch_id, position, to_user_id, amount, fee, reference, status, transaction_id, failure_reason, error
+        FROM transfer_batch_items
+        WHERE batch_id = $1
+        ORDER BY position
+    `
+
+    if err := exec.SelectContext(ctx, &batch.Items, query, batch.ID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting items of transfer batch %d", batch.ID), err)
+        return nil, fmt.Errorf("failed to fetch items of transfer batch %d: %w", batch.ID, err)
+    }
+    return batch, nil
+}
+
+// UpdateBatchItem stores the result of a transfer batch item: its status, transaction, failure reason and error.
+func (r *BatchRepository) UpdateBatchItem(ctx context.Context, exec Executor, item *model.TransferBatchItem) error {
+    query := `
+        UPDATE transfer_batch_items
+        SET status = $3, transaction_id = $4, failure_reason = $5, error = $6
+        WHERE batch_id = $1 AND position = $2
+    `
+
+    if _, err := exec.ExecContext(ctx, query, item.BatchID, item.Position, item.Status, item.TransactionID, item.FailureReason, item.Error); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to update item %d of transfer batch %d", item.Position, item.BatchID), err)
+        return fmt.Errorf("failed to update item %d of transfer batch %d: %w", item.Position, item.BatchID, err)
+    }
+    return nil
+}
+
+// UpdateBatch stores the progress of a transfer batch: its status and the number of items that succeeded and failed.
+func (r *BatchRepository) UpdateBatch(ctx context.Context, exec Executor, batch *model.TransferBatch) error {
+    query := `
+        UPDATE transfer_batches
+        SET status = $2, succeeded_count = $3, failed_count = $4, updated_at = NOW()
+        WHERE id = $1
+    `
+
+    if _, err := exec.ExecContext(ctx, query, batch.ID, batch.Status, batch.SucceededCount, batch.FailedCount); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to update transfer batch %d", batch.ID), err)
+        return fmt.Errorf("failed to update transfer batch %d: %w", batch.ID, err)
+    }
+    return nil
+}
@@ -0,0 +1,20 @@
+package repository
+
+import (
+    "context"
+    "github.com/jmoiron/sqlx"
+)
+
+// Executor runs queries either directly on the database pool or inside a database transaction.
+// Both *sqlx.DB and *sqlx.Tx implement it, so callers decide whether a repository call takes
+// part in their transaction, and row locks taken with SELECT ... FOR UPDATE are held until it ends.
+type Executor interface {
+    sqlx.ExtContext
+    GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+    SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+var (
+    _ Executor = (*sqlx.DB)(nil)
+    _ Executor = (*sqlx.Tx)(nil)
+)
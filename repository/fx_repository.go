@@ -0,0 +1,101 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrQuoteNotFound is returned when the requested FX quote does not exist.
+var ErrQuoteNotFound = errors.New("fx quote not found")
+
+// ErrQuoteUsed is returned when an FX quote is executed a second time.
+var ErrQuoteUsed = errors.New("fx quote has already been used")
+
+// FXRepository provides database operations related to FX quotes
+type FXRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewFXRepository creates a new instance of FXRepository
+func NewFXRepository(db *sqlx.DB) *FXRepository {
+    logger := utils.GetLogger()
+    return &FXRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// CreateQuote stores a new FX quote and fills in its generated ID and creation time.
+func (r *FXRepository) CreateQuote(ctx context.Context, exec Executor, quote *model.FXQuote) error {
+    query := `
+        INSERT INTO fx_quotes (user_id, source_currency, target_currency, source_amount, target_amount, rate, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+        RETURNING id, created_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, quote.UserID, quote.SourceCurrency, quote.TargetCurrency, quote.SourceAmount,
+        quote.TargetAmount, quote.Rate, quote.ExpiresAt).Scan(&quote.ID, &quote.CreatedAt)
+    if err != nil {
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+            return fmt.Errorf("%w: %d", ErrUserNotFound, quote.UserID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to create %s/%s quote for user %d", quote.SourceCurrency, quote.TargetCurrency, quote.UserID), err)
+        return fmt.Errorf("failed to create fx quote for user %d: %w", quote.UserID, err)
+    }
+    return nil
+}
+
+// GetQuote retrieves the FX quote with the given ID, returning ErrQuoteNotFound if it does not exist.
+func (r *FXRepository) GetQuote(ctx context.Context, exec Executor, quoteID int) (*model.FXQuote, error) {
+    var quote model.FXQuote
+
+    query := `
+        SELECT id, user_id, source_currency, target_currency, source_amount, target_amount, rate, expires_at, used_at, transaction_id, created_at
+        FROM fx_quotes
+        WHERE id = $1
+    `
+
+    err := exec.GetContext(ctx, &quote, query, quoteID)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrQuoteNotFound, quoteID)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting fx quote %d", quoteID), err)
+        return nil, fmt.Errorf("failed to fetch fx quote %d: %w", quoteID, err)
+    }
+    return &quote, nil
+}
+
+// MarkQuoteUsed links the FX quote to the transfer that executed it. The update only succeeds once per quote,
+// so a quote executed concurrently by two requests returns ErrQuoteUsed for the one that comes second.
+func (r *FXRepository) MarkQuoteUsed(ctx context.Context, exec Executor, quoteID, transactionID int) error {
+    query := `
+        UPDATE fx_quotes
+        SET used_at = NOW(), transaction_id = $2
+        WHERE id = $1 AND used_at IS NULL
+    `
+
+    result, err := exec.ExecContext(ctx, query, quoteID, transactionID)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to mark fx quote %d as used", quoteID), err)
+        return fmt.Errorf("failed to mark fx quote %d as used: %w", quoteID, err)
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to get affected rows: %w", err)
+    }
+    if rowsAffected == 0 {
+        return fmt.Errorf("%w: %d", ErrQuoteUsed, quoteID)
+    }
+    return nil
+}
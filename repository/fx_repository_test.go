@@ -0,0 +1,114 @@
+package repository
+
+import (
+    "context"
+    "testing"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/jmoiron/sqlx"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/lib/pq"
+    "time"
+)
+
+// Test that a quote is stored, and that a quote for an unknown user is reported as such
+func TestCreateQuote(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &FXRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    expiresAt := time.Now().Add(30 * time.Second)
+    mock.ExpectQuery("INSERT INTO fx_quotes").
+        WithArgs(1, "USD", "EUR", decimal.NewFromInt(100), decimal.NewFromInt(92), decimal.RequireFromString("0.92"), expiresAt).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+    mock.ExpectQuery("INSERT INTO fx_quotes").
+        WithArgs(99, "USD", "EUR", decimal.NewFromInt(100), decimal.NewFromInt(92), decimal.RequireFromString("0.92"), expiresAt).
+        WillReturnError(&pq.Error{Code: "23503"})
+
+    quote := &model.FXQuote{
+        UserID:         1,
+        SourceCurrency: "USD",
+        TargetCurrency: "EUR",
+        SourceAmount:   decimal.NewFromInt(100),
+        TargetAmount:   decimal.NewFromInt(92),
+        Rate:           decimal.RequireFromString("0.92"),
+        ExpiresAt:      expiresAt,
+    }
+    err = r.CreateQuote(context.Background(), r.DB, quote)
+    require.NoError(t, err)
+    require.Equal(t, 5, quote.ID)
+
+    quote.UserID = 99
+    err = r.CreateQuote(context.Background(), r.DB, quote)
+    require.ErrorIs(t, err, ErrUserNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a quote is read, and that an unknown quote is reported as such
+func TestGetQuote(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &FXRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    columns := []string{"id", "user_id", "source_currency", "target_currency", "source_amount", "target_amount", "rate", "expires_at", "used_at", "transaction_id", "created_at"}
+    mock.ExpectQuery("SELECT (.+) FROM fx_quotes WHERE id = \\$1").
+        WithArgs(5).
+        WillReturnRows(sqlmock.NewRows(columns).AddRow(5, 1, "USD", "EUR", "100", "92", "0.92", time.Now(), time.Now(), 7, time.Now()))
+    mock.ExpectQuery("SELECT (.+) FROM fx_quotes WHERE id = \\$1").
+        WithArgs(6).
+        WillReturnRows(sqlmock.NewRows(columns))
+
+    quote, err := r.GetQuote(context.Background(), r.DB, 5)
+    require.NoError(t, err)
+    require.Equal(t, "EUR", quote.TargetCurrency)
+    require.Equal(t, "0.92", quote.Rate.String())
+    require.NotNil(t, quote.UsedAt)
+    require.Equal(t, 7, *quote.TransactionID)
+
+    _, err = r.GetQuote(context.Background(), r.DB, 6)
+    require.ErrorIs(t, err, ErrQuoteNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a quote can only be marked as used once
+func TestMarkQuoteUsed(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &FXRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectExec("UPDATE fx_quotes SET used_at = NOW\\(\\), transaction_id = \\$2 WHERE id = \\$1 AND used_at IS NULL").
+        WithArgs(5, 7).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE fx_quotes SET used_at = NOW\\(\\), transaction_id = \\$2 WHERE id = \\$1 AND used_at IS NULL").
+        WithArgs(5, 8).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+
+    err = r.MarkQuoteUsed(context.Background(), r.DB, 5, 7)
+    require.NoError(t, err)
+
+    err = r.MarkQuoteUsed(context.Background(), r.DB, 5, 8)
+    require.ErrorIs(t, err, ErrQuoteUsed)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,121 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrHoldNotFound is returned when the requested hold does not exist.
+var ErrHoldNotFound = errors.New("hold not found")
+
+// HoldRepository provides database operations related to holds
+type HoldRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewHoldRepository creates a new instance of HoldRepository
+func NewHoldRepository(db *sqlx.DB) *HoldRepository {
+    logger := utils.GetLogger()
+    return &HoldRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// CreateHold stores a new active hold and fills in its generated ID and timestamps.
+func (r *HoldRepository) CreateHold(ctx context.Context, exec Executor, hold *model.Hold) error {
+    query := `
+        INSERT INTO holds (user_id, currency, amount, status, description, expires_at, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+        RETURNING id, created_at, updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, hold.UserID, hold.Currency, hold.Amount, hold.Status, hold.Description, hold.ExpiresAt).
+        Scan(&hold.ID, &hold.CreatedAt, &hold.UpdatedAt)
+    if err != nil {
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+            return fmt.Errorf("%w: %d", ErrUserNotFound, hold.UserID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to create %s hold for user %d", hold.Currency, hold.UserID), err)
+        return fmt.Errorf("failed to create hold for user %d: %w", hold.UserID, err)
+    }
+    return nil
+}
+
+// GetHold retrieves the hold with the given ID, returning ErrHoldNotFound if it does not exist.
+func (r *HoldRepository) GetHold(ctx context.Context, exec Executor, holdID int) (*model.Hold, error) {
+    query := `
+        SELECT id, user_id, currency, amount, captured_amount, status, description, expires_at, transaction_id, created_at, updated_at
+        FROM holds
+        WHERE id = $1
+    `
+    return r.getHold(ctx, exec, query, holdID)
+}
+
+// LockHold retrieves the hold like GetHold, and locks it until the end of the transaction exec belongs to.
+func (r *HoldRepository) LockHold(ctx context.Context, exec Executor, holdID int) (*model.Hold, error) {
+    query := `
+        SELECT id, user_id, currency, amount, captured_amount, status, description, expires_at, transaction_id, created_at, updated_at
+        FROM holds
+        WHERE id = $1
+        FOR UPDATE
+    `
+    return r.getHold(ctx, exec, query, holdID)
+}
+
+func (r *HoldRepository) getHold(ctx context.Context, exec Executor, query string, holdID int) (*model.Hold, error) {
+    var hold model.Hold
+    err := exec.GetContext(ctx, &hold, query, holdID)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrHoldNotFound, holdID)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting hold %d", holdID), err)
+        return nil, fmt.Errorf("failed to fetch hold %d: %w", holdID, err)
+    }
+    return &hold, nil
+}
+
+// CloseHold stores the final status of a hold, with the captured amount and the capture transaction if it was captured.
+func (r *HoldRepository) CloseHold(ctx context.Context, exec Executor, hold *model.Hold) error {
+    query := `
+        UPDATE holds
+        SET status = $2, captured_amount = $3, transaction_id = $4, updated_at = NOW()
+        WHERE id = $1
+    `
+
+    if _, err := exec.ExecContext(ctx, query, hold.ID, hold.Status, hold.CapturedAmount, hold.TransactionID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to close hold %d as %s", hold.ID, hold.Status), err)
+        return fmt.Errorf("failed to close hold %d: %w", hold.ID, err)
+    }
+    return nil
+}
+
+// GetExpiredHolds retrieves up to limit holds that are still active after their expiry, oldest expiry first.
+func (r *HoldRepository) GetExpiredHolds(ctx context.Context, exec Executor, now time.Time, limit int) ([]model.Hold, error) {
+    var holds []model.Hold
+
+    query := `
+        SELECT id, user_id, currency, amount, captured_amount, status, description, expires_at, transaction_id, created_at, updated_at
+        FROM holds
+        WHERE status = 'active' AND expires_at <= $1
+        ORDER BY expires_at
+        LIMIT $2
+    `
+
+    if err := exec.SelectContext(ctx, &holds, query, now, limit); err != nil {
+        r.Logger.Error("Error getting expired holds", err)
+        return nil, fmt.Errorf("failed to fetch expired holds: %w", err)
+    }
+    return holds, nil
+}
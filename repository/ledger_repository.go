@@ -0,0 +1,137 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/shopspring/decimal"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrUnbalancedJournalEntry is returned when the postings of a journal entry do not sum to zero in every currency.
+var ErrUnbalancedJournalEntry = errors.New("journal entry postings must sum to zero")
+
+// LedgerRepository provides database operations related to the double-entry ledger
+type LedgerRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewLedgerRepository creates a new instance of LedgerRepository
+func NewLedgerRepository(db *sqlx.DB) *LedgerRepository {
+    logger := utils.GetLogger()
+    return &LedgerRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// GetOrCreateAccount returns the ID of the ledger account with the given code, creating the account if it does not exist yet.
+// A userID of 0 creates an account that is not owned by any user.
+func (r *LedgerRepository) GetOrCreateAccount(ctx context.Context, exec Executor, code string, userID int, accountType, currency string) (int, error) {
+    query := `
+        INSERT INTO ledger_accounts (code, user_id, account_type, currency)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (code) DO UPDATE SET code = EXCLUDED.code
+        RETURNING id
+    `
+
+    var accountID int
+    err := exec.QueryRowxContext(ctx, query, code, sql.NullInt64{Int64: int64(userID), Valid: userID != 0}, accountType, currency).Scan(&accountID)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to get ledger account %s", code), err)
+        return 0, fmt.Errorf("failed to get ledger account %s: %w", code, err)
+    }
+    return accountID, nil
+}
+
+// PostJournalEntry records a journal entry together with its postings.
+// The postings must sum to zero in every currency, otherwise ErrUnbalancedJournalEntry is returned and nothing is written.
+func (r *LedgerRepository) PostJournalEntry(ctx context.Context, exec Executor, entry *model.JournalEntry) error {
+    if len(entry.Postings) < 2 {
+        return fmt.Errorf("journal entry needs at least two postings, got %d", len(entry.Postings))
+    }
+
+    totals := make(map[string]decimal.Decimal)
+    for _, posting := range entry.Postings {
+        if posting.Amount.IsZero() {
+            return fmt.Errorf("journal entry postings must not be zero")
+        }
+        totals[posting.Currency] = totals[posting.Currency].Add(posting.Amount)
+    }
+    for currency, total := range totals {
+        if !total.IsZero() {
+            return fmt.Errorf("%w: %s is off by %s", ErrUnbalancedJournalEntry, currency, total.String())
+        }
+    }
+
+    // Insert the journal entry itself
+    query := `
+        INSERT INTO journal_entries (transaction_id, description, created_at)
+        VALUES ($1, $2, NOW())
+        RETURNING id, created_at
+    `
+    transactionID := sql.NullInt64{Int64: int64(entry.TransactionID), Valid: entry.TransactionID != 0}
+    if err := exec.QueryRowxContext(ctx, query, transactionID, entry.Description).Scan(&entry.ID, &entry.CreatedAt); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to record journal entry for transaction %d", entry.TransactionID), err)
+        return fmt.Errorf("failed to record journal entry for transaction %d: %w", entry.TransactionID, err)
+    }
+
+    // Insert all postings of the entry with a single statement
+    values := make([]string, 0, len(entry.Postings))
+    args := make([]interface{}, 0, len(entry.Postings)*3)
+    for i := range entry.Postings {
+        entry.Postings[i].JournalEntryID = entry.ID
+        values = append(values, fmt.Sprintf("($%d, $%d, $%d)", i*3+1, i*3+2, i*3+3))
+        args = append(args, entry.ID, entry.Postings[i].AccountID, entry.Postings[i].Amount)
+    }
+    query = "INSERT INTO postings (journal_entry_id, account_id, amount) VALUES " + strings.Join(values, ", ")
+    if _, err := exec.ExecContext(ctx, query, args...); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to record postings for journal entry %d", entry.ID), err)
+        return fmt.Errorf("failed to record postings for journal entry %d: %w", entry.ID, err)
+    }
+
+    return nil
+}
+
+// GetAccountBalanceAt returns the balance the ledger account with the given code had at the given time,
+// the sum of the postings of the journal entries posted before it.
+func (r *LedgerRepository) GetAccountBalanceAt(ctx context.Context, code string, at time.Time) (decimal.Decimal, error) {
+    query := `
+        SELECT COALESCE(SUM(p.amount), 0)
+        FROM postings p
+        JOIN ledger_accounts a ON a.id = p.account_id
+        JOIN journal_entries je ON je.id = p.journal_entry_id
+        WHERE a.code = $1 AND je.created_at < $2
+    `
+
+    var balance decimal.Decimal
+    if err := r.DB.GetContext(ctx, &balance, query, code, at); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to get ledger balance for account %s at %s", code, at), err)
+        return decimal.Zero, fmt.Errorf("failed to get ledger balance for account %s: %w", code, err)
+    }
+    return balance, nil
+}
+
+// GetAccountBalance returns the balance of the ledger account with the given code, derived from the sum of its postings
+func (r *LedgerRepository) GetAccountBalance(ctx context.Context, code string) (decimal.Decimal, error) {
+    query := `
+        SELECT COALESCE(SUM(p.amount), 0)
+        FROM postings p
+        JOIN ledger_accounts a ON a.id = p.account_id
+        WHERE a.code = $1
+    `
+
+    var balance decimal.Decimal
+    if err := r.DB.GetContext(ctx, &balance, query, code); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to get ledger balance for account %s", code), err)
+        return decimal.Zero, fmt.Errorf("failed to get ledger balance for account %s: %w", code, err)
+    }
+    return balance, nil
+}
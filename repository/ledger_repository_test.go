@@ -0,0 +1,168 @@
+package repository
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/jmoiron/sqlx"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+func TestGetOrCreateAccount(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &LedgerRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectBegin()
+    // User accounts are linked to the user
+    mock.ExpectQuery("INSERT INTO ledger_accounts").
+        WithArgs("user:1:USD", 1, "user", "USD").
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+    // System accounts have no user
+    mock.ExpectQuery("INSERT INTO ledger_accounts").
+        WithArgs("system:external_funding:JPY", nil, "system", "JPY").
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+    mock.ExpectCommit()
+
+    tx, err := r.DB.Beginx()
+    require.NoError(t, err)
+
+    accountID, err := r.GetOrCreateAccount(context.Background(), tx, model.UserAccountCode(1, "USD"), 1, model.AccountTypeUser, "USD")
+    require.NoError(t, err)
+    require.Equal(t, 4, accountID)
+
+    accountID, err = r.GetOrCreateAccount(context.Background(), tx, model.SystemAccountCode(model.SystemAccountExternalFunding, "JPY"), 0, model.AccountTypeSystem, "JPY")
+    require.NoError(t, err)
+    require.Equal(t, 1, accountID)
+
+    err = tx.Commit()
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestPostJournalEntry(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &LedgerRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    amount := decimal.NewFromFloat(25.5)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO journal_entries").
+        WithArgs(7, "transfer").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+    mock.ExpectExec("INSERT INTO postings \\(journal_entry_id, account_id, amount\\) VALUES \\(\\$1, \\$2, \\$3\\), \\(\\$4, \\$5, \\$6\\)").
+        WithArgs(3, 4, amount.Neg(), 3, 5, amount).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectCommit()
+
+    tx, err := r.DB.Beginx()
+    require.NoError(t, err)
+
+    entry := &model.JournalEntry{
+        TransactionID: 7,
+        Description:   "transfer",
+        Postings: []model.Posting{
+            {AccountID: 4, Amount: amount.Neg()},
+            {AccountID: 5, Amount: amount},
+        },
+    }
+    err = r.PostJournalEntry(context.Background(), tx, entry)
+    require.NoError(t, err)
+    require.Equal(t, 3, entry.ID)
+    require.Equal(t, 3, entry.Postings[1].JournalEntryID)
+
+    err = tx.Commit()
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestPostJournalEntryUnbalanced(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &LedgerRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectBegin()
+    mock.ExpectRollback()
+
+    tx, err := r.DB.Beginx()
+    require.NoError(t, err)
+
+    // The postings do not sum to zero, so nothing must be written
+    err = r.PostJournalEntry(context.Background(), tx, &model.JournalEntry{
+        Description: "deposit",
+        Postings: []model.Posting{
+            {AccountID: 1, Amount: decimal.NewFromInt(-10)},
+            {AccountID: 4, Amount: decimal.NewFromInt(11)},
+        },
+    })
+    require.ErrorIs(t, err, ErrUnbalancedJournalEntry)
+
+    // The postings sum to zero overall, but neither currency balances on its own
+    err = r.PostJournalEntry(context.Background(), tx, &model.JournalEntry{
+        Description: "transfer",
+        Postings: []model.Posting{
+            {AccountID: 1, Amount: decimal.NewFromInt(-10), Currency: "USD"},
+            {AccountID: 4, Amount: decimal.NewFromInt(10), Currency: "EUR"},
+        },
+    })
+    require.ErrorIs(t, err, ErrUnbalancedJournalEntry)
+
+    err = tx.Rollback()
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestGetAccountBalance(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &LedgerRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\) FROM postings p JOIN ledger_accounts a").
+        WithArgs("user:1:USD").
+        WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("60.4"))
+    mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\) FROM postings p JOIN ledger_accounts a").
+        WithArgs("user:2:USD").
+        WillReturnError(fmt.Errorf("DB error"))
+
+    balance, err := r.GetAccountBalance(context.Background(), "user:1:USD")
+    require.NoError(t, err)
+    require.Equal(t, "60.4", balance.String())
+
+    _, err = r.GetAccountBalance(context.Background(), "user:2:USD")
+    require.Error(t, err)
+    require.Contains(t, err.Error(), "failed to get ledger balance for account user:2:USD")
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
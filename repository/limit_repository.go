@@ -0,0 +1,68 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// LimitRepository provides database operations related to the usage counters transaction limits are checked against
+type LimitRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewLimitRepository creates a new instance of LimitRepository
+func NewLimitRepository(db *sqlx.DB) *LimitRepository {
+    logger := utils.GetLogger()
+    return &LimitRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// AddUsage adds the amount of one movement to the usage counter of its window, creating the counter for the first
+// movement of the window, and fills in the totals of the window including it. The counter row stays locked until the
+// end of the transaction exec belongs to, so concurrent movements of the user are counted one after the other.
+func (r *LimitRepository) AddUsage(ctx context.Context, exec Executor, counter *model.UsageCounter) error {
+    query := `
+        INSERT INTO usage_counters (user_id, transaction_type, period, period_start, amount, count)
+        VALUES ($1, $2, $3, $4, $5, 1)
+        ON CONFLICT (user_id, transaction_type, period, period_start)
+        DO UPDATE SET amount = usage_counters.amount + EXCLUDED.amount, count = usage_counters.count + 1
+        RETURNING amount, count
+    `
+
+    err := exec.QueryRowxContext(ctx, query, counter.UserID, counter.TransactionType, counter.Period, counter.PeriodStart, counter.Amount).
+        Scan(&counter.Amount, &counter.Count)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to count %s usage of user %d", counter.TransactionType, counter.UserID), err)
+        return fmt.Errorf("failed to count %s usage of user %d: %w", counter.TransactionType, counter.UserID, err)
+    }
+    return nil
+}
+
+// GetUsage retrieves the usage counter of the user's movements of the type in the window starting at start.
+// A window without movements has a zero counter.
+func (r *LimitRepository) GetUsage(ctx context.Context, exec Executor, userID int, txType, period string, start time.Time) (*model.UsageCounter, error) {
+    counter := model.UsageCounter{UserID: userID, TransactionType: txType, Period: period, PeriodStart: start, Amount: decimal.Zero}
+
+    query := `
+        SELECT amount, count
+        FROM usage_counters
+        WHERE user_id = $1 AND transaction_type = $2 AND period = $3 AND period_start = $4
+    `
+
+    err := exec.QueryRowxContext(ctx, query, userID, txType, period, start).Scan(&counter.Amount, &counter.Count)
+    if err != nil && err != sql.ErrNoRows {
+        r.Logger.Error(fmt.Sprintf("Failed to fetch %s usage of user %d", txType, userID), err)
+        return nil, fmt.Errorf("failed to fetch %s usage of user %d: %w", txType, userID, err)
+    }
+    return &counter, nil
+}
@@ -0,0 +1,110 @@
+package repository
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// OutboxRepository provides database operations related to the outbox of domain events
+type OutboxRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewOutboxRepository creates a new instance of OutboxRepository
+func NewOutboxRepository(db *sqlx.DB) *OutboxRepository {
+    logger := utils.GetLogger()
+    return &OutboxRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// AddEvents writes the events to the outbox in one statement, in order. Call it inside the database transaction of
+// the change the events describe, so they are only published if the change is committed.
+func (r *OutboxRepository) AddEvents(ctx context.Context, exec Executor, events []model.OutboxEvent) error {
+    if len(events) == 0 {
+        return nil
+    }
+
+    rows := make([]string, 0, len(events))
+    args := make([]interface{}, 0, 4*len(events))
+    for i, event := range events {
+        rows = append(rows, fmt.Sprintf("($%d, $%d, $%d, $%d, NOW())", 4*i+1, 4*i+2, 4*i+3, 4*i+4))
+        // The payload is passed as text, a byte slice would be sent as bytea
+        args = append(args, event.EventType, event.AggregateType, event.AggregateID, string(event.Payload))
+    }
+    query := "INSERT INTO outbox_events (event_type, aggregate_type, aggregate_id, payload, created_at) VALUES " + strings.Join(rows, ", ")
+
+    if _, err := exec.ExecContext(ctx, query, args...); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to write %d events to the outbox", len(events)), err)
+        return fmt.Errorf("failed to write events to the outbox: %w", err)
+    }
+    return nil
+}
+
+// ClaimUnpublished claims up to limit of the oldest events neither published nor dead, and not claimed by another relay
+// at now, for the relay until the given time, and returns them in ID order. The claim is made in one statement, so no
+// lock is held while the events are published; events claimed by a relay that stops are claimed again once it expires.
+func (r *OutboxRepository) ClaimUnpublished(ctx context.Context, exec Executor, now, until time.Time, limit int) ([]model.OutboxEvent, error) {
+    events := []model.OutboxEvent{}
+
+    query := `
+        UPDATE outbox_events SET claimed_until = $2
+        WHERE id IN (
+            SELECT id FROM outbox_events
+            WHERE published_at IS NULL AND dead_at IS NULL AND (claimed_until IS NULL OR claimed_until <= $1)
+            ORDER BY id
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, event_type, aggregate_type, aggregate_id, payload, attempts, last_error, created_at, published_at
+    `
+
+    if err := exec.SelectContext(ctx, &events, query, now, until, limit); err != nil {
+        r.Logger.Error("Error claiming unpublished outbox events", err)
+        return nil, fmt.Errorf("failed to claim unpublished outbox events: %w", err)
+    }
+    // RETURNING does not keep the order of the subquery
+    sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+    return events, nil
+}
+
+// MarkPublished records that the events with the given IDs have been published.
+func (r *OutboxRepository) MarkPublished(ctx context.Context, exec Executor, ids []int64) error {
+    if len(ids) == 0 {
+        return nil
+    }
+
+    query := "UPDATE outbox_events SET published_at = NOW() WHERE id = ANY($1)"
+
+    if _, err := exec.ExecContext(ctx, query, pq.Array(ids)); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to mark %d outbox events as published", len(ids)), err)
+        return fmt.Errorf("failed to mark outbox events as published: %w", err)
+    }
+    return nil
+}
+
+// RecordFailure counts a failed attempt to publish the event and keeps its error. The event is retried once retryAt
+// has passed, unless the attempt was its last: it is then parked as dead and no longer published.
+func (r *OutboxRepository) RecordFailure(ctx context.Context, exec Executor, id int64, message string, retryAt time.Time, dead bool) error {
+    query := `
+        UPDATE outbox_events
+        SET attempts = attempts + 1, last_error = $2, claimed_until = $3, dead_at = CASE WHEN $4 THEN NOW() END
+        WHERE id = $1
+    `
+
+    if _, err := exec.ExecContext(ctx, query, id, message, retryAt, dead); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to record failure of outbox event %d", id), err)
+        return fmt.Errorf("failed to record failure of outbox event %d: %w", id, err)
+    }
+    return nil
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/shopspring/decimal"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrRoleNotFound is returned when a user is granted a role that does not exist.
+var ErrRoleNotFound = errors.New("role not found")
+
+// RoleRepository provides database operations related to roles, their permissions and the roles granted to users
+type RoleRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewRoleRepository creates a new instance of RoleRepository
+func NewRoleRepository(db *sqlx.DB) *RoleRepository {
+    logger := utils.GetLogger()
+    return &RoleRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// GetRoles retrieves every role with its permissions, ordered by name.
+func (r *RoleRepository) GetRoles(ctx context.Context, exec Executor) ([]model.Role, error) {
+    query := `
+        SELECT r.name, r.description, r.refund_limit, COALESCE(array_agg(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}') AS permissions
+        FROM roles r
+        LEFT JOIN role_permissions rp ON rp.role = r.name
+        GROUP BY r.name, r.description, r.refund_limit
+        ORDER BY r.name
+    `
+
+    var rows []struct {
+        Name        string           `db:"name"`
+        Description string           `db:"description"`
+        RefundLimit *decimal.Decimal `db:"refund_limit"`
+        Permissions pq.StringArray   `db:"permissions"`
+    }
+    if err := exec.SelectContext(ctx, &rows, query); err != nil {
+        r.Logger.Error("Error getting roles", err)
+        return nil, fmt.Errorf("failed to fetch roles: %w", err)
+    }
+
+    roles := make([]model.Role, 0, len(rows))
+    for _, row := range rows {
+        roles = append(roles, model.Role{Name: row.Name, Description: row.Description, RefundLimit: row.RefundLimit, Permissions: row.Permissions})
+    }
+    return roles, nil
+}
+
+// GetUserRoles retrieves the names of the roles granted to the user, ordered by name.
+// The customer role every user has is only included if it was granted explicitly.
+func (r *RoleRepository) GetUserRoles(ctx context.Context, exec Executor, userID int) ([]string, error) {
+    var roles []string
+
+    query := "SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role"
+    if err := exec.SelectContext(ctx, &roles, query, userID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting the roles of user %d", userID), err)
+        return nil, fmt.Errorf("failed to fetch roles of user %d: %w", userID, err)
+    }
+    return roles, nil
+}
+
+// SetUserRoles replaces the roles granted to the user. It returns ErrRoleNotFound if one of the roles does not exist,
+// and ErrUserNotFound if the user does not exist.
+func (r *RoleRepository) SetUserRoles(ctx context.Context, exec Executor, userID int, roles []string) error {
+    if _, err := exec.ExecContext(ctx, "DELETE FROM user_roles WHERE user_id = $1", userID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to clear the roles of user %d", userID), err)
+        return fmt.Errorf("failed to set roles of user %d: %w", userID, err)
+    }
+
+    for _, role := range roles {
+        _, err := exec.ExecContext(ctx, "INSERT INTO user_roles (user_id, role) VALUES ($1, $2)", userID, role)
+        if err != nil {
+            var pqErr *pq.Error
+            if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+                if pqErr.Constraint == "user_roles_user_id_fkey" {
+                    return fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+                }
+                return fmt.Errorf("%w: %s", ErrRoleNotFound, role)
+            }
+            r.Logger.Error(fmt.Sprintf("Failed to grant role %s to user %d", role, userID), err)
+            return fmt.Errorf("failed to set roles of user %d: %w", userID, err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,169 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrScheduleNotFound is returned when the requested transfer schedule does not exist.
+var ErrScheduleNotFound = errors.New("transfer schedule not found")
+
+// scheduleColumns are the columns a transfer schedule is read from.
+const scheduleColumns = "id, from_user_id, to_user_id, amount, currency, description, repeat_interval, cron_expression, time_zone, start_at, end_at, next_run_at, last_run_at, run_count, status, created_at, updated_at"
+
+// ScheduleRepository provides database operations related to transfer schedules and their runs
+type ScheduleRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewScheduleRepository creates a new instance of ScheduleRepository
+func NewScheduleRepository(db *sqlx.DB) *ScheduleRepository {
+    logger := utils.GetLogger()
+    return &ScheduleRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// CreateSchedule stores a new transfer schedule and fills in its generated ID and timestamps.
+// It returns ErrUserNotFound if the paying or the receiving user does not exist.
+func (r *ScheduleRepository) CreateSchedule(ctx context.Context, exec Executor, schedule *model.TransferSchedule) error {
+    query := `
+        INSERT INTO transfer_schedules (from_user_id, to_user_id, amount, currency, description, repeat_interval, cron_expression, time_zone, start_at, end_at, next_run_at, status, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NOW(), NOW())
+        RETURNING id, created_at, updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, schedule.FromUserID, schedule.ToUserID, schedule.Amount, schedule.Currency, schedule.Description,
+        schedule.Interval, schedule.Cron, schedule.TimeZone, schedule.StartAt, schedule.EndAt, schedule.NextRunAt, schedule.Status).
+        Scan(&schedule.ID, &schedule.CreatedAt, &schedule.UpdatedAt)
+    if err != nil {
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+            return fmt.Errorf("%w: %d or %d", ErrUserNotFound, schedule.FromUserID, schedule.ToUserID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to create transfer schedule for user %d", schedule.FromUserID), err)
+        return fmt.Errorf("failed to create transfer schedule for user %d: %w", schedule.FromUserID, err)
+    }
+    return nil
+}
+
+// GetSchedule retrieves the transfer schedule with the given ID, returning ErrScheduleNotFound if it does not exist.
+func (r *ScheduleRepository) GetSchedule(ctx context.Context, exec Executor, scheduleID int) (*model.TransferSchedule, error) {
+    query := "SELECT " + scheduleColumns + " FROM transfer_schedules WHERE id = $1"
+    return r.getSchedule(ctx, exec, query, scheduleID)
+}
+
+// LockSchedule retrieves the transfer schedule like GetSchedule, and locks it until the end of the transaction exec belongs to.
+func (r *ScheduleRepository) LockSchedule(ctx context.Context, exec Executor, scheduleID int) (*model.TransferSchedule, error) {
+    query := "SELECT " + scheduleColumns + " FROM transfer_schedules WHERE id = $1 FOR UPDATE"
+    return r.getSchedule(ctx, exec, query, scheduleID)
+}
+
+func (r *ScheduleRepository) getSchedule(ctx context.Context, exec Executor, query string, scheduleID int) (*model.TransferSchedule, error) {
+    var schedule model.TransferSchedule
+    err := exec.GetContext(ctx, &schedule, query, scheduleID)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrScheduleNotFound, scheduleID)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting transfer schedule %d", scheduleID), err)
+        return nil, fmt.Errorf("failed to fetch transfer schedule %d: %w", scheduleID, err)
+    }
+    return &schedule, nil
+}
+
+// LockDueSchedule retrieves the active schedule that has been due the longest at the given time, and locks it until
+// the end of the transaction exec belongs to. Schedules locked by another transaction are skipped, so several
+// instances of the service can execute due schedules at the same time. It returns nil if no schedule is due.
+func (r *ScheduleRepository) LockDueSchedule(ctx context.Context, exec Executor, now time.Time) (*model.TransferSchedule, error) {
+    query := "SELECT " + scheduleColumns + ` FROM transfer_schedules
+        WHERE status = 'active' AND next_run_at <= $1
+        ORDER BY next_run_at
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED`
+
+    var schedule model.TransferSchedule
+    err := exec.GetContext(ctx, &schedule, query, now)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        r.Logger.Error("Error getting due transfer schedules", err)
+        return nil, fmt.Errorf("failed to fetch due transfer schedules: %w", err)
+    }
+    return &schedule, nil
+}
+
+// GetSchedules retrieves the transfer schedules paid by the user, newest first.
+func (r *ScheduleRepository) GetSchedules(ctx context.Context, exec Executor, userID int) ([]model.TransferSchedule, error) {
+    schedules := []model.TransferSchedule{}
+
+    query := "SELECT " + scheduleColumns + " FROM transfer_schedules WHERE from_user_id = $1 ORDER BY created_at DESC, id DESC"
+
+    if err := exec.SelectContext(ctx, &schedules, query, userID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting transfer schedules of user %d", userID), err)
+        return nil, fmt.Errorf("failed to fetch transfer schedules of user %d: %w", userID, err)
+    }
+    return schedules, nil
+}
+
+// UpdateSchedule stores the progress of a transfer schedule: its status, next and last run, and run count.
+func (r *ScheduleRepository) UpdateSchedule(ctx context.Context, exec Executor, schedule *model.TransferSchedule) error {
+    query := `
+        UPDATE transfer_schedules
+        SET status = $2, next_run_at = $3, last_run_at = $4, run_count = $5, updated_at = NOW()
+        WHERE id = $1
+    `
+
+    if _, err := exec.ExecContext(ctx, query, schedule.ID, schedule.Status, schedule.NextRunAt, schedule.LastRunAt, schedule.RunCount); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to update transfer schedule %d", schedule.ID), err)
+        return fmt.Errorf("failed to update transfer schedule %d: %w", schedule.ID, err)
+    }
+    return nil
+}
+
+// RecordRun stores the outcome of one run of a transfer schedule and fills in its generated ID and creation time.
+func (r *ScheduleRepository) RecordRun(ctx context.Context, exec Executor, run *model.ScheduleRun) error {
+    query := `
+        INSERT INTO transfer_schedule_runs (schedule_id, scheduled_for, status, transaction_id, failure_reason, error, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, NOW())
+        RETURNING id, created_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, run.ScheduleID, run.ScheduledFor, run.Status, run.TransactionID, run.FailureReason, run.Error).
+        Scan(&run.ID, &run.CreatedAt)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to record run of transfer schedule %d", run.ScheduleID), err)
+        return fmt.Errorf("failed to record run of transfer schedule %d: %w", run.ScheduleID, err)
+    }
+    return nil
+}
+
+// GetRuns retrieves up to limit of the latest runs of the transfer schedule, newest first.
+func (r *ScheduleRepository) GetRuns(ctx context.Context, exec Executor, scheduleID, limit int) ([]model.ScheduleRun, error) {
+    runs := []model.ScheduleRun{}
+
+    query := `
+        SELECT id, schedule_id, scheduled_for, status, transaction_id, failure_reason, error, created_at
+        FROM transfer_schedule_runs
+        WHERE schedule_id = $1
+        ORDER BY scheduled_for DESC
+        LIMIT $2
+    `
+
+    if err := exec.SelectContext(ctx, &runs, query, scheduleID, limit); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting runs of transfer schedule %d", scheduleID), err)
+        return nil, fmt.Errorf("failed to fetch runs of transfer schedule %d: %w", scheduleID, err)
+    }
+    return runs, nil
+}
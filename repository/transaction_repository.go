@@ -5,14 +5,30 @@ package repository
 
 import (
     "context"
+    "database/sql"
+    "errors"
     "fmt"
+    "strings"
+    "time"
     "github.com/jmoiron/sqlx"
     "github.com/yaoweihua/wallet-service/model"
-    "github.com/shopspring/decimal"
     "github.com/yaoweihua/wallet-service/utils"
     "github.com/sirupsen/logrus"
+    "github.com/lib/pq"
+    "github.com/shopspring/decimal"
 )
 
+// uniqueViolation is the PostgreSQL error code raised when a unique constraint is violated.
+const uniqueViolation = "23505"
+
+// foreignKeyViolation is the PostgreSQL error code raised when a referenced row does not exist.
+const foreignKeyViolation = "23503"
+
+// nullString converts an empty string into a SQL NULL so optional columns stay unset.
+func nullString(s string) sql.NullString {
+    return sql.NullString{String: s, Valid: s != ""}
+}
+
 // TransactionRepository provides database operations related to transactions
 type TransactionRepository struct {
     DB     *sqlx.DB
@@ -28,52 +44,381 @@ func NewTransactionRepository(DB *sqlx.DB) *TransactionRepository {
     }
 }
 
+// ErrDuplicateIdempotencyKey is returned when a transaction is recorded with an
+// idempotency key that has already been stored by another request.
+var ErrDuplicateIdempotencyKey = errors.New("idempotency key already used")
+
 // RecordTransaction records a new transaction in the database.
-// It stores the details of the transaction including the sender, receiver, amount, type, and status.
-func (r *TransactionRepository) RecordTransaction(ctx context.Context, tx *sqlx.Tx, fromUserID, toUserID int, amount decimal.Decimal, txType string, txStatus string) error {
-    transactionFee := decimal.NewFromFloat(0.0)  // Assume that the transaction handling fee is a fixed value, and it can also be modified according to the actual business
-    paymentMethod := "credit_card"  // Assume that the payment method is a fixed value and can also be modified
+// It stores the details of the transaction including the sender, receiver, amount, type, and status,
+// the payment method and its metadata, plus the target leg and rate of a cross-currency transfer and the transaction a refund refunds,
+// and fills in the generated ID and timestamps on the given transaction.
+func (r *TransactionRepository) RecordTransaction(ctx context.Context, exec Executor, txn *model.Transaction) error {
+    if txn.PaymentMethod == "" {
+        txn.PaymentMethod = model.DefaultPaymentMethod
+    }
 
     query := `
-        INSERT INTO transactions (from_user_id, to_user_id, amount, transaction_type, transaction_status, transaction_fee, payment_method, created_at, updated_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW())
+        INSERT INTO transactions (from_user_id, to_user_id, amount, currency, transaction_type, transaction_status, transaction_fee, payment_method, idempotency_key, request_hash, failure_reason,
+            target_amount, target_currency, fx_rate, fx_quote_id, payment_metadata, refund_of, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, NOW(), NOW())
+        RETURNING id, created_at, updated_at
     `
 
     // 执行插入操作
-    _, err := tx.ExecContext(ctx, query, fromUserID, toUserID, amount, txType, txStatus, transactionFee, paymentMethod)
+    err := exec.QueryRowxContext(ctx, query, txn.FromUserID, txn.ToUserID, txn.Amount, txn.Currency, txn.TransactionType, txn.TransactionStatus,
+        txn.TransactionFee, txn.PaymentMethod, nullString(txn.IdempotencyKey), nullString(txn.RequestHash), nullString(txn.FailureReason),
+        txn.TargetAmount, nullString(txn.TargetCurrency), txn.FXRate, txn.FXQuoteID, txn.PaymentMetadata, txn.RefundOf).
+        Scan(&txn.ID, &txn.CreatedAt, &txn.UpdatedAt)
     if err != nil {
-        r.Logger.Error(fmt.Sprintf("Failed to record transaction from user %d to user %d, amount: %s, type: %s", fromUserID, toUserID, amount.String(), txType), err)
-        return fmt.Errorf("failed to record transaction for user %d to user %d: %w", fromUserID, toUserID, err)
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+            return ErrDuplicateIdempotencyKey
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to record transaction from user %d to user %d, amount: %s, type: %s", txn.FromUserID, txn.ToUserID, txn.Amount.String(), txn.TransactionType), err)
+        return fmt.Errorf("failed to record transaction for user %d to user %d: %w", txn.FromUserID, txn.ToUserID, err)
     }
 
     //r.Logger.Info(fmt.Sprintf("Recorded transaction from user %d to user %d, amount: %s, type: %s", fromUserID, toUserID, amount.String(), txType))
     return nil
 }
 
-// GetTransactions retrieves the transaction records of the specified user
-func (r *TransactionRepository) GetTransactions(ctx context.Context, userID int) ([]model.Transaction, error) {
-    var transactions []model.Transaction
+// GetTransactionByIdempotencyKey retrieves the transaction the user previously recorded with the given idempotency key.
+// Keys are scoped per user, the same key sent by another user is a different key.
+// It returns nil without an error if the user has not recorded a transaction with the key yet.
+func (r *TransactionRepository) GetTransactionByIdempotencyKey(ctx context.Context, exec Executor, userID int, key string) (*model.Transaction, error) {
+    var txn model.Transaction
 
     query := `
         SELECT 
             id, 
             from_user_id, 
-            to_user_id, 
+            COALESCE(to_user_id, 0) AS to_user_id, 
             amount, 
+            currency, 
             transaction_type, 
             transaction_status, 
+            transaction_fee, 
+            payment_method, 
+            payment_metadata, 
+            idempotency_key, 
+            request_hash, 
+            COALESCE(failure_reason, '') AS failure_reason, 
+            target_amount, 
+            COALESCE(target_currency, '') AS target_currency, 
+            fx_rate, 
+            fx_quote_id, 
+            refund_of, 
+            refunded_amount, 
             created_at, 
             updated_at
         FROM transactions
-        WHERE from_user_id = $1 OR to_user_id = $1
-        ORDER BY created_at DESC
+        WHERE from_user_id = $1 AND idempotency_key = $2
     `
-    
-    err := r.DB.SelectContext(ctx, &transactions, query, userID)
+
+    err := exec.GetContext(ctx, &txn, query, userID, key)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting transaction of user %d for idempotency key %s", userID, key), err)
+        return nil, fmt.Errorf("failed to fetch transaction by idempotency key: %w", err)
+    }
+
+    return &txn, nil
+}
+
+// TransactionQuery selects a page of the transaction history of a user. Zero values leave a filter out.
+type TransactionQuery struct {
+    UserID         int              // The user whose transactions are listed, as sender or recipient
+    Type           string           // Only transactions of this type, such as deposit or transfer
+    Status         string           // Only transactions in this status, such as completed or failed
+    CounterpartyID int              // Only transactions between the user and this other user
+    MinAmount      *decimal.Decimal // Only transactions of at least this amount
+    MaxAmount      *decimal.Decimal // Only transactions of at most this amount
+    From           *time.Time       // Only transactions created at or after this time
+    To             *time.Time       // Only transactions created before this time
+    Ascending      bool             // Oldest first instead of newest first
+    After          *TransactionCursor // Only transactions after this one in the sort order
+    Limit          int              // The maximum number of transactions returned
+}
+
+// TransactionCursor is the position of a transaction in the history, which is ordered by creation time and then ID.
+type TransactionCursor struct {
+    CreatedAt time.Time
+    ID        int
+}
+
+// GetTransactions retrieves one page of the transaction records of the specified user, newest first unless the query asks otherwise.
+// Pages are read with a keyset on (created_at, id), so they stay stable while new transactions are recorded.
+func (r *TransactionRepository) GetTransactions(ctx context.Context, q TransactionQuery) ([]model.Transaction, error) {
+    var transactions []model.Transaction
+
+    args := []interface{}{q.UserID}
+    conditions := []string{"(from_user_id = $1 OR to_user_id = $1)"}
+    where := func(condition string, arg interface{}) {
+        args = append(args, arg)
+        conditions = append(conditions, strings.ReplaceAll(condition, "?", fmt.Sprintf("$%d", len(args))))
+    }
+    if q.Type != "" {
+        where("transaction_type = ?", q.Type)
+    }
+    if q.Status != "" {
+        where("transaction_status = ?", q.Status)
+    }
+    if q.CounterpartyID != 0 {
+        where("((from_user_id = $1 AND to_user_id = ?) OR (from_user_id = ? AND to_user_id = $1))", q.CounterpartyID)
+    }
+    if q.MinAmount != nil {
+        where("amount >= ?", *q.MinAmount)
+    }
+    if q.MaxAmount != nil {
+        where("amount <= ?", *q.MaxAmount)
+    }
+    if q.From != nil {
+        where("created_at >= ?", *q.From)
+    }
+    if q.To != nil {
+        where("created_at < ?", *q.To)
+    }
+
+    direction, comparison := "DESC", "<"
+    if q.Ascending {
+        direction, comparison = "ASC", ">"
+    }
+    if q.After != nil {
+        args = append(args, q.After.CreatedAt, q.After.ID)
+        conditions = append(conditions, fmt.Sprintf("(created_at, id) %s ($%d, $%d)", comparison, len(args)-1, len(args)))
+    }
+    args = append(args, q.Limit)
+
+    query := fmt.Sprintf(`
+        SELECT 
+            id, 
+            from_user_id, 
+            to_user_id, 
+            amount, 
+            currency, 
+            transaction_type, 
+            transaction_status, 
+            transaction_fee, 
+            payment_method, 
+            payment_metadata, 
+            COALESCE(failure_reason, '') AS failure_reason, 
+            target_amount, 
+            COALESCE(target_currency, '') AS target_currency, 
+            fx_rate, 
+            fx_quote_id, 
+            refund_of, 
+            refunded_amount, 
+            created_at, 
+            updated_at
+        FROM transactions
+        WHERE %s
+        ORDER BY created_at %s, id %s
+        LIMIT $%d
+    `, strings.Join(conditions, " AND "), direction, direction, len(args))
+
+    err := r.DB.SelectContext(ctx, &transactions, query, args...)
     if err != nil {
-        r.Logger.Error(fmt.Sprintf("Error getting transactions for user %d", userID), err)
+        r.Logger.Error(fmt.Sprintf("Error getting transactions for user %d", q.UserID), err)
         return nil, err
     }
 
     return transactions, nil
-}
\ No newline at end of file
+}
+
+// ErrTransactionNotFound is returned when the requested transaction does not exist.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// ErrStatusChanged is returned when a transaction status is updated from a status it no longer has.
+var ErrStatusChanged = errors.New("transaction status was changed concurrently")
+
+// GetTransaction retrieves a transaction by its ID. It returns ErrTransactionNotFound if the transaction does not exist.
+func (r *TransactionRepository) GetTransaction(ctx context.Context, exec Executor, id int) (*model.Transaction, error) {
+    query := `
+        SELECT 
+            id, 
+            from_user_id, 
+            COALESCE(to_user_id, 0) AS to_user_id, 
+            amount, 
+            currency, 
+            transaction_type, 
+            transaction_status, 
+            transaction_fee, 
+            payment_method, 
+            payment_metadata, 
+            COALESCE(failure_reason, '') AS failure_reason, 
+            target_amount, 
+            COALESCE(target_currency, '') AS target_currency, 
+            fx_rate, 
+            fx_quote_id, 
+            refund_of, 
+            refunded_amount, 
+            created_at, 
+            updated_at
+        FROM transactions
+        WHERE id = $1
+    `
+    return r.getTransaction(ctx, exec, query, id)
+}
+
+// LockTransaction retrieves a transaction like GetTransaction, and locks it until the end of the transaction exec belongs to,
+// so its status cannot change under the caller.
+func (r *TransactionRepository) LockTransaction(ctx context.Context, exec Executor, id int) (*model.Transaction, error) {
+    query := `
+        SELECT 
+            id, 
+            from_user_id, 
+            COALESCE(to_user_id, 0) AS to_user_id, 
+            amount, 
+            currency, 
+            transaction_type, 
+            transaction_status, 
+            transaction_fee, 
+            payment_method, 
+            payment_metadata, 
+            COALESCE(failure_reason, '') AS failure_reason, 
+            target_amount, 
+            COALESCE(target_currency, '') AS target_currency, 
+            fx_rate, 
+            fx_quote_id, 
+            refund_of, 
+            refunded_amount, 
+            created_at, 
+            updated_at
+        FROM transactions
+        WHERE id = $1
+        FOR UPDATE
+    `
+    return r.getTransaction(ctx, exec, query, id)
+}
+
+func (r *TransactionRepository) getTransaction(ctx context.Context, exec Executor, query string, id int) (*model.Transaction, error) {
+    var txn model.Transaction
+    err := exec.GetContext(ctx, &txn, query, id)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrTransactionNotFound, id)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting transaction %d", id), err)
+        return nil, fmt.Errorf("failed to fetch transaction %d: %w", id, err)
+    }
+
+    return &txn, nil
+}
+
+// UpdateStatus moves a transaction from one status to another, setting the failure reason, which is cleared if empty.
+// It returns ErrStatusChanged if the transaction no longer has the status it is moved from.
+func (r *TransactionRepository) UpdateStatus(ctx context.Context, exec Executor, id int, from, to, failureReason string) error {
+    query := `
+        UPDATE transactions
+        SET transaction_status = $3, failure_reason = $4, updated_at = NOW()
+        WHERE id = $1 AND transaction_status = $2
+    `
+
+    result, err := exec.ExecContext(ctx, query, id, from, to, nullString(failureReason))
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to move transaction %d from %s to %s", id, from, to), err)
+        return fmt.Errorf("failed to update status of transaction %d: %w", id, err)
+    }
+
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to update status of transaction %d: %w", id, err)
+    }
+    if rows == 0 {
+        return ErrStatusChanged
+    }
+    return nil
+}
+
+// GetUnsettled retrieves up to limit transactions that are pending or processing, oldest first.
+func (r *TransactionRepository) GetUnsettled(ctx context.Context, exec Executor, limit int) ([]model.Transaction, error) {
+    var transactions []model.Transaction
+
+    query := `
+        SELECT 
+            id, 
+            from_user_id, 
+            COALESCE(to_user_id, 0) AS to_user_id, 
+            amount, 
+            currency, 
+            transaction_type, 
+            transaction_status, 
+            transaction_fee, 
+            payment_method, 
+            payment_metadata, 
+            created_at, 
+            updated_at
+        FROM transactions
+        WHERE transaction_status IN ('pending', 'processing')
+        ORDER BY created_at
+        LIMIT $1
+    `
+
+    if err := exec.SelectContext(ctx, &transactions, query, limit); err != nil {
+        r.Logger.Error("Error getting unsettled transactions", err)
+        return nil, fmt.Errorf("failed to fetch unsettled transactions: %w", err)
+    }
+    return transactions, nil
+}
+
+// AddRefund adds a refunded amount to the total refunded of a transaction, which must be locked with LockTransaction.
+func (r *TransactionRepository) AddRefund(ctx context.Context, exec Executor, id int, amount decimal.Decimal) error {
+    query := `
+        UPDATE transactions
+        SET refunded_amount = refunded_amount + $2, updated_at = NOW()
+        WHERE id = $1
+    `
+
+    if _, err := exec.ExecContext(ctx, query, id, amount); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to add a refund of %s to transaction %d", amount.String(), id), err)
+        return fmt.Errorf("failed to add refund to transaction %d: %w", id, err)
+    }
+    return nil
+}
+
+// StreamStatement calls fn with every journal entry posted to the ledger account of the user's wallet in the currency
+// between from (inclusive) and to (exclusive), oldest first, with the transaction it belongs to.
+// The rows are read one at a time, so statements of any length are produced without loading them into memory.
+// The running balance of the lines is left to the caller. Iteration stops at the first error fn returns.
+func (r *TransactionRepository) StreamStatement(ctx context.Context, userID int, currency string, from, to time.Time, fn func(line *model.StatementLine) error) error {
+    query := `
+        SELECT 
+            je.id AS entry_id, 
+            je.transaction_id, 
+            COALESCE(t.transaction_type, '') AS transaction_type, 
+            je.description, 
+            SUM(p.amount) AS amount, 
+            je.created_at
+        FROM postings p
+        JOIN ledger_accounts a ON a.id = p.account_id
+        JOIN journal_entries je ON je.id = p.journal_entry_id
+        LEFT JOIN transactions t ON t.id = je.transaction_id
+        WHERE a.code = $1 AND je.created_at >= $2 AND je.created_at < $3
+        GROUP BY je.id, je.transaction_id, t.transaction_type, je.description, je.created_at
+        ORDER BY je.created_at, je.id
+    `
+
+    rows, err := r.DB.QueryxContext(ctx, query, model.UserAccountCode(userID, currency), from, to)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting the %s statement of user %d", currency, userID), err)
+        return fmt.Errorf("failed to fetch statement of user %d: %w", userID, err)
+    }
+    defer rows.Close() // nolint:errcheck
+
+    for rows.Next() {
+        var line model.StatementLine
+        if err := rows.StructScan(&line); err != nil {
+            return fmt.Errorf("failed to read statement line of user %d: %w", userID, err)
+        }
+        if err := fn(&line); err != nil {
+            return err
+        }
+    }
+    if err := rows.Err(); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error reading the %s statement of user %d", currency, userID), err)
+        return fmt.Errorf("failed to fetch statement of user %d: %w", userID, err)
+    }
+    return nil
+}
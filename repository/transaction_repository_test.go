@@ -9,7 +9,10 @@ import (
     "github.com/jmoiron/sqlx"
     "time"
     "fmt"
+    "database/sql"
     "github.com/sirupsen/logrus"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/lib/pq"
     "io"
 )
 
@@ -35,11 +38,12 @@ func TestRecordTransaction(t *testing.T) {
     mock.ExpectBegin()
 
     // Simulate the execution of the SQL for inserting transactions and ensure that the number of parameters matches the SQL
-    mock.ExpectExec("INSERT INTO transactions").
+    now := time.Now()
+    mock.ExpectQuery("INSERT INTO transactions").
         WithArgs(
-            fromUserID, toUserID, amount, transactionType, "completed", transactionFee, paymentMethod,
+            fromUserID, toUserID, amount, "USD", transactionType, "completed", transactionFee, paymentMethod, nil, nil, nil, nil, nil, nil, nil, nil, nil,
         ).
-        WillReturnResult(sqlmock.NewResult(1, 1))  // Simulate a successful insertion
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, now, now))  // Simulate a successful insertion
 
     // Set the expectation of committing the transaction
     mock.ExpectCommit()
@@ -49,8 +53,17 @@ func TestRecordTransaction(t *testing.T) {
     require.NoError(t, err)
 
     // Call the RecordTransaction method
-    err = txRepo.RecordTransaction(context.Background(), tx, fromUserID, toUserID, amount, transactionType, "completed")
+    txn := &model.Transaction{
+        FromUserID:        fromUserID,
+        ToUserID:          toUserID,
+        Amount:            amount,
+        Currency:          "USD",
+        TransactionType:   transactionType,
+        TransactionStatus: "completed",
+    }
+    err = txRepo.RecordTransaction(context.Background(), tx, txn)
     require.NoError(t, err)
+    require.Equal(t, 1, txn.ID)
 
     // Commit the transaction
     err = tx.Commit()
@@ -73,20 +86,56 @@ func TestGetTransactions(t *testing.T) {
 
     // Set the query results to be returned by the simulation
     rows := sqlmock.NewRows([]string{
-        "id", "from_user_id", "to_user_id", "amount", "transaction_type", "transaction_status", "transaction_fee", "payment_method", "created_at", "updated_at",
+        "id", "from_user_id", "to_user_id", "amount", "currency", "transaction_type", "transaction_status", "transaction_fee", "payment_method", "created_at", "updated_at",
     }).AddRow(
-        1, 1, 2, decimal.NewFromFloat(100.5), "transfer", "completed", decimal.NewFromFloat(0.0), "credit_card", time.Now(), time.Now(),
+        1, 1, 2, decimal.NewFromFloat(100.5), "USD", "transfer", "completed", decimal.NewFromFloat(0.0), "credit_card", time.Now(), time.Now(),
     ).AddRow(
-        2, 2, 3, decimal.NewFromFloat(50.5), "withdraw", "completed", decimal.NewFromFloat(1.0), "bank_transfer", time.Now(), time.Now(),
+        2, 2, 3, decimal.NewFromInt(5000), "JPY", "withdraw", "completed", decimal.NewFromFloat(1.0), "bank_transfer", time.Now(), time.Now(),
     )
 
     // Set the query expectations
-    mock.ExpectQuery("SELECT").WithArgs(1).WillReturnRows(rows)
+    mock.ExpectQuery("SELECT").WithArgs(1, 50).WillReturnRows(rows)
 
     // Call the method and verify
-    transactions, err := txRepo.GetTransactions(context.Background(), 1)
+    transactions, err := txRepo.GetTransactions(context.Background(), TransactionQuery{UserID: 1, Limit: 50})
     require.NoError(t, err)
     require.Len(t, transactions, 2)
+    require.Equal(t, "JPY", transactions[1].Currency)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// TestGetTransactionsFiltered tests that the filters and the cursor of a history page are turned into query conditions
+func TestGetTransactionsFiltered(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    txRepo := NewTransactionRepository(sqlx.NewDb(db, "postgres"))
+
+    minAmount := decimal.NewFromInt(10)
+    from := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+    after := time.Date(2024, 11, 12, 18, 0, 0, 0, time.UTC)
+
+    mock.ExpectQuery("WHERE \\(from_user_id = \\$1 OR to_user_id = \\$1\\) AND transaction_type = \\$2 " +
+        "AND \\(\\(from_user_id = \\$1 AND to_user_id = \\$3\\) OR \\(from_user_id = \\$3 AND to_user_id = \\$1\\)\\) " +
+        "AND amount >= \\$4 AND created_at >= \\$5 AND \\(created_at, id\\) > \\(\\$6, \\$7\\) ORDER BY created_at ASC, id ASC LIMIT \\$8").
+        WithArgs(1, "transfer", 2, minAmount, from, after, 7, 21).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "from_user_id", "to_user_id", "amount", "currency", "transaction_type", "transaction_status", "created_at", "updated_at"}))
+
+    transactions, err := txRepo.GetTransactions(context.Background(), TransactionQuery{
+        UserID:         1,
+        Type:           "transfer",
+        CounterpartyID: 2,
+        MinAmount:      &minAmount,
+        From:           &from,
+        Ascending:      true,
+        After:          &TransactionCursor{CreatedAt: after, ID: 7},
+        Limit:          21,
+    })
+    require.NoError(t, err)
+    require.Empty(t, transactions)
 
     err = mock.ExpectationsWereMet()
     require.NoError(t, err)
@@ -117,9 +166,9 @@ func TestRecordTransactionError(t *testing.T) {
     mock.ExpectBegin()
 
     // Simulate an error occurring during the execution of the SQL for inserting transactions
-    mock.ExpectExec(`INSERT INTO transactions`).
+    mock.ExpectQuery(`INSERT INTO transactions`).
         WithArgs(
-            fromUserID, toUserID, amount, transactionType, "completed", transactionFee, paymentMethod,
+            fromUserID, toUserID, amount, "USD", transactionType, "completed", transactionFee, paymentMethod, nil, nil, nil, nil, nil, nil, nil, nil, nil,
         ).
         WillReturnError(fmt.Errorf("DB insert error"))
 
@@ -131,7 +180,14 @@ func TestRecordTransactionError(t *testing.T) {
     require.NoError(t, err)
 
     // Call the RecordTransaction method and verify the error
-    err = txRepo.RecordTransaction(context.Background(), tx, fromUserID, toUserID, amount, transactionType, "completed")
+    err = txRepo.RecordTransaction(context.Background(), tx, &model.Transaction{
+        FromUserID:        fromUserID,
+        ToUserID:          toUserID,
+        Amount:            amount,
+        Currency:          "USD",
+        TransactionType:   transactionType,
+        TransactionStatus: "completed",
+    })
     require.Error(t, err)
     require.Contains(t, err.Error(), "DB insert error")
 
@@ -154,12 +210,12 @@ func TestGetTransactionsNoFound(t *testing.T) {
     txRepo := NewTransactionRepository(sqlxDB)
 
     // Simulate the database query to return empty results
-    mock.ExpectQuery(`SELECT`).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{
+    mock.ExpectQuery(`SELECT`).WithArgs(1, 50).WillReturnRows(sqlmock.NewRows([]string{
         "id", "from_user_id", "to_user_id", "amount", "transaction_type", "transaction_status", "transaction_fee", "payment_method", "created_at", "updated_at",
     }))
 
     // Call the GetTransactions method and verify that the returned result is empty
-    transactions, err := txRepo.GetTransactions(context.Background(), 1)
+    transactions, err := txRepo.GetTransactions(context.Background(), TransactionQuery{UserID: 1, Limit: 50})
     require.NoError(t, err)
     require.Empty(t, transactions)
 
@@ -167,3 +223,99 @@ func TestGetTransactionsNoFound(t *testing.T) {
     err = mock.ExpectationsWereMet()
     require.NoError(t, err)
 }
+
+func TestRecordTransactionDuplicateIdempotencyKey(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    txRepo := &TransactionRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectBegin()
+
+    // Simulate another request having stored the same idempotency key first
+    mock.ExpectQuery(`INSERT INTO transactions`).
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card", "key-1", "hash-1", nil, nil, nil, nil, nil, nil, nil).
+        WillReturnError(&pq.Error{Code: "23505"})
+
+    mock.ExpectRollback()
+
+    tx, err := txRepo.DB.Beginx()
+    require.NoError(t, err)
+
+    err = txRepo.RecordTransaction(context.Background(), tx, &model.Transaction{
+        FromUserID:        1,
+        Amount:            decimal.NewFromInt(50),
+        Currency:          "USD",
+        TransactionType:   "deposit",
+        TransactionStatus: "completed",
+        IdempotencyKey:    "key-1",
+        RequestHash:       "hash-1",
+    })
+    require.ErrorIs(t, err, ErrDuplicateIdempotencyKey)
+
+    err = tx.Rollback()
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestGetTransactionByIdempotencyKey(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    txRepo := &TransactionRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    columns := []string{
+        "id", "from_user_id", "to_user_id", "amount", "transaction_type", "transaction_status", "transaction_fee",
+        "payment_method", "idempotency_key", "request_hash", "created_at", "updated_at",
+    }
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, "key-1").
+        WillReturnRows(sqlmock.NewRows(columns).AddRow(
+            7, 1, 0, decimal.NewFromInt(50), "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card", "key-1", "hash-1", time.Now(), time.Now(),
+        ))
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, "key-2").
+        WillReturnError(sql.ErrNoRows)
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(2, "key-1").
+        WillReturnError(sql.ErrNoRows)
+    mock.ExpectCommit()
+
+    tx, err := txRepo.DB.Beginx()
+    require.NoError(t, err)
+
+    // A known key returns the stored transaction
+    txn, err := txRepo.GetTransactionByIdempotencyKey(context.Background(), tx, 1, "key-1")
+    require.NoError(t, err)
+    require.NotNil(t, txn)
+    require.Equal(t, 7, txn.ID)
+    require.Equal(t, "hash-1", txn.RequestHash)
+
+    // An unknown key returns nothing without an error
+    txn, err = txRepo.GetTransactionByIdempotencyKey(context.Background(), tx, 1, "key-2")
+    require.NoError(t, err)
+    require.Nil(t, txn)
+
+    // Keys are scoped per user, the key of user 1 is unknown to user 2
+    txn, err = txRepo.GetTransactionByIdempotencyKey(context.Background(), tx, 2, "key-1")
+    require.NoError(t, err)
+    require.Nil(t, txn)
+
+    err = tx.Commit()
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
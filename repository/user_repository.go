@@ -0,0 +1,237 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/sirupsen/logrus"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// ErrDuplicateEmail is returned when an open account already uses the email address.
+var ErrDuplicateEmail = errors.New("email is already in use")
+
+// ErrDuplicatePhone is returned when an open account already uses the phone number.
+var ErrDuplicatePhone = errors.New("phone is already in use")
+
+// The partial unique indexes keeping emails and phone numbers unique among open accounts.
+const (
+    usersEmailIndex = "users_email_idx"
+    usersPhoneIndex = "users_phone_idx"
+)
+
+// UserRepository provides database operations related to user accounts
+type UserRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewUserRepository creates a new instance of UserRepository
+func NewUserRepository(db *sqlx.DB) *UserRepository {
+    logger := utils.GetLogger()
+    return &UserRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// CreateUser inserts a new user, and fills in the generated ID and timestamps on the given user.
+// It returns ErrDuplicateEmail or ErrDuplicatePhone if an open account already uses the email or phone.
+func (r *UserRepository) CreateUser(ctx context.Context, exec Executor, user *model.User) error {
+    query := `
+        INSERT INTO users (name, email, phone, status, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, NOW(), NOW())
+        RETURNING id, created_at, updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, user.Name, user.Email, user.Phone, user.Status).
+        Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+    if err != nil {
+        if dupErr := duplicateUserError(err); dupErr != nil {
+            return dupErr
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to create user with email %s", user.Email), err)
+        return fmt.Errorf("failed to create user: %w", err)
+    }
+
+    return nil
+}
+
+// GetUser retrieves an open user account. It returns ErrUserNotFound if the user does not exist or has been deleted.
+func (r *UserRepository) GetUser(ctx context.Context, exec Executor, userID int) (*model.User, error) {
+    var user model.User
+
+    query := `
+        SELECT id, name, email, phone, status, kyc_tier, created_at, updated_at
+        FROM users
+        WHERE id = $1 AND deleted_at IS NULL
+    `
+
+    err := exec.GetContext(ctx, &user, query, userID)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to fetch user %d", userID), err)
+        return nil, fmt.Errorf("failed to fetch user: %w", err)
+    }
+
+    return &user, nil
+}
+
+// UpdateUser saves the name, email and phone of an open user account and refreshes its update time.
+// It returns ErrDuplicateEmail or ErrDuplicatePhone if another open account already uses the email or phone.
+func (r *UserRepository) UpdateUser(ctx context.Context, exec Executor, user *model.User) error {
+    query := `
+        UPDATE users
+        SET name = $1, email = $2, phone = $3, updated_at = NOW()
+        WHERE id = $4 AND deleted_at IS NULL
+        RETURNING updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, user.Name, user.Email, user.Phone, user.ID).Scan(&user.UpdatedAt)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return fmt.Errorf("%w: %d", ErrUserNotFound, user.ID)
+        }
+        if dupErr := duplicateUserError(err); dupErr != nil {
+            return dupErr
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to update user %d", user.ID), err)
+        return fmt.Errorf("failed to update user %d: %w", user.ID, err)
+    }
+
+    return nil
+}
+
+// DeleteUser soft deletes an open user account: the row is kept for the transaction history, but the account
+// is marked inactive and closed.
+func (r *UserRepository) DeleteUser(ctx context.Context, exec Executor, userID int) error {
+    query := `
+        UPDATE users
+        SET status = 'inactive', deleted_at = NOW(), updated_at = NOW()
+        WHERE id = $1 AND deleted_at IS NULL
+    `
+
+    result, err := exec.ExecContext(ctx, query, userID)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to delete user %d", userID), err)
+        return fmt.Errorf("failed to delete user %d: %w", userID, err)
+    }
+
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to delete user %d: %w", userID, err)
+    }
+    if rows == 0 {
+        return fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+    }
+
+    return nil
+}
+
+// UpdateStatus changes the status of an open user account and returns the status it had before.
+func (r *UserRepository) UpdateStatus(ctx context.Context, exec Executor, userID int, status string) (string, error) {
+    query := `
+        UPDATE users u
+        SET status = $1, updated_at = NOW()
+        FROM (SELECT id, status FROM users WHERE id = $2 AND deleted_at IS NULL FOR UPDATE) old
+        WHERE u.id = old.id
+        RETURNING old.status
+    `
+
+    var oldStatus string
+    err := exec.QueryRowxContext(ctx, query, status, userID).Scan(&oldStatus)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to update status of user %d to %s", userID, status), err)
+        return "", fmt.Errorf("failed to update status of user %d: %w", userID, err)
+    }
+
+    return oldStatus, nil
+}
+
+// UpdateKYCTier moves an open user account to another KYC tier.
+// It returns ErrUserNotFound if the user does not exist or has been deleted.
+func (r *UserRepository) UpdateKYCTier(ctx context.Context, exec Executor, userID int, tier string) error {
+    query := `
+        UPDATE users
+        SET kyc_tier = $1, updated_at = NOW()
+        WHERE id = $2 AND deleted_at IS NULL
+    `
+
+    result, err := exec.ExecContext(ctx, query, tier, userID)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to update KYC tier of user %d to %s", userID, tier), err)
+        return fmt.Errorf("failed to update KYC tier of user %d: %w", userID, err)
+    }
+
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to update KYC tier of user %d: %w", userID, err)
+    }
+    if rows == 0 {
+        return fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+    }
+    return nil
+}
+
+// RecordStatusChange adds a status change to the audit trail, and fills in its generated ID and creation time.
+func (r *UserRepository) RecordStatusChange(ctx context.Context, exec Executor, change *model.StatusChange) error {
+    query := `
+        INSERT INTO user_status_changes (user_id, old_status, new_status, reason, changed_by, created_at)
+        VALUES ($1, $2, $3, $4, $5, NOW())
+        RETURNING id, created_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, change.UserID, change.OldStatus, change.NewStatus, change.Reason, nullString(change.ChangedBy)).
+        Scan(&change.ID, &change.CreatedAt)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to record status change of user %d", change.UserID), err)
+        return fmt.Errorf("failed to record status change of user %d: %w", change.UserID, err)
+    }
+
+    return nil
+}
+
+// GetStatusChanges retrieves the audit trail of status changes of a user, newest first.
+func (r *UserRepository) GetStatusChanges(ctx context.Context, userID int) ([]model.StatusChange, error) {
+    var changes []model.StatusChange
+
+    query := `
+        SELECT id, user_id, old_status, new_status, reason, COALESCE(changed_by, '') AS changed_by, created_at
+        FROM user_status_changes
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC
+    `
+
+    err := r.DB.SelectContext(ctx, &changes, query, userID)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to fetch status changes of user %d", userID), err)
+        return nil, fmt.Errorf("failed to fetch status changes of user %d: %w", userID, err)
+    }
+
+    return changes, nil
+}
+
+// duplicateUserError maps a unique violation on the email or phone index to its sentinel error, or returns nil.
+func duplicateUserError(err error) error {
+    var pqErr *pq.Error
+    if !errors.As(err, &pqErr) || pqErr.Code != uniqueViolation {
+        return nil
+    }
+
+    switch pqErr.Constraint {
+    case usersEmailIndex:
+        return ErrDuplicateEmail
+    case usersPhoneIndex:
+        return ErrDuplicatePhone
+    }
+    return nil
+}
@@ -0,0 +1,173 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+func newTestUserRepository(t *testing.T) (*UserRepository, sqlmock.Sqlmock) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    t.Cleanup(func() { db.Close() }) // nolint:errcheck
+
+    return &UserRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }, mock
+}
+
+func TestCreateUser(t *testing.T) {
+    r, mock := newTestUserRepository(t)
+
+    now := time.Now()
+    mock.ExpectQuery("INSERT INTO users").
+        WithArgs("Dave", "dave@example.com", "13300000004", "active").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(4, now, now))
+
+    user := &model.User{Name: "Dave", Email: "dave@example.com", Phone: "13300000004", Status: "active"}
+    err := r.CreateUser(context.Background(), r.DB, user)
+    require.NoError(t, err)
+    require.Equal(t, 4, user.ID)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that unique violations on the email and phone indexes are told apart
+func TestCreateUserDuplicate(t *testing.T) {
+    r, mock := newTestUserRepository(t)
+
+    mock.ExpectQuery("INSERT INTO users").
+        WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_idx"})
+    mock.ExpectQuery("INSERT INTO users").
+        WillReturnError(&pq.Error{Code: "23505", Constraint: "users_phone_idx"})
+
+    err := r.CreateUser(context.Background(), r.DB, &model.User{Name: "Dave", Email: "alice@example.com", Phone: "13300000004", Status: "active"})
+    require.ErrorIs(t, err, ErrDuplicateEmail)
+
+    err = r.CreateUser(context.Background(), r.DB, &model.User{Name: "Dave", Email: "dave@example.com", Phone: "13300000001", Status: "active"})
+    require.ErrorIs(t, err, ErrDuplicatePhone)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestGetUser(t *testing.T) {
+    r, mock := newTestUserRepository(t)
+
+    now := time.Now()
+    mock.ExpectQuery("SELECT id, name, email, phone, status, kyc_tier, created_at, updated_at FROM users WHERE id = \\$1 AND deleted_at IS NULL").
+        WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "phone", "status", "kyc_tier", "created_at", "updated_at"}).
+            AddRow(1, "Alice", "alice@example.com", "13300000001", "active", "basic", now, now))
+    mock.ExpectQuery("SELECT id, name, email, phone, status, kyc_tier, created_at, updated_at FROM users WHERE id = \\$1 AND deleted_at IS NULL").
+        WithArgs(9).
+        WillReturnError(sql.ErrNoRows)
+
+    user, err := r.GetUser(context.Background(), r.DB, 1)
+    require.NoError(t, err)
+    require.Equal(t, "Alice", user.Name)
+    require.Equal(t, "active", user.Status)
+    require.Equal(t, "basic", user.KYCTier)
+
+    _, err = r.GetUser(context.Background(), r.DB, 9)
+    require.ErrorIs(t, err, ErrUserNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestUpdateUser(t *testing.T) {
+    r, mock := newTestUserRepository(t)
+
+    mock.ExpectQuery("UPDATE users SET name = \\$1, email = \\$2, phone = \\$3, updated_at = NOW\\(\\) WHERE id = \\$4 AND deleted_at IS NULL").
+        WithArgs("Alice Smith", "alice@example.com", "13300000001", 1).
+        WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(time.Now()))
+    mock.ExpectQuery("UPDATE users SET name").
+        WithArgs("Bob", "alice@example.com", "13300000002", 2).
+        WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_idx"})
+
+    err := r.UpdateUser(context.Background(), r.DB, &model.User{ID: 1, Name: "Alice Smith", Email: "alice@example.com", Phone: "13300000001"})
+    require.NoError(t, err)
+
+    err = r.UpdateUser(context.Background(), r.DB, &model.User{ID: 2, Name: "Bob", Email: "alice@example.com", Phone: "13300000002"})
+    require.ErrorIs(t, err, ErrDuplicateEmail)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestDeleteUser(t *testing.T) {
+    r, mock := newTestUserRepository(t)
+
+    mock.ExpectExec("UPDATE users SET status = 'inactive', deleted_at = NOW\\(\\), updated_at = NOW\\(\\) WHERE id = \\$1 AND deleted_at IS NULL").
+        WithArgs(3).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    // The user has already been deleted
+    mock.ExpectExec("UPDATE users SET status = 'inactive'").
+        WithArgs(3).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+
+    err := r.DeleteUser(context.Background(), r.DB, 3)
+    require.NoError(t, err)
+
+    err = r.DeleteUser(context.Background(), r.DB, 3)
+    require.ErrorIs(t, err, ErrUserNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestUpdateStatus(t *testing.T) {
+    r, mock := newTestUserRepository(t)
+
+    mock.ExpectQuery("UPDATE users u SET status = \\$1, updated_at = NOW\\(\\) FROM \\(SELECT id, status FROM users WHERE id = \\$2 AND deleted_at IS NULL FOR UPDATE\\) old").
+        WithArgs("suspended", 2).
+        WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+    mock.ExpectQuery("UPDATE users u SET status").
+        WithArgs("active", 9).
+        WillReturnError(sql.ErrNoRows)
+
+    oldStatus, err := r.UpdateStatus(context.Background(), r.DB, 2, "suspended")
+    require.NoError(t, err)
+    require.Equal(t, "active", oldStatus)
+
+    _, err = r.UpdateStatus(context.Background(), r.DB, 9, "active")
+    require.ErrorIs(t, err, ErrUserNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestStatusChanges(t *testing.T) {
+    r, mock := newTestUserRepository(t)
+
+    now := time.Now()
+    mock.ExpectQuery("INSERT INTO user_status_changes").
+        WithArgs(2, "active", "suspended", "chargeback investigation", nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, now))
+    mock.ExpectQuery("SELECT id, user_id, old_status, new_status, reason, COALESCE\\(changed_by, ''\\) AS changed_by, created_at FROM user_status_changes WHERE user_id = \\$1").
+        WithArgs(2).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "old_status", "new_status", "reason", "changed_by", "created_at"}).
+            AddRow(1, 2, "active", "suspended", "chargeback investigation", "", now))
+
+    change := &model.StatusChange{UserID: 2, OldStatus: "active", NewStatus: "suspended", Reason: "chargeback investigation"}
+    err := r.RecordStatusChange(context.Background(), r.DB, change)
+    require.NoError(t, err)
+    require.Equal(t, 1, change.ID)
+
+    changes, err := r.GetStatusChanges(context.Background(), 2)
+    require.NoError(t, err)
+    require.Len(t, changes, 1)
+    require.Equal(t, "suspended", changes[0].NewStatus)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -2,9 +2,11 @@ package repository
 
 import (
     "context"
+    "errors"
     "fmt"
     "database/sql"
     "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
     "github.com/yaoweihua/wallet-service/model"
     "github.com/shopspring/decimal"
     "github.com/yaoweihua/wallet-service/utils"
@@ -12,6 +14,17 @@ import (
     "github.com/sirupsen/logrus"
 )
 
+// ErrUserNotFound is returned when the requested user does not exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrStaleFencingToken is returned when a balance is written with a fencing token older than one already seen for the user,
+// which means the caller's lock expired and another request has taken it over in the meantime.
+var ErrStaleFencingToken = errors.New("stale fencing token, the balance lock was lost")
+
+// ErrVersionConflict is returned when a wallet balance is updated with a version that is no longer current,
+// because another request changed the balance after it was read.
+var ErrVersionConflict = errors.New("balance was modified concurrently")
+
 // WalletRepository provides database operations related to wallets
 type WalletRepository struct {
     DB     *sqlx.DB
@@ -27,35 +40,198 @@ func NewWalletRepository(db *sqlx.DB) *WalletRepository {
     }
 }
 
-// GetUserBalance retrieves the current balance of the user
-func (r *WalletRepository) GetUserBalance(ctx context.Context, userID int) (*model.User, error) {
-    var user model.User
+// EnsureWallet opens the user's wallet in the given currency with a zero balance, unless it exists already.
+// It returns ErrUserNotFound if the user does not exist.
+func (r *WalletRepository) EnsureWallet(ctx context.Context, exec Executor, userID int, currency string) error {
+    query := `
+        INSERT INTO wallets (user_id, currency, balance, created_at, updated_at)
+        VALUES ($1, $2, 0, NOW(), NOW())
+        ON CONFLICT (user_id, currency) DO NOTHING
+    `
+
+    if _, err := exec.ExecContext(ctx, query, userID, currency); err != nil {
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+            return fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to open %s wallet for user %d", currency, userID), err)
+        return fmt.Errorf("failed to open %s wallet for user %d: %w", currency, userID, err)
+    }
+    return nil
+}
+
+// GetWallet retrieves the user's wallet in the given currency together with the user's status, and locks the wallet row
+// until the end of the transaction exec belongs to. Pass the caller's *sqlx.Tx so the lock covers the following UpdateBalance.
+// The user row is share locked, so the status cannot change before the transaction ends.
+func (r *WalletRepository) GetWallet(ctx context.Context, exec Executor, userID int, currency string) (*model.Wallet, error) {
     query := `
-        SELECT id, balance
-        FROM users
-        WHERE id = $1
-        FOR UPDATE
+        SELECT w.id, w.user_id, w.currency, w.balance, w.held, w.version, u.status AS user_status, u.kyc_tier AS user_tier, w.created_at, w.updated_at
+        FROM wallets w
+        JOIN users u ON u.id = w.user_id
+        WHERE w.user_id = $1 AND w.currency = $2 AND u.deleted_at IS NULL
+        FOR UPDATE OF w FOR SHARE OF u
     `
     // Execute the query and apply a lock
-    err := r.DB.GetContext(ctx, &user, query, userID)
+    return r.getWallet(ctx, exec, query, userID, currency)
+}
+
+// GetWalletSnapshot retrieves the user's wallet in the given currency without locking any row.
+// It is used in optimistic concurrency mode, where UpdateBalance detects concurrent changes through the version.
+func (r *WalletRepository) GetWalletSnapshot(ctx context.Context, exec Executor, userID int, currency string) (*model.Wallet, error) {
+    query := `
+        SELECT w.id, w.user_id, w.currency, w.balance, w.held, w.version, u.status AS user_status, u.kyc_tier AS user_tier, w.created_at, w.updated_at
+        FROM wallets w
+        JOIN users u ON u.id = w.user_id
+        WHERE w.user_id = $1 AND w.currency = $2 AND u.deleted_at IS NULL
+    `
+    return r.getWallet(ctx, exec, query, userID, currency)
+}
+
+func (r *WalletRepository) getWallet(ctx context.Context, exec Executor, query string, userID int, currency string) (*model.Wallet, error) {
+    var wallet model.Wallet
+    err := exec.GetContext(ctx, &wallet, query, userID, currency)
     if err != nil {
         if err == sql.ErrNoRows {
-            return nil, fmt.Errorf("user %d not found", userID)
+            return nil, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
         }
-        r.Logger.Error(fmt.Sprintf("Failed to fetch user balance for user %d", userID), err)
+        r.Logger.Error(fmt.Sprintf("Failed to fetch %s wallet for user %d", currency, userID), err)
         return nil, fmt.Errorf("failed to fetch user balance: %w", err)
     }
 
-    return &user, nil
+    return &wallet, nil
+}
+
+// GetWallets retrieves all wallets of an open user, ordered by currency.
+// It returns ErrUserNotFound if the user does not exist, has been deleted or has no wallet.
+func (r *WalletRepository) GetWallets(ctx context.Context, exec Executor, userID int) ([]model.Wallet, error) {
+    query := `
+        SELECT w.id, w.user_id, w.currency, w.balance, w.held, w.version, u.status AS user_status, u.kyc_tier AS user_tier, w.created_at, w.updated_at
+        FROM wallets w
+        JOIN users u ON u.id = w.user_id
+        WHERE w.user_id = $1 AND u.deleted_at IS NULL
+        ORDER BY w.currency
+    `
+    return r.getWallets(ctx, exec, query, userID)
+}
+
+// LockWallets retrieves all wallets of an open user like GetWallets, and locks them until the end of the transaction exec belongs to.
+func (r *WalletRepository) LockWallets(ctx context.Context, exec Executor, userID int) ([]model.Wallet, error) {
+    query := `
+        SELECT w.id, w.user_id, w.currency, w.balance, w.held, w.version, u.status AS user_status, u.kyc_tier AS user_tier, w.created_at, w.updated_at
+        FROM wallets w
+        JOIN users u ON u.id = w.user_id
+        WHERE w.user_id = $1 AND u.deleted_at IS NULL
+        ORDER BY w.currency
+        FOR UPDATE OF w
+    `
+    return r.getWallets(ctx, exec, query, userID)
+}
+
+func (r *WalletRepository) getWallets(ctx context.Context, exec Executor, query string, userID int) ([]model.Wallet, error) {
+    var wallets []model.Wallet
+    if err := exec.SelectContext(ctx, &wallets, query, userID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to fetch wallets for user %d", userID), err)
+        return nil, fmt.Errorf("failed to fetch wallets for user %d: %w", userID, err)
+    }
+    if len(wallets) == 0 {
+        return nil, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+    }
+    return wallets, nil
 }
 
-// UpdateBalance updates the user's balance
-func (r *WalletRepository) UpdateBalance(ctx context.Context, tx *sqlx.Tx, userID int, newBalance decimal.Decimal) error {
+// UpdateBalance updates the wallet's balance if its version still matches the version it was read with,
+// and increments the version. It returns ErrVersionConflict if the balance was changed in the meantime.
+func (r *WalletRepository) UpdateBalance(ctx context.Context, exec Executor, walletID int, newBalance decimal.Decimal, version int64) error {
     now := time.Now()
-    _, err := tx.ExecContext(ctx, "UPDATE users SET balance = $1, updated_at = $2 WHERE id = $3", newBalance, now, userID)
+    result, err := exec.ExecContext(ctx, "UPDATE wallets SET balance = $1, version = version + 1, updated_at = $2 WHERE id = $3 AND version = $4", newBalance, now, walletID, version)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to update balance of wallet %d", walletID), err)
+        return fmt.Errorf("failed to update balance of wallet %d: %w", walletID, err)
+    }
+
+    rows, err := result.RowsAffected()
     if err != nil {
-        r.Logger.Error(fmt.Sprintf("Failed to update balance for user %d", userID), err)
-        return fmt.Errorf("failed to update balance for user %d: %w", userID, err)
+        return fmt.Errorf("failed to update balance of wallet %d: %w", walletID, err)
+    }
+    if rows == 0 {
+        return ErrVersionConflict
+    }
+    return nil
+}
+
+// UpdateFunds updates the wallet's balance and the part of it held for pending withdrawals together, if its version
+// still matches the version it was read with, and increments the version. It returns ErrVersionConflict otherwise.
+func (r *WalletRepository) UpdateFunds(ctx context.Context, exec Executor, walletID int, newBalance, newHeld decimal.Decimal, version int64) error {
+    result, err := exec.ExecContext(ctx, "UPDATE wallets SET balance = $1, held = $2, version = version + 1, updated_at = $3 WHERE id = $4 AND version = $5",
+        newBalance, newHeld, time.Now(), walletID, version)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to update funds of wallet %d", walletID), err)
+        return fmt.Errorf("failed to update funds of wallet %d: %w", walletID, err)
+    }
+
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to update funds of wallet %d: %w", walletID, err)
+    }
+    if rows == 0 {
+        return ErrVersionConflict
+    }
+    return nil
+}
+
+// BumpWalletVersions increments the version of all wallets of the user, so that in-flight optimistic
+// balance updates are retried, for example against a status that has just changed.
+func (r *WalletRepository) BumpWalletVersions(ctx context.Context, exec Executor, userID int) error {
+    if _, err := exec.ExecContext(ctx, "UPDATE wallets SET version = version + 1 WHERE user_id = $1", userID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to bump wallet versions for user %d", userID), err)
+        return fmt.Errorf("failed to bump wallet versions for user %d: %w", userID, err)
+    }
+    return nil
+}
+
+// CheckFence stores the fencing token of the caller's balance lock on the user row, rejecting tokens older than the latest one seen.
+// It must run in the same database transaction as the balance update it protects.
+func (r *WalletRepository) CheckFence(ctx context.Context, exec Executor, userID int, token int64) error {
+    result, err := exec.ExecContext(ctx, "UPDATE users SET fence_token = $1 WHERE id = $2 AND fence_token <= $1", token, userID)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to check fencing token for user %d", userID), err)
+        return fmt.Errorf("failed to check fencing token for user %d: %w", userID, err)
+    }
+
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to check fencing token for user %d: %w", userID, err)
+    }
+    if rows == 0 {
+        return ErrStaleFencingToken
     }
     return nil
 }
+
+// SwitchFencingBackend records the lock backend issuing fencing tokens from now on. If another backend issued the
+// tokens stored so far, they are reset to 0, because the tokens of different backends are not comparable: the
+// PostgreSQL backend takes them from one global sequence and the Redis backend counts per key, so stored tokens
+// of one would make every token of the other look stale. It returns the number of users whose token was reset.
+func (r *WalletRepository) SwitchFencingBackend(ctx context.Context, exec Executor, backend string) (int64, error) {
+    query := `
+        WITH previous AS (
+            SELECT lock_backend FROM fencing_state WHERE id FOR UPDATE
+        ), switched AS (
+            INSERT INTO fencing_state (id, lock_backend) VALUES (TRUE, $1)
+            ON CONFLICT (id) DO UPDATE SET lock_backend = EXCLUDED.lock_backend
+        )
+        UPDATE users SET fence_token = 0
+        WHERE fence_token <> 0 AND NOT EXISTS (SELECT 1 FROM previous WHERE lock_backend = $1)
+    `
+
+    result, err := exec.ExecContext(ctx, query, backend)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to switch fencing tokens to lock backend %s", backend), err)
+        return 0, fmt.Errorf("failed to switch fencing tokens to lock backend %s: %w", backend, err)
+    }
+    reset, err := result.RowsAffected()
+    if err != nil {
+        return 0, fmt.Errorf("failed to switch fencing tokens to lock backend %s: %w", backend, err)
+    }
+    return reset, nil
+}
@@ -10,8 +10,9 @@ import (
     "github.com/jmoiron/sqlx"
     "github.com/sirupsen/logrus"
     "database/sql"
-    "github.com/yaoweihua/wallet-service/model"
+    "github.com/lib/pq"
     "io"
+    "time"
 )
 
 func NewTestLogger() *logrus.Logger {
@@ -20,8 +21,39 @@ func NewTestLogger() *logrus.Logger {
     return logger
 }
 
-// Test the scenario where retrieving the user's balance is successful
-func TestGetUserBalance(t *testing.T) {
+// walletColumns are the columns selected by the wallet queries
+var walletColumns = []string{"id", "user_id", "currency", "balance", "version", "user_status", "created_at", "updated_at"}
+
+// Test that a missing wallet is opened, and that opening a wallet for an unknown user is reported as such
+func TestEnsureWallet(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &WalletRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectExec("INSERT INTO wallets \\(user_id, currency, balance, created_at, updated_at\\) VALUES \\(\\$1, \\$2, 0, NOW\\(\\), NOW\\(\\)\\) ON CONFLICT \\(user_id, currency\\) DO NOTHING").
+        WithArgs(1, "JPY").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(99, "JPY").
+        WillReturnError(&pq.Error{Code: "23503"})
+
+    err = r.EnsureWallet(context.Background(), r.DB, 1, "JPY")
+    require.NoError(t, err)
+
+    err = r.EnsureWallet(context.Background(), r.DB, 99, "JPY")
+    require.ErrorIs(t, err, ErrUserNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test the scenario where retrieving the user's wallet is successful
+func TestGetWallet(t *testing.T) {
     db, mock, err := sqlmock.New()
     require.NoError(t, err)
     defer db.Close() // nolint:errcheck
@@ -33,29 +65,58 @@ func TestGetUserBalance(t *testing.T) {
         Logger: logger,
     }
 
-    userID := 1
-    expectedUser := model.User{
-        ID:      userID,
-        Balance: decimal.NewFromInt(100),
+    now := time.Now()
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u ON u.id = w.user_id WHERE w.user_id = \\$1 AND w.currency = \\$2 AND u.deleted_at IS NULL FOR UPDATE OF w FOR SHARE OF u").
+        WithArgs(1, "USD").
+        WillReturnRows(sqlmock.NewRows(walletColumns).AddRow(5, 1, "USD", decimal.NewFromInt(100), 4, "suspended", now, now))
+
+    wallet, err := r.GetWallet(context.Background(), r.DB, 1, "USD")
+    require.NoError(t, err)
+    require.NotNil(t, wallet)
+    require.Equal(t, 5, wallet.ID)
+    require.Equal(t, decimal.NewFromInt(100), wallet.Balance)
+    require.Equal(t, "suspended", wallet.UserStatus)
+    require.Equal(t, int64(4), wallet.Version)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that the wallet snapshot is read inside the caller's transaction without locking the row
+func TestGetWalletSnapshot(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &WalletRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
     }
 
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1 FOR UPDATE").
-        WithArgs(userID).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).
-            AddRow(expectedUser.ID, expectedUser.Balance))
+    now := time.Now()
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u ON u.id = w.user_id WHERE w.user_id = \\$1 AND w.currency = \\$2 AND u.deleted_at IS NULL$").
+        WithArgs(1, "EUR").
+        WillReturnRows(sqlmock.NewRows(walletColumns).AddRow(6, 1, "EUR", decimal.NewFromInt(100), 7, "active", now, now))
+    mock.ExpectRollback()
 
-    user, err := r.GetUserBalance(context.Background(), userID)
+    tx, err := r.DB.Beginx()
+    require.NoError(t, err)
+
+    wallet, err := r.GetWalletSnapshot(context.Background(), tx, 1, "EUR")
+    require.NoError(t, err)
+    require.Equal(t, decimal.NewFromInt(100), wallet.Balance)
+    require.Equal(t, int64(7), wallet.Version)
+
+    err = tx.Rollback()
     require.NoError(t, err)
-    require.NotNil(t, user)
-    require.Equal(t, expectedUser.ID, user.ID)
-    require.Equal(t, expectedUser.Balance, user.Balance)
 
     err = mock.ExpectationsWereMet()
     require.NoError(t, err)
 }
 
-// Test the situation where retrieving the user's balance fails because the user does not exist
-func TestGetUserBalanceNoFound(t *testing.T) {
+// Test the situation where retrieving the user's wallet fails because the user does not exist
+func TestGetWalletNoFound(t *testing.T) {
     db, mock, err := sqlmock.New()
     require.NoError(t, err)
     defer db.Close() // nolint:errcheck
@@ -68,16 +129,48 @@ func TestGetUserBalanceNoFound(t *testing.T) {
         Logger: logger,
     }
 
-    userID := 1
-
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1 FOR UPDATE").
-        WithArgs(userID).
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u").
+        WithArgs(1, "USD").
         WillReturnError(sql.ErrNoRows)
 
-    user, err := r.GetUserBalance(context.Background(), userID)
+    wallet, err := r.GetWallet(context.Background(), r.DB, 1, "USD")
     require.Error(t, err)
-    require.Nil(t, user)
-    require.Contains(t, err.Error(), "user 1 not found")
+    require.Nil(t, wallet)
+    require.ErrorIs(t, err, ErrUserNotFound)
+    require.Equal(t, "user not found: 1", err.Error())
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that all wallets of a user are listed, and that a user without wallets is not found
+func TestGetWallets(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &WalletRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    now := time.Now()
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u ON u.id = w.user_id WHERE w.user_id = \\$1 AND u.deleted_at IS NULL ORDER BY w.currency$").
+        WithArgs(1).
+        WillReturnRows(sqlmock.NewRows(walletColumns).
+            AddRow(6, 1, "EUR", decimal.RequireFromString("12.5"), 0, "active", now, now).
+            AddRow(7, 1, "JPY", decimal.NewFromInt(1500), 0, "active", now, now))
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u ON u.id = w.user_id WHERE w.user_id = \\$1 AND u.deleted_at IS NULL ORDER BY w.currency FOR UPDATE OF w").
+        WithArgs(9).
+        WillReturnRows(sqlmock.NewRows(walletColumns))
+
+    wallets, err := r.GetWallets(context.Background(), r.DB, 1)
+    require.NoError(t, err)
+    require.Len(t, wallets, 2)
+    require.Equal(t, "JPY", wallets[1].Currency)
+
+    _, err = r.LockWallets(context.Background(), r.DB, 9)
+    require.ErrorIs(t, err, ErrUserNotFound)
 
     err = mock.ExpectationsWereMet()
     require.NoError(t, err)
@@ -93,19 +186,19 @@ func TestUpdateBalance(t *testing.T) {
         Logger: NewTestLogger(),
     }
 
-    userID := 1
+    walletID := 1
     newBalance := decimal.NewFromInt(150)
 
     mock.ExpectBegin()
     // Use AnyTime() to allow time matching while ignoring minor differences
-    mock.ExpectExec("UPDATE users SET balance = \\$1, updated_at = \\$2 WHERE id = \\$3").
-        WithArgs(newBalance, sqlmock.AnyArg(), userID).
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(newBalance, sqlmock.AnyArg(), walletID, int64(0)).
         WillReturnResult(sqlmock.NewResult(1, 1))
     mock.ExpectCommit()
 
     tx, err := r.DB.Beginx()
     require.NoError(t, err)
-    err = r.UpdateBalance(context.Background(), tx, userID, newBalance)
+    err = r.UpdateBalance(context.Background(), tx, walletID, newBalance, 0)
     require.NoError(t, err)
 
     err = tx.Commit()
@@ -128,21 +221,51 @@ func TestUpdateBalance_Error(t *testing.T) {
         Logger: logger,
     }
 
-    userID := 1
+    walletID := 1
     newBalance := decimal.NewFromInt(150)
 
     mock.ExpectBegin()
     // Use AnyTime() to allow time matching while ignoring minor differences
-    mock.ExpectExec("UPDATE users SET balance = \\$1, updated_at = \\$2 WHERE id = \\$3").
-        WithArgs(newBalance, sqlmock.AnyArg(), userID).
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(newBalance, sqlmock.AnyArg(), walletID, int64(0)).
         WillReturnError(fmt.Errorf("DB error"))
     mock.ExpectRollback()
 
     tx, err := r.DB.Beginx()
     require.NoError(t, err)
-    err = r.UpdateBalance(context.Background(), tx, userID, newBalance)
+    err = r.UpdateBalance(context.Background(), tx, walletID, newBalance, 0)
     require.Error(t, err)
-    require.Contains(t, err.Error(), "failed to update balance for user 1")
+    require.Contains(t, err.Error(), "failed to update balance of wallet 1")
+
+    err = tx.Rollback()
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that an update based on a stale version is reported as a conflict
+func TestUpdateBalanceVersionConflict(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &WalletRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectBegin()
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(150), sqlmock.AnyArg(), 1, int64(2)).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectRollback()
+
+    tx, err := r.DB.Beginx()
+    require.NoError(t, err)
+
+    err = r.UpdateBalance(context.Background(), tx, 1, decimal.NewFromInt(150), 2)
+    require.ErrorIs(t, err, ErrVersionConflict)
 
     err = tx.Rollback()
     require.NoError(t, err)
@@ -151,3 +274,92 @@ func TestUpdateBalance_Error(t *testing.T) {
     require.NoError(t, err)
 }
 
+// Test that bumping the wallet versions touches every wallet of the user
+func TestBumpWalletVersions(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &WalletRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectExec("UPDATE wallets SET version = version \\+ 1 WHERE user_id = \\$1").
+        WithArgs(2).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+
+    err = r.BumpWalletVersions(context.Background(), r.DB, 2)
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestCheckFence(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &WalletRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    mock.ExpectBegin()
+    // The token is newer than the stored one
+    mock.ExpectExec("UPDATE users SET fence_token = \\$1 WHERE id = \\$2 AND fence_token <= \\$1").
+        WithArgs(int64(8), 1).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    // The token is older than the stored one
+    mock.ExpectExec("UPDATE users SET fence_token = \\$1 WHERE id = \\$2 AND fence_token <= \\$1").
+        WithArgs(int64(3), 1).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectRollback()
+
+    tx, err := r.DB.Beginx()
+    require.NoError(t, err)
+
+    err = r.CheckFence(context.Background(), tx, 1, 8)
+    require.NoError(t, err)
+
+    err = r.CheckFence(context.Background(), tx, 1, 3)
+    require.ErrorIs(t, err, ErrStaleFencingToken)
+
+    err = tx.Rollback()
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestSwitchFencingBackend(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    r := &WalletRepository{
+        DB:     sqlx.NewDb(db, "sqlmock"),
+        Logger: NewTestLogger(),
+    }
+
+    // The tokens were issued by another backend and are reset
+    mock.ExpectExec("WITH previous AS (.+) FROM fencing_state (.+) UPDATE users SET fence_token = 0").
+        WithArgs("redis").
+        WillReturnResult(sqlmock.NewResult(0, 3))
+    // The backend did not change
+    mock.ExpectExec("WITH previous AS (.+) FROM fencing_state (.+) UPDATE users SET fence_token = 0").
+        WithArgs("redis").
+        WillReturnResult(sqlmock.NewResult(0, 0))
+
+    reset, err := r.SwitchFencingBackend(context.Background(), r.DB, "redis")
+    require.NoError(t, err)
+    require.Equal(t, int64(3), reset)
+
+    reset, err = r.SwitchFencingBackend(context.Background(), r.DB, "redis")
+    require.NoError(t, err)
+    require.Equal(t, int64(0), reset)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
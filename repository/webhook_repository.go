@@ -0,0 +1,228 @@
+package repository
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/sirupsen/logrus"
+)
+
+// ErrWebhookEndpointNotFound is returned when the requested webhook endpoint does not exist.
+var ErrWebhookEndpointNotFound = errors.New("webhook endpoint not found")
+
+// ErrWebhookDeliveryNotFound is returned when the requested webhook delivery does not exist.
+var ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+
+// Columns webhook endpoints and deliveries are read from.
+const (
+    webhookEndpointColumns = "id, user_id, url, secret, event_types, status, created_at, updated_at"
+    webhookDeliveryColumns = "id, endpoint_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_status_code, last_error, delivered_at, created_at, updated_at"
+)
+
+// WebhookRepository provides database operations related to webhook endpoints and their deliveries
+type WebhookRepository struct {
+    DB     *sqlx.DB
+    Logger *logrus.Logger
+}
+
+// NewWebhookRepository creates a new instance of WebhookRepository
+func NewWebhookRepository(db *sqlx.DB) *WebhookRepository {
+    logger := utils.GetLogger()
+    return &WebhookRepository{
+        DB:     db,
+        Logger: logger,
+    }
+}
+
+// CreateEndpoint stores a new webhook endpoint and fills in its generated ID and timestamps.
+// It returns ErrUserNotFound if the user does not exist.
+func (r *WebhookRepository) CreateEndpoint(ctx context.Context, exec Executor, endpoint *model.WebhookEndpoint) error {
+    query := `
+        INSERT INTO webhook_endpoints (user_id, url, secret, event_types, status, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+        RETURNING id, created_at, updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, endpoint.UserID, endpoint.URL, endpoint.Secret, endpoint.EventTypes, endpoint.Status).
+        Scan(&endpoint.ID, &endpoint.CreatedAt, &endpoint.UpdatedAt)
+    if err != nil {
+        var pqErr *pq.Error
+        if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+            return fmt.Errorf("%w: %d", ErrUserNotFound, endpoint.UserID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to create webhook endpoint for user %d", endpoint.UserID), err)
+        return fmt.Errorf("failed to create webhook endpoint for user %d: %w", endpoint.UserID, err)
+    }
+    return nil
+}
+
+// GetEndpoint retrieves the webhook endpoint with the given ID, returning ErrWebhookEndpointNotFound if it does not exist.
+func (r *WebhookRepository) GetEndpoint(ctx context.Context, exec Executor, endpointID int) (*model.WebhookEndpoint, error) {
+    var endpoint model.WebhookEndpoint
+    query := "SELECT " + webhookEndpointColumns + " FROM webhook_endpoints WHERE id = $1"
+
+    if err := exec.GetContext(ctx, &endpoint, query, endpointID); err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrWebhookEndpointNotFound, endpointID)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting webhook endpoint %d", endpointID), err)
+        return nil, fmt.Errorf("failed to fetch webhook endpoint %d: %w", endpointID, err)
+    }
+    return &endpoint, nil
+}
+
+// GetEndpoints retrieves the webhook endpoints of the user, including disabled ones, newest first.
+func (r *WebhookRepository) GetEndpoints(ctx context.Context, exec Executor, userID int) ([]model.WebhookEndpoint, error) {
+    endpoints := []model.WebhookEndpoint{}
+    query := "SELECT " + webhookEndpointColumns + " FROM webhook_endpoints WHERE user_id = $1 ORDER BY id DESC"
+
+    if err := exec.SelectContext(ctx, &endpoints, query, userID); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting webhook endpoints of user %d", userID), err)
+        return nil, fmt.Errorf("failed to fetch webhook endpoints of user %d: %w", userID, err)
+    }
+    return endpoints, nil
+}
+
+// GetSubscribedEndpoints retrieves the active webhook endpoints of any of the users that subscribed to the event type, in ID order.
+func (r *WebhookRepository) GetSubscribedEndpoints(ctx context.Context, exec Executor, userIDs []int, eventType string) ([]model.WebhookEndpoint, error) {
+    endpoints := []model.WebhookEndpoint{}
+    query := "SELECT " + webhookEndpointColumns + ` FROM webhook_endpoints
+        WHERE user_id = ANY($1) AND status = 'active' AND $2 = ANY(event_types)
+        ORDER BY id`
+
+    if err := exec.SelectContext(ctx, &endpoints, query, pq.Array(userIDs), eventType); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting webhook endpoints subscribed to %s", eventType), err)
+        return nil, fmt.Errorf("failed to fetch webhook endpoints subscribed to %s: %w", eventType, err)
+    }
+    return endpoints, nil
+}
+
+// UpdateEndpointStatus stores the status of the webhook endpoint and fills in its update time.
+func (r *WebhookRepository) UpdateEndpointStatus(ctx context.Context, exec Executor, endpoint *model.WebhookEndpoint) error {
+    query := "UPDATE webhook_endpoints SET status = $2, updated_at = NOW() WHERE id = $1 RETURNING updated_at"
+
+    if err := exec.QueryRowxContext(ctx, query, endpoint.ID, endpoint.Status).Scan(&endpoint.UpdatedAt); err != nil {
+        if err == sql.ErrNoRows {
+            return fmt.Errorf("%w: %d", ErrWebhookEndpointNotFound, endpoint.ID)
+        }
+        r.Logger.Error(fmt.Sprintf("Failed to update webhook endpoint %d", endpoint.ID), err)
+        return fmt.Errorf("failed to update webhook endpoint %d: %w", endpoint.ID, err)
+    }
+    return nil
+}
+
+// AddDeliveries stores pending deliveries, due right away, in one statement. A delivery of an event the endpoint
+// already has is skipped, so an event published twice is only delivered once.
+func (r *WebhookRepository) AddDeliveries(ctx context.Context, exec Executor, deliveries []model.WebhookDelivery) error {
+    if len(deliveries) == 0 {
+        return nil
+    }
+
+    rows := make([]string, 0, len(deliveries))
+    args := make([]interface{}, 0, 4*len(deliveries))
+    for i, delivery := range deliveries {
+        rows = append(rows, fmt.Sprintf("($%d, $%d, $%d, $%d, 'pending', NOW(), NOW(), NOW())", 4*i+1, 4*i+2, 4*i+3, 4*i+4))
+        // The payload is passed as text, a byte slice would be sent as bytea
+        args = append(args, delivery.EndpointID, delivery.EventID, delivery.EventType, string(delivery.Payload))
+    }
+    query := "INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload, status, next_attempt_at, created_at, updated_at) VALUES " +
+        strings.Join(rows, ", ") + " ON CONFLICT (endpoint_id, event_id) DO NOTHING"
+
+    if _, err := exec.ExecContext(ctx, query, args...); err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to add %d webhook deliveries", len(deliveries)), err)
+        return fmt.Errorf("failed to add webhook deliveries: %w", err)
+    }
+    return nil
+}
+
+// GetDelivery retrieves the webhook delivery with the given ID, returning ErrWebhookDeliveryNotFound if it does not exist.
+func (r *WebhookRepository) GetDelivery(ctx context.Context, exec Executor, deliveryID int64) (*model.WebhookDelivery, error) {
+    query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE id = $1"
+    return r.getDelivery(ctx, exec, query, deliveryID)
+}
+
+// LockDelivery retrieves the webhook delivery like GetDelivery, and locks it until the end of the transaction exec belongs to.
+func (r *WebhookRepository) LockDelivery(ctx context.Context, exec Executor, deliveryID int64) (*model.WebhookDelivery, error) {
+    query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE id = $1 FOR UPDATE"
+    return r.getDelivery(ctx, exec, query, deliveryID)
+}
+
+func (r *WebhookRepository) getDelivery(ctx context.Context, exec Executor, query string, deliveryID int64) (*model.WebhookDelivery, error) {
+    var delivery model.WebhookDelivery
+    if err := exec.GetContext(ctx, &delivery, query, deliveryID); err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w: %d", ErrWebhookDeliveryNotFound, deliveryID)
+        }
+        r.Logger.Error(fmt.Sprintf("Error getting webhook delivery %d", deliveryID), err)
+        return nil, fmt.Errorf("failed to fetch webhook delivery %d: %w", deliveryID, err)
+    }
+    return &delivery, nil
+}
+
+// ClaimDueDelivery claims the pending delivery that has been due the longest at now, by putting its next attempt off
+// until the given time, and returns it. The claim is made in one statement, so no lock is held while the delivery is
+// attempted; a delivery claimed by an instance of the service that stops falls due again once the claim expires.
+// It returns nil if no delivery is due.
+func (r *WebhookRepository) ClaimDueDelivery(ctx context.Context, exec Executor, now, until time.Time) (*model.WebhookDelivery, error) {
+    query := `
+        UPDATE webhook_deliveries SET next_attempt_at = $2, updated_at = NOW()
+        WHERE id = (
+            SELECT id FROM webhook_deliveries
+            WHERE status = 'pending' AND next_attempt_at <= $1
+            ORDER BY next_attempt_at, id
+            LIMIT 1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING ` + webhookDeliveryColumns
+
+    var delivery model.WebhookDelivery
+    if err := exec.GetContext(ctx, &delivery, query, now, until); err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        r.Logger.Error("Error claiming due webhook deliveries", err)
+        return nil, fmt.Errorf("failed to claim due webhook deliveries: %w", err)
+    }
+    return &delivery, nil
+}
+
+// UpdateDelivery stores the outcome of the last attempt of a webhook delivery and fills in its update time.
+func (r *WebhookRepository) UpdateDelivery(ctx context.Context, exec Executor, delivery *model.WebhookDelivery) error {
+    query := `
+        UPDATE webhook_deliveries
+        SET status = $2, attempts = $3, next_attempt_at = $4, last_status_code = $5, last_error = $6, delivered_at = $7, updated_at = NOW()
+        WHERE id = $1
+        RETURNING updated_at
+    `
+
+    err := exec.QueryRowxContext(ctx, query, delivery.ID, delivery.Status, delivery.Attempts, delivery.NextAttemptAt,
+        delivery.LastStatusCode, delivery.LastError, delivery.DeliveredAt).Scan(&delivery.UpdatedAt)
+    if err != nil {
+        r.Logger.Error(fmt.Sprintf("Failed to update webhook delivery %d", delivery.ID), err)
+        return fmt.Errorf("failed to update webhook delivery %d: %w", delivery.ID, err)
+    }
+    return nil
+}
+
+// GetDeliveries retrieves up to limit of the latest deliveries to the webhook endpoint, newest first,
+// only those with the given status unless it is empty.
+func (r *WebhookRepository) GetDeliveries(ctx context.Context, exec Executor, endpointID int, status string, limit int) ([]model.WebhookDelivery, error) {
+    deliveries := []model.WebhookDelivery{}
+    query := "SELECT " + webhookDeliveryColumns + ` FROM webhook_deliveries
+        WHERE endpoint_id = $1 AND ($2 = '' OR status = $2)
+        ORDER BY id DESC
+        LIMIT $3`
+
+    if err := exec.SelectContext(ctx, &deliveries, query, endpointID, status, limit); err != nil {
+        r.Logger.Error(fmt.Sprintf("Error getting deliveries of webhook endpoint %d", endpointID), err)
+        return nil, fmt.Errorf("failed to fetch deliveries of webhook endpoint %d: %w", endpointID, err)
+    }
+    return deliveries, nil
+}
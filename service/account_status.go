@@ -0,0 +1,29 @@
+package service
+
+import (
+    "errors"
+    "fmt"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// ErrAccountSuspended is returned when a suspended account tries to withdraw or transfer money out.
+var ErrAccountSuspended = errors.New("account is suspended")
+
+// ErrAccountInactive is returned when money is deposited or transferred into an inactive account.
+var ErrAccountInactive = errors.New("account is inactive")
+
+// checkCanSend rejects money leaving the wallet if the owning account is suspended.
+func checkCanSend(wallet *model.Wallet) error {
+    if wallet.UserStatus == model.UserStatusSuspended {
+        return reject(model.FailureReasonAccountSuspended, fmt.Errorf("%w: user %d", ErrAccountSuspended, wallet.UserID))
+    }
+    return nil
+}
+
+// checkCanReceive rejects money entering the wallet if the owning account is inactive.
+func checkCanReceive(wallet *model.Wallet) error {
+    if wallet.UserStatus == model.UserStatusInactive {
+        return reject(model.FailureReasonAccountInactive, fmt.Errorf("%w: user %d", ErrAccountInactive, wallet.UserID))
+    }
+    return nil
+}
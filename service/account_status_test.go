@@ -0,0 +1,171 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+)
+
+// Test that a suspended account cannot withdraw, and the rejection is recorded
+func TestWithdrawService_Withdraw_Suspended(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(150), "suspended")
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "withdraw", "failed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, "account_suspended", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.ErrorIs(t, err, ErrAccountSuspended)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a suspended account can still receive deposits
+func TestDepositService_Deposit_Suspended(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(150), "suspended")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromInt(200), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 1, "deposit", "system:external_funding:USD", "user:1:USD", decimal.NewFromInt(50))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    _, _, err = depositService.Deposit(1, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that an inactive account cannot receive deposits
+func TestDepositService_Deposit_Inactive(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 3, "USD", decimal.NewFromInt(0), "inactive")
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(3, 0, decimal.NewFromInt(50), "USD", "deposit", "failed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, "account_inactive", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = depositService.Deposit(3, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.ErrorIs(t, err, ErrAccountInactive)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a transfer into an inactive account is rejected, undoing the debit of the sender
+func TestTransferService_Transfer_InactiveRecipient(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectWalletRead(mock, 2, "USD", decimal.NewFromInt(0), "inactive")
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(100), "USD", "transfer", "failed", decimal.NewFromFloat(0.0), "wallet", nil, nil, "account_inactive", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = transferService.Transfer(1, 2, "USD", decimal.NewFromInt(100), "")
+    require.ErrorIs(t, err, ErrAccountInactive)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a status change is applied and audited in one transaction
+func TestUserService_ChangeStatus(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    userService := NewUserService(sqlx.NewDb(db, "sqlmock"), redisClient)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("UPDATE users u SET status").
+        WithArgs("suspended", 2).
+        WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+    mock.ExpectExec("UPDATE wallets SET version = version \\+ 1 WHERE user_id = \\$1").
+        WithArgs(2).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO user_status_changes").
+        WithArgs(2, "active", "suspended", "chargeback investigation", "support@example.com").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+    mock.ExpectCommit()
+
+    change, err := userService.ChangeStatus(context.Background(), 2, "suspended", " chargeback investigation ", "support@example.com")
+    require.NoError(t, err)
+    require.Equal(t, "active", change.OldStatus)
+    require.Equal(t, "suspended", change.NewStatus)
+
+    // An unknown status or a missing reason is rejected before touching the database
+    _, err = userService.ChangeStatus(context.Background(), 2, "frozen", "chargeback investigation", "")
+    require.ErrorIs(t, err, ErrInvalidStatusChange)
+    _, err = userService.ChangeStatus(context.Background(), 2, "active", " ", "")
+    require.ErrorIs(t, err, ErrInvalidStatusChange)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/go-redis/redis/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+)
+
+// ErrInvalidAdjustment is returned when a balance adjustment has no amount, or no reason or one that is too long.
+var ErrInvalidAdjustment = errors.New("invalid balance adjustment")
+
+// maxAdjustmentReason is the longest reason kept with an adjustment, leaving room in the journal entry description.
+const maxAdjustmentReason = 200
+
+// AdjustmentService corrects wallet balances by hand, booking the difference against the adjustments system account.
+type AdjustmentService struct {
+    walletRepo      *repository.WalletRepository
+    transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+    outboxRepo      *repository.OutboxRepository
+    dbConn          *sqlx.DB
+    redisClient     *redis.Client
+    locker          lock.Locker
+    mode            ConcurrencyMode
+}
+
+// NewAdjustmentService creates a new instance of AdjustmentService.
+// It shares the locker and the concurrency mode of the money movement services.
+func NewAdjustmentService(dbConn *sqlx.DB, redisClient *redis.Client, locker lock.Locker, mode ConcurrencyMode) *AdjustmentService {
+    return &AdjustmentService{
+        walletRepo:      repository.NewWalletRepository(dbConn),
+        transactionRepo: repository.NewTransactionRepository(dbConn),
+        ledgerRepo:      repository.NewLedgerRepository(dbConn),
+        outboxRepo:      repository.NewOutboxRepository(dbConn),
+        dbConn:          dbConn,
+        redisClient:     redisClient,
+        locker:          locker,
+        mode:            mode,
+    }
+}
+
+// Adjust credits a positive amount to the user's wallet in the given currency, or debits a negative one.
+// The adjustment is recorded as an adjustment transaction with the signed amount, and the reason and who made it
+// are kept in the description of its journal entry. A debit must be covered by the available balance, but unlike
+// a withdrawal it is also allowed on a suspended account; a credit cannot go to an inactive account.
+// When an idempotency key is given and an adjustment was already recorded with it, the original adjustment
+// is returned and the replayed flag is set instead of adjusting the balance again.
+func (s *AdjustmentService) Adjust(ctx context.Context, userID int, currency string, amount decimal.Decimal, reason, adjustedBy, idempotencyKey string) (*model.Transaction, bool, error) {
+    reason = strings.TrimSpace(reason)
+    if reason == "" {
+        return nil, false, fmt.Errorf("%w: a reason is required", ErrInvalidAdjustment)
+    }
+    if len(reason) > maxAdjustmentReason {
+        return nil, false, fmt.Errorf("%w: the reason is longer than %d bytes", ErrInvalidAdjustment, maxAdjustmentReason)
+    }
+    if amount.IsZero() {
+        return nil, false, fmt.Errorf("%w: amount must not be zero", ErrInvalidAdjustment)
+    }
+    currency, err := validateMoney("Adjustment", amount.Abs(), currency)
+    if err != nil {
+        return nil, false, err
+    }
+
+    locks, err := lockBalances(ctx, s.locker, userID)
+    if err != nil {
+        return nil, false, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    description := fmt.Sprintf("adjustment: %s", reason)
+    if adjustedBy != "" {
+        description = fmt.Sprintf("%s (by %s)", description, adjustedBy)
+    }
+
+    txn, replayed, err := withConcurrencyRetry(s.mode, func() (*model.Transaction, bool, error) {
+        return s.adjust(ctx, locks, userID, currency, amount, description, idempotencyKey)
+    })
+    if err != nil {
+        // The attempt has been rolled back by now, so a rejected adjustment is recorded on its own
+        recordRejection(ctx, s.transactionRepo, s.outboxRepo, s.dbConn, adjustmentTransaction(userID, currency, amount), err)
+        return nil, false, err
+    }
+    return txn, replayed, nil
+}
+
+// adjustmentTransaction builds the record of an adjustment of the user's wallet.
+func adjustmentTransaction(userID int, currency string, amount decimal.Decimal) *model.Transaction {
+    return &model.Transaction{
+        FromUserID:      userID,
+        ToUserID:        0,
+        Amount:          amount,
+        Currency:        currency,
+        TransactionType: "adjustment",
+        PaymentMethod:   model.PaymentMethodManual,
+    }
+}
+
+// adjust runs a single attempt of the adjustment inside one database transaction, while the user lock is held.
+func (s *AdjustmentService) adjust(ctx context.Context, locks []lock.Lock, userID int, currency string, amount decimal.Decimal, description, idempotencyKey string) (*model.Transaction, bool, error) {
+    logger := utils.GetLogger()
+
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to start transaction: %w", err)
+    }
+
+    defer func() {
+        if rErr := tx.Rollback(); rErr != nil && err == nil {
+            logger.Warnf("rollback transaction: %v", rErr)
+        }
+    }()
+
+    // Return the original adjustment if this request is a replay of an earlier one
+    fingerprint := requestFingerprint("adjustment", userID, 0, currency, amount, description)
+    replayed, err := findReplay(ctx, s.transactionRepo, tx, userID, idempotencyKey, fingerprint)
+    if err != nil {
+        return nil, false, err
+    }
+    if replayed != nil {
+        return replayed, true, nil
+    }
+
+    wallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, userID, currency)
+    if err != nil {
+        return nil, false, err
+    }
+    if amount.IsPositive() {
+        if err := checkCanReceive(wallet); err != nil {
+            return nil, false, err
+        }
+    } else if wallet.Available().LessThan(amount.Neg()) {
+        return nil, false, reject(model.FailureReasonInsufficientBalance, ErrInsufficientBalance)
+    }
+    if err := checkFence(ctx, s.walletRepo, tx, locks, userID); err != nil {
+        return nil, false, err
+    }
+
+    if err := s.walletRepo.UpdateBalance(ctx, tx, wallet.ID, wallet.Balance.Add(amount), wallet.Version); err != nil {
+        return nil, false, err
+    }
+
+    txn := adjustmentTransaction(userID, currency, amount)
+    txn.TransactionStatus = model.TransactionStatusCompleted
+    if idempotencyKey != "" {
+        txn.IdempotencyKey = idempotencyKey
+        txn.RequestHash = fingerprint
+    }
+    if err := recordTransaction(ctx, s.transactionRepo, tx, txn); err != nil {
+        return nil, false, err
+    }
+
+    // Credits come out of the adjustments account, debits go into it
+    from, to := systemLedgerAccount(model.SystemAccountAdjustments, currency), userLedgerAccount(userID, currency)
+    if amount.IsNegative() {
+        from, to = to, from
+    }
+    if err := postMovement(ctx, s.ledgerRepo, tx, txn.ID, description, from, to, amount.Abs()); err != nil {
+        return nil, false, fmt.Errorf("failed to post adjustment to the ledger: %w", err)
+    }
+    if err := recordEvents(ctx, s.outboxRepo, tx, txn, balanceChange(wallet, wallet.Balance.Add(amount))); err != nil {
+        return nil, false, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+
+    invalidateBalances(ctx, s.redisClient, userID)
+
+    return txn, false, nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+)
+
+// Test that adjustments credit and debit the wallet against the adjustments account, and that debits need the money
+func TestAdjustmentService_Adjust(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    adjustmentService := NewAdjustmentService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency)
+
+    // A reason and a non-zero amount are required
+    _, _, err = adjustmentService.Adjust(context.Background(), 1, "USD", decimal.NewFromInt(10), " ", "user 9", "")
+    require.ErrorIs(t, err, ErrInvalidAdjustment)
+    _, _, err = adjustmentService.Adjust(context.Background(), 1, "USD", decimal.Zero, "chargeback", "user 9", "")
+    require.ErrorIs(t, err, ErrInvalidAdjustment)
+
+    // A credit comes out of the adjustments account
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mock.ExpectBegin()
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(20), decimal.Zero)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(30), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(10), "USD", "adjustment", "completed", decimal.Zero, "manual", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(8, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 8, "adjustment: goodwill (by user 9)", "system:adjustments:USD", "user:1:USD", decimal.NewFromInt(10))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, replayed, err := adjustmentService.Adjust(context.Background(), 1, "usd", decimal.NewFromInt(10), "goodwill", "user 9", "")
+    require.NoError(t, err)
+    require.False(t, replayed)
+    require.Equal(t, "adjustment", txn.TransactionType)
+    require.Equal(t, "10", txn.Amount.String())
+
+    // A debit goes into it, and is recorded with a negative amount
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mock.ExpectBegin()
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(30), decimal.Zero)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(5), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(-25), "USD", "adjustment", "completed", decimal.Zero, "manual", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(9, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 9, "adjustment: chargeback", "user:1:USD", "system:adjustments:USD", decimal.NewFromInt(25))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, _, err = adjustmentService.Adjust(context.Background(), 1, "USD", decimal.NewFromInt(-25), "chargeback", "", "")
+    require.NoError(t, err)
+    require.Equal(t, "-25", txn.Amount.String())
+
+    // A debit the available balance does not cover is rejected and recorded as failed
+    mock.ExpectBegin()
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(5), decimal.Zero)
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(-25), "USD", "adjustment", "failed", decimal.Zero, "manual", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(10, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = adjustmentService.Adjust(context.Background(), 1, "USD", decimal.NewFromInt(-25), "chargeback", "", "")
+    require.ErrorIs(t, err, ErrInsufficientBalance)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
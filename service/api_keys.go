@@ -0,0 +1,208 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    "github.com/go-redis/redis/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/yaoweihua/wallet-service/auth"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// ErrInvalidAPIKey is returned when a request presents an API key that is malformed, unknown, revoked or expired.
+// The reason is deliberately not told apart.
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// ErrInvalidAPIKeyRequest is returned when an API key is created without a name or with unknown scopes.
+var ErrInvalidAPIKeyRequest = errors.New("invalid API key request")
+
+// ErrAPIKeyInactive is returned when a revoked or expired API key is rotated or revoked again.
+var ErrAPIKeyInactive = errors.New("API key is revoked or expired")
+
+// ErrRequestReplayed is returned when a signed request is presented again.
+var ErrRequestReplayed = errors.New("signed request was already used")
+
+// SignedRequest is the part of an HTTP request an API key signature covers, with the signature headers.
+type SignedRequest struct {
+    Method    string // The HTTP method
+    Path      string // The path with the query string
+    Body      []byte // The raw body
+    Timestamp string // The Unix time the request was signed at
+    Signature string // The hex HMAC-SHA256 signature, see auth.SignRequest
+}
+
+// APIKeyService creates, rotates and revokes the API keys of backend services, and authenticates their signed requests.
+type APIKeyService struct {
+    apiKeyRepo         *repository.APIKeyRepository
+    dbConn             *sqlx.DB
+    redisClient        *redis.Client
+    rotationGrace      time.Duration
+    signatureTolerance time.Duration
+}
+
+// NewAPIKeyService creates a new instance of APIKeyService. A rotated key keeps working for the rotation grace period,
+// and signed requests are accepted for the signature tolerance around the time they were signed.
+func NewAPIKeyService(dbConn *sqlx.DB, redisClient *redis.Client, rotationGrace, signatureTolerance time.Duration) *APIKeyService {
+    return &APIKeyService{
+        apiKeyRepo:         repository.NewAPIKeyRepository(dbConn),
+        dbConn:             dbConn,
+        redisClient:        redisClient,
+        rotationGrace:      rotationGrace,
+        signatureTolerance: signatureTolerance,
+    }
+}
+
+// CreateAPIKey creates an API key with the scopes for the named service. It returns the stored key and the key itself,
+// which is not stored and cannot be retrieved again.
+func (s *APIKeyService) CreateAPIKey(ctx context.Context, name string, scopes []string) (*model.APIKey, string, error) {
+    name = strings.TrimSpace(name)
+    if name == "" {
+        return nil, "", fmt.Errorf("%w: a name is required", ErrInvalidAPIKeyRequest)
+    }
+    if len(scopes) == 0 {
+        return nil, "", fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKeyRequest)
+    }
+    for _, scope := range scopes {
+        if !contains(model.APIKeyScopes, scope) {
+            return nil, "", fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKeyRequest, scope)
+        }
+    }
+
+    apiKey, key, err := newAPIKey(name, scopes, nil)
+    if err != nil {
+        return nil, "", err
+    }
+    if err := s.apiKeyRepo.CreateAPIKey(ctx, s.dbConn, apiKey); err != nil {
+        return nil, "", err
+    }
+    return apiKey, key, nil
+}
+
+// RotateAPIKey replaces an active API key with a new one of the same name and scopes, returned with the new key itself.
+// The old key keeps working for the rotation grace period, so that the service using it can switch over without downtime.
+func (s *APIKeyService) RotateAPIKey(ctx context.Context, keyID int) (*model.APIKey, string, error) {
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, "", fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    old, err := s.apiKeyRepo.LockAPIKey(ctx, tx, keyID)
+    if err != nil {
+        return nil, "", err
+    }
+    now := time.Now()
+    if !old.Active(now) {
+        return nil, "", fmt.Errorf("%w: %d", ErrAPIKeyInactive, keyID)
+    }
+
+    apiKey, key, err := newAPIKey(old.Name, old.Scopes, &old.ID)
+    if err != nil {
+        return nil, "", err
+    }
+    if err := s.apiKeyRepo.CreateAPIKey(ctx, tx, apiKey); err != nil {
+        return nil, "", err
+    }
+
+    // Keep an earlier expiry of the old key, rotating must not extend it
+    expiresAt := now.Add(s.rotationGrace)
+    if old.ExpiresAt == nil || expiresAt.Before(*old.ExpiresAt) {
+        if err := s.apiKeyRepo.ExpireAPIKey(ctx, tx, old.ID, expiresAt); err != nil {
+            return nil, "", err
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
+    }
+    return apiKey, key, nil
+}
+
+// RevokeAPIKey revokes an active API key, which stops authenticating requests right away.
+func (s *APIKeyService) RevokeAPIKey(ctx context.Context, keyID int) (*model.APIKey, error) {
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    apiKey, err := s.apiKeyRepo.LockAPIKey(ctx, tx, keyID)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    if !apiKey.Active(now) {
+        return nil, fmt.Errorf("%w: %d", ErrAPIKeyInactive, keyID)
+    }
+
+    if err := s.apiKeyRepo.RevokeAPIKey(ctx, tx, keyID, now); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+
+    apiKey.RevokedAt = &now
+    return apiKey, nil
+}
+
+// Authenticate checks the API key a request was made with and the signature of the request, and returns the key.
+// Each signature is accepted once: it is remembered in Redis for as long as its timestamp is within the tolerance,
+// so a captured request can neither be replayed later nor right away.
+// It returns ErrInvalidAPIKey, auth.ErrInvalidSignature, auth.ErrStaleSignature or ErrRequestReplayed if the request is rejected.
+func (s *APIKeyService) Authenticate(ctx context.Context, key string, req SignedRequest) (*model.APIKey, error) {
+    prefix, ok := auth.ParseAPIKey(key)
+    if !ok {
+        return nil, ErrInvalidAPIKey
+    }
+
+    apiKey, err := s.apiKeyRepo.GetAPIKeyByPrefix(ctx, s.dbConn, prefix)
+    if err != nil {
+        if errors.Is(err, repository.ErrAPIKeyNotFound) {
+            return nil, ErrInvalidAPIKey
+        }
+        return nil, err
+    }
+    now := time.Now()
+    if !auth.MatchAPIKey(key, apiKey.KeyHash) || !apiKey.Active(now) {
+        return nil, ErrInvalidAPIKey
+    }
+
+    if err := auth.VerifyRequestSignature(key, req.Timestamp, req.Method, req.Path, req.Body, req.Signature, now, s.signatureTolerance); err != nil {
+        return nil, err
+    }
+
+    fresh, err := s.redisClient.SetNX(ctx, "api_signatures:"+strings.ToLower(req.Signature), apiKey.ID, 2*s.signatureTolerance).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to check the signature for replays: %w", err)
+    }
+    if !fresh {
+        return nil, ErrRequestReplayed
+    }
+
+    // Recording the use is informational, a failure does not reject the request
+    if err := s.apiKeyRepo.TouchAPIKey(ctx, s.dbConn, apiKey.ID); err != nil {
+        utils.GetLogger().Warnf("record use of API key %d: %v", apiKey.ID, err)
+    }
+    return apiKey, nil
+}
+
+// newAPIKey generates a new key and builds its stored record, which keeps only the prefix and the hash of the key.
+func newAPIKey(name string, scopes []string, rotatedFrom *int) (*model.APIKey, string, error) {
+    key, prefix, err := auth.GenerateAPIKey()
+    if err != nil {
+        return nil, "", err
+    }
+    return &model.APIKey{
+        Name:        name,
+        Prefix:      prefix,
+        KeyHash:     auth.HashAPIKey(key),
+        Scopes:      scopes,
+        RotatedFrom: rotatedFrom,
+    }, key, nil
+}
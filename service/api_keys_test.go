@@ -0,0 +1,135 @@
+package service
+
+import (
+    "context"
+    "strconv"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/auth"
+)
+
+// apiKeyColumns are the columns selected when an API key is read
+var apiKeyColumns = []string{"id", "name", "key_prefix", "key_hash", "scopes", "expires_at", "revoked_at", "rotated_from", "last_used_at", "created_at", "updated_at"}
+
+// Test that a created API key is stored hashed, authenticates signed requests once, and rejects replays and bad signatures
+func TestAPIKeyService_CreateAndAuthenticate(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    apiKeyService := NewAPIKeyService(sqlx.NewDb(db, "sqlmock"), redisClient, time.Hour, 5*time.Minute)
+
+    mock.ExpectQuery("INSERT INTO api_keys").
+        WithArgs("payments", sqlmock.AnyArg(), sqlmock.AnyArg(), pq.StringArray{"deposit"}, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(4, time.Now(), time.Now()))
+
+    apiKey, key, err := apiKeyService.CreateAPIKey(context.Background(), "payments", []string{"deposit"})
+    require.NoError(t, err)
+    require.Equal(t, 4, apiKey.ID)
+    require.NotContains(t, apiKey.KeyHash, key)
+    require.True(t, auth.MatchAPIKey(key, apiKey.KeyHash))
+
+    body := []byte(`{"user_id":1,"amount":"10"}`)
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req := SignedRequest{
+        Method:    "POST",
+        Path:      "/v1/wallet/deposit",
+        Body:      body,
+        Timestamp: timestamp,
+        Signature: auth.SignRequest(key, timestamp, "POST", "/v1/wallet/deposit", body),
+    }
+    expectKeyRead := func() {
+        mock.ExpectQuery("SELECT (.+) FROM api_keys WHERE key_prefix = \\$1").
+            WithArgs(apiKey.Prefix).
+            WillReturnRows(sqlmock.NewRows(apiKeyColumns).
+                AddRow(4, "payments", apiKey.Prefix, apiKey.KeyHash, "{deposit}", nil, nil, nil, nil, time.Now(), time.Now()))
+    }
+
+    expectKeyRead()
+    mockRedis.ExpectSetNX("api_signatures:"+req.Signature, 4, 10*time.Minute).SetVal(true)
+    mock.ExpectExec("UPDATE api_keys SET last_used_at = NOW\\(\\)").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    authenticated, err := apiKeyService.Authenticate(context.Background(), key, req)
+    require.NoError(t, err)
+    require.Equal(t, []string{"deposit"}, []string(authenticated.Scopes))
+
+    // The same signed request cannot be used twice
+    expectKeyRead()
+    mockRedis.ExpectSetNX("api_signatures:"+req.Signature, 4, 10*time.Minute).SetVal(false)
+
+    _, err = apiKeyService.Authenticate(context.Background(), key, req)
+    require.ErrorIs(t, err, ErrRequestReplayed)
+
+    // A body that was tampered with does not match the signature
+    expectKeyRead()
+    tampered := req
+    tampered.Body = []byte(`{"user_id":1,"amount":"1000"}`)
+
+    _, err = apiKeyService.Authenticate(context.Background(), key, tampered)
+    require.ErrorIs(t, err, auth.ErrInvalidSignature)
+
+    // Only the key with the stored hash is accepted
+    expectKeyRead()
+    _, err = apiKeyService.Authenticate(context.Background(), apiKey.Prefix+".guessed", req)
+    require.ErrorIs(t, err, ErrInvalidAPIKey)
+
+    _, _, err = apiKeyService.CreateAPIKey(context.Background(), "payments", []string{"everything"})
+    require.ErrorIs(t, err, ErrInvalidAPIKeyRequest)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that rotating a key issues a replacement with the same scopes and lets the old key expire after the grace period,
+// and that revoked keys can be neither rotated nor revoked again
+func TestAPIKeyService_RotateAndRevoke(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    apiKeyService := NewAPIKeyService(sqlx.NewDb(db, "sqlmock"), nil, time.Hour, 5*time.Minute)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM api_keys WHERE id = \\$1 FOR UPDATE").
+        WithArgs(4).
+        WillReturnRows(sqlmock.NewRows(apiKeyColumns).
+            AddRow(4, "payments", "wk_000000000004", "hash", "{deposit,read-balance}", nil, nil, nil, nil, time.Now(), time.Now()))
+    mock.ExpectQuery("INSERT INTO api_keys").
+        WithArgs("payments", sqlmock.AnyArg(), sqlmock.AnyArg(), pq.StringArray{"deposit", "read-balance"}, nil, 4).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(5, time.Now(), time.Now()))
+    mock.ExpectExec("UPDATE api_keys SET expires_at = \\$2").
+        WithArgs(4, sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    apiKey, key, err := apiKeyService.RotateAPIKey(context.Background(), 4)
+    require.NoError(t, err)
+    require.Equal(t, 5, apiKey.ID)
+    require.Equal(t, 4, *apiKey.RotatedFrom)
+    require.True(t, auth.MatchAPIKey(key, apiKey.KeyHash))
+
+    revokedAt := time.Now().Add(-time.Minute)
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM api_keys WHERE id = \\$1 FOR UPDATE").
+        WithArgs(4).
+        WillReturnRows(sqlmock.NewRows(apiKeyColumns).
+            AddRow(4, "payments", "wk_000000000004", "hash", "{deposit}", nil, revokedAt, nil, nil, time.Now(), time.Now()))
+    mock.ExpectRollback()
+
+    _, err = apiKeyService.RevokeAPIKey(context.Background(), 4)
+    require.ErrorIs(t, err, ErrAPIKeyInactive)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
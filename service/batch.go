@@ -0,0 +1,415 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/shopspring/decimal"
+    "github.com/jmoiron/sqlx"
+)
+
+// ErrInvalidBatch is returned when a transfer batch cannot be made as requested.
+var ErrInvalidBatch = errors.New("invalid transfer batch")
+
+const (
+    // MaxBatchItems is the largest number of transfers a batch can make, they are all locked for the whole batch.
+    // Lockers that limit how many locks are held at once, see lock.MaxHeld, limit the users of a batch further.
+    MaxBatchItems = 500
+    // maxBatchReference is the longest reference kept with a batch item.
+    maxBatchReference = 100
+    // maxBatchError is the longest error message kept with a failed batch item.
+    maxBatchError = 255
+)
+
+// BatchItem is one transfer requested in a batch.
+type BatchItem struct {
+    ToUserID  int
+    Amount    decimal.Decimal
+    Reference string // The caller's reference of the item, such as a payslip number
+}
+
+// BatchService pays many users from one wallet in a single request, either all of them or none (model.BatchModeAtomic)
+// or as many as possible (model.BatchModeBestEffort). Every item paid is a transfer of the transfer service, charged
+// the transfer fee and counted towards the transaction limits of the payer like a single transfer.
+type BatchService struct {
+    batchRepo *repository.BatchRepository
+    transfers *TransferService
+    dbConn    *sqlx.DB
+}
+
+// NewBatchService creates a new instance of BatchService making the transfers of a batch through the transfer service.
+func NewBatchService(dbConn *sqlx.DB, transfers *TransferService) *BatchService {
+    return &BatchService{
+        batchRepo: repository.NewBatchRepository(dbConn),
+        transfers: transfers,
+        dbConn:    dbConn,
+    }
+}
+
+// TransferBatch pays the items from the user's wallet in the given currency, model.DefaultCurrency when empty, and
+// returns the batch with the result of every item. An empty mode selects model.BatchModeAtomic. A batch whose items
+// failed is returned without an error; errors are only returned when the batch could not be made at all.
+// When an idempotency key is given and a batch was already made with it, that batch is returned in its current state
+// and the replayed flag is set instead of paying the items again.
+func (s *BatchService) TransferBatch(ctx context.Context, fromUserID int, currency, mode string, items []BatchItem, idempotencyKey string) (*model.TransferBatch, bool, error) {
+    batch, err := s.newBatch(fromUserID, currency, mode, items)
+    if err != nil {
+        return nil, false, err
+    }
+
+    // A batch made before is returned whatever has changed since, such as the limits of the locker below
+    if idempotencyKey != "" {
+        batch.IdempotencyKey = idempotencyKey
+        batch.RequestHash = batchFingerprint(batch)
+        existing, err := s.batchRepo.GetBatchByIdempotencyKey(ctx, s.dbConn, fromUserID, idempotencyKey)
+        if err != nil {
+            return nil, false, err
+        }
+        if existing != nil {
+            if existing.RequestHash != batch.RequestHash {
+                return nil, false, ErrIdempotencyKeyConflict
+            }
+            return existing, true, nil
+        }
+    }
+
+    // Every user of the batch is locked at once, which the locker may not allow for as many users as a batch can pay,
+    // such as PostgreSQL advisory locks that each pin a pooled connection
+    users := batchUserIDs(batch)
+    if maxUsers := lock.MaxHeld(s.transfers.locker); maxUsers > 0 && len(users) > maxUsers {
+        return nil, false, fmt.Errorf("%w: the batch involves %d users, at most %d can be locked at once", ErrInvalidBatch, len(users), maxUsers)
+    }
+
+    // Lock the balances of the payer and of every recipient for the whole batch. The locks are taken in key order
+    // whatever the order of the items, so batches and transfers paying overlapping sets of users cannot deadlock
+    locks, err := lockBalances(ctx, s.transfers.locker, users...)
+    if err != nil {
+        return nil, false, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    err = withTx(s.dbConn, func(tx *sqlx.Tx) error {
+        return s.batchRepo.CreateBatch(ctx, tx, batch)
+    })
+    if err != nil {
+        if errors.Is(err, repository.ErrDuplicateIdempotencyKey) {
+            return nil, false, ErrIdempotencyKeyConflict
+        }
+        return nil, false, err
+    }
+
+    if batch.Mode == model.BatchModeAtomic {
+        err = s.payAtomically(ctx, locks, batch)
+    } else {
+        err = s.payEach(ctx, locks, batch)
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    return batch, false, nil
+}
+
+// GetBatch retrieves the transfer batch with the given ID together with the result of its items.
+func (s *BatchService) GetBatch(ctx context.Context, batchID int) (*model.TransferBatch, error) {
+    return s.batchRepo.GetBatch(ctx, s.dbConn, batchID)
+}
+
+// newBatch validates the request and builds the batch with its pending items and their fees.
+func (s *BatchService) newBatch(fromUserID int, currency, mode string, items []BatchItem) (*model.TransferBatch, error) {
+    switch mode {
+    case "":
+        mode = model.BatchModeAtomic
+    case model.BatchModeAtomic, model.BatchModeBestEffort:
+    default:
+        return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidBatch, mode)
+    }
+    if len(items) == 0 {
+        return nil, fmt.Errorf("%w: the batch has no items", ErrInvalidBatch)
+    }
+    if len(items) > MaxBatchItems {
+        return nil, fmt.Errorf("%w: the batch has more than %d items", ErrInvalidBatch, MaxBatchItems)
+    }
+
+    batch := &model.TransferBatch{
+        FromUserID:  fromUserID,
+        Mode:        mode,
+        Status:      model.BatchStatusProcessing,
+        TotalAmount: decimal.Zero,
+        ItemCount:   len(items),
+        Items:       make([]model.TransferBatchItem, 0, len(items)),
+    }
+    for i, item := range items {
+        if item.ToUserID == fromUserID {
+            return nil, fmt.Errorf("%w: item %d transfers to the same user", ErrInvalidBatch, i)
+        }
+        itemCurrency, err := validateMoney("Transfer", item.Amount, currency)
+        if err != nil {
+            return nil, fmt.Errorf("item %d: %w", i, err)
+        }
+        reference := strings.TrimSpace(item.Reference)
+        if len(reference) > maxBatchReference {
+            return nil, fmt.Errorf("%w: the reference of item %d is longer than %d bytes", ErrInvalidBatch, i, maxBatchReference)
+        }
+
+        batch.Currency = itemCurrency
+        batch.TotalAmount = batch.TotalAmount.Add(item.Amount)
+        batch.Items = append(batch.Items, model.TransferBatchItem{
+            Position:  i,
+            ToUserID:  item.ToUserID,
+            Amount:    item.Amount,
+            Fee:       s.transfers.fees.Calculate("transfer", model.PaymentMethodWallet, itemCurrency, item.Amount),
+            Reference: reference,
+            Status:    model.BatchItemPending,
+        })
+    }
+    return batch, nil
+}
+
+// payAtomically makes the transfers of all items in one database transaction, so either every item is paid or none.
+// If an item is rejected, it fails with the reason and the other items fail as batch_aborted; a rejection of the batch
+// as a whole, such as an insufficient balance for the total, fails every item with its reason. Every item failing
+// with a rejection is recorded as a failed transfer, like a rejected single transfer.
+func (s *BatchService) payAtomically(ctx context.Context, locks []lock.Lock, batch *model.TransferBatch) error {
+    var failed *model.TransferBatchItem
+    _, _, err := withConcurrencyRetry(s.transfers.mode, func() (*model.Transaction, bool, error) {
+        var err error
+        failed, err = s.transferAll(ctx, locks, batch)
+        return nil, false, err
+    })
+    if err == nil {
+        // Evict the cached balances of everyone paid, they are read from the database again on the next request
+        invalidateBalances(ctx, s.transfers.redisClient, batchUserIDs(batch)...)
+        return nil
+    }
+
+    // The attempt has been rolled back by now, so the rejected transfers and the failure of the batch are recorded on their own
+    reason := rejectionReason(err)
+    for i := range batch.Items {
+        item := &batch.Items[i]
+        item.Status = model.BatchItemFailed
+        item.TransactionID = nil
+        if failed == nil || failed.Position == item.Position {
+            item.FailureReason = reason
+            item.Error = truncateError(err, maxBatchError)
+            recordRejection(ctx, s.transfers.transactionRepo, s.transfers.outboxRepo, s.dbConn, batchLegs(batch, item).transaction(batch.FromUserID, item.ToUserID), err)
+        } else {
+            item.FailureReason = model.FailureReasonBatchAborted
+            item.Error = ""
+        }
+    }
+
+    batch.Status = model.BatchStatusFailed
+    batch.SucceededCount = 0
+    batch.FailedCount = len(batch.Items)
+    return withTx(s.dbConn, func(tx *sqlx.Tx) error {
+        for i := range batch.Items {
+            if err := s.batchRepo.UpdateBatchItem(ctx, tx, &batch.Items[i]); err != nil {
+                return err
+            }
+        }
+        return s.batchRepo.UpdateBatch(ctx, tx, batch)
+    })
+}
+
+// transferAll attempts the transfers of all items in one database transaction, and stores the completed batch with it.
+// It returns the item that was rejected, or nil if the batch failed as a whole.
+func (s *BatchService) transferAll(ctx context.Context, locks []lock.Lock, batch *model.TransferBatch) (*model.TransferBatchItem, error) {
+    t := s.transfers
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    // Read the wallets of all users in ascending user order, so that batches lock the wallet rows in the same order
+    userIDs := batchUserIDs(batch)
+    wallets := make(map[int]*model.Wallet, len(userIDs))
+    for _, userID := range userIDs {
+        wallet, err := readWallet(ctx, t.walletRepo, tx, t.mode, userID, batch.Currency)
+        if err != nil {
+            err = fmt.Errorf("failed to get balance for user %d: %w", userID, err)
+            if userID != batch.FromUserID && errors.Is(err, repository.ErrUserNotFound) {
+                return batchItemTo(batch, userID), reject(model.FailureReasonUnknownRecipient, err)
+            }
+            return nil, err
+        }
+        wallets[userID] = wallet
+    }
+
+    // Suspended accounts cannot send money, and the part of the balance not held must cover every item and its fee
+    fromWallet := wallets[batch.FromUserID]
+    if err := checkCanSend(fromWallet); err != nil {
+        return nil, err
+    }
+    debit := decimal.Zero
+    for _, item := range batch.Items {
+        debit = debit.Add(item.Amount).Add(item.Fee)
+    }
+    if fromWallet.Available().LessThan(debit) {
+        return nil, reject(model.FailureReasonInsufficientBalance, ErrInsufficientBalance)
+    }
+
+    // Every item counts towards the limits of the payer like a single transfer, and inactive accounts cannot receive money
+    balances := map[int]decimal.Decimal{batch.FromUserID: fromWallet.Balance.Sub(debit)}
+    now := time.Now()
+    for i := range batch.Items {
+        item := &batch.Items[i]
+        if err := t.limits.enforce(ctx, t.limitRepo, tx, fromWallet, "transfer", item.Amount, now); err != nil {
+            return item, err
+        }
+        toWallet := wallets[item.ToUserID]
+        if err := checkCanReceive(toWallet); err != nil {
+            return item, err
+        }
+        balance, ok := balances[item.ToUserID]
+        if !ok {
+            balance = toWallet.Balance
+        }
+        balances[item.ToUserID] = balance.Add(item.Amount)
+    }
+
+    // Make sure none of the balance locks has been taken over by another request in the meantime, then write each balance once
+    for _, userID := range userIDs {
+        if err := checkFence(ctx, t.walletRepo, tx, locks, userID); err != nil {
+            return nil, err
+        }
+    }
+    for _, userID := range userIDs {
+        wallet := wallets[userID]
+        if err := t.walletRepo.UpdateBalance(ctx, tx, wallet.ID, balances[userID], wallet.Version); err != nil {
+            return nil, fmt.Errorf("failed to update balance for user %d: %w", userID, err)
+        }
+    }
+
+    // Record the transfer of every item and post it to the ledger
+    running := make(map[int]decimal.Decimal, len(wallets))
+    for userID, wallet := range wallets {
+        running[userID] = wallet.Balance
+    }
+    for i := range batch.Items {
+        item := &batch.Items[i]
+        txn := batchLegs(batch, item).transaction(batch.FromUserID, item.ToUserID)
+        txn.TransactionStatus = model.TransactionStatusCompleted
+        if err := recordTransaction(ctx, t.transactionRepo, tx, txn); err != nil {
+            return nil, fmt.Errorf("failed to record transaction for user %d: %w", batch.FromUserID, err)
+        }
+        from, to := userLedgerAccount(batch.FromUserID, batch.Currency), userLedgerAccount(item.ToUserID, batch.Currency)
+        if err := postMovement(ctx, t.ledgerRepo, tx, txn.ID, "transfer", from, to, item.Amount); err != nil {
+            return nil, fmt.Errorf("failed to post transfer to the ledger: %w", err)
+        }
+        if err := postFee(ctx, t.ledgerRepo, tx, txn.ID, batch.FromUserID, batch.Currency, item.Fee); err != nil {
+            return nil, fmt.Errorf("failed to post transfer fee to the ledger: %w", err)
+        }
+
+        // Raise the events of the transfer, with the balances of both users as each item leaves them
+        fromChange := model.BalanceChange{UserID: batch.FromUserID, Currency: batch.Currency, Delta: item.Amount.Add(item.Fee).Neg()}
+        toChange := model.BalanceChange{UserID: item.ToUserID, Currency: batch.Currency, Delta: item.Amount}
+        running[batch.FromUserID] = running[batch.FromUserID].Add(fromChange.Delta)
+        running[item.ToUserID] = running[item.ToUserID].Add(toChange.Delta)
+        fromChange.Balance, toChange.Balance = running[batch.FromUserID], running[item.ToUserID]
+        if err := recordEvents(ctx, t.outboxRepo, tx, txn, fromChange, toChange); err != nil {
+            return nil, err
+        }
+
+        item.Status = model.BatchItemSucceeded
+        item.TransactionID = &txn.ID
+        if err := s.batchRepo.UpdateBatchItem(ctx, tx, item); err != nil {
+            return nil, err
+        }
+    }
+
+    batch.Status = model.BatchStatusCompleted
+    batch.SucceededCount = len(batch.Items)
+    batch.FailedCount = 0
+    if err := s.batchRepo.UpdateBatch(ctx, tx, batch); err != nil {
+        return nil, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+    return nil, nil
+}
+
+// payEach makes the transfers of the items one after the other, each in its own database transaction like a single
+// transfer, and stores the result of every item as soon as it is known. Items that are rejected fail on their own and
+// are recorded as failed transfers, the others are paid.
+func (s *BatchService) payEach(ctx context.Context, locks []lock.Lock, batch *model.TransferBatch) error {
+    for i := range batch.Items {
+        item := &batch.Items[i]
+        txn, _, err := s.transfers.execute(ctx, locks, batch.FromUserID, item.ToUserID, batchLegs(batch, item), "")
+        if err != nil {
+            item.Status = model.BatchItemFailed
+            item.FailureReason = rejectionReason(err)
+            item.Error = truncateError(err, maxBatchError)
+            batch.FailedCount++
+        } else {
+            item.Status = model.BatchItemSucceeded
+            item.TransactionID = &txn.ID
+            batch.SucceededCount++
+        }
+        if err := s.batchRepo.UpdateBatchItem(ctx, s.dbConn, item); err != nil {
+            return err
+        }
+    }
+
+    switch batch.SucceededCount {
+    case len(batch.Items):
+        batch.Status = model.BatchStatusCompleted
+    case 0:
+        batch.Status = model.BatchStatusFailed
+    default:
+        batch.Status = model.BatchStatusPartiallyCompleted
+    }
+    return s.batchRepo.UpdateBatch(ctx, s.dbConn, batch)
+}
+
+// batchLegs describes the transfer of a batch item, within the currency of the batch.
+func batchLegs(batch *model.TransferBatch, item *model.TransferBatchItem) transferLegs {
+    return transferLegs{
+        sourceCurrency: batch.Currency,
+        sourceAmount:   item.Amount,
+        targetCurrency: batch.Currency,
+        targetAmount:   item.Amount,
+        fee:            item.Fee,
+    }
+}
+
+// batchFingerprint builds the idempotency fingerprint of the batch from its mode and every item, in order.
+func batchFingerprint(batch *model.TransferBatch) string {
+    extra := []string{batch.Mode}
+    for _, item := range batch.Items {
+        extra = append(extra, fmt.Sprintf("%d:%s:%s", item.ToUserID, item.Amount.String(), item.Reference))
+    }
+    return requestFingerprint("transfer_batch", batch.FromUserID, 0, batch.Currency, batch.TotalAmount, extra...)
+}
+
+// batchUserIDs returns the payer and every recipient of the batch once, in ascending order.
+func batchUserIDs(batch *model.TransferBatch) []int {
+    seen := map[int]bool{batch.FromUserID: true}
+    userIDs := []int{batch.FromUserID}
+    for _, item := range batch.Items {
+        if !seen[item.ToUserID] {
+            seen[item.ToUserID] = true
+            userIDs = append(userIDs, item.ToUserID)
+        }
+    }
+    sort.Ints(userIDs)
+    return userIDs
+}
+
+// batchItemTo returns the first item of the batch paying the user.
+func batchItemTo(batch *model.TransferBatch, userID int) *model.TransferBatchItem {
+    for i := range batch.Items {
+        if batch.Items[i].ToUserID == userID {
+            return &batch.Items[i]
+        }
+    }
+    return nil
+}
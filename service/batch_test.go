@@ -0,0 +1,336 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// testBatchItems pays 50 USD to user 2 and 30 USD to user 3
+var testBatchItems = []BatchItem{
+    {ToUserID: 3, Amount: decimal.NewFromInt(30), Reference: "payslip-3"},
+    {ToUserID: 2, Amount: decimal.NewFromInt(50), Reference: "payslip-2"},
+}
+
+// Columns of transfer batches and their items, in the order the repository selects them
+var (
+    batchColumns     = []string{"id", "from_user_id", "currency", "mode", "status", "total_amount", "item_count", "succeeded_count", "failed_count", "idempotency_key", "request_hash", "created_at", "updated_at"}
+    batchItemColumns = []string{"batch_id", "position", "to_user_id", "amount", "fee", "reference", "status", "transaction_id", "failure_reason", "error"}
+)
+
+// expectBatchCreated expects the batch of testBatchItems to be stored with ID 7 and its pending items
+func expectBatchCreated(mock sqlmock.Sqlmock, mode string) {
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transfer_batches").
+        WithArgs(1, "USD", mode, "processing", decimal.NewFromInt(80), 2, 0, 0, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(7, time.Now(), time.Now()))
+    mock.ExpectExec("INSERT INTO transfer_batch_items").
+        WithArgs(7, 0, 3, decimal.NewFromInt(30), decimal.Zero, "payslip-3", "pending").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO transfer_batch_items").
+        WithArgs(7, 1, 2, decimal.NewFromInt(50), decimal.Zero, "payslip-2", "pending").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+}
+
+// expectBalanceUpdate expects the balance of the wallet of the user to be written
+func expectBalanceUpdate(mock sqlmock.Sqlmock, userID int, balance decimal.Decimal) {
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(balance, sqlmock.AnyArg(), userID, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectItemUpdate expects the result of a batch item to be stored
+func expectItemUpdate(mock sqlmock.Sqlmock, position int, status string, transactionID interface{}, reason string) {
+    mock.ExpectExec("UPDATE transfer_batch_items").
+        WithArgs(7, position, status, transactionID, reason, sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func newTestBatchService(t *testing.T) (*BatchService, sqlmock.Sqlmock, redismock.ClientMock) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    t.Cleanup(func() { db.Close() }) // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    t.Cleanup(func() { redisClient.Close() }) // nolint:errcheck
+
+    dbConn := sqlx.NewDb(db, "sqlmock")
+    transfers := NewTransferService(dbConn, redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+    return NewBatchService(dbConn, transfers), mock, mockRedis
+}
+
+// Test that an atomic batch reads the wallets in user order, writes every balance once and records a transfer per item
+func TestBatchService_TransferBatch_Atomic(t *testing.T) {
+    batchService, mock, mockRedis := newTestBatchService(t)
+
+    expectBatchCreated(mock, "atomic")
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
+    expectWalletRead(mock, 2, "USD", decimal.NewFromInt(10), "active")
+    expectWalletRead(mock, 3, "USD", decimal.Zero, "active")
+    expectBalanceUpdate(mock, 1, decimal.NewFromInt(120))
+    expectBalanceUpdate(mock, 2, decimal.NewFromInt(60))
+    expectBalanceUpdate(mock, 3, decimal.NewFromInt(30))
+
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 3, decimal.NewFromInt(30), "USD", "transfer", "completed", decimal.Zero, "wallet", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(41, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 41, "transfer", "user:1:USD", "user:3:USD", decimal.NewFromInt(30))
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    expectItemUpdate(mock, 0, "succeeded", 41, "")
+
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(50), "USD", "transfer", "completed", decimal.Zero, "wallet", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(42, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 42, "transfer", "user:1:USD", "user:2:USD", decimal.NewFromInt(50))
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    expectItemUpdate(mock, 1, "succeeded", 42, "")
+
+    mock.ExpectExec("UPDATE transfer_batches").
+        WithArgs(7, "completed", 2, 0).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mockRedis.ExpectDel("balances:2").SetVal(1)
+    mockRedis.ExpectDel("balances:3").SetVal(1)
+
+    batch, replayed, err := batchService.TransferBatch(context.Background(), 1, "usd", "", testBatchItems, "")
+    require.NoError(t, err)
+    require.False(t, replayed)
+    require.Equal(t, 7, batch.ID)
+    require.Equal(t, model.BatchStatusCompleted, batch.Status)
+    require.Equal(t, 2, batch.SucceededCount)
+    require.Equal(t, 42, *batch.Items[1].TransactionID)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+    require.NoError(t, mockRedis.ExpectationsWereMet())
+}
+
+// Test that an item rejected in an atomic batch fails with its reason, and aborts the other items
+func TestBatchService_TransferBatch_AtomicAbort(t *testing.T) {
+    batchService, mock, _ := newTestBatchService(t)
+
+    expectBatchCreated(mock, "atomic")
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
+    expectWalletRead(mock, 2, "USD", decimal.Zero, "inactive")
+    expectWalletRead(mock, 3, "USD", decimal.Zero, "active")
+    mock.ExpectRollback()
+
+    // The rejected transfer is recorded on its own, then the failure of every item
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(50), "USD", "transfer", "failed", decimal.Zero, "wallet", nil, nil, "account_inactive", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(43, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+    mock.ExpectBegin()
+    expectItemUpdate(mock, 0, "failed", nil, model.FailureReasonBatchAborted)
+    expectItemUpdate(mock, 1, "failed", nil, model.FailureReasonAccountInactive)
+    mock.ExpectExec("UPDATE transfer_batches").
+        WithArgs(7, "failed", 0, 2).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    batch, _, err := batchService.TransferBatch(context.Background(), 1, "USD", model.BatchModeAtomic, testBatchItems, "")
+    require.NoError(t, err)
+    require.Equal(t, model.BatchStatusFailed, batch.Status)
+    require.Equal(t, model.FailureReasonAccountInactive, batch.Items[1].FailureReason)
+    require.Contains(t, batch.Items[1].Error, "account is inactive")
+    require.Empty(t, batch.Items[0].Error)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that a rejection of an atomic batch as a whole fails every item with its reason, and records each as a failed transfer
+func TestBatchService_TransferBatch_AtomicRejected(t *testing.T) {
+    batchService, mock, _ := newTestBatchService(t)
+
+    expectBatchCreated(mock, "atomic")
+
+    // 60 does not cover the 80 of both items
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(60), "active")
+    expectWalletRead(mock, 2, "USD", decimal.Zero, "active")
+    expectWalletRead(mock, 3, "USD", decimal.Zero, "active")
+    mock.ExpectRollback()
+
+    for i, item := range testBatchItems {
+        mock.ExpectBegin()
+        mock.ExpectQuery("INSERT INTO transactions").
+            WithArgs(1, item.ToUserID, item.Amount, "USD", "transfer", "failed", decimal.Zero, "wallet", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+            WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(43+i, time.Now(), time.Now()))
+        expectEvents(mock, "transaction.failed")
+        mock.ExpectCommit()
+    }
+    mock.ExpectBegin()
+    expectItemUpdate(mock, 0, "failed", nil, model.FailureReasonInsufficientBalance)
+    expectItemUpdate(mock, 1, "failed", nil, model.FailureReasonInsufficientBalance)
+    mock.ExpectExec("UPDATE transfer_batches").
+        WithArgs(7, "failed", 0, 2).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    batch, _, err := batchService.TransferBatch(context.Background(), 1, "USD", model.BatchModeAtomic, testBatchItems, "")
+    require.NoError(t, err)
+    require.Equal(t, model.BatchStatusFailed, batch.Status)
+    require.Equal(t, model.FailureReasonInsufficientBalance, batch.Items[0].FailureReason)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that a best-effort batch pays the items that can be paid and fails the others on their own
+func TestBatchService_TransferBatch_BestEffort(t *testing.T) {
+    batchService, mock, mockRedis := newTestBatchService(t)
+
+    expectBatchCreated(mock, "best_effort")
+
+    // The first item is paid like a single transfer
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(60), "active")
+    expectBalanceUpdate(mock, 1, decimal.NewFromInt(30))
+    expectWalletRead(mock, 3, "USD", decimal.Zero, "active")
+    expectBalanceUpdate(mock, 3, decimal.NewFromInt(30))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 3, decimal.NewFromInt(30), "USD", "transfer", "completed", decimal.Zero, "wallet", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(41, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 41, "transfer", "user:1:USD", "user:3:USD", decimal.NewFromInt(30))
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    mock.ExpectCommit()
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mockRedis.ExpectDel("balances:3").SetVal(1)
+    expectItemUpdate(mock, 0, "succeeded", 41, "")
+
+    // The rest of the balance does not cover the second item
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(30), "active")
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(50), "USD", "transfer", "failed", decimal.Zero, "wallet", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(42, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+    expectItemUpdate(mock, 1, "failed", nil, model.FailureReasonInsufficientBalance)
+
+    mock.ExpectExec("UPDATE transfer_batches").
+        WithArgs(7, "partially_completed", 1, 1).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    batch, _, err := batchService.TransferBatch(context.Background(), 1, "USD", model.BatchModeBestEffort, testBatchItems, "")
+    require.NoError(t, err)
+    require.Equal(t, model.BatchStatusPartiallyCompleted, batch.Status)
+    require.Equal(t, model.BatchItemSucceeded, batch.Items[0].Status)
+    require.Equal(t, model.BatchItemFailed, batch.Items[1].Status)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+    require.NoError(t, mockRedis.ExpectationsWereMet())
+}
+
+// Test that a batch replayed with its idempotency key is returned as it is, and that the key cannot be reused for another batch
+func TestBatchService_TransferBatch_Replay(t *testing.T) {
+    batchService, mock, _ := newTestBatchService(t)
+
+    batch, err := batchService.newBatch(1, "USD", "", testBatchItems)
+    require.NoError(t, err)
+    fingerprint := batchFingerprint(batch)
+
+    for i := 0; i < 2; i++ {
+        mock.ExpectQuery("SELECT (.+) FROM transfer_batches WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+            WithArgs(1, "payroll-2024-11").
+            WillReturnRows(sqlmock.NewRows(batchColumns).AddRow(7, 1, "USD", "atomic", "completed", decimal.NewFromInt(80), 2, 2, 0, "payroll-2024-11", fingerprint, time.Now(), time.Now()))
+        mock.ExpectQuery("SELECT (.+) FROM transfer_batch_items").
+            WithArgs(7).
+            WillReturnRows(sqlmock.NewRows(batchItemColumns).
+                AddRow(7, 0, 3, decimal.NewFromInt(30), decimal.Zero, "payslip-3", "succeeded", 41, "", "").
+                AddRow(7, 1, 2, decimal.NewFromInt(50), decimal.Zero, "payslip-2", "succeeded", 42, "", ""))
+    }
+
+    replay, replayed, err := batchService.TransferBatch(context.Background(), 1, "USD", "", testBatchItems, "payroll-2024-11")
+    require.NoError(t, err)
+    require.True(t, replayed)
+    require.Equal(t, model.BatchStatusCompleted, replay.Status)
+    require.Len(t, replay.Items, 2)
+
+    // The same key with another amount
+    items := []BatchItem{testBatchItems[0], {ToUserID: 2, Amount: decimal.NewFromInt(500)}}
+    _, _, err = batchService.TransferBatch(context.Background(), 1, "USD", "", items, "payroll-2024-11")
+    require.ErrorIs(t, err, ErrIdempotencyKeyConflict)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that invalid batches are refused before anything is stored
+func TestBatchService_TransferBatch_Invalid(t *testing.T) {
+    batchService, mock, _ := newTestBatchService(t)
+
+    _, _, err := batchService.TransferBatch(context.Background(), 1, "USD", "", nil, "")
+    require.ErrorIs(t, err, ErrInvalidBatch)
+
+    _, _, err = batchService.TransferBatch(context.Background(), 1, "USD", "all_at_once", testBatchItems, "")
+    require.ErrorIs(t, err, ErrInvalidBatch)
+
+    _, _, err = batchService.TransferBatch(context.Background(), 1, "USD", "", []BatchItem{{ToUserID: 1, Amount: decimal.NewFromInt(5)}}, "")
+    require.ErrorIs(t, err, ErrInvalidBatch)
+
+    _, _, err = batchService.TransferBatch(context.Background(), 1, "USD", "", []BatchItem{{ToUserID: 2, Amount: decimal.NewFromInt(-5)}}, "")
+    require.Error(t, err)
+
+    items := make([]BatchItem, MaxBatchItems+1)
+    _, _, err = batchService.TransferBatch(context.Background(), 1, "USD", "", items, "")
+    require.ErrorIs(t, err, ErrInvalidBatch)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that with PostgreSQL advisory locks, which pin a pooled connection each, a batch cannot lock more users than
+// the pool can spare, and is refused before any lock is taken, while a batch made before is still replayed
+func TestBatchService_TransferBatch_PoolHeadroom(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    // A pool of 8 connections spares 2 for the locks of one batch
+    db.SetMaxOpenConns(8)
+    dbConn := sqlx.NewDb(db, "sqlmock")
+    locker := lock.NewPostgresLocker(dbConn, lock.DefaultOptions())
+    transfers := NewTransferService(dbConn, redisClient, locker, PessimisticConcurrency, nil, nil)
+    batchService := NewBatchService(dbConn, transfers)
+
+    items := []BatchItem{{ToUserID: 2, Amount: decimal.NewFromInt(10)}, {ToUserID: 3, Amount: decimal.NewFromInt(10)}}
+    _, _, err = batchService.TransferBatch(context.Background(), 1, "USD", "", items, "")
+    require.ErrorIs(t, err, ErrInvalidBatch)
+    require.Contains(t, err.Error(), "3 users, at most 2")
+
+    batch, err := batchService.newBatch(1, "USD", "", items)
+    require.NoError(t, err)
+    mock.ExpectQuery("SELECT (.+) FROM transfer_batches WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, "payroll-2024-10").
+        WillReturnRows(sqlmock.NewRows(batchColumns).AddRow(6, 1, "USD", "atomic", "completed", decimal.NewFromInt(20), 2, 2, 0, "payroll-2024-10", batchFingerprint(batch), time.Now(), time.Now()))
+    mock.ExpectQuery("SELECT (.+) FROM transfer_batch_items").
+        WithArgs(6).
+        WillReturnRows(sqlmock.NewRows(batchItemColumns).
+            AddRow(6, 0, 2, decimal.NewFromInt(10), decimal.Zero, "", "succeeded", 31, "", "").
+            AddRow(6, 1, 3, decimal.NewFromInt(10), decimal.Zero, "", "succeeded", 32, "", ""))
+
+    replay, replayed, err := batchService.TransferBatch(context.Background(), 1, "USD", "", items, "payroll-2024-10")
+    require.NoError(t, err)
+    require.True(t, replayed)
+    require.Equal(t, 6, replay.ID)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/jmoiron/sqlx"
+)
+
+// ConcurrencyMode selects how the read-modify-write cycle of a balance is protected in the database.
+type ConcurrencyMode string
+
+const (
+    // PessimisticConcurrency locks the wallet rows with SELECT ... FOR UPDATE inside the transaction.
+    PessimisticConcurrency ConcurrencyMode = "pessimistic"
+    // OptimisticConcurrency reads the wallet rows without locking and retries the operation
+    // when the version check of the balance update detects a concurrent change.
+    OptimisticConcurrency ConcurrencyMode = "optimistic"
+)
+
+// maxOptimisticAttempts is how many times an operation is attempted in optimistic mode before giving up.
+const maxOptimisticAttempts = 3
+
+// readWallet reads the user's wallet in the given currency inside the transaction, locking the row in pessimistic mode.
+// A wallet the user does not hold yet is opened with a zero balance first, it disappears again if the transaction rolls back.
+func readWallet(ctx context.Context, walletRepo *repository.WalletRepository, exec repository.Executor, mode ConcurrencyMode, userID int, currency string) (*model.Wallet, error) {
+    if err := walletRepo.EnsureWallet(ctx, exec, userID, currency); err != nil {
+        return nil, err
+    }
+    if mode == OptimisticConcurrency {
+        return walletRepo.GetWalletSnapshot(ctx, exec, userID, currency)
+    }
+    return walletRepo.GetWallet(ctx, exec, userID, currency)
+}
+
+// withConcurrencyRetry runs a money movement attempt. In optimistic mode the attempt is repeated when it
+// lost a race on the balance version; if it keeps losing, ErrBalanceBusy is returned so the client can retry later.
+func withConcurrencyRetry(mode ConcurrencyMode, attempt func() (*model.Transaction, bool, error)) (*model.Transaction, bool, error) {
+    attempts := 1
+    if mode == OptimisticConcurrency {
+        attempts = maxOptimisticAttempts
+    }
+
+    var err error
+    for i := 0; i < attempts; i++ {
+        var txn *model.Transaction
+        var replayed bool
+        txn, replayed, err = attempt()
+        if !errors.Is(err, repository.ErrVersionConflict) {
+            return txn, replayed, err
+        }
+    }
+    return nil, false, fmt.Errorf("%w: %w", ErrBalanceBusy, err)
+}
+
+// withTx runs fn inside a database transaction, committing it if fn succeeds.
+func withTx(dbConn *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+    tx, err := dbConn.Beginx()
+    if err != nil {
+        return fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    if err := fn(tx); err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %w", err)
+    }
+    return nil
+}
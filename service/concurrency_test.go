@@ -0,0 +1,106 @@
+package service
+
+import (
+    "testing"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/jmoiron/sqlx"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/repository"
+    "time"
+)
+
+// walletColumns are the columns selected when a wallet is read
+var walletColumns = []string{"id", "user_id", "currency", "balance", "version", "user_status", "created_at", "updated_at"}
+
+// expectWalletRead expects the user's wallet in the currency to be opened if missing, then read with a row lock.
+// The wallet ID equals the user ID, so the following balance update can be matched by it.
+func expectWalletRead(mock sqlmock.Sqlmock, userID int, currency string, balance decimal.Decimal, status string) {
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(userID, currency).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u (.+) FOR UPDATE OF w FOR SHARE OF u").
+        WithArgs(userID, currency).
+        WillReturnRows(sqlmock.NewRows(walletColumns).AddRow(userID, userID, currency, balance, 0, status, time.Now(), time.Now()))
+}
+
+// expectOptimisticRead expects the user's USD wallet to be read without a row lock
+func expectOptimisticRead(mock sqlmock.Sqlmock, userID int, balance decimal.Decimal, version int64) {
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(userID, "USD").
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u (.+) AND u.deleted_at IS NULL$").
+        WithArgs(userID, "USD").
+        WillReturnRows(sqlmock.NewRows(walletColumns).AddRow(userID, userID, "USD", balance, version, "active", time.Now(), time.Now()))
+}
+
+// Test that an optimistic withdrawal is retried when another request changed the balance in between
+func TestWithdrawService_Withdraw_OptimisticRetry(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), OptimisticConcurrency, nil, nil, nil)
+
+    // The first attempt loses the race on the version
+    mock.ExpectBegin()
+    expectOptimisticRead(mock, 1, decimal.NewFromInt(150), 3)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(3)).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectRollback()
+
+    // The second attempt sees the new balance and succeeds
+    mock.ExpectBegin()
+    expectOptimisticRead(mock, 1, decimal.NewFromInt(130), 4)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(80), sqlmock.AnyArg(), 1, int64(4)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "withdraw", "completed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 1, "withdraw", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(50))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that an optimistic deposit gives up with ErrBalanceBusy after losing every attempt
+func TestDepositService_Deposit_OptimisticExhausted(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), OptimisticConcurrency, nil, nil)
+
+    for i := 0; i < maxOptimisticAttempts; i++ {
+        mock.ExpectBegin()
+        expectOptimisticRead(mock, 1, decimal.NewFromInt(100), int64(i))
+        mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+            WithArgs(decimal.NewFromInt(150), sqlmock.AnyArg(), 1, int64(i)).
+            WillReturnResult(sqlmock.NewResult(0, 0))
+        mock.ExpectRollback()
+    }
+
+    _, _, err = depositService.Deposit(1, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.ErrorIs(t, err, ErrBalanceBusy)
+    require.ErrorIs(t, err, repository.ErrVersionConflict)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
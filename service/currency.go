@@ -0,0 +1,56 @@
+package service
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/shopspring/decimal"
+)
+
+// ErrUnsupportedCurrency is returned when a money movement names a currency the wallet service does not hold.
+var ErrUnsupportedCurrency = errors.New("unsupported currency")
+
+// ErrInvalidAmountScale is returned when an amount has more decimals than its currency allows, such as 1.5 JPY.
+var ErrInvalidAmountScale = errors.New("amount has more decimals than the currency allows")
+
+// normalizeCurrency upper-cases an ISO 4217 currency code and checks that it is supported.
+// An empty currency selects model.DefaultCurrency, so clients that predate multi-currency wallets keep working.
+func normalizeCurrency(currency string) (string, error) {
+    currency = strings.ToUpper(strings.TrimSpace(currency))
+    if currency == "" {
+        return model.DefaultCurrency, nil
+    }
+    if _, ok := model.CurrencyScale(currency); !ok {
+        return "", fmt.Errorf("%w: %s", ErrUnsupportedCurrency, currency)
+    }
+    return currency, nil
+}
+
+// checkAmountScale rejects amounts that cannot be expressed in minor units of the currency.
+func checkAmountScale(amount decimal.Decimal, currency string) error {
+    scale, ok := model.CurrencyScale(currency)
+    if !ok {
+        return fmt.Errorf("%w: %s", ErrUnsupportedCurrency, currency)
+    }
+    if !amount.Equal(amount.Truncate(scale)) {
+        return fmt.Errorf("%w: %s amounts have at most %d decimals", ErrInvalidAmountScale, currency, scale)
+    }
+    return nil
+}
+
+// validateMoney normalizes the currency of a money movement and checks that the amount is positive and fits the currency.
+// The label names the movement in the error message, such as Deposit or Transfer.
+func validateMoney(label string, amount decimal.Decimal, currency string) (string, error) {
+    if amount.LessThanOrEqual(decimal.Zero) {
+        return "", fmt.Errorf("%s amount must be greater than zero", label)
+    }
+    currency, err := normalizeCurrency(currency)
+    if err != nil {
+        return "", err
+    }
+    if err := checkAmountScale(amount, currency); err != nil {
+        return "", err
+    }
+    return currency, nil
+}
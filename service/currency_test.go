@@ -0,0 +1,42 @@
+package service
+
+import (
+    "testing"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+)
+
+func TestValidateMoney(t *testing.T) {
+    cases := []struct {
+        amount   string
+        currency string
+        want     string
+        err      error
+    }{
+        {"10.05", "", "USD", nil},
+        {"10.05", " eur ", "EUR", nil},
+        {"1500", "JPY", "JPY", nil},
+        {"1.250", "KWD", "KWD", nil},
+        {"10.005", "USD", "", ErrInvalidAmountScale},
+        {"1500.5", "JPY", "", ErrInvalidAmountScale},
+        {"10", "XYZ", "", ErrUnsupportedCurrency},
+    }
+
+    for _, tc := range cases {
+        currency, err := validateMoney("Deposit", decimal.RequireFromString(tc.amount), tc.currency)
+        if tc.err != nil {
+            require.ErrorIs(t, err, tc.err, "%s %s", tc.amount, tc.currency)
+            continue
+        }
+        require.NoError(t, err, "%s %s", tc.amount, tc.currency)
+        require.Equal(t, tc.want, currency)
+    }
+
+    // Trailing zeros do not count as decimals
+    _, err := validateMoney("Deposit", decimal.RequireFromString("1500.00"), "JPY")
+    require.NoError(t, err)
+
+    // The amount is checked before the currency
+    _, err = validateMoney("Deposit", decimal.Zero, "XYZ")
+    require.EqualError(t, err, "Deposit amount must be greater than zero")
+}
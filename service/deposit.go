@@ -11,72 +11,118 @@ package service
 import (
     "context"
     "fmt"
-    "sync"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/repository"
     "github.com/yaoweihua/wallet-service/utils"
     "github.com/shopspring/decimal"
     "github.com/go-redis/redis/v8"
     "github.com/jmoiron/sqlx"
-    "time"
 )
 
-// Use global locks to prevent concurrent access to the same transaction
-var transferLocks sync.Map
-
-// Use global locks to prevent concurrent access to the balance of the same user
-var userLocks sync.Map
-
 // DepositService provides methods for handling deposit operations.
 // It interacts with the WalletRepository and TransactionRepository to manage user balances and transaction records.
 type DepositService struct {
     walletRepo      *repository.WalletRepository
     transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+    outboxRepo      *repository.OutboxRepository
     dbConn          *sqlx.DB
     redisClient     *redis.Client
+    locker          lock.Locker
+    mode            ConcurrencyMode
+    fees            *FeeSchedule
+    methods         *PaymentMethodRegistry
 }
 
 // NewDepositService creates a new instance of DepositService.
-// It initializes the service with the provided database connection and Redis client.
-func NewDepositService(dbConn *sqlx.DB, redisClient *redis.Client) *DepositService {
+// It initializes the service with the provided database connection, Redis client, the locker guarding user balances
+// the concurrency mode protecting balance updates in the database, the fee schedule pricing deposits
+// and the registry of payment methods, nil selecting DefaultPaymentMethods.
+func NewDepositService(dbConn *sqlx.DB, redisClient *redis.Client, locker lock.Locker, mode ConcurrencyMode, fees *FeeSchedule, methods *PaymentMethodRegistry) *DepositService {
     walletRepo := repository.NewWalletRepository(dbConn)
     transactionRepo := repository.NewTransactionRepository(dbConn)
+    ledgerRepo := repository.NewLedgerRepository(dbConn)
+    if methods == nil {
+        methods = DefaultPaymentMethods()
+    }
 
     return &DepositService{
         walletRepo:      walletRepo,
         transactionRepo: transactionRepo,
+        ledgerRepo:      ledgerRepo,
+        outboxRepo:      repository.NewOutboxRepository(dbConn),
         dbConn:          dbConn,
         redisClient:     redisClient,
+        locker:          locker,
+        mode:            mode,
+        fees:            fees,
+        methods:         methods,
     }
 }
 
-// Deposit function is responsible for handling the deposit logic
-func (s *DepositService) Deposit(userID int, amount decimal.Decimal) error {
-    // Acquire the user lock to prevent concurrent conflicts
-    logger := utils.GetLogger()
-    lock, ok := userLocks.LoadOrStore(userID, &sync.Mutex{})
-    if !ok {
-        logger.Warnf("Lock for user %d was newly created", userID)
+// Deposit function is responsible for handling the deposit logic. The amount is credited to the user's wallet
+// in the given currency, which is opened on the first deposit; an empty currency selects model.DefaultCurrency.
+// The payment must use a method of the registry enabled for deposits, within its limits, and its metadata is stored
+// with the transaction. The deposit fee is deducted from the credited amount and booked as fee revenue.
+// When an idempotency key is given and a deposit was already recorded with it, the original
+// transaction is returned and the replayed flag is set instead of applying the deposit again.
+func (s *DepositService) Deposit(userID int, currency string, amount decimal.Decimal, payment Payment, idempotencyKey string) (*model.Transaction, bool, error) {
+    // Acquire the user lock to prevent concurrent conflicts, across all instances of the service
+    ctx := context.Background()
+    locks, err := lockBalances(ctx, s.locker, userID)
+    if err != nil {
+        return nil, false, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    // Check whether the deposit amount is reasonable and fits the currency
+    currency, err = validateMoney("Deposit", amount, currency)
+    if err != nil {
+        return nil, false, err
     }
 
-    userLock, ok := lock.(*sync.Mutex)
-    if !ok {
-        return fmt.Errorf("failed to assert lock as *sync.Mutex for user %d", userID)
+    // Check that the payment method is enabled for the deposit of the amount, and mask its details
+    authorized, err := s.methods.authorize("deposit", payment, currency, amount)
+    if err != nil {
+        return nil, false, err
     }
 
-    userLock.Lock()
-    defer userLock.Unlock()
+    // The fee is taken out of the deposit, so it must leave something to credit
+    fee := s.fees.Calculate("deposit", authorized.method, currency, amount)
+    if fee.GreaterThanOrEqual(amount) {
+        return nil, false, fmt.Errorf("%w: a fee of %s %s leaves nothing to deposit", ErrFeeExceedsAmount, fee.String(), currency)
+    }
 
-    // Check whether the deposit amount is reasonable
-    if amount.LessThanOrEqual(decimal.Zero) {
-        return fmt.Errorf("Deposit amount must be greater than zero")
+    txn, replayed, err := withConcurrencyRetry(s.mode, func() (*model.Transaction, bool, error) {
+        return s.deposit(ctx, locks, userID, currency, amount, fee, authorized, idempotencyKey)
+    })
+    if err != nil {
+        // The attempt has been rolled back by now, so a rejected deposit is recorded on its own
+        recordRejection(ctx, s.transactionRepo, s.outboxRepo, s.dbConn, &model.Transaction{
+            FromUserID:      userID,
+            ToUserID:        0,
+            Amount:          amount,
+            Currency:        currency,
+            TransactionType: "deposit",
+            TransactionFee:  fee,
+            PaymentMethod:   authorized.method,
+            PaymentMetadata: authorized.metadata,
+        }, err)
+        return nil, false, err
     }
+    return txn, replayed, nil
+}
+
+// deposit runs a single attempt of the deposit inside one database transaction, while the user lock is held.
+func (s *DepositService) deposit(ctx context.Context, locks []lock.Lock, userID int, currency string, amount, fee decimal.Decimal, payment authorizedPayment, idempotencyKey string) (*model.Transaction, bool, error) {
+    logger := utils.GetLogger()
 
     // Begin the database transaction
     conn := s.dbConn
-    ctx := context.Background()
     tx, err := conn.Beginx()
     if err != nil {
-        return fmt.Errorf("failed to start transaction: %w", err)
+        return nil, false, fmt.Errorf("failed to start transaction: %w", err)
     }
 
     defer func() {
@@ -86,34 +132,77 @@ func (s *DepositService) Deposit(userID int, amount decimal.Decimal) error {
         }
     }()
 
-    // Query the current balance of the user, and use row-level locks to ensure the consistency of the balance
-    user, err := s.walletRepo.GetUserBalance(ctx, userID)
+    // Return the original deposit if this request is a replay of an earlier one
+    fingerprint := requestFingerprint("deposit", userID, 0, currency, amount, payment.method)
+    replayed, err := findReplay(ctx, s.transactionRepo, tx, userID, idempotencyKey, fingerprint)
     if err != nil {
-        return err
+        return nil, false, err
+    }
+    if replayed != nil {
+        return replayed, true, nil
+    }
+
+    // Query the current balance of the user's wallet inside the transaction, using a row-level lock unless running in optimistic mode
+    wallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, userID, currency)
+    if err != nil {
+        return nil, false, err
+    }
+
+    // Inactive accounts cannot receive money
+    if err := checkCanReceive(wallet); err != nil {
+        return nil, false, err
+    }
+
+    // Make sure the balance lock has not been taken over by another request in the meantime
+    if err := checkFence(ctx, s.walletRepo, tx, locks, userID); err != nil {
+        return nil, false, err
     }
 
-    // Update the user's balance
-    newBalance := user.Balance.Add(amount)
-    if err := s.walletRepo.UpdateBalance(ctx, tx, userID, newBalance); err != nil {
-        return err
+    // Update the wallet's balance, crediting the amount less the fee
+    newBalance := wallet.Balance.Add(amount).Sub(fee)
+    if err := s.walletRepo.UpdateBalance(ctx, tx, wallet.ID, newBalance, wallet.Version); err != nil {
+        return nil, false, err
     }
 
     // Record the deposit transaction
-    if err := s.transactionRepo.RecordTransaction(ctx, tx, userID, 0, amount, "deposit", "completed"); err != nil {
-        return err
+    txn := &model.Transaction{
+        FromUserID:        userID,
+        ToUserID:          0,
+        Amount:            amount,
+        Currency:          currency,
+        TransactionType:   "deposit",
+        TransactionStatus: model.TransactionStatusCompleted,
+        TransactionFee:    fee,
+        PaymentMethod:     payment.method,
+        PaymentMetadata:   payment.metadata,
+    }
+    if idempotencyKey != "" {
+        txn.IdempotencyKey = idempotencyKey
+        txn.RequestHash = fingerprint
+    }
+    if err := recordTransaction(ctx, s.transactionRepo, tx, txn); err != nil {
+        return nil, false, err
+    }
+
+    // Post the deposit to the ledger, funded by the external funding account
+    if err := postMovement(ctx, s.ledgerRepo, tx, txn.ID, "deposit", systemLedgerAccount(model.SystemAccountExternalFunding, currency), userLedgerAccount(userID, currency), amount); err != nil {
+        return nil, false, err
+    }
+    if err := postFee(ctx, s.ledgerRepo, tx, txn.ID, userID, currency, fee); err != nil {
+        return nil, false, err
+    }
+
+    // Raise the events of the deposit for downstream systems, they are only published if it is committed
+    if err := recordEvents(ctx, s.outboxRepo, tx, txn, balanceChange(wallet, newBalance)); err != nil {
+        return nil, false, err
     }
 
     // Commit the transaction
     if err := tx.Commit(); err != nil {
-        return fmt.Errorf("failed to commit transaction: %w", err)
+        return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
     }
 
-    // Update the Redis cache
-    cacheKey := fmt.Sprintf("balance:%d", userID)
-    if s.redisClient != nil {
-        if err := s.redisClient.Set(ctx, cacheKey, newBalance.String(), time.Second*3600); err != nil {
-            logger.Warnf("Warning: failed to cache balance: %v", err)
-        }        
-    }
-    return nil
+    // Evict the cached balances, they are read from the database again on the next request
+    invalidateBalances(ctx, s.redisClient, userID)
+    return txn, false, nil
 }
@@ -7,6 +7,7 @@ import (
     "github.com/stretchr/testify/require"
     "github.com/jmoiron/sqlx"
     redismock "github.com/go-redis/redismock/v8"
+    "github.com/yaoweihua/wallet-service/lock"
     "time"
     "fmt"
 )
@@ -22,32 +23,34 @@ func TestDepositService_Deposit_Success(t *testing.T) {
     defer redisClient.Close() // nolint:errcheck
 
     // Set expectations for Redis operations
-    mockRedis.ExpectSet("balance:1", "150", time.Second*3600).SetVal("")
+    mockRedis.ExpectDel("balances:1").SetVal(1)
 
     // Create an instance of the wallet deposit service and pass in the mock Redis client
-    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
 
     // Set database expectations
     mock.ExpectBegin()
 
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1").
-        WithArgs(1).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(1, decimal.NewFromInt(100)))
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(100), "active")
 
     // Expectations for transaction operations
-    mock.ExpectExec("UPDATE users SET balance = \\$1, updated_at = \\$2 WHERE id = \\$3").
-        WithArgs(decimal.NewFromInt(150), sqlmock.AnyArg(), 1).
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(150), sqlmock.AnyArg(), 1, int64(0)).
         WillReturnResult(sqlmock.NewResult(1, 1))
 
     // Expectations for inserting transaction records
-    mock.ExpectExec("INSERT INTO transactions").
-        WithArgs(1, 0, decimal.NewFromInt(50), "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card").
-        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+
+    // The expectations of posting the movement to the ledger
+    expectLedgerMovement(mock, 1, "deposit", "system:external_funding:USD", "user:1:USD", decimal.NewFromInt(50))
 
+    expectEvents(mock, "transaction.completed", "balance.changed")
     mock.ExpectCommit()
 
     // Call the deposit method
-    err = depositService.Deposit(1, decimal.NewFromInt(50))
+    _, _, err = depositService.Deposit(1, "USD", decimal.NewFromInt(50), Payment{}, "")
     require.NoError(t, err)
 
     // Check if all the expectations are fully matched
@@ -68,7 +71,7 @@ func TestDepositService_Deposit_InvalidAmount(t *testing.T) {
     defer redisClient.Close() // nolint:errcheck
 
     // Create an instance of the wallet deposit service and pass in the mock Redis client
-    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
 
     // Invalid amount test
     invalidAmounts := []decimal.Decimal{
@@ -79,7 +82,7 @@ func TestDepositService_Deposit_InvalidAmount(t *testing.T) {
     for _, amount := range invalidAmounts {
         t.Run(fmt.Sprintf("deposit amount: %s", amount.String()), func(t *testing.T) {
             // Here, directly verify whether the amount is valid. If it is not valid, return an error in advance
-            err := depositService.Deposit(1, amount)
+            _, _, err := depositService.Deposit(1, "USD", amount, Payment{}, "")
 
             // Verify whether an error has been returned
             require.Error(t, err)
@@ -96,3 +99,43 @@ func TestDepositService_Deposit_InvalidAmount(t *testing.T) {
     }
 }
 
+
+// Test that the first deposit in a currency opens the wallet and posts to the ledger accounts of that currency
+func TestDepositService_Deposit_NewCurrency(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "JPY", decimal.Zero, "active")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromInt(1500), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(1500), "JPY", "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 1, "deposit", "system:external_funding:JPY", "user:1:JPY", decimal.NewFromInt(1500))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, _, err := depositService.Deposit(1, "jpy", decimal.NewFromInt(1500), Payment{}, "")
+    require.NoError(t, err)
+    require.Equal(t, "JPY", txn.Currency)
+
+    // Yen have no minor unit
+    _, _, err = depositService.Deposit(1, "JPY", decimal.RequireFromString("0.5"), Payment{}, "")
+    require.ErrorIs(t, err, ErrInvalidAmountScale)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/jmoiron/sqlx"
+)
+
+// ErrInsufficientBalance is returned when the payer's balance does not cover the amount.
+var ErrInsufficientBalance = errors.New("Insufficient balance")
+
+// rejection marks an error that rejects a money movement for a business reason,
+// such as an insufficient balance, as opposed to an infrastructure failure.
+type rejection struct {
+    reason string
+    err    error
+}
+
+// reject wraps err as a rejection with the given machine-readable failure reason.
+func reject(reason string, err error) error {
+    return &rejection{reason: reason, err: err}
+}
+
+func (r *rejection) Error() string {
+    return r.err.Error()
+}
+
+func (r *rejection) Unwrap() error {
+    return r.err
+}
+
+// recordRejection durably records a rejected money movement as a failed transaction with the reason of the rejection,
+// together with its transaction.failed event. It runs in a database transaction of its own rather than the rolled-back
+// transaction of the attempt, so the record survives.
+// Errors that are not rejections are ignored, and a failure to record is only logged so the original error reaches the caller.
+func recordRejection(ctx context.Context, transactionRepo *repository.TransactionRepository, outboxRepo *repository.OutboxRepository, dbConn *sqlx.DB, txn *model.Transaction, err error) {
+    var rejected *rejection
+    if !errors.As(err, &rejected) {
+        return
+    }
+
+    txn.TransactionStatus = model.TransactionStatusFailed
+    txn.FailureReason = rejected.reason
+    rErr := withTx(dbConn, func(tx *sqlx.Tx) error {
+        if err := transactionRepo.RecordTransaction(ctx, tx, txn); err != nil {
+            return err
+        }
+        return recordEvents(ctx, outboxRepo, tx, txn)
+    })
+    if rErr != nil {
+        utils.GetLogger().Warnf("Warning: failed to record rejected %s for user %d: %v", txn.TransactionType, txn.FromUserID, rErr)
+    }
+}
+
+// rejectionReason returns the failure reason of a rejection, or an empty string for other errors.
+func rejectionReason(err error) string {
+    var rejected *rejection
+    if errors.As(err, &rejected) {
+        return rejected.reason
+    }
+    return ""
+}
+
+// truncateError returns the message of err, cut to at most max bytes so it fits the column it is stored in.
+func truncateError(err error, max int) string {
+    message := err.Error()
+    if len(message) > max {
+        message = message[:max]
+    }
+    return message
+}
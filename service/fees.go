@@ -0,0 +1,127 @@
+package service
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/shopspring/decimal"
+)
+
+// ErrFeeExceedsAmount is returned when the fee of a deposit would swallow the whole deposited amount.
+var ErrFeeExceedsAmount = errors.New("fee exceeds the amount")
+
+// FeeRule prices the money movements it matches. Empty transaction type, payment method and currency fields match
+// any value, and the amount band runs from MinAmount (inclusive) to MaxAmount (exclusive, unbounded if nil).
+// The fee is Flat plus Percent of the amount, clamped between MinFee and MaxFee. All amounts are in the currency of the movement.
+type FeeRule struct {
+    TransactionType string           `json:"transaction_type"` // deposit, withdraw or transfer
+    PaymentMethod   string           `json:"payment_method"`   // Such as credit_card or bank_transfer
+    Currency        string           `json:"currency"`         // ISO 4217 code
+    MinAmount       decimal.Decimal  `json:"min_amount"`       // Lower bound of the amount band, inclusive
+    MaxAmount       *decimal.Decimal `json:"max_amount"`       // Upper bound of the amount band, exclusive
+    Flat            decimal.Decimal  `json:"flat"`             // Fixed part of the fee
+    Percent         decimal.Decimal  `json:"percent"`          // Proportional part of the fee, 1.5 charges 1.5% of the amount
+    MinFee          decimal.Decimal  `json:"min_fee"`          // The fee charged at least
+    MaxFee          *decimal.Decimal `json:"max_fee"`          // The fee charged at most
+}
+
+// matches reports whether the rule applies to the money movement.
+func (r FeeRule) matches(txType, paymentMethod, currency string, amount decimal.Decimal) bool {
+    if r.TransactionType != "" && r.TransactionType != txType {
+        return false
+    }
+    if r.PaymentMethod != "" && r.PaymentMethod != paymentMethod {
+        return false
+    }
+    if r.Currency != "" && r.Currency != currency {
+        return false
+    }
+    if amount.LessThan(r.MinAmount) {
+        return false
+    }
+    return r.MaxAmount == nil || amount.LessThan(*r.MaxAmount)
+}
+
+// validate checks that the rule can be applied, so mistakes in the rules file are found when it is loaded.
+func (r FeeRule) validate() error {
+    switch r.TransactionType {
+    case "", "deposit", "withdraw", "transfer":
+    default:
+        return fmt.Errorf("unknown transaction type %q", r.TransactionType)
+    }
+    if r.Currency != "" {
+        if _, ok := model.CurrencyScale(r.Currency); !ok {
+            return fmt.Errorf("%w: %s", ErrUnsupportedCurrency, r.Currency)
+        }
+    }
+    if r.Flat.IsNegative() || r.Percent.IsNegative() || r.MinFee.IsNegative() || r.MinAmount.IsNegative() {
+        return fmt.Errorf("fees and amounts must not be negative")
+    }
+    if r.MaxAmount != nil && r.MaxAmount.LessThanOrEqual(r.MinAmount) {
+        return fmt.Errorf("max_amount must be greater than min_amount")
+    }
+    if r.MaxFee != nil && r.MaxFee.LessThan(r.MinFee) {
+        return fmt.Errorf("max_fee must not be less than min_fee")
+    }
+    return nil
+}
+
+// FeeSchedule holds the fee rules of the wallet service. The first rule matching a money movement prices it,
+// so more specific rules go first; a movement no rule matches is free. A nil schedule charges no fees at all.
+type FeeSchedule struct {
+    rules []FeeRule
+}
+
+// NewFeeSchedule creates a FeeSchedule from rules in order of precedence.
+func NewFeeSchedule(rules []FeeRule) (*FeeSchedule, error) {
+    for i := range rules {
+        rules[i].TransactionType = strings.ToLower(strings.TrimSpace(rules[i].TransactionType))
+        rules[i].PaymentMethod = strings.ToLower(strings.TrimSpace(rules[i].PaymentMethod))
+        rules[i].Currency = strings.ToUpper(strings.TrimSpace(rules[i].Currency))
+        if err := rules[i].validate(); err != nil {
+            return nil, fmt.Errorf("invalid fee rule %d: %w", i+1, err)
+        }
+    }
+    return &FeeSchedule{rules: rules}, nil
+}
+
+// LoadFeeSchedule reads a JSON array of fee rules into a FeeSchedule.
+func LoadFeeSchedule(path string) (*FeeSchedule, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read fee rules file: %w", err)
+    }
+
+    var rules []FeeRule
+    if err := json.Unmarshal(data, &rules); err != nil {
+        return nil, fmt.Errorf("failed to parse fee rules file %s: %w", path, err)
+    }
+    return NewFeeSchedule(rules)
+}
+
+// Calculate returns the fee of a money movement, rounded half up to the minor unit of its currency.
+func (s *FeeSchedule) Calculate(txType, paymentMethod, currency string, amount decimal.Decimal) decimal.Decimal {
+    if s == nil {
+        return decimal.Zero
+    }
+
+    for _, rule := range s.rules {
+        if !rule.matches(txType, paymentMethod, currency, amount) {
+            continue
+        }
+
+        fee := rule.Flat.Add(amount.Mul(rule.Percent).Div(decimal.NewFromInt(100)))
+        if fee.LessThan(rule.MinFee) {
+            fee = rule.MinFee
+        }
+        if rule.MaxFee != nil && fee.GreaterThan(*rule.MaxFee) {
+            fee = *rule.MaxFee
+        }
+        scale, _ := model.CurrencyScale(currency)
+        return fee.Round(scale)
+    }
+    return decimal.Zero
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+)
+
+// testFees charges withdrawals 1.5% with a minimum of 0.30 and a maximum of 10, except for small
+// withdrawals below 10 which cost a flat 0.25, and charges deposits a flat 1 JPY
+func testFees(t *testing.T) *FeeSchedule {
+    maxSmall := decimal.NewFromInt(10)
+    maxFee := decimal.NewFromInt(10)
+    fees, err := NewFeeSchedule([]FeeRule{
+        {TransactionType: "withdraw", MaxAmount: &maxSmall, Flat: decimal.RequireFromString("0.25")},
+        {TransactionType: "withdraw", Percent: decimal.RequireFromString("1.5"), MinFee: decimal.RequireFromString("0.30"), MaxFee: &maxFee},
+        {TransactionType: "deposit", Currency: "jpy", Flat: decimal.NewFromInt(1)},
+    })
+    require.NoError(t, err)
+    return fees
+}
+
+// Test that the first matching rule prices a movement, with its caps and rounding applied
+func TestFeeSchedule_Calculate(t *testing.T) {
+    fees := testFees(t)
+
+    tests := []struct {
+        txType, currency, amount, expected string
+    }{
+        {"withdraw", "USD", "5", "0.25"},         // Small withdrawal band
+        {"withdraw", "USD", "10", "0.3"},         // 0.15, raised to the minimum
+        {"withdraw", "USD", "100.33", "1.5"},     // 1.50495, rounded to cents
+        {"withdraw", "USD", "5000", "10"},        // 75, capped at the maximum
+        {"deposit", "JPY", "1500", "1"},          // Currency specific rule
+        {"deposit", "USD", "1500", "0"},          // No rule matches
+        {"transfer", "USD", "100", "0"},
+    }
+
+    for _, tt := range tests {
+        fee := fees.Calculate(tt.txType, "credit_card", tt.currency, decimal.RequireFromString(tt.amount))
+        require.Equal(t, tt.expected, fee.String(), "%s of %s %s", tt.txType, tt.amount, tt.currency)
+    }
+
+    // A nil schedule charges nothing
+    var none *FeeSchedule
+    require.True(t, none.Calculate("withdraw", "credit_card", "USD", decimal.NewFromInt(100)).IsZero())
+}
+
+// Test that invalid rules are rejected when the schedule is built or loaded
+func TestLoadFeeSchedule(t *testing.T) {
+    dir := t.TempDir()
+
+    path := filepath.Join(dir, "fees.json")
+    require.NoError(t, os.WriteFile(path, []byte(`[{"transaction_type": "transfer", "payment_method": "paypal", "percent": "2"}]`), 0o600))
+    fees, err := LoadFeeSchedule(path)
+    require.NoError(t, err)
+    require.Equal(t, "2", fees.Calculate("transfer", "paypal", "USD", decimal.NewFromInt(100)).String())
+    require.True(t, fees.Calculate("transfer", "credit_card", "USD", decimal.NewFromInt(100)).IsZero())
+
+    invalid := []string{
+        `[{"transaction_type": "refund"}]`,
+        `[{"currency": "XXX"}]`,
+        `[{"flat": "-1"}]`,
+        `[{"min_fee": "5", "max_fee": "1"}]`,
+        `[{"min_amount": "10", "max_amount": "10"}]`,
+    }
+    for _, rules := range invalid {
+        require.NoError(t, os.WriteFile(path, []byte(rules), 0o600))
+        _, err := LoadFeeSchedule(path)
+        require.Error(t, err, rules)
+    }
+}
+
+// Test that a withdrawal debits the fee on top of the amount and books it as revenue in the same transaction
+func TestWithdrawService_Withdraw_Fee(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, testFees(t), nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(150), "active")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromFloat(48.5), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(100), "USD", "withdraw", "completed", decimal.NewFromFloat(1.5), "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 1, "withdraw", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(100))
+    expectLedgerMovement(mock, 1, "fee", "user:1:USD", "system:fee_revenue:USD", decimal.NewFromFloat(1.5))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, _, err := withdrawService.Withdraw(1, "USD", decimal.NewFromInt(100), Payment{}, "")
+    require.NoError(t, err)
+    require.Equal(t, "1.5", txn.TransactionFee.String())
+
+    // The balance covers the amount but not the fee, so the withdrawal is rejected and recorded with the fee it would have cost
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(100), "active")
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(100), "USD", "withdraw", "failed", decimal.NewFromFloat(1.5), "credit_card", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(2, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(100), Payment{}, "")
+    require.ErrorIs(t, err, ErrInsufficientBalance)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a deposit fee is deducted from the credited amount, and cannot swallow the whole deposit
+func TestDepositService_Deposit_Fee(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, testFees(t), nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "JPY", decimal.Zero, "active")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromInt(1499), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(1500), "JPY", "deposit", "completed", decimal.NewFromInt(1), "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 1, "deposit", "system:external_funding:JPY", "user:1:JPY", decimal.NewFromInt(1500))
+    expectLedgerMovement(mock, 1, "fee", "user:1:JPY", "system:fee_revenue:JPY", decimal.NewFromInt(1))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    _, _, err = depositService.Deposit(1, "JPY", decimal.NewFromInt(1500), Payment{}, "")
+    require.NoError(t, err)
+
+    _, _, err = depositService.Deposit(1, "JPY", decimal.NewFromInt(1), Payment{}, "")
+    require.ErrorIs(t, err, ErrFeeExceedsAmount)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
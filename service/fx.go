@@ -0,0 +1,178 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/shopspring/decimal"
+    "github.com/jmoiron/sqlx"
+)
+
+// ErrRateUnavailable is returned when the rate provider has no rate for a currency pair.
+var ErrRateUnavailable = errors.New("no fx rate available")
+
+// ErrSameCurrency is returned when a conversion is quoted from a currency into itself.
+var ErrSameCurrency = errors.New("source and target currency must differ")
+
+// ErrQuoteExpired is returned when an FX quote is executed after its expiry.
+var ErrQuoteExpired = errors.New("fx quote has expired")
+
+// ErrAmountTooSmall is returned when a converted amount rounds down to nothing in the target currency.
+var ErrAmountTooSmall = errors.New("amount is too small to convert")
+
+// fxRateScale is the number of decimals rates are held with, matching the fx_rate columns.
+const fxRateScale = 10
+
+// FXRateProvider supplies conversion rates between currencies.
+// Rate returns how many units of the target currency one unit of the source currency buys,
+// or ErrRateUnavailable if the pair is not offered.
+type FXRateProvider interface {
+    Rate(ctx context.Context, source, target string) (decimal.Decimal, error)
+}
+
+// StaticRateProvider serves a fixed table of rates, loaded from a file or given in code for tests.
+// A pair missing from the table is served as the inverse of the opposite pair if that one is present.
+type StaticRateProvider struct {
+    rates map[string]decimal.Decimal
+}
+
+// NewStaticRateProvider creates a StaticRateProvider from rates keyed by pair, such as USD/EUR.
+func NewStaticRateProvider(rates map[string]decimal.Decimal) *StaticRateProvider {
+    normalized := make(map[string]decimal.Decimal, len(rates))
+    for pair, rate := range rates {
+        normalized[strings.ToUpper(strings.TrimSpace(pair))] = rate
+    }
+    return &StaticRateProvider{rates: normalized}
+}
+
+// LoadStaticRateProvider reads a JSON file mapping pairs to rates, such as {"USD/EUR": "0.92"}, into a StaticRateProvider.
+func LoadStaticRateProvider(path string) (*StaticRateProvider, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read fx rates file: %w", err)
+    }
+
+    var rates map[string]decimal.Decimal
+    if err := json.Unmarshal(data, &rates); err != nil {
+        return nil, fmt.Errorf("failed to parse fx rates file %s: %w", path, err)
+    }
+    for pair, rate := range rates {
+        if rate.LessThanOrEqual(decimal.Zero) {
+            return nil, fmt.Errorf("fx rate for %s must be greater than zero", pair)
+        }
+    }
+    return NewStaticRateProvider(rates), nil
+}
+
+// Rate returns the rate of the pair from the table, falling back to the inverse of the opposite pair.
+func (p *StaticRateProvider) Rate(ctx context.Context, source, target string) (decimal.Decimal, error) {
+    if rate, ok := p.rates[source+"/"+target]; ok {
+        return rate, nil
+    }
+    if rate, ok := p.rates[target+"/"+source]; ok && rate.IsPositive() {
+        return decimal.NewFromInt(1).DivRound(rate, fxRateScale), nil
+    }
+    return decimal.Zero, fmt.Errorf("%w: %s/%s", ErrRateUnavailable, source, target)
+}
+
+// convertAmount converts an amount at the given rate following the rounding rules of the wallet service:
+// the rate is rounded half-even to fxRateScale decimals, and the converted amount is rounded down to the minor unit
+// of the target currency, so the recipient never receives more than the rate pays for. The remainder below
+// the minor unit stays in the FX clearing account.
+func convertAmount(amount, rate decimal.Decimal, targetCurrency string) (decimal.Decimal, decimal.Decimal, error) {
+    scale, ok := model.CurrencyScale(targetCurrency)
+    if !ok {
+        return decimal.Zero, decimal.Zero, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, targetCurrency)
+    }
+
+    rate = rate.RoundBank(fxRateScale)
+    converted := amount.Mul(rate).RoundDown(scale)
+    if !converted.IsPositive() {
+        return decimal.Zero, decimal.Zero, fmt.Errorf("%w: %s", ErrAmountTooSmall, amount.String())
+    }
+    return converted, rate, nil
+}
+
+// baseAmount values an amount of the currency in model.DefaultCurrency, the currency limits are set in, at the rate of
+// the provider, to the 8 decimals amounts are stored with. It returns ErrRateUnavailable if the currency cannot be valued,
+// so that limits are never skipped.
+func baseAmount(ctx context.Context, rates FXRateProvider, amount decimal.Decimal, currency string) (decimal.Decimal, error) {
+    if currency == model.DefaultCurrency {
+        return amount, nil
+    }
+    if rates == nil {
+        return decimal.Zero, fmt.Errorf("%w: %s/%s", ErrRateUnavailable, currency, model.DefaultCurrency)
+    }
+    rate, err := rates.Rate(ctx, currency, model.DefaultCurrency)
+    if err != nil {
+        return decimal.Zero, err
+    }
+    return amount.Mul(rate.RoundBank(fxRateScale)).Round(8), nil
+}
+
+// FXService issues FX quotes for cross-currency transfers.
+type FXService struct {
+    fxRepo   *repository.FXRepository
+    dbConn   *sqlx.DB
+    rates    FXRateProvider
+    quoteTTL time.Duration
+}
+
+// NewFXService creates a new instance of FXService quoting from the given rate provider.
+// Quotes can be executed for quoteTTL after they were issued.
+func NewFXService(dbConn *sqlx.DB, rates FXRateProvider, quoteTTL time.Duration) *FXService {
+    return &FXService{
+        fxRepo:   repository.NewFXRepository(dbConn),
+        dbConn:   dbConn,
+        rates:    rates,
+        quoteTTL: quoteTTL,
+    }
+}
+
+// CreateQuote quotes the conversion of amount from the source into the target currency for the user.
+// The quote fixes the rate and both amounts; it is executed with TransferService.TransferQuoted before it expires.
+func (s *FXService) CreateQuote(ctx context.Context, userID int, sourceCurrency, targetCurrency string, amount decimal.Decimal) (*model.FXQuote, error) {
+    sourceCurrency, err := validateMoney("Transfer", amount, sourceCurrency)
+    if err != nil {
+        return nil, err
+    }
+    if strings.TrimSpace(targetCurrency) == "" {
+        return nil, fmt.Errorf("target currency is required")
+    }
+    targetCurrency, err = normalizeCurrency(targetCurrency)
+    if err != nil {
+        return nil, err
+    }
+    if sourceCurrency == targetCurrency {
+        return nil, fmt.Errorf("%w: %s", ErrSameCurrency, sourceCurrency)
+    }
+
+    rate, err := s.rates.Rate(ctx, sourceCurrency, targetCurrency)
+    if err != nil {
+        return nil, err
+    }
+    targetAmount, rate, err := convertAmount(amount, rate, targetCurrency)
+    if err != nil {
+        return nil, err
+    }
+
+    quote := &model.FXQuote{
+        UserID:         userID,
+        SourceCurrency: sourceCurrency,
+        TargetCurrency: targetCurrency,
+        SourceAmount:   amount,
+        TargetAmount:   targetAmount,
+        Rate:           rate,
+        ExpiresAt:      time.Now().Add(s.quoteTTL),
+    }
+    if err := s.fxRepo.CreateQuote(ctx, s.dbConn, quote); err != nil {
+        return nil, err
+    }
+    return quote, nil
+}
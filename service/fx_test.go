@@ -0,0 +1,210 @@
+package service
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/repository"
+)
+
+// quoteColumns are the columns selected when an FX quote is read
+var quoteColumns = []string{"id", "user_id", "source_currency", "target_currency", "source_amount", "target_amount", "rate", "expires_at", "used_at", "transaction_id", "created_at"}
+
+// expectQuote expects the FX quote to be read, converting 100 USD into 92 EUR for user 1
+func expectQuote(mock sqlmock.Sqlmock, quoteID int, expiresAt time.Time) {
+    mock.ExpectQuery("SELECT (.+) FROM fx_quotes WHERE id = \\$1").
+        WithArgs(quoteID).
+        WillReturnRows(sqlmock.NewRows(quoteColumns).AddRow(quoteID, 1, "USD", "EUR", "100", "92", "0.92", expiresAt, nil, nil, time.Now()))
+}
+
+// expectLedgerConversion expects both legs of a conversion to be posted through the FX clearing accounts in one journal entry
+func expectLedgerConversion(mock sqlmock.Sqlmock, transactionID int, fromCode, toCode, sourceCurrency, targetCurrency string, sourceAmount, targetAmount decimal.Decimal) {
+    codes := []string{fromCode, "system:fx_clearing:" + sourceCurrency, "system:fx_clearing:" + targetCurrency, toCode}
+    for i, code := range codes {
+        mock.ExpectQuery("INSERT INTO ledger_accounts").
+            WithArgs(code, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+            WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11 + i))
+    }
+    mock.ExpectQuery("INSERT INTO journal_entries").
+        WithArgs(transactionID, "fx transfer").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(21, time.Now()))
+    mock.ExpectExec("INSERT INTO postings").
+        WithArgs(21, 11, sourceAmount.Neg(), 21, 12, sourceAmount, 21, 13, targetAmount.Neg(), 21, 14, targetAmount).
+        WillReturnResult(sqlmock.NewResult(0, 4))
+}
+
+// Test that rates are served directly, as the inverse of the opposite pair, or not at all
+func TestStaticRateProvider(t *testing.T) {
+    rates := NewStaticRateProvider(map[string]decimal.Decimal{"usd/eur": decimal.RequireFromString("0.8")})
+
+    rate, err := rates.Rate(context.Background(), "USD", "EUR")
+    require.NoError(t, err)
+    require.Equal(t, "0.8", rate.String())
+
+    rate, err = rates.Rate(context.Background(), "EUR", "USD")
+    require.NoError(t, err)
+    require.Equal(t, "1.25", rate.String())
+
+    _, err = rates.Rate(context.Background(), "USD", "JPY")
+    require.ErrorIs(t, err, ErrRateUnavailable)
+}
+
+// Test that the rates file is parsed and rejects rates that are not positive
+func TestLoadStaticRateProvider(t *testing.T) {
+    dir := t.TempDir()
+
+    path := filepath.Join(dir, "rates.json")
+    require.NoError(t, os.WriteFile(path, []byte(`{"USD/JPY": "151.25"}`), 0o600))
+    rates, err := LoadStaticRateProvider(path)
+    require.NoError(t, err)
+    rate, err := rates.Rate(context.Background(), "USD", "JPY")
+    require.NoError(t, err)
+    require.Equal(t, "151.25", rate.String())
+
+    invalid := filepath.Join(dir, "invalid.json")
+    require.NoError(t, os.WriteFile(invalid, []byte(`{"USD/JPY": "0"}`), 0o600))
+    _, err = LoadStaticRateProvider(invalid)
+    require.Error(t, err)
+
+    _, err = LoadStaticRateProvider(filepath.Join(dir, "missing.json"))
+    require.Error(t, err)
+}
+
+// Test that converted amounts are rounded down to the minor unit of the target currency
+func TestConvertAmount(t *testing.T) {
+    tests := []struct {
+        amount, rate, currency, expected string
+    }{
+        {"10.01", "0.92", "EUR", "9.2"},          // 9.2092 EUR
+        {"1.99", "151.25", "JPY", "300"},         // 300.9875 JPY
+        {"3.33", "0.307", "KWD", "1.022"},        // 1.02231 KWD
+        {"1", "0.12345678905", "USD", "0.12"},    // The rate itself is rounded to 10 decimals first
+    }
+
+    for _, tt := range tests {
+        converted, _, err := convertAmount(decimal.RequireFromString(tt.amount), decimal.RequireFromString(tt.rate), tt.currency)
+        require.NoError(t, err)
+        require.Equal(t, tt.expected, converted.String())
+    }
+
+    _, rate, err := convertAmount(decimal.NewFromInt(1), decimal.RequireFromString("0.12345678905"), "USD")
+    require.NoError(t, err)
+    require.Equal(t, "0.123456789", rate.String())
+
+    // Less than one yen cent converts to nothing
+    _, _, err = convertAmount(decimal.RequireFromString("0.01"), decimal.RequireFromString("0.0065"), "USD")
+    require.ErrorIs(t, err, ErrAmountTooSmall)
+}
+
+// Test that a quote is stored with the rate, the converted amount and an expiry
+func TestFXService_CreateQuote(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    rates := NewStaticRateProvider(map[string]decimal.Decimal{"USD/EUR": decimal.RequireFromString("0.92")})
+    fxService := NewFXService(sqlx.NewDb(db, "sqlmock"), rates, 30*time.Second)
+
+    mock.ExpectQuery("INSERT INTO fx_quotes").
+        WithArgs(1, "USD", "EUR", decimal.RequireFromString("10.01"), decimal.RequireFromString("9.2"), decimal.RequireFromString("0.92"), sqlmock.AnyArg()).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+
+    quote, err := fxService.CreateQuote(context.Background(), 1, "usd", "eur", decimal.RequireFromString("10.01"))
+    require.NoError(t, err)
+    require.Equal(t, 5, quote.ID)
+    require.Equal(t, "9.2", quote.TargetAmount.String())
+    require.WithinDuration(t, time.Now().Add(30*time.Second), quote.ExpiresAt, time.Second)
+
+    // Converting a currency into itself, or into a currency without a rate, is rejected before touching the database
+    _, err = fxService.CreateQuote(context.Background(), 1, "USD", "USD", decimal.NewFromInt(10))
+    require.ErrorIs(t, err, ErrSameCurrency)
+    _, err = fxService.CreateQuote(context.Background(), 1, "USD", "JPY", decimal.NewFromInt(10))
+    require.ErrorIs(t, err, ErrRateUnavailable)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a quoted transfer debits the source currency, credits the target currency and records both legs and the rate
+func TestTransferService_TransferQuoted_Success(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mockRedis.ExpectDel("balances:2").SetVal(1)
+
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    expectQuote(mock, 5, time.Now().Add(time.Minute))
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectWalletRead(mock, 2, "EUR", decimal.NewFromInt(10), "active")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromInt(102), sqlmock.AnyArg(), 2, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(100), "USD", "transfer", "completed", decimal.NewFromFloat(0.0), "wallet", nil, nil, nil,
+            decimal.NewFromInt(92), "EUR", decimal.RequireFromString("0.92"), 5, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(7, time.Now(), time.Now()))
+    mock.ExpectExec("UPDATE fx_quotes SET used_at = NOW\\(\\), transaction_id = \\$2 WHERE id = \\$1 AND used_at IS NULL").
+        WithArgs(5, 7).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectLedgerConversion(mock, 7, "user:1:USD", "user:2:EUR", "USD", "EUR", decimal.NewFromInt(100), decimal.NewFromInt(92))
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, replayed, err := transferService.TransferQuoted(1, 2, 5, "")
+    require.NoError(t, err)
+    require.False(t, replayed)
+    require.Equal(t, "EUR", txn.TargetCurrency)
+    require.Equal(t, "92", txn.TargetAmount.String())
+    require.Equal(t, "0.92", txn.FXRate.String())
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that an expired quote, or a quote issued to another user, cannot be executed
+func TestTransferService_TransferQuoted_Rejected(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    expectQuote(mock, 5, time.Now().Add(-time.Second))
+    mock.ExpectBegin()
+    mock.ExpectRollback()
+
+    _, _, err = transferService.TransferQuoted(1, 2, 5, "")
+    require.ErrorIs(t, err, ErrQuoteExpired)
+
+    expectQuote(mock, 6, time.Now().Add(time.Minute))
+
+    _, _, err = transferService.TransferQuoted(3, 2, 6, "")
+    require.ErrorIs(t, err, repository.ErrQuoteNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -3,13 +3,42 @@ package service
 import (
     "context"
     "fmt"
+    "sort"
+    "strings"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
     "github.com/go-redis/redis/v8"
     "github.com/shopspring/decimal"
     "github.com/jmoiron/sqlx"
     "time"
 )
 
+// balanceCacheTTL is how long the cached balances of a user are served before they are read from the database again.
+const balanceCacheTTL = time.Second * 3600
+
+// balanceCacheKey returns the key of the Redis hash caching a user's balances, with one field per currency.
+func balanceCacheKey(userID int) string {
+    return fmt.Sprintf("balances:%d", userID)
+}
+
+// heldCacheField is the prefix of the balance cache fields holding the held part of a balance, such as held:USD.
+// The field is only cached when some of the balance is held.
+const heldCacheField = "held:"
+
+// invalidateBalances evicts the cached balances of the given users after their wallets changed.
+// The next read repopulates the cache from the database, so a failure to evict is only logged.
+func invalidateBalances(ctx context.Context, redisClient *redis.Client, userIDs ...int) {
+    if redisClient == nil {
+        return
+    }
+    for _, userID := range userIDs {
+        if err := redisClient.Del(ctx, balanceCacheKey(userID)).Err(); err != nil {
+            utils.GetLogger().Warnf("Warning: failed to evict cached balances for user %d: %v", userID, err)
+        }
+    }
+}
+
 // BalanceService provides services related to user balance operations.
 // It interacts with the WalletRepository to manage user wallet data,
 // and uses the database and Redis client for storing and retrieving balance information.
@@ -31,35 +60,62 @@ func NewBalanceService(dbConn *sqlx.DB, redisClient *redis.Client) *BalanceServi
     }
 }
 
-// GetBalance function retrieves the user's balance. It first attempts to obtain the balance from the Redis cache. If the data is not found in the Redis cache (a cache miss occurs), it then queries the database to get the balance.
-func (s *BalanceService) GetBalance(ctx context.Context, userID int) (decimal.Decimal, error) {
-    cacheKey := fmt.Sprintf("balance:%d", userID)
+// GetBalances retrieves the balances of all wallets of the user, ordered by currency. It first attempts to obtain them from the Redis cache.
+// If the data is not found in the Redis cache (a cache miss occurs), it then queries the database and caches the result.
+func (s *BalanceService) GetBalances(ctx context.Context, userID int) ([]model.Wallet, error) {
+    cacheKey := balanceCacheKey(userID)
 
-    // Attempt to retrieve the balance from the Redis cache
-    cacheValue, err := s.redisClient.Get(ctx, cacheKey).Result()
-    if err == redis.Nil {
+    // Attempt to retrieve the balances from the Redis cache
+    cached, err := s.redisClient.HGetAll(ctx, cacheKey).Result()
+    if err != nil {
+        // Other errors occurred while retrieving from Redis
+        return nil, fmt.Errorf("failed to get balance from Redis: %w", err)
+    }
+
+    if len(cached) == 0 {
         // If the Redis cache misses, query from the database
-        user, err := s.walletRepo.GetUserBalance(ctx, userID)
+        wallets, err := s.walletRepo.GetWallets(ctx, s.dbConn, userID)
         if err != nil {
-            return decimal.Zero, fmt.Errorf("failed to get balance from DB: %w", err)
+            return nil, fmt.Errorf("failed to get balance from DB: %w", err)
         }
 
         // Update the Redis cache
-        if err := s.redisClient.Set(ctx, cacheKey, user.Balance.String(), time.Second*3600).Err(); err != nil {
-            return decimal.Zero, fmt.Errorf("failed to cache balance: %w", err)
+        fields := make([]interface{}, 0, len(wallets)*2)
+        for _, wallet := range wallets {
+            fields = append(fields, wallet.Currency, wallet.Balance.String())
+            if !wallet.Held.IsZero() {
+                fields = append(fields, heldCacheField+wallet.Currency, wallet.Held.String())
+            }
+        }
+        if err := s.redisClient.HSet(ctx, cacheKey, fields...).Err(); err != nil {
+            return nil, fmt.Errorf("failed to cache balance: %w", err)
+        }
+        if err := s.redisClient.Expire(ctx, cacheKey, balanceCacheTTL).Err(); err != nil {
+            return nil, fmt.Errorf("failed to cache balance: %w", err)
         }
 
-        return user.Balance, nil
-    } else if err != nil {
-        // Other errors occurred while retrieving from Redis
-        return decimal.Zero, fmt.Errorf("failed to get balance from Redis: %w", err)
+        return wallets, nil
     }
 
-    // If the Redis cache hits, parse the balance in the cache
-    cacheBalance, err := decimal.NewFromString(cacheValue)
-    if err != nil {
-        return decimal.Zero, fmt.Errorf("invalid balance in cache: %w", err)
+    // If the Redis cache hits, parse the balances in the cache
+    wallets := make([]model.Wallet, 0, len(cached))
+    for currency, value := range cached {
+        if strings.HasPrefix(currency, heldCacheField) {
+            continue
+        }
+        balance, err := decimal.NewFromString(value)
+        if err != nil {
+            return nil, fmt.Errorf("invalid balance in cache: %w", err)
+        }
+        held := decimal.Zero
+        if value, ok := cached[heldCacheField+currency]; ok {
+            if held, err = decimal.NewFromString(value); err != nil {
+                return nil, fmt.Errorf("invalid held balance in cache: %w", err)
+            }
+        }
+        wallets = append(wallets, model.Wallet{UserID: userID, Currency: currency, Balance: balance, Held: held})
     }
+    sort.Slice(wallets, func(i, j int) bool { return wallets[i].Currency < wallets[j].Currency })
 
-    return cacheBalance, nil
+    return wallets, nil
 }
@@ -6,13 +6,12 @@ import (
     "github.com/shopspring/decimal"
     "github.com/jmoiron/sqlx"
     "github.com/DATA-DOG/go-sqlmock"
-    "github.com/go-redis/redis/v8"
     "github.com/go-redis/redismock/v8"
     "github.com/stretchr/testify/require"
     "time"
 )
 
-func TestBalanceService_GetBalance_CacheMiss(t *testing.T) {
+func TestBalanceService_GetBalances_CacheMiss(t *testing.T) {
     db, mock, err := sqlmock.New()
     require.NoError(t, err)
     defer db.Close() // nolint:errcheck
@@ -20,26 +19,29 @@ func TestBalanceService_GetBalance_CacheMiss(t *testing.T) {
     redisClient, mockRedis := redismock.NewClientMock()
     defer redisClient.Close() // nolint:errcheck
 
-    // Set the expectation for the Redis GET operation: Return redis.Nil when the cache is not hit
-    mockRedis.ExpectGet("balance:1").SetErr(redis.Nil)
+    // Set the expectation for the Redis HGETALL operation: an empty hash when the cache is not hit
+    mockRedis.ExpectHGetAll("balances:1").SetVal(map[string]string{})
 
-    // Simulate querying the balance from the database and return a balance with decimals
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1 FOR UPDATE").
+    // Simulate querying the wallets from the database, one of them in a currency without decimals
+    now := time.Now()
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u ON u.id = w.user_id WHERE w.user_id = \\$1 AND u.deleted_at IS NULL ORDER BY w.currency$").
         WithArgs(1).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(1, decimal.NewFromInt(100)))
+        WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "version", "user_status", "created_at", "updated_at"}).
+            AddRow(2, 1, "JPY", decimal.NewFromInt(1500), 0, "active", now, now).
+            AddRow(1, 1, "USD", decimal.RequireFromString("100.5"), 0, "active", now, now))
 
-    mockRedis.ExpectSet("balance:1", "100", time.Second*3600).SetVal("OK")
-    
-    balanceService := NewBalanceService(sqlx.NewDb(db, "sqlmock"), redisClient)
-    balance, err := balanceService.GetBalance(context.Background(), 1)
+    mockRedis.ExpectHSet("balances:1", "JPY", "1500", "USD", "100.5").SetVal(2)
+    mockRedis.ExpectExpire("balances:1", time.Second*3600).SetVal(true)
 
-    require.NoError(t, err)
+    balanceService := NewBalanceService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    wallets, err := balanceService.GetBalances(context.Background(), 1)
 
-    expectedBalance, err := decimal.NewFromString("100")
     require.NoError(t, err)
-
-    // Convert the Decimal to a string when making the comparison
-    require.Equal(t, expectedBalance.String(), balance.String())
+    require.Len(t, wallets, 2)
+    require.Equal(t, "JPY", wallets[0].Currency)
+    require.Equal(t, "1500", wallets[0].Balance.String())
+    require.Equal(t, "USD", wallets[1].Currency)
+    require.Equal(t, "100.5", wallets[1].Balance.String())
 
     // Check whether the expectations of the SQL mock and the Redis mock have both been met
     err = mock.ExpectationsWereMet()
@@ -49,7 +51,7 @@ func TestBalanceService_GetBalance_CacheMiss(t *testing.T) {
     require.NoError(t, err)
 }
 
-func TestBalanceService_GetBalance_CacheHit(t *testing.T) {
+func TestBalanceService_GetBalances_CacheHit(t *testing.T) {
     db, _, err := sqlmock.New()
     require.NoError(t, err)
     defer db.Close() // nolint:errcheck
@@ -57,25 +59,48 @@ func TestBalanceService_GetBalance_CacheHit(t *testing.T) {
     redisClient, mockRedis := redismock.NewClientMock()
     defer redisClient.Close() // nolint:errcheck
 
-    mockRedis.ExpectGet("balance:1").SetVal("100")
+    mockRedis.ExpectHGetAll("balances:1").SetVal(map[string]string{"USD": "100", "EUR": "20.25"})
 
     // Create an instance of BalanceService
     balanceService := NewBalanceService(sqlx.NewDb(db, "sqlmock"), redisClient)
 
-    // Call GetBalance, expecting to retrieve the balance from the Redis cache
-    balance, err := balanceService.GetBalance(context.Background(), 1)
+    // Call GetBalances, expecting to retrieve the balances from the Redis cache, ordered by currency
+    wallets, err := balanceService.GetBalances(context.Background(), 1)
+
+    require.NoError(t, err)
+    require.Len(t, wallets, 2)
+    require.Equal(t, "EUR", wallets[0].Currency)
+    require.Equal(t, "20.25", wallets[0].Balance.String())
+    require.Equal(t, "USD", wallets[1].Currency)
+    require.Equal(t, "100", wallets[1].Balance.String())
 
+    // Check whether the expectations of the Redis mock have been met
+    err = mockRedis.ExpectationsWereMet()
     require.NoError(t, err)
+}
 
-    // The expected value is the one retrieved from Redis
-    expectedBalance, err := decimal.NewFromString("100")
+func TestBalanceService_GetBalances_CacheHitHeld(t *testing.T) {
+    db, _, err := sqlmock.New()
     require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
 
-    // When comparing, convert the Decimal to a string for comparison
-    require.Equal(t, expectedBalance.String(), balance.String())
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    // The held part of a balance is cached next to it, only when some of it is held
+    mockRedis.ExpectHGetAll("balances:1").SetVal(map[string]string{"USD": "100", "held:USD": "40", "EUR": "20.25"})
+
+    balanceService := NewBalanceService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    wallets, err := balanceService.GetBalances(context.Background(), 1)
+
+    require.NoError(t, err)
+    require.Len(t, wallets, 2)
+    require.Equal(t, "EUR", wallets[0].Currency)
+    require.True(t, wallets[0].Held.IsZero())
+    require.Equal(t, "USD", wallets[1].Currency)
+    require.Equal(t, "40", wallets[1].Held.String())
+    require.Equal(t, "60", wallets[1].Available().String())
 
-    // Check whether the expectations of the Redis mock have been met
     err = mockRedis.ExpectationsWereMet()
     require.NoError(t, err)
 }
-
@@ -4,8 +4,14 @@ import (
     "github.com/yaoweihua/wallet-service/repository"
     "github.com/yaoweihua/wallet-service/model"
     "context"
+    "encoding/base64"
+    "errors"
     "fmt"
+    "strconv"
+    "strings"
+    "time"
     "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
 )
 
 // TransactionService provides methods for managing transactions.
@@ -26,12 +32,171 @@ func NewTransactionService(dbConn *sqlx.DB) *TransactionService {
     }
 }
 
-// GetTransactions retrieves the transaction records of the specified user
-func (s *TransactionService) GetTransactions(ctx context.Context, userID int) ([]model.Transaction, error) {
-    transactions, err := s.transactionRepo.GetTransactions(ctx, userID)
+// GetTransaction retrieves a single transaction for the caller. Only the sender and the recipient of a transaction
+// and administrators may see it; for anyone else it is reported as repository.ErrTransactionNotFound, so its existence is not revealed.
+// A nil caller, an anonymous request when authentication is disabled, sees every transaction.
+func (s *TransactionService) GetTransaction(ctx context.Context, transactionID int, caller *model.Caller) (*model.Transaction, error) {
+    txn, err := s.transactionRepo.GetTransaction(ctx, s.dbConn, transactionID)
+    if err != nil {
+        return nil, err
+    }
+    if caller != nil && !caller.CanSee(txn) {
+        return nil, fmt.Errorf("%w: %d", repository.ErrTransactionNotFound, transactionID)
+    }
+    return txn, nil
+}
+
+// ErrInvalidTransactionFilter is returned when the filters or the cursor of a transaction history request are invalid.
+var ErrInvalidTransactionFilter = errors.New("invalid transaction filter")
+
+// Page sizes of the transaction history.
+const (
+    DefaultTransactionPageSize = 50
+    MaxTransactionPageSize     = 200
+)
+
+// transactionTypes and transactionStatuses are the values the history can be filtered by.
+var (
+    transactionTypes    = []string{"deposit", "withdraw", "transfer", "capture", "refund", "adjustment"}
+    transactionStatuses = []string{
+        model.TransactionStatusPending, model.TransactionStatusProcessing, model.TransactionStatusCompleted,
+        model.TransactionStatusFailed, model.TransactionStatusReversed, model.TransactionStatusCancelled,
+    }
+)
+
+// TransactionFilter narrows down and pages the transaction history of a user. Zero values leave a filter out.
+type TransactionFilter struct {
+    Type           string           // One of deposit, withdraw, transfer, capture, refund or adjustment
+    Status         string           // One of the model.TransactionStatus constants
+    CounterpartyID int              // Only transactions between the user and this other user
+    MinAmount      *decimal.Decimal // Only transactions of at least this amount
+    MaxAmount      *decimal.Decimal // Only transactions of at most this amount
+    From           *time.Time       // Only transactions created at or after this time
+    To             *time.Time       // Only transactions created before this time
+    Order          string           // asc for oldest first, desc (the default) for newest first
+    Limit          int              // The page size, DefaultTransactionPageSize when 0 and at most MaxTransactionPageSize
+    Cursor         string           // The next_cursor of the previous page, empty for the first page
+}
+
+// TransactionPage is one page of the transaction history.
+// NextCursor fetches the following page with the same filters, it is empty on the last page.
+type TransactionPage struct {
+    Transactions []model.Transaction
+    NextCursor   string
+}
+
+// GetTransactions retrieves one page of the transaction records of the specified user matching the filter.
+// It returns ErrInvalidTransactionFilter if the filter or its cursor is invalid.
+func (s *TransactionService) GetTransactions(ctx context.Context, userID int, filter TransactionFilter) (*TransactionPage, error) {
+    query, err := filter.query(userID)
+    if err != nil {
+        return nil, err
+    }
+
+    // Read one transaction more than the page holds, to know whether there is a next page
+    limit := query.Limit
+    query.Limit++
+    transactions, err := s.transactionRepo.GetTransactions(ctx, query)
     if err != nil {
         return nil, fmt.Errorf("failed to fetch transactions from repository: %w", err)
     }
 
-    return transactions, nil
+    page := &TransactionPage{Transactions: transactions}
+    if len(transactions) > limit {
+        page.Transactions = transactions[:limit]
+        last := page.Transactions[limit-1]
+        page.NextCursor = encodeTransactionCursor(repository.TransactionCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+    }
+    return page, nil
+}
+
+// query validates the filter and translates it into the repository query of the user's history.
+func (f TransactionFilter) query(userID int) (repository.TransactionQuery, error) {
+    query := repository.TransactionQuery{
+        UserID:         userID,
+        Type:           f.Type,
+        Status:         f.Status,
+        CounterpartyID: f.CounterpartyID,
+        MinAmount:      f.MinAmount,
+        MaxAmount:      f.MaxAmount,
+        From:           f.From,
+        To:             f.To,
+        Limit:          f.Limit,
+    }
+
+    if f.Type != "" && !contains(transactionTypes, f.Type) {
+        return query, fmt.Errorf("%w: unknown transaction type %q", ErrInvalidTransactionFilter, f.Type)
+    }
+    if f.Status != "" && !contains(transactionStatuses, f.Status) {
+        return query, fmt.Errorf("%w: unknown transaction status %q", ErrInvalidTransactionFilter, f.Status)
+    }
+    if f.MinAmount != nil && f.MaxAmount != nil && f.MinAmount.GreaterThan(*f.MaxAmount) {
+        return query, fmt.Errorf("%w: min_amount is greater than max_amount", ErrInvalidTransactionFilter)
+    }
+    if f.From != nil && f.To != nil && !f.From.Before(*f.To) {
+        return query, fmt.Errorf("%w: from is not before to", ErrInvalidTransactionFilter)
+    }
+
+    switch f.Order {
+    case "", "desc":
+    case "asc":
+        query.Ascending = true
+    default:
+        return query, fmt.Errorf("%w: order must be asc or desc", ErrInvalidTransactionFilter)
+    }
+
+    switch {
+    case f.Limit == 0:
+        query.Limit = DefaultTransactionPageSize
+    case f.Limit < 0 || f.Limit > MaxTransactionPageSize:
+        return query, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidTransactionFilter, MaxTransactionPageSize)
+    }
+
+    if f.Cursor != "" {
+        cursor, err := decodeTransactionCursor(f.Cursor)
+        if err != nil {
+            return query, err
+        }
+        query.After = &cursor
+    }
+    return query, nil
+}
+
+// contains reports whether the value is one of the values.
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// encodeTransactionCursor encodes the position of a transaction as an opaque cursor.
+func encodeTransactionCursor(cursor repository.TransactionCursor) string {
+    raw := fmt.Sprintf("%s|%d", cursor.CreatedAt.UTC().Format(time.RFC3339Nano), cursor.ID)
+    return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeTransactionCursor decodes a cursor built by encodeTransactionCursor.
+func decodeTransactionCursor(encoded string) (repository.TransactionCursor, error) {
+    invalid := fmt.Errorf("%w: invalid cursor", ErrInvalidTransactionFilter)
+
+    raw, err := base64.RawURLEncoding.DecodeString(encoded)
+    if err != nil {
+        return repository.TransactionCursor{}, invalid
+    }
+    createdAt, id, ok := strings.Cut(string(raw), "|")
+    if !ok {
+        return repository.TransactionCursor{}, invalid
+    }
+
+    var cursor repository.TransactionCursor
+    if cursor.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+        return repository.TransactionCursor{}, invalid
+    }
+    if cursor.ID, err = strconv.Atoi(id); err != nil {
+        return repository.TransactionCursor{}, invalid
+    }
+    return cursor, nil
 }
@@ -8,6 +8,8 @@ import (
     "github.com/jmoiron/sqlx"
     "github.com/DATA-DOG/go-sqlmock"
     "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
     "time"
 )
 
@@ -29,18 +31,20 @@ func TestTransactionService_GetTransactions(t *testing.T) {
 
     rows := sqlmock.NewRows([]string{
         "id", "from_user_id", "to_user_id", "amount", "transaction_type", 
-        "transaction_status", "created_at", "updated_at"}).
-        AddRow(1, 1, 0, "100", "deposit", "completed", createdAt1, createdAt1).
-        AddRow(2, 1, 0, "50", "withdraw", "completed", createdAt2, createdAt2)
+        "transaction_status", "failure_reason", "created_at", "updated_at"}).
+        AddRow(1, 1, 0, "100", "deposit", "completed", "", createdAt1, createdAt1).
+        AddRow(2, 1, 0, "500", "withdraw", "failed", "insufficient_balance", createdAt2, createdAt2)
 
     // Set the expected SQL query and ensure that the column fields are consistent
-    mock.ExpectQuery("SELECT id, from_user_id, to_user_id, amount, transaction_type, transaction_status, created_at, updated_at FROM transactions WHERE from_user_id = \\$1 OR to_user_id = \\$1 ORDER BY created_at DESC").
-        WithArgs(1).
+    mock.ExpectQuery("SELECT id, from_user_id, to_user_id, amount, currency, transaction_type, transaction_status, transaction_fee, payment_method, payment_metadata, COALESCE\\(failure_reason, ''\\) AS failure_reason, target_amount, COALESCE\\(target_currency, ''\\) AS target_currency, fx_rate, fx_quote_id, refund_of, refunded_amount, created_at, updated_at FROM transactions WHERE \\(from_user_id = \\$1 OR to_user_id = \\$1\\) ORDER BY created_at DESC, id DESC LIMIT \\$2").
+        WithArgs(1, 51).
         WillReturnRows(rows)
 
     // Call the GetTransactions method
-    transactions, err := transactionService.GetTransactions(context.Background(), 1)
+    page, err := transactionService.GetTransactions(context.Background(), 1, TransactionFilter{})
     require.NoError(t, err)
+    require.Empty(t, page.NextCursor)
+    transactions := page.Transactions
 
     // Check the returned transaction records
     require.Len(t, transactions, 2)
@@ -57,9 +61,10 @@ func TestTransactionService_GetTransactions(t *testing.T) {
     require.Equal(t, 2, transactions[1].ID)
     require.Equal(t, 1, transactions[1].FromUserID)
     require.Equal(t, 0, transactions[1].ToUserID)
-    require.Equal(t, decimal.NewFromInt(50), transactions[1].Amount)
+    require.Equal(t, decimal.NewFromInt(500), transactions[1].Amount)
     require.Equal(t, "withdraw", transactions[1].TransactionType)
-    require.Equal(t, "completed", transactions[1].TransactionStatus)
+    require.Equal(t, "failed", transactions[1].TransactionStatus)
+    require.Equal(t, "insufficient_balance", transactions[1].FailureReason)
 
     // Check whether all the expectations of the SQL mock have been met
     err = mock.ExpectationsWereMet()
@@ -78,19 +83,116 @@ func TestTransactionService_GetTransactions_Error(t *testing.T) {
     transactionService := NewTransactionService(sqlxDB)
 
     // Set the expected SQL query and simulate a database query failure
-    mock.ExpectQuery("SELECT id, from_user_id, to_user_id, amount, transaction_type, transaction_status, created_at, updated_at FROM transactions WHERE from_user_id = \\$1 OR to_user_id = \\$1 ORDER BY created_at DESC").
-        WithArgs(1). // 用户ID为1
+    mock.ExpectQuery("SELECT id, from_user_id, to_user_id, amount, currency, transaction_type, transaction_status, transaction_fee, payment_method, payment_metadata, COALESCE\\(failure_reason, ''\\) AS failure_reason, target_amount, COALESCE\\(target_currency, ''\\) AS target_currency, fx_rate, fx_quote_id, refund_of, refunded_amount, created_at, updated_at FROM transactions WHERE \\(from_user_id = \\$1 OR to_user_id = \\$1\\) ORDER BY created_at DESC, id DESC LIMIT \\$2").
+        WithArgs(1, 51). // 用户ID为1
         WillReturnError(fmt.Errorf("database query failed"))
 
     // Call the GetTransactions method
-    transactions, err := transactionService.GetTransactions(context.Background(), 1)
+    page, err := transactionService.GetTransactions(context.Background(), 1, TransactionFilter{})
 
     // Expect the returned error to be not nil
     require.Error(t, err)
-    require.Nil(t, transactions)
+    require.Nil(t, page)
     require.Equal(t, "failed to fetch transactions from repository: database query failed", err.Error())
 
     // Check whether all the expectations of the SQL mock have been met
     err = mock.ExpectationsWereMet()
     require.NoError(t, err)
 }
+
+// TestTransactionService_GetTransactions_Pages tests that a full page carries a cursor that continues after its last transaction
+func TestTransactionService_GetTransactions_Pages(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    transactionService := NewTransactionService(sqlx.NewDb(db, "sqlmock"))
+
+    createdAt := time.Date(2024, 11, 12, 18, 22, 43, 954443000, time.UTC)
+    columns := []string{"id", "from_user_id", "to_user_id", "amount", "transaction_type", "transaction_status", "created_at", "updated_at"}
+
+    // One transaction more than the page size is read, so the first page knows a second one follows
+    mock.ExpectQuery("ORDER BY created_at DESC, id DESC LIMIT \\$3").
+        WithArgs(1, "deposit", 3).
+        WillReturnRows(sqlmock.NewRows(columns).
+            AddRow(9, 1, 0, "10", "deposit", "completed", createdAt, createdAt).
+            AddRow(8, 1, 0, "20", "deposit", "completed", createdAt, createdAt).
+            AddRow(5, 1, 0, "30", "deposit", "completed", createdAt.Add(-time.Hour), createdAt))
+
+    page, err := transactionService.GetTransactions(context.Background(), 1, TransactionFilter{Type: "deposit", Limit: 2})
+    require.NoError(t, err)
+    require.Len(t, page.Transactions, 2)
+    require.NotEmpty(t, page.NextCursor)
+
+    mock.ExpectQuery("AND \\(created_at, id\\) < \\(\\$3, \\$4\\) ORDER BY created_at DESC, id DESC LIMIT \\$5").
+        WithArgs(1, "deposit", createdAt, 8, 3).
+        WillReturnRows(sqlmock.NewRows(columns).
+            AddRow(5, 1, 0, "30", "deposit", "completed", createdAt.Add(-time.Hour), createdAt))
+
+    page, err = transactionService.GetTransactions(context.Background(), 1, TransactionFilter{Type: "deposit", Limit: 2, Cursor: page.NextCursor})
+    require.NoError(t, err)
+    require.Len(t, page.Transactions, 1)
+    require.Empty(t, page.NextCursor)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// TestTransactionService_GetTransactions_InvalidFilter tests that invalid filters are rejected before the database is queried
+func TestTransactionService_GetTransactions_InvalidFilter(t *testing.T) {
+    db, _, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    transactionService := NewTransactionService(sqlx.NewDb(db, "sqlmock"))
+
+    minAmount, maxAmount := decimal.NewFromInt(50), decimal.NewFromInt(10)
+    for _, filter := range []TransactionFilter{
+        {Type: "payout"},
+        {Status: "done"},
+        {Order: "newest"},
+        {Limit: MaxTransactionPageSize + 1},
+        {Cursor: "not a cursor"},
+        {MinAmount: &minAmount, MaxAmount: &maxAmount},
+    } {
+        _, err := transactionService.GetTransactions(context.Background(), 1, filter)
+        require.ErrorIs(t, err, ErrInvalidTransactionFilter)
+    }
+}
+
+// TestTransactionService_GetTransaction tests that a transaction is only shown to its participants and to administrators
+func TestTransactionService_GetTransaction(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    transactionService := NewTransactionService(sqlx.NewDb(db, "sqlmock"))
+
+    callers := []struct {
+        caller  model.Caller
+        allowed bool
+    }{
+        {model.Caller{UserID: 1}, true},
+        {model.Caller{UserID: 2}, true},
+        {model.Caller{UserID: 3}, false},
+        {model.Caller{UserID: 3, Roles: []string{model.RoleAdmin}}, true},
+    }
+    for _, tc := range callers {
+        mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").
+            WithArgs(7).
+            WillReturnRows(sqlmock.NewRows([]string{"id", "from_user_id", "to_user_id", "amount", "currency", "transaction_type", "transaction_status", "transaction_fee", "payment_method", "created_at", "updated_at"}).
+                AddRow(7, 1, 2, "25", "USD", "transfer", "completed", "0.5", "wallet", time.Now(), time.Now()))
+
+        txn, err := transactionService.GetTransaction(context.Background(), 7, &tc.caller)
+        if !tc.allowed {
+            require.ErrorIs(t, err, repository.ErrTransactionNotFound)
+            continue
+        }
+        require.NoError(t, err)
+        require.Equal(t, "0.5", txn.TransactionFee.String())
+        require.Equal(t, "wallet", txn.PaymentMethod)
+    }
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
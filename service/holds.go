@@ -0,0 +1,293 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/go-redis/redis/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+)
+
+// ErrHoldClosed is returned when a hold that was already captured, voided or expired is captured or voided.
+var ErrHoldClosed = errors.New("hold is no longer active")
+
+// ErrHoldExpired is returned when a hold is captured after its expiry, before the expiry worker released it.
+var ErrHoldExpired = errors.New("hold has expired")
+
+// ErrCaptureExceedsHold is returned when more than the held amount is captured.
+var ErrCaptureExceedsHold = errors.New("capture exceeds the held amount")
+
+// maxHoldDescriptionLength is the size of the holds.description column.
+const maxHoldDescriptionLength = 255
+
+// holdExpiryBatchSize is the number of expired holds the expiry worker releases per run.
+const holdExpiryBatchSize = 100
+
+// HoldService places card-style authorisations on wallet balances and captures or voids them.
+type HoldService struct {
+    walletRepo      *repository.WalletRepository
+    transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+    outboxRepo      *repository.OutboxRepository
+    holdRepo        *repository.HoldRepository
+    limitRepo       *repository.LimitRepository
+    dbConn          *sqlx.DB
+    redisClient     *redis.Client
+    locker          lock.Locker
+    mode            ConcurrencyMode
+    ttl             time.Duration
+    limits          *LimitSchedule
+}
+
+// NewHoldService creates a new instance of HoldService.
+// It shares the locker and the concurrency mode of the money movement services, and holds expire after ttl unless captured or voided.
+// Captures count towards the withdrawal limits, nil for none.
+func NewHoldService(dbConn *sqlx.DB, redisClient *redis.Client, locker lock.Locker, mode ConcurrencyMode, ttl time.Duration, limits *LimitSchedule) *HoldService {
+    return &HoldService{
+        walletRepo:      repository.NewWalletRepository(dbConn),
+        transactionRepo: repository.NewTransactionRepository(dbConn),
+        ledgerRepo:      repository.NewLedgerRepository(dbConn),
+        outboxRepo:      repository.NewOutboxRepository(dbConn),
+        holdRepo:        repository.NewHoldRepository(dbConn),
+        limitRepo:       repository.NewLimitRepository(dbConn),
+        dbConn:          dbConn,
+        redisClient:     redisClient,
+        locker:          locker,
+        mode:            mode,
+        ttl:             ttl,
+        limits:          limits,
+    }
+}
+
+// PlaceHold reserves the amount of the user's wallet in the given currency, an empty currency selecting model.DefaultCurrency.
+// The amount must be covered by the available balance, and suspended accounts cannot place holds.
+func (s *HoldService) PlaceHold(ctx context.Context, userID int, currency string, amount decimal.Decimal, description string) (*model.Hold, error) {
+    currency, err := validateMoney("Hold", amount, currency)
+    if err != nil {
+        return nil, err
+    }
+    if len(description) > maxHoldDescriptionLength {
+        return nil, fmt.Errorf("the description is longer than %d characters", maxHoldDescriptionLength)
+    }
+
+    locks, err := lockBalances(ctx, s.locker, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    hold := &model.Hold{
+        UserID:      userID,
+        Currency:    currency,
+        Amount:      amount,
+        Status:      model.HoldStatusActive,
+        Description: description,
+        ExpiresAt:   time.Now().Add(s.ttl),
+    }
+    err = s.withHoldTx(ctx, func(tx *sqlx.Tx) error {
+        wallet, err := s.lockWallet(ctx, tx, locks, userID, currency)
+        if err != nil {
+            return err
+        }
+        if err := checkCanSend(wallet); err != nil {
+            return err
+        }
+        if wallet.Available().LessThan(amount) {
+            return ErrInsufficientBalance
+        }
+
+        if err := s.walletRepo.UpdateFunds(ctx, tx, wallet.ID, wallet.Balance, wallet.Held.Add(amount), wallet.Version); err != nil {
+            return err
+        }
+        return s.holdRepo.CreateHold(ctx, tx, hold)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    invalidateBalances(ctx, s.redisClient, userID)
+    return hold, nil
+}
+
+// Capture debits the captured amount of an active hold from the wallet and releases the rest of it.
+// A zero amount captures the whole hold. The capture is recorded as a capture transaction paid out of the wallet, and
+// like a withdrawal it must stay within the withdrawal limits of the user, see LimitSchedule, and counts towards them.
+func (s *HoldService) Capture(ctx context.Context, holdID int, amount decimal.Decimal) (*model.Hold, *model.Transaction, error) {
+    var txn *model.Transaction
+    hold, err := s.closeHold(ctx, holdID, func(tx *sqlx.Tx, hold *model.Hold, wallet *model.Wallet) error {
+        if hold.Expired(time.Now()) {
+            return fmt.Errorf("%w: hold %d", ErrHoldExpired, hold.ID)
+        }
+
+        captured := amount
+        if captured.IsZero() {
+            captured = hold.Amount
+        }
+        if _, err := validateMoney("Capture", captured, hold.Currency); err != nil {
+            return err
+        }
+        if captured.GreaterThan(hold.Amount) {
+            return fmt.Errorf("%w: %s of %s %s", ErrCaptureExceedsHold, captured.String(), hold.Amount.String(), hold.Currency)
+        }
+        if err := s.limits.enforce(ctx, s.limitRepo, tx, wallet, "withdraw", captured, time.Now()); err != nil {
+            return err
+        }
+
+        if err := s.walletRepo.UpdateFunds(ctx, tx, wallet.ID, wallet.Balance.Sub(captured), wallet.Held.Sub(hold.Amount), wallet.Version); err != nil {
+            return err
+        }
+
+        txn = &model.Transaction{
+            FromUserID:        hold.UserID,
+            Amount:            captured,
+            Currency:          hold.Currency,
+            TransactionType:   "capture",
+            TransactionStatus: model.TransactionStatusCompleted,
+            PaymentMethod:     model.PaymentMethodWallet,
+        }
+        if err := recordTransaction(ctx, s.transactionRepo, tx, txn); err != nil {
+            return err
+        }
+        if err := postMovement(ctx, s.ledgerRepo, tx, txn.ID, "capture", userLedgerAccount(hold.UserID, hold.Currency), systemLedgerAccount(model.SystemAccountExternalPayout, hold.Currency), captured); err != nil {
+            return err
+        }
+        if err := recordEvents(ctx, s.outboxRepo, tx, txn, balanceChange(wallet, wallet.Balance.Sub(captured))); err != nil {
+            return err
+        }
+
+        hold.Status = model.HoldStatusCaptured
+        hold.CapturedAmount = captured
+        hold.TransactionID = &txn.ID
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    return hold, txn, nil
+}
+
+// Void cancels an active hold and releases its amount. Holds can be voided after their expiry, which releases them early.
+func (s *HoldService) Void(ctx context.Context, holdID int) (*model.Hold, error) {
+    return s.closeHold(ctx, holdID, s.release(ctx, model.HoldStatusVoided))
+}
+
+// ExpireHolds releases up to one batch of active holds past their expiry, and returns how many were released.
+// A hold that cannot be released is logged and left for the next run.
+func (s *HoldService) ExpireHolds(ctx context.Context) (int, error) {
+    holds, err := s.holdRepo.GetExpiredHolds(ctx, s.dbConn, time.Now(), holdExpiryBatchSize)
+    if err != nil {
+        return 0, err
+    }
+
+    expired := 0
+    for _, hold := range holds {
+        if _, err := s.closeHold(ctx, hold.ID, s.release(ctx, model.HoldStatusExpired)); err != nil {
+            // The hold may have been captured or voided since it was listed
+            if !errors.Is(err, ErrHoldClosed) {
+                utils.GetLogger().Warnf("Warning: failed to expire hold %d: %v", hold.ID, err)
+            }
+            continue
+        }
+        expired++
+    }
+    return expired, nil
+}
+
+// RunExpiry releases expired holds every interval until the context is cancelled.
+func (s *HoldService) RunExpiry(ctx context.Context, interval time.Duration) {
+    runPeriodically(ctx, "hold expiry", interval, s.ExpireHolds)
+}
+
+// release returns the closing step that releases the whole held amount and closes the hold with the given status.
+func (s *HoldService) release(ctx context.Context, status string) func(tx *sqlx.Tx, hold *model.Hold, wallet *model.Wallet) error {
+    return func(tx *sqlx.Tx, hold *model.Hold, wallet *model.Wallet) error {
+        if err := s.walletRepo.UpdateFunds(ctx, tx, wallet.ID, wallet.Balance, wallet.Held.Sub(hold.Amount), wallet.Version); err != nil {
+            return err
+        }
+        hold.Status = status
+        return nil
+    }
+}
+
+// closeHold locks an active hold and the wallet it holds, runs the closing step, which moves the funds and sets the final status,
+// and stores the closed hold, all in one database transaction while the user lock is held.
+func (s *HoldService) closeHold(ctx context.Context, holdID int, closing func(tx *sqlx.Tx, hold *model.Hold, wallet *model.Wallet) error) (*model.Hold, error) {
+    // Find the owner of the hold, whose balance lock is needed before the hold is locked
+    hold, err := s.holdRepo.GetHold(ctx, s.dbConn, holdID)
+    if err != nil {
+        return nil, err
+    }
+
+    locks, err := lockBalances(ctx, s.locker, hold.UserID)
+    if err != nil {
+        return nil, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    err = s.withHoldTx(ctx, func(tx *sqlx.Tx) error {
+        hold, err = s.holdRepo.LockHold(ctx, tx, holdID)
+        if err != nil {
+            return err
+        }
+        if hold.Status != model.HoldStatusActive {
+            return fmt.Errorf("%w: hold %d is %s", ErrHoldClosed, hold.ID, hold.Status)
+        }
+
+        wallet, err := s.lockWallet(ctx, tx, locks, hold.UserID, hold.Currency)
+        if err != nil {
+            return err
+        }
+        if err := closing(tx, hold, wallet); err != nil {
+            return err
+        }
+        return s.holdRepo.CloseHold(ctx, tx, hold)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    invalidateBalances(ctx, s.redisClient, hold.UserID)
+    return hold, nil
+}
+
+// lockWallet reads the user's wallet for an update of its funds, and checks that the balance lock is still held.
+func (s *HoldService) lockWallet(ctx context.Context, tx *sqlx.Tx, locks []lock.Lock, userID int, currency string) (*model.Wallet, error) {
+    wallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, userID, currency)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkFence(ctx, s.walletRepo, tx, locks, userID); err != nil {
+        return nil, err
+    }
+    return wallet, nil
+}
+
+// withHoldTx runs fn in a database transaction, committing it if fn succeeds, and retries it on a concurrent balance update.
+func (s *HoldService) withHoldTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+    _, _, err := withConcurrencyRetry(s.mode, func() (*model.Transaction, bool, error) {
+        tx, err := s.dbConn.Beginx()
+        if err != nil {
+            return nil, false, fmt.Errorf("failed to start transaction: %w", err)
+        }
+        defer func() {
+            if rErr := tx.Rollback(); rErr != nil && err == nil {
+                utils.GetLogger().Warnf("rollback transaction: %v", rErr)
+            }
+        }()
+
+        if err = fn(tx); err != nil {
+            return nil, false, err
+        }
+        if err = tx.Commit(); err != nil {
+            return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+        }
+        return nil, false, nil
+    })
+    return err
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// holdColumns are the columns selected when a hold is read
+var holdColumns = []string{"id", "user_id", "currency", "amount", "captured_amount", "status", "description", "expires_at", "transaction_id", "created_at", "updated_at"}
+
+// expectHoldRead expects a 40 USD hold of user 1 to be read, then locked
+func expectHoldRead(mock sqlmock.Sqlmock, holdID int, status string, expiresAt time.Time) {
+    row := func() *sqlmock.Rows {
+        return sqlmock.NewRows(holdColumns).
+            AddRow(holdID, 1, "USD", decimal.NewFromInt(40), decimal.Zero, status, "order 42", expiresAt, nil, time.Now(), time.Now())
+    }
+    mock.ExpectQuery("SELECT (.+) FROM holds WHERE id = \\$1$").WithArgs(holdID).WillReturnRows(row())
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM holds WHERE id = \\$1 FOR UPDATE").WithArgs(holdID).WillReturnRows(row())
+}
+
+// Test that placing a hold reserves part of the available balance, and that held funds cannot be held again
+func TestHoldService_PlaceHold(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    holdService := NewHoldService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, time.Hour, nil)
+
+    mock.ExpectBegin()
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(20))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(100), decimal.NewFromInt(60), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO holds").
+        WithArgs(1, "USD", decimal.NewFromInt(40), "active", "order 42", sqlmock.AnyArg()).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, time.Now(), time.Now()))
+    mock.ExpectCommit()
+
+    hold, err := holdService.PlaceHold(context.Background(), 1, "USD", decimal.NewFromInt(40), "order 42")
+    require.NoError(t, err)
+    require.Equal(t, 3, hold.ID)
+    require.Equal(t, model.HoldStatusActive, hold.Status)
+    require.WithinDuration(t, time.Now().Add(time.Hour), hold.ExpiresAt, time.Minute)
+
+    // 100 with 60 held leaves 40 available, not enough for another hold of 50
+    mock.ExpectBegin()
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(60))
+    mock.ExpectRollback()
+
+    _, err = holdService.PlaceHold(context.Background(), 1, "USD", decimal.NewFromInt(50), "")
+    require.ErrorIs(t, err, ErrInsufficientBalance)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a partial capture debits the captured amount, releases the whole hold and records a capture transaction
+func TestHoldService_Capture_Partial(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    holdService := NewHoldService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, time.Hour, nil)
+
+    expectHoldRead(mock, 3, "active", time.Now().Add(time.Hour))
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(60))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(75), decimal.NewFromInt(20), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(25), "USD", "capture", "completed", decimal.Zero, "wallet", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(9, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 9, "capture", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(25))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectExec("UPDATE holds").
+        WithArgs(3, "captured", decimal.NewFromInt(25), sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    hold, txn, err := holdService.Capture(context.Background(), 3, decimal.NewFromInt(25))
+    require.NoError(t, err)
+    require.Equal(t, model.HoldStatusCaptured, hold.Status)
+    require.Equal(t, "25", hold.CapturedAmount.String())
+    require.NotNil(t, hold.TransactionID)
+    require.Equal(t, 9, *hold.TransactionID)
+    require.Equal(t, "capture", txn.TransactionType)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a capture counts towards the withdrawal limits of the user, and is refused over them
+func TestHoldService_Capture_Limits(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    holdService := NewHoldService(sqlx.NewDb(db, "sqlmock"), nil, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, time.Hour, testLimits(t))
+
+    // 40 on top of the 70 withdrawn today exceeds the daily limit of 100, the hold stays active
+    expectHoldRead(mock, 3, "active", time.Now().Add(time.Hour))
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(1, "USD").
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u (.+) FOR UPDATE OF w FOR SHARE OF u").
+        WithArgs(1, "USD").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "held", "version", "user_status", "user_tier", "created_at", "updated_at"}).
+            AddRow(1, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(40), 0, "active", model.KYCTierBasic, time.Now(), time.Now()))
+    expectUsage(mock, 1, "withdraw", "hour", decimal.NewFromInt(40), decimal.NewFromInt(40), 1)
+    expectUsage(mock, 1, "withdraw", "day", decimal.NewFromInt(40), decimal.NewFromInt(110), 2)
+    mock.ExpectRollback()
+
+    _, _, err = holdService.Capture(context.Background(), 3, decimal.Zero)
+    require.ErrorIs(t, err, ErrLimitExceeded)
+    require.Contains(t, err.Error(), "day")
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that holds cannot be captured beyond their amount, after their expiry or once they are closed
+func TestHoldService_Capture_Invalid(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    holdService := NewHoldService(sqlx.NewDb(db, "sqlmock"), nil, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, time.Hour, nil)
+
+    expectHoldRead(mock, 3, "active", time.Now().Add(time.Hour))
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(40))
+    mock.ExpectRollback()
+
+    _, _, err = holdService.Capture(context.Background(), 3, decimal.NewFromInt(41))
+    require.ErrorIs(t, err, ErrCaptureExceedsHold)
+
+    expectHoldRead(mock, 3, "active", time.Now().Add(-time.Minute))
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(40))
+    mock.ExpectRollback()
+
+    _, _, err = holdService.Capture(context.Background(), 3, decimal.Zero)
+    require.ErrorIs(t, err, ErrHoldExpired)
+
+    expectHoldRead(mock, 3, "voided", time.Now().Add(time.Hour))
+    mock.ExpectRollback()
+
+    _, _, err = holdService.Capture(context.Background(), 3, decimal.Zero)
+    require.ErrorIs(t, err, ErrHoldClosed)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that voiding a hold releases its amount without touching the balance
+func TestHoldService_Void(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    holdService := NewHoldService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, time.Hour, nil)
+
+    expectHoldRead(mock, 3, "active", time.Now().Add(time.Hour))
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(40))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(100), decimal.Zero, sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE holds").
+        WithArgs(3, "voided", decimal.Zero, nil).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    hold, err := holdService.Void(context.Background(), 3)
+    require.NoError(t, err)
+    require.Equal(t, model.HoldStatusVoided, hold.Status)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that the expiry worker releases the holds past their expiry
+func TestHoldService_ExpireHolds(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    holdService := NewHoldService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, time.Hour, nil)
+
+    expiresAt := time.Now().Add(-time.Minute)
+    mock.ExpectQuery("SELECT (.+) FROM holds WHERE status = 'active' AND expires_at <= \\$1").
+        WithArgs(sqlmock.AnyArg(), 100).
+        WillReturnRows(sqlmock.NewRows(holdColumns).
+            AddRow(3, 1, "USD", decimal.NewFromInt(40), decimal.Zero, "active", "", expiresAt, nil, time.Now(), time.Now()))
+    expectHoldRead(mock, 3, "active", expiresAt)
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(100), decimal.NewFromInt(40))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(100), decimal.Zero, sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE holds").
+        WithArgs(3, "expired", decimal.Zero, nil).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    expired, err := holdService.ExpireHolds(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 1, expired)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/shopspring/decimal"
+)
+
+// ErrIdempotencyKeyConflict is returned when an idempotency key is reused for a request
+// whose payload differs from the one the key was first used with.
+var ErrIdempotencyKeyConflict = errors.New("Idempotency-Key has already been used with a different request")
+
+// InternalIdempotencyKeyPrefix starts the idempotency keys the service makes up for the movements it makes on its own,
+// such as the transfers of schedules. Clients may not send keys starting with it, so they cannot claim those keys first.
+const InternalIdempotencyKeyPrefix = "internal:"
+
+// requestFingerprint builds a stable hash of a money movement request, so that a replay
+// can be told apart from a different request sent with the same idempotency key.
+// Extra request fields, such as the payment method, are appended to the payload in order.
+func requestFingerprint(txType string, fromUserID, toUserID int, currency string, amount decimal.Decimal, extra ...string) string {
+    payload := fmt.Sprintf("%s|%d|%d|%s|%s", txType, fromUserID, toUserID, currency, amount.String())
+    for _, field := range extra {
+        payload += "|" + field
+    }
+    sum := sha256.Sum256([]byte(payload))
+    return hex.EncodeToString(sum[:])
+}
+
+// findReplay returns the transaction the paying user previously recorded with the idempotency key, or nil if the key
+// is new to the user. It returns ErrIdempotencyKeyConflict if the key was recorded for a different request payload.
+func findReplay(ctx context.Context, transactionRepo *repository.TransactionRepository, exec repository.Executor, userID int, idempotencyKey, fingerprint string) (*model.Transaction, error) {
+    if idempotencyKey == "" {
+        return nil, nil
+    }
+
+    existing, err := transactionRepo.GetTransactionByIdempotencyKey(ctx, exec, userID, idempotencyKey)
+    if err != nil {
+        return nil, err
+    }
+    if existing == nil {
+        return nil, nil
+    }
+
+    if existing.RequestHash != fingerprint {
+        return nil, ErrIdempotencyKeyConflict
+    }
+    return existing, nil
+}
+
+// recordTransaction records the transaction and reports a concurrent use of the same
+// idempotency key as a conflict rather than a storage failure.
+func recordTransaction(ctx context.Context, transactionRepo *repository.TransactionRepository, exec repository.Executor, txn *model.Transaction) error {
+    err := transactionRepo.RecordTransaction(ctx, exec, txn)
+    if errors.Is(err, repository.ErrDuplicateIdempotencyKey) {
+        return ErrIdempotencyKeyConflict
+    }
+    return err
+}
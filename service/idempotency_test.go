@@ -0,0 +1,137 @@
+package service
+
+import (
+    "testing"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/jmoiron/sqlx"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/yaoweihua/wallet-service/lock"
+    "time"
+)
+
+var idempotencyColumns = []string{
+    "id", "from_user_id", "to_user_id", "amount", "transaction_type", "transaction_status", "transaction_fee",
+    "payment_method", "idempotency_key", "request_hash", "created_at", "updated_at",
+}
+
+func TestDepositService_Deposit_IdempotentReplay(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    // The key was already used for the very same deposit
+    fingerprint := requestFingerprint("deposit", 1, 0, "USD", decimal.NewFromInt(50), "credit_card")
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, "key-1").
+        WillReturnRows(sqlmock.NewRows(idempotencyColumns).AddRow(
+            9, 1, 0, decimal.NewFromInt(50), "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card", "key-1", fingerprint, time.Now(), time.Now(),
+        ))
+    mock.ExpectRollback()
+
+    // No balance update and no new transaction is expected for a replay
+    txn, replayed, err := depositService.Deposit(1, "USD", decimal.RequireFromString("50.00"), Payment{}, "key-1")
+    require.NoError(t, err)
+    require.True(t, replayed)
+    require.Equal(t, 9, txn.ID)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestDepositService_Deposit_IdempotencyKeyConflict(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    // The key was used for a deposit of a different amount
+    fingerprint := requestFingerprint("deposit", 1, 0, "USD", decimal.NewFromInt(20), "credit_card")
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, "key-1").
+        WillReturnRows(sqlmock.NewRows(idempotencyColumns).AddRow(
+            9, 1, 0, decimal.NewFromInt(20), "deposit", "completed", decimal.NewFromFloat(0.0), "credit_card", "key-1", fingerprint, time.Now(), time.Now(),
+        ))
+    mock.ExpectRollback()
+
+    txn, replayed, err := depositService.Deposit(1, "USD", decimal.NewFromInt(50), Payment{}, "key-1")
+    require.ErrorIs(t, err, ErrIdempotencyKeyConflict)
+    require.False(t, replayed)
+    require.Nil(t, txn)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestTransferService_Transfer_StoresIdempotencyKey(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mockRedis.ExpectDel("balances:2").SetVal(1)
+
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+    fingerprint := requestFingerprint("transfer", 1, 2, "USD", decimal.NewFromInt(100))
+
+    mock.ExpectBegin()
+
+    // The key has not been used yet
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, "key-1").
+        WillReturnRows(sqlmock.NewRows(idempotencyColumns))
+
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    expectWalletRead(mock, 2, "USD", decimal.NewFromInt(150), "active")
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(250), sqlmock.AnyArg(), 2, int64(0)).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+
+    // The key and the request fingerprint are stored with the transaction
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(100), "USD", "transfer", "completed", decimal.NewFromFloat(0.0), "wallet", "key-1", fingerprint, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, time.Now(), time.Now()))
+
+    // The expectations of posting the movement to the ledger
+    expectLedgerMovement(mock, 3, "transfer", "user:1:USD", "user:2:USD", decimal.NewFromInt(100))
+
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, replayed, err := transferService.Transfer(1, 2, "USD", decimal.NewFromInt(100), "key-1")
+    require.NoError(t, err)
+    require.False(t, replayed)
+    require.Equal(t, 3, txn.ID)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+    "context"
+    "fmt"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/shopspring/decimal"
+    "github.com/jmoiron/sqlx"
+)
+
+// ledgerAccount identifies a ledger account by its code, together with the owning user for user accounts and its currency.
+type ledgerAccount struct {
+    code        string
+    userID      int
+    accountType string
+    currency    string
+}
+
+// userLedgerAccount returns the ledger account of the given user's wallet in the given currency.
+func userLedgerAccount(userID int, currency string) ledgerAccount {
+    return ledgerAccount{code: model.UserAccountCode(userID, currency), userID: userID, accountType: model.AccountTypeUser, currency: currency}
+}
+
+// systemLedgerAccount returns the named system ledger account in the given currency.
+func systemLedgerAccount(name, currency string) ledgerAccount {
+    return ledgerAccount{code: model.SystemAccountCode(name, currency), accountType: model.AccountTypeSystem, currency: currency}
+}
+
+// postMovement records the movement of amount from one ledger account to another as a balanced journal entry
+// linked to the given transaction. It must run inside the same database transaction as the balance update.
+func postMovement(ctx context.Context, ledgerRepo *repository.LedgerRepository, exec repository.Executor, transactionID int, description string, from, to ledgerAccount, amount decimal.Decimal) error {
+    fromAccountID, err := ledgerRepo.GetOrCreateAccount(ctx, exec, from.code, from.userID, from.accountType, from.currency)
+    if err != nil {
+        return err
+    }
+    toAccountID, err := ledgerRepo.GetOrCreateAccount(ctx, exec, to.code, to.userID, to.accountType, to.currency)
+    if err != nil {
+        return err
+    }
+
+    entry := &model.JournalEntry{
+        TransactionID: transactionID,
+        Description:   description,
+        Postings: []model.Posting{
+            {AccountID: fromAccountID, Amount: amount.Neg(), Currency: from.currency},
+            {AccountID: toAccountID, Amount: amount, Currency: to.currency},
+        },
+    }
+    return ledgerRepo.PostJournalEntry(ctx, exec, entry)
+}
+
+// postFee books the fee of a transaction from the paying user's account to the fee revenue account of the currency.
+// It runs inside the same database transaction as the movement it belongs to, and does nothing for a free movement.
+func postFee(ctx context.Context, ledgerRepo *repository.LedgerRepository, exec repository.Executor, transactionID, userID int, currency string, fee decimal.Decimal) error {
+    if !fee.IsPositive() {
+        return nil
+    }
+    return postMovement(ctx, ledgerRepo, exec, transactionID, "fee", userLedgerAccount(userID, currency), systemLedgerAccount(model.SystemAccountFeeRevenue, currency), fee)
+}
+
+// postPayout posts a completed withdrawal to the ledger, paid out to the external payout account, together with its fee.
+func postPayout(ctx context.Context, ledgerRepo *repository.LedgerRepository, exec repository.Executor, txn *model.Transaction) error {
+    if err := postMovement(ctx, ledgerRepo, exec, txn.ID, "withdraw", userLedgerAccount(txn.FromUserID, txn.Currency), systemLedgerAccount(model.SystemAccountExternalPayout, txn.Currency), txn.Amount); err != nil {
+        return err
+    }
+    return postFee(ctx, ledgerRepo, exec, txn.ID, txn.FromUserID, txn.Currency, txn.TransactionFee)
+}
+
+// postPayoutReversal posts a returned withdrawal to the ledger, crediting the payout and its fee back to the user.
+func postPayoutReversal(ctx context.Context, ledgerRepo *repository.LedgerRepository, exec repository.Executor, txn *model.Transaction) error {
+    user := userLedgerAccount(txn.FromUserID, txn.Currency)
+    if err := postMovement(ctx, ledgerRepo, exec, txn.ID, "withdraw reversal", systemLedgerAccount(model.SystemAccountExternalPayout, txn.Currency), user, txn.Amount); err != nil {
+        return err
+    }
+    if !txn.TransactionFee.IsPositive() {
+        return nil
+    }
+    return postMovement(ctx, ledgerRepo, exec, txn.ID, "fee reversal", systemLedgerAccount(model.SystemAccountFeeRevenue, txn.Currency), user, txn.TransactionFee)
+}
+
+// postConversion records a cross-currency movement as a single journal entry with both legs. The source amount moves
+// from the payer into the FX clearing account of its currency, and the target amount moves from the FX clearing account
+// of the target currency to the payee, so each currency of the entry balances on its own.
+func postConversion(ctx context.Context, ledgerRepo *repository.LedgerRepository, exec repository.Executor, transactionID int, description string, from, to ledgerAccount, sourceAmount, targetAmount decimal.Decimal) error {
+    legs := []struct {
+        account ledgerAccount
+        amount  decimal.Decimal
+    }{
+        {from, sourceAmount.Neg()},
+        {systemLedgerAccount(model.SystemAccountFXClearing, from.currency), sourceAmount},
+        {systemLedgerAccount(model.SystemAccountFXClearing, to.currency), targetAmount.Neg()},
+        {to, targetAmount},
+    }
+
+    entry := &model.JournalEntry{
+        TransactionID: transactionID,
+        Description:   description,
+    }
+    for _, leg := range legs {
+        accountID, err := ledgerRepo.GetOrCreateAccount(ctx, exec, leg.account.code, leg.account.userID, leg.account.accountType, leg.account.currency)
+        if err != nil {
+            return err
+        }
+        entry.Postings = append(entry.Postings, model.Posting{AccountID: accountID, Amount: leg.amount, Currency: leg.account.currency})
+    }
+    return ledgerRepo.PostJournalEntry(ctx, exec, entry)
+}
+
+// LedgerService provides methods for checking the stored wallet balances against the double-entry ledger.
+type LedgerService struct {
+    walletRepo *repository.WalletRepository
+    ledgerRepo *repository.LedgerRepository
+    dbConn     *sqlx.DB
+}
+
+// NewLedgerService creates a new instance of LedgerService with the provided database connection.
+func NewLedgerService(dbConn *sqlx.DB) *LedgerService {
+    return &LedgerService{
+        walletRepo: repository.NewWalletRepository(dbConn),
+        ledgerRepo: repository.NewLedgerRepository(dbConn),
+        dbConn:     dbConn,
+    }
+}
+
+// Reconcile compares the balance stored in each of the user's wallets with the balance derived from the postings
+// on the wallet's ledger account.
+func (s *LedgerService) Reconcile(ctx context.Context, userID int) ([]model.Reconciliation, error) {
+    wallets, err := s.walletRepo.GetWallets(ctx, s.dbConn, userID)
+    if err != nil {
+        return nil, err
+    }
+
+    results := make([]model.Reconciliation, 0, len(wallets))
+    for _, wallet := range wallets {
+        ledgerBalance, err := s.ledgerRepo.GetAccountBalance(ctx, model.UserAccountCode(userID, wallet.Currency))
+        if err != nil {
+            return nil, fmt.Errorf("failed to get ledger balance: %w", err)
+        }
+
+        results = append(results, model.Reconciliation{
+            UserID:        userID,
+            Currency:      wallet.Currency,
+            StoredBalance: wallet.Balance,
+            LedgerBalance: ledgerBalance,
+            Balanced:      wallet.Balance.Equal(ledgerBalance),
+        })
+    }
+    return results, nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/jmoiron/sqlx"
+    "time"
+)
+
+// expectLedgerMovement sets the database expectations for posting amount from one ledger account to another.
+func expectLedgerMovement(mock sqlmock.Sqlmock, transactionID int, description, fromCode, toCode string, amount decimal.Decimal) {
+    mock.ExpectQuery("INSERT INTO ledger_accounts").
+        WithArgs(fromCode, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11))
+    mock.ExpectQuery("INSERT INTO ledger_accounts").
+        WithArgs(toCode, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+    mock.ExpectQuery("INSERT INTO journal_entries").
+        WithArgs(transactionID, description).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(21, time.Now()))
+    mock.ExpectExec("INSERT INTO postings").
+        WithArgs(21, 11, amount.Neg(), 21, 12, amount).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
+// expectWallets expects all wallets of the user to be listed, with the given balances by currency in currency order
+func expectWallets(mock sqlmock.Sqlmock, userID int, balances ...string) {
+    rows := sqlmock.NewRows(walletColumns)
+    for i := 0; i < len(balances); i += 2 {
+        rows.AddRow(userID*10+i, userID, balances[i], balances[i+1], 0, "active", time.Now(), time.Now())
+    }
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u ON u.id = w.user_id WHERE w.user_id = \\$1 AND u.deleted_at IS NULL ORDER BY w.currency$").
+        WithArgs(userID).
+        WillReturnRows(rows)
+}
+
+func TestLedgerService_Reconcile_Balanced(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    ledgerService := NewLedgerService(sqlx.NewDb(db, "sqlmock"))
+
+    expectWallets(mock, 1, "JPY", "1500", "USD", "10.05")
+    mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\) FROM postings").
+        WithArgs("user:1:JPY").
+        WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("1500.00000000"))
+    mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\) FROM postings").
+        WithArgs("user:1:USD").
+        WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("10.05000000"))
+
+    results, err := ledgerService.Reconcile(context.Background(), 1)
+    require.NoError(t, err)
+    require.Len(t, results, 2)
+    require.Equal(t, "JPY", results[0].Currency)
+    require.True(t, results[0].Balanced)
+    require.Equal(t, "USD", results[1].Currency)
+    require.True(t, results[1].Balanced)
+    require.Equal(t, "10.05", results[1].LedgerBalance.String())
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestLedgerService_Reconcile_Mismatch(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    ledgerService := NewLedgerService(sqlx.NewDb(db, "sqlmock"))
+
+    // The stored balance was changed without a matching journal entry
+    expectWallets(mock, 1, "USD", "110.05")
+    mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\) FROM postings").
+        WithArgs("user:1:USD").
+        WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("10.05"))
+
+    results, err := ledgerService.Reconcile(context.Background(), 1)
+    require.NoError(t, err)
+    require.Len(t, results, 1)
+    require.False(t, results[0].Balanced)
+    require.Equal(t, "110.05", results[0].StoredBalance.String())
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,304 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+)
+
+// ErrLimitExceeded is returned when a withdrawal or transfer would exceed one of the transaction limits of the user.
+var ErrLimitExceeded = errors.New("transaction limit exceeded")
+
+// limitedTransactionTypes are the money movements transaction limits apply to.
+var limitedTransactionTypes = []string{"withdraw", "transfer"}
+
+// LimitRule caps the withdrawals or transfers it matches. Empty transaction type and KYC tier fields match any value,
+// and caps left out do not apply. Rules apply to movements in every currency: all amounts are in model.DefaultCurrency,
+// movements in other currencies are valued in it, and the user's movements in all currencies count towards the same caps.
+// Fees do not count.
+type LimitRule struct {
+    TransactionType string           `json:"transaction_type"` // withdraw or transfer
+    KYCTier         string           `json:"kyc_tier"`         // basic, verified or premium
+    MaxAmount       *decimal.Decimal `json:"max_amount"`       // The largest single movement
+    DailyAmount     *decimal.Decimal `json:"daily_amount"`     // The most moved in total per calendar day
+    MonthlyAmount   *decimal.Decimal `json:"monthly_amount"`   // The most moved in total per calendar month
+    HourlyCount     *int             `json:"hourly_count"`     // The most movements per hour
+}
+
+// matches reports whether the rule applies to the user's movement.
+func (r LimitRule) matches(txType, tier string) bool {
+    if r.TransactionType != "" && r.TransactionType != txType {
+        return false
+    }
+    return r.KYCTier == "" || r.KYCTier == tier
+}
+
+// validate checks that the rule can be applied, so mistakes in the limits file are found when it is loaded.
+func (r LimitRule) validate() error {
+    switch r.TransactionType {
+    case "", "withdraw", "transfer":
+    default:
+        return fmt.Errorf("unknown transaction type %q", r.TransactionType)
+    }
+    switch r.KYCTier {
+    case "", model.KYCTierBasic, model.KYCTierVerified, model.KYCTierPremium:
+    default:
+        return fmt.Errorf("unknown KYC tier %q", r.KYCTier)
+    }
+    for _, amount := range []*decimal.Decimal{r.MaxAmount, r.DailyAmount, r.MonthlyAmount} {
+        if amount != nil && !amount.IsPositive() {
+            return fmt.Errorf("limit amounts must be greater than zero")
+        }
+    }
+    if r.HourlyCount != nil && *r.HourlyCount <= 0 {
+        return fmt.Errorf("hourly_count must be greater than zero")
+    }
+    return nil
+}
+
+// cap returns the cap of the rule on the amount moved over the window, nil if there is none.
+func (r LimitRule) cap(period string) *decimal.Decimal {
+    switch period {
+    case model.LimitPeriodDay:
+        return r.DailyAmount
+    case model.LimitPeriodMonth:
+        return r.MonthlyAmount
+    }
+    return nil
+}
+
+// LimitSchedule holds the transaction limits of the wallet service. The first rule matching a movement limits it,
+// so more specific rules go first; a movement no rule matches is not limited. A nil schedule limits nothing.
+type LimitSchedule struct {
+    rules []LimitRule
+    rates FXRateProvider
+}
+
+// NewLimitSchedule creates a LimitSchedule from rules in order of precedence. The rates value movements in other
+// currencies than model.DefaultCurrency; limited movements in a currency without a rate are rejected.
+func NewLimitSchedule(rules []LimitRule, rates FXRateProvider) (*LimitSchedule, error) {
+    for i := range rules {
+        rules[i].TransactionType = strings.ToLower(strings.TrimSpace(rules[i].TransactionType))
+        rules[i].KYCTier = strings.ToLower(strings.TrimSpace(rules[i].KYCTier))
+        if err := rules[i].validate(); err != nil {
+            return nil, fmt.Errorf("invalid limit rule %d: %w", i+1, err)
+        }
+    }
+    return &LimitSchedule{rules: rules, rates: rates}, nil
+}
+
+// LoadLimitSchedule reads a JSON array of limit rules into a LimitSchedule. Unknown fields are rejected, so that a rule
+// written for per-currency limits is not silently applied to every currency.
+func LoadLimitSchedule(path string, rates FXRateProvider) (*LimitSchedule, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read limits file: %w", err)
+    }
+
+    var rules []LimitRule
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&rules); err != nil {
+        return nil, fmt.Errorf("failed to parse limits file %s: %w", path, err)
+    }
+    return NewLimitSchedule(rules, rates)
+}
+
+// rule returns the rule limiting the movement, nil if it is not limited.
+func (s *LimitSchedule) rule(txType, tier string) *LimitRule {
+    if s == nil {
+        return nil
+    }
+    for i := range s.rules {
+        if s.rules[i].matches(txType, tier) {
+            return &s.rules[i]
+        }
+    }
+    return nil
+}
+
+// limitWindow is the calendar window usage is counted over, from start (inclusive) to end (exclusive).
+type limitWindow struct {
+    period string
+    start  time.Time
+    end    time.Time
+}
+
+// limitWindows returns the hour, day and month windows in UTC that contain now.
+func limitWindows(now time.Time) []limitWindow {
+    now = now.UTC()
+    hour := now.Truncate(time.Hour)
+    day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+    month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+    return []limitWindow{
+        {period: model.LimitPeriodHour, start: hour, end: hour.Add(time.Hour)},
+        {period: model.LimitPeriodDay, start: day, end: day.AddDate(0, 0, 1)},
+        {period: model.LimitPeriodMonth, start: month, end: month.AddDate(0, 1, 0)},
+    }
+}
+
+// enforce checks a withdrawal or transfer out of the wallet against the limits of its owner's KYC tier, and counts it
+// towards the cumulative limits, valued in model.DefaultCurrency. It runs inside the database transaction moving the money: the usage counters are
+// updated and checked in one statement each, and roll back together with the movement if it is rejected or fails,
+// so concurrent movements of the user can never exceed a limit together. Movements count when they are accepted,
+// a pending withdrawal that fails to settle later is not taken off again.
+func (s *LimitSchedule) enforce(ctx context.Context, limitRepo *repository.LimitRepository, exec repository.Executor, wallet *model.Wallet, txType string, amount decimal.Decimal, now time.Time) error {
+    rule := s.rule(txType, wallet.UserTier)
+    if rule == nil {
+        return nil
+    }
+
+    value, err := baseAmount(ctx, s.rates, amount, wallet.Currency)
+    if err != nil {
+        return limitExceeded("%s of %s %s cannot be valued in %s: %v", txType, amount.String(), wallet.Currency, model.DefaultCurrency, err)
+    }
+    moved := amount.String() + " " + wallet.Currency
+    if wallet.Currency != model.DefaultCurrency {
+        moved += fmt.Sprintf(" (%s %s)", value.StringFixed(2), model.DefaultCurrency)
+    }
+
+    if rule.MaxAmount != nil && value.GreaterThan(*rule.MaxAmount) {
+        return limitExceeded("%s of %s exceeds the single %s limit of %s %s", txType, moved, txType, rule.MaxAmount.String(), model.DefaultCurrency)
+    }
+
+    for _, window := range limitWindows(now) {
+        amountCap := rule.cap(window.period)
+        var countCap *int
+        if window.period == model.LimitPeriodHour {
+            countCap = rule.HourlyCount
+        }
+        if amountCap == nil && countCap == nil {
+            continue
+        }
+
+        counter := &model.UsageCounter{
+            UserID:          wallet.UserID,
+            TransactionType: txType,
+            Period:          window.period,
+            PeriodStart:     window.start,
+            Amount:          value,
+        }
+        if err := limitRepo.AddUsage(ctx, exec, counter); err != nil {
+            return err
+        }
+
+        if amountCap != nil && counter.Amount.GreaterThan(*amountCap) {
+            used := counter.Amount.Sub(value)
+            return limitExceeded("%s of %s exceeds the %s %s limit of %s %s, %s %s used", txType, moved, window.period, txType, amountCap.String(), model.DefaultCurrency, used.String(), model.DefaultCurrency)
+        }
+        if countCap != nil && counter.Count > *countCap {
+            return limitExceeded("at most %d %ss per %s", *countCap, txType, window.period)
+        }
+    }
+    return nil
+}
+
+// limitExceeded returns the rejection of a movement over a limit, recorded with the limit_exceeded reason.
+func limitExceeded(format string, args ...interface{}) error {
+    return reject(model.FailureReasonLimitExceeded, fmt.Errorf("%w: %s", ErrLimitExceeded, fmt.Sprintf(format, args...)))
+}
+
+// AmountAllowance is how much of a cumulative amount limit is used and left in the current window.
+type AmountAllowance struct {
+    Limit     decimal.Decimal `json:"limit"`
+    Used      decimal.Decimal `json:"used"`
+    Remaining decimal.Decimal `json:"remaining"`
+    ResetsAt  time.Time       `json:"resets_at"` // When the next window starts
+}
+
+// CountAllowance is how many movements of a count limit are used and left in the current window.
+type CountAllowance struct {
+    Limit     int       `json:"limit"`
+    Used      int       `json:"used"`
+    Remaining int       `json:"remaining"`
+    ResetsAt  time.Time `json:"resets_at"` // When the next window starts
+}
+
+// RemainingLimits describes the limits of one type of movement for a user, and what is left of them across all currencies.
+// Limits that do not apply are left out.
+type RemainingLimits struct {
+    TransactionType string           `json:"transaction_type"`
+    Currency        string           `json:"currency"` // The currency of the amounts, always model.DefaultCurrency
+    KYCTier         string           `json:"kyc_tier"`
+    MaxAmount       *decimal.Decimal `json:"max_amount,omitempty"` // The largest single movement
+    Hourly          *CountAllowance  `json:"hourly,omitempty"`
+    Daily           *AmountAllowance `json:"daily,omitempty"`
+    Monthly         *AmountAllowance `json:"monthly,omitempty"`
+}
+
+// LimitService reports the transaction limits of users and how much of them is left.
+type LimitService struct {
+    userRepo  *repository.UserRepository
+    limitRepo *repository.LimitRepository
+    dbConn    *sqlx.DB
+    limits    *LimitSchedule
+}
+
+// NewLimitService creates a new instance of LimitService reporting the limits of the schedule.
+func NewLimitService(dbConn *sqlx.DB, limits *LimitSchedule) *LimitService {
+    return &LimitService{
+        userRepo:  repository.NewUserRepository(dbConn),
+        limitRepo: repository.NewLimitRepository(dbConn),
+        dbConn:    dbConn,
+        limits:    limits,
+    }
+}
+
+// Remaining returns the limits of the user's withdrawals and transfers, with what is left of them right now.
+// The amounts are in model.DefaultCurrency, and the user's movements in every currency count towards them.
+func (s *LimitService) Remaining(ctx context.Context, userID int) ([]RemainingLimits, error) {
+    user, err := s.userRepo.GetUser(ctx, s.dbConn, userID)
+    if err != nil {
+        return nil, err
+    }
+
+    windows := limitWindows(time.Now())
+    remaining := make([]RemainingLimits, 0, len(limitedTransactionTypes))
+    for _, txType := range limitedTransactionTypes {
+        limits := RemainingLimits{TransactionType: txType, Currency: model.DefaultCurrency, KYCTier: user.KYCTier}
+        rule := s.limits.rule(txType, user.KYCTier)
+        if rule == nil {
+            remaining = append(remaining, limits)
+            continue
+        }
+        limits.MaxAmount = rule.MaxAmount
+
+        for _, window := range windows {
+            amountCap := rule.cap(window.period)
+            if amountCap == nil && (window.period != model.LimitPeriodHour || rule.HourlyCount == nil) {
+                continue
+            }
+
+            counter, err := s.limitRepo.GetUsage(ctx, s.dbConn, userID, txType, window.period, window.start)
+            if err != nil {
+                return nil, err
+            }
+
+            if amountCap != nil {
+                allowance := &AmountAllowance{Limit: *amountCap, Used: counter.Amount, Remaining: decimal.Max(amountCap.Sub(counter.Amount), decimal.Zero), ResetsAt: window.end}
+                if window.period == model.LimitPeriodDay {
+                    limits.Daily = allowance
+                } else {
+                    limits.Monthly = allowance
+                }
+            } else {
+                left := *rule.HourlyCount - counter.Count
+                if left < 0 {
+                    left = 0
+                }
+                limits.Hourly = &CountAllowance{Limit: *rule.HourlyCount, Used: counter.Count, Remaining: left, ResetsAt: window.end}
+            }
+        }
+        remaining = append(remaining, limits)
+    }
+    return remaining, nil
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+    "context"
+    "database/sql"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// testLimits limits withdrawals of basic users to 500 USD at once, 100 USD a day and 2 an hour, and transfers of all users
+// to 1000 USD a month, valuing EUR at 0.92 EUR per USD
+func testLimits(t *testing.T) *LimitSchedule {
+    maxAmount, daily, monthly, hourly := decimal.NewFromInt(500), decimal.NewFromInt(100), decimal.NewFromInt(1000), 2
+    rates := NewStaticRateProvider(map[string]decimal.Decimal{"USD/EUR": decimal.RequireFromString("0.92")})
+    limits, err := NewLimitSchedule([]LimitRule{
+        {TransactionType: "withdraw", KYCTier: "Basic", MaxAmount: &maxAmount, DailyAmount: &daily, HourlyCount: &hourly},
+        {TransactionType: "transfer", MonthlyAmount: &monthly},
+    }, rates)
+    require.NoError(t, err)
+    return limits
+}
+
+// expectTieredWalletRead expects the user's wallet to be read and locked, together with the user's KYC tier
+func expectTieredWalletRead(mock sqlmock.Sqlmock, userID int, currency string, balance decimal.Decimal, tier string) {
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(userID, currency).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u (.+) FOR UPDATE OF w FOR SHARE OF u").
+        WithArgs(userID, currency).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "held", "version", "user_status", "user_tier", "created_at", "updated_at"}).
+            AddRow(userID, userID, currency, balance, 0, 0, "active", tier, time.Now(), time.Now()))
+}
+
+// expectUsage expects the amount in USD to be counted in the user's window of the period, returning the totals of the window
+func expectUsage(mock sqlmock.Sqlmock, userID int, txType, period string, amount, total decimal.Decimal, count int) {
+    mock.ExpectQuery("INSERT INTO usage_counters (.+) ON CONFLICT").
+        WithArgs(userID, txType, period, sqlmock.AnyArg(), amount).
+        WillReturnRows(sqlmock.NewRows([]string{"amount", "count"}).AddRow(total, count))
+}
+
+// Test that the first matching rule limits a movement, and that invalid rules are rejected
+func TestLimitSchedule(t *testing.T) {
+    limits := testLimits(t)
+
+    require.NotNil(t, limits.rule("withdraw", model.KYCTierBasic))
+    require.Nil(t, limits.rule("withdraw", model.KYCTierVerified))
+    require.Equal(t, "1000", limits.rule("transfer", model.KYCTierPremium).MonthlyAmount.String())
+
+    var none *LimitSchedule
+    require.Nil(t, none.rule("withdraw", model.KYCTierBasic))
+
+    negative := decimal.NewFromInt(-1)
+    _, err := NewLimitSchedule([]LimitRule{{MaxAmount: &negative}}, nil)
+    require.Error(t, err)
+    _, err = NewLimitSchedule([]LimitRule{{KYCTier: "gold"}}, nil)
+    require.Error(t, err)
+    _, err = NewLimitSchedule([]LimitRule{{TransactionType: "deposit"}}, nil)
+    require.Error(t, err)
+
+    // Limits apply to every currency, rules naming one are refused rather than applied to all of them
+    dir := t.TempDir()
+    path := filepath.Join(dir, "limits.json")
+    require.NoError(t, os.WriteFile(path, []byte(`[{"transaction_type": "withdraw", "daily_amount": "1000"}]`), 0o600))
+    _, err = LoadLimitSchedule(path, nil)
+    require.NoError(t, err)
+
+    perCurrency := filepath.Join(dir, "per_currency.json")
+    require.NoError(t, os.WriteFile(perCurrency, []byte(`[{"transaction_type": "withdraw", "currency": "EUR", "daily_amount": "1000"}]`), 0o600))
+    _, err = LoadLimitSchedule(perCurrency, nil)
+    require.Error(t, err)
+
+    // The windows are calendar periods in UTC
+    windows := limitWindows(time.Date(2024, 11, 30, 23, 45, 0, 0, time.FixedZone("CET", 3600)))
+    require.Equal(t, time.Date(2024, 11, 30, 22, 0, 0, 0, time.UTC), windows[0].start)
+    require.Equal(t, time.Date(2024, 11, 30, 0, 0, 0, 0, time.UTC), windows[1].start)
+    require.Equal(t, time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), windows[2].end)
+}
+
+// Test that withdrawals over the single, daily or hourly limit of the user's tier are rejected and recorded as failed
+func TestWithdrawService_Withdraw_Limits(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil, testLimits(t))
+
+    // Over the single withdrawal limit, nothing is counted
+    mock.ExpectBegin()
+    expectTieredWalletRead(mock, 1, "USD", decimal.NewFromInt(1000), model.KYCTierBasic)
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(600), "USD", "withdraw", "failed", decimal.Zero, "credit_card", nil, nil, "limit_exceeded", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(600), Payment{}, "")
+    require.ErrorIs(t, err, ErrLimitExceeded)
+
+    // Within the limits, counted towards the hour and the day
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mock.ExpectBegin()
+    expectTieredWalletRead(mock, 1, "USD", decimal.NewFromInt(1000), model.KYCTierBasic)
+    expectUsage(mock, 1, "withdraw", "hour", decimal.NewFromInt(60), decimal.NewFromInt(60), 1)
+    expectUsage(mock, 1, "withdraw", "day", decimal.NewFromInt(60), decimal.NewFromInt(60), 1)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(940), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(60), "USD", "withdraw", "completed", decimal.Zero, "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(2, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 2, "withdraw", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(60))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(60), Payment{}, "")
+    require.NoError(t, err)
+
+    // Over the daily limit together with the earlier withdrawal, the counters are rolled back
+    mock.ExpectBegin()
+    expectTieredWalletRead(mock, 1, "USD", decimal.NewFromInt(940), model.KYCTierBasic)
+    expectUsage(mock, 1, "withdraw", "hour", decimal.NewFromInt(50), decimal.NewFromInt(110), 2)
+    expectUsage(mock, 1, "withdraw", "day", decimal.NewFromInt(50), decimal.NewFromInt(110), 2)
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "withdraw", "failed", decimal.Zero, "credit_card", nil, nil, "limit_exceeded", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.ErrorIs(t, err, ErrLimitExceeded)
+    require.Contains(t, err.Error(), "day")
+
+    // Over the hourly count
+    mock.ExpectBegin()
+    expectTieredWalletRead(mock, 1, "USD", decimal.NewFromInt(940), model.KYCTierBasic)
+    expectUsage(mock, 1, "withdraw", "hour", decimal.NewFromInt(10), decimal.NewFromInt(80), 3)
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(10), "USD", "withdraw", "failed", decimal.Zero, "credit_card", nil, nil, "limit_exceeded", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(4, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(10), Payment{}, "")
+    require.ErrorIs(t, err, ErrLimitExceeded)
+    require.Contains(t, err.Error(), "per hour")
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that one user's withdrawals in different currencies count towards the same limits, valued in USD
+func TestWithdrawService_Withdraw_LimitsAcrossCurrencies(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil, testLimits(t))
+
+    // 60 USD of the daily 100 USD
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mock.ExpectBegin()
+    expectTieredWalletRead(mock, 1, "USD", decimal.NewFromInt(1000), model.KYCTierBasic)
+    expectUsage(mock, 1, "withdraw", "hour", decimal.NewFromInt(60), decimal.NewFromInt(60), 1)
+    expectUsage(mock, 1, "withdraw", "day", decimal.NewFromInt(60), decimal.NewFromInt(60), 1)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(940), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(60), "USD", "withdraw", "completed", decimal.Zero, "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(2, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 2, "withdraw", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(60))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(60), Payment{}, "")
+    require.NoError(t, err)
+
+    // 50 EUR are worth 54.35 USD, which exceed the day together with the USD withdrawal, though not on their own
+    value := decimal.RequireFromString("54.34782609")
+    mock.ExpectBegin()
+    expectTieredWalletRead(mock, 1, "EUR", decimal.NewFromInt(1000), model.KYCTierBasic)
+    expectUsage(mock, 1, "withdraw", "hour", value, decimal.NewFromInt(60).Add(value), 2)
+    expectUsage(mock, 1, "withdraw", "day", value, decimal.NewFromInt(60).Add(value), 2)
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "EUR", "withdraw", "failed", decimal.Zero, "credit_card", nil, nil, "limit_exceeded", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "EUR", decimal.NewFromInt(50), Payment{}, "")
+    require.ErrorIs(t, err, ErrLimitExceeded)
+    require.Contains(t, err.Error(), "50 EUR (54.35 USD) exceeds the day withdraw limit of 100 USD, 60 USD used")
+
+    // A currency without a rate to USD cannot be counted, and is rejected
+    mock.ExpectBegin()
+    expectTieredWalletRead(mock, 1, "JPY", decimal.NewFromInt(10000), model.KYCTierBasic)
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(1000), "JPY", "withdraw", "failed", decimal.Zero, "credit_card", nil, nil, "limit_exceeded", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(4, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "JPY", decimal.NewFromInt(1000), Payment{}, "")
+    require.ErrorIs(t, err, ErrLimitExceeded)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+    require.NoError(t, mockRedis.ExpectationsWereMet())
+}
+
+// Test that the remaining limits report what is used and left in the current windows
+func TestLimitService_Remaining(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    limitService := NewLimitService(sqlx.NewDb(db, "sqlmock"), testLimits(t))
+
+    now := time.Now()
+    mock.ExpectQuery("SELECT (.+) FROM users WHERE id = \\$1").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "phone", "status", "kyc_tier", "created_at", "updated_at"}).
+            AddRow(1, "Alice", "alice@example.com", "13300000001", "active", "basic", now, now))
+    mock.ExpectQuery("SELECT amount, count FROM usage_counters").WithArgs(1, "withdraw", "hour", sqlmock.AnyArg()).
+        WillReturnRows(sqlmock.NewRows([]string{"amount", "count"}).AddRow(decimal.NewFromInt(60), 1))
+    mock.ExpectQuery("SELECT amount, count FROM usage_counters").WithArgs(1, "withdraw", "day", sqlmock.AnyArg()).
+        WillReturnRows(sqlmock.NewRows([]string{"amount", "count"}).AddRow(decimal.NewFromInt(120), 3))
+    mock.ExpectQuery("SELECT amount, count FROM usage_counters").WithArgs(1, "transfer", "month", sqlmock.AnyArg()).
+        WillReturnError(sql.ErrNoRows)
+
+    remaining, err := limitService.Remaining(context.Background(), 1)
+    require.NoError(t, err)
+    require.Len(t, remaining, 2)
+
+    withdraw := remaining[0]
+    require.Equal(t, "basic", withdraw.KYCTier)
+    require.Equal(t, "500", withdraw.MaxAmount.String())
+    require.Equal(t, 1, withdraw.Hourly.Remaining)
+    require.Equal(t, "0", withdraw.Daily.Remaining.String())
+    require.Nil(t, withdraw.Monthly)
+
+    transfer := remaining[1]
+    require.Nil(t, transfer.MaxAmount)
+    require.Equal(t, "1000", transfer.Monthly.Remaining.String())
+    require.True(t, transfer.Monthly.ResetsAt.After(now))
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// ErrBalanceBusy is returned when a user's balance is locked by another request for longer than the lock wait timeout,
+// or when the lock was lost before the balance could be written. The request can safely be retried.
+var ErrBalanceBusy = errors.New("the balance is being updated by another request, please retry")
+
+// lockBalances acquires the balance locks of the given users in a deadlock-free order.
+func lockBalances(ctx context.Context, locker lock.Locker, userIDs ...int) ([]lock.Lock, error) {
+    keys := make([]string, 0, len(userIDs))
+    for _, userID := range userIDs {
+        keys = append(keys, lock.UserKey(userID))
+    }
+
+    locks, err := lock.AcquireAll(ctx, locker, keys...)
+    if err != nil {
+        if errors.Is(err, lock.ErrLockTimeout) {
+            return nil, fmt.Errorf("%w: %w", ErrBalanceBusy, err)
+        }
+        return nil, fmt.Errorf("failed to lock balances: %w", err)
+    }
+    return locks, nil
+}
+
+// unlockBalances releases the balance locks. Failures are only logged, because by then the database
+// transaction has already been committed or rolled back.
+func unlockBalances(ctx context.Context, locks []lock.Lock) {
+    if err := lock.ReleaseAll(ctx, locks); err != nil {
+        utils.GetLogger().Warnf("Warning: failed to release balance lock: %v", err)
+    }
+}
+
+// checkFence verifies inside tx that the balance lock held for the user has not been taken over by another request.
+func checkFence(ctx context.Context, walletRepo *repository.WalletRepository, exec repository.Executor, locks []lock.Lock, userID int) error {
+    key := lock.UserKey(userID)
+    for _, l := range locks {
+        if l.Key() != key {
+            continue
+        }
+        if l.Token() == lock.NoFencingToken {
+            return nil
+        }
+        err := walletRepo.CheckFence(ctx, exec, userID, l.Token())
+        if errors.Is(err, repository.ErrStaleFencingToken) {
+            return fmt.Errorf("%w: %w", ErrBalanceBusy, err)
+        }
+        return err
+    }
+    return fmt.Errorf("no balance lock held for user %d", userID)
+}
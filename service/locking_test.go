@@ -0,0 +1,87 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/jmoiron/sqlx"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/repository"
+)
+
+// fencedLocker hands out locks with a fixed fencing token, like a distributed backend would.
+type fencedLocker struct {
+    token int64
+    err   error
+}
+
+func (l *fencedLocker) Acquire(_ context.Context, key string) (lock.Lock, error) {
+    if l.err != nil {
+        return nil, l.err
+    }
+    return &fencedLock{key: key, token: l.token}, nil
+}
+
+type fencedLock struct {
+    key   string
+    token int64
+}
+
+func (l *fencedLock) Key() string                     { return l.key }
+func (l *fencedLock) Token() int64                    { return l.token }
+func (l *fencedLock) Release(_ context.Context) error { return nil }
+
+func TestWithdrawService_Withdraw_StaleFencingToken(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, &fencedLocker{token: 5}, PessimisticConcurrency, nil, nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(150), "active")
+
+    // A newer token has already been written by another request, so the update is rejected
+    mock.ExpectExec("UPDATE users SET fence_token = \\$1 WHERE id = \\$2 AND fence_token <= \\$1").
+        WithArgs(int64(5), 1).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectRollback()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.ErrorIs(t, err, ErrBalanceBusy)
+    require.ErrorIs(t, err, repository.ErrStaleFencingToken)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestDepositService_Deposit_LockTimeout(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, &fencedLocker{err: lock.ErrLockTimeout}, PessimisticConcurrency, nil, nil)
+
+    // The balance lock is never acquired, so the database must not be touched
+    _, _, err = depositService.Deposit(1, "USD", decimal.NewFromInt(50), Payment{}, "")
+    require.True(t, errors.Is(err, ErrBalanceBusy))
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
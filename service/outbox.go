@@ -0,0 +1,144 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "time"
+    "github.com/yaoweihua/wallet-service/events"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/shopspring/decimal"
+    "github.com/jmoiron/sqlx"
+)
+
+const (
+    // outboxBatchSize is the number of events the outbox relay publishes per run.
+    outboxBatchSize = 100
+    // maxOutboxError is the longest error message kept with an event that failed to publish.
+    maxOutboxError = 255
+    // outboxClaimTTL is how long the events claimed by a relay are left to it, before another relay may claim them.
+    outboxClaimTTL = time.Minute
+    // outboxRetryDelay is how long an event that failed to publish waits before it is retried.
+    outboxRetryDelay = 30 * time.Second
+)
+
+// balanceChange describes the new balance of the wallet, written by a money movement.
+func balanceChange(wallet *model.Wallet, balance decimal.Decimal) model.BalanceChange {
+    return model.BalanceChange{
+        UserID:   wallet.UserID,
+        Currency: wallet.Currency,
+        Balance:  balance,
+        Delta:    balance.Sub(wallet.Balance),
+    }
+}
+
+// recordEvents writes the domain events of a recorded transaction to the outbox, inside the database transaction that
+// recorded it or changed its status: the event of its current status, and balance.changed for every balance it changed.
+func recordEvents(ctx context.Context, outboxRepo *repository.OutboxRepository, exec repository.Executor, txn *model.Transaction, changes ...model.BalanceChange) error {
+    payload, err := json.Marshal(txn)
+    if err != nil {
+        return fmt.Errorf("failed to encode event of transaction %d: %w", txn.ID, err)
+    }
+    batch := []model.OutboxEvent{{
+        EventType:     model.TransactionEventType(txn.TransactionStatus),
+        AggregateType: model.AggregateTransaction,
+        AggregateID:   strconv.Itoa(txn.ID),
+        Payload:       payload,
+    }}
+
+    for _, change := range changes {
+        change.TransactionID = txn.ID
+        payload, err := json.Marshal(change)
+        if err != nil {
+            return fmt.Errorf("failed to encode balance change of user %d: %w", change.UserID, err)
+        }
+        batch = append(batch, model.OutboxEvent{
+            EventType:     model.EventBalanceChanged,
+            AggregateType: model.AggregateWallet,
+            AggregateID:   fmt.Sprintf("%d:%s", change.UserID, change.Currency),
+            Payload:       payload,
+        })
+    }
+    return outboxRepo.AddEvents(ctx, exec, batch)
+}
+
+// OutboxRelay publishes the domain events written to the outbox through a publisher, in the order they were written.
+// Delivery is at least once: an event published just before the relay or its database fails is published again.
+// An event that fails to publish is retried later without holding back the events after it, even those of the same
+// aggregate, and is parked as dead after the maximum number of attempts. Order is therefore not guaranteed, consumers
+// order the events of an aggregate by their ID.
+type OutboxRelay struct {
+    outboxRepo  *repository.OutboxRepository
+    publisher   events.Publisher
+    dbConn      *sqlx.DB
+    maxAttempts int
+}
+
+// NewOutboxRelay creates a new instance of OutboxRelay publishing the events of the outbox through the publisher,
+// making at most maxAttempts attempts per event.
+func NewOutboxRelay(dbConn *sqlx.DB, publisher events.Publisher, maxAttempts int) *OutboxRelay {
+    return &OutboxRelay{
+        outboxRepo:  repository.NewOutboxRepository(dbConn),
+        publisher:   publisher,
+        dbConn:      dbConn,
+        maxAttempts: maxAttempts,
+    }
+}
+
+// RelayPending publishes up to one batch of the events not published yet, and returns how many were published.
+// The events are claimed for the relay first, so concurrent relays publish different events, and are published
+// without a database transaction or lock held. The events that fail to publish have their failure recorded and are
+// retried after outboxRetryDelay, by when later events may have been published, or are parked as dead after their last
+// attempt; the error of the first is returned.
+func (r *OutboxRelay) RelayPending(ctx context.Context) (int, error) {
+    now := time.Now()
+    pending, err := r.outboxRepo.ClaimUnpublished(ctx, r.dbConn, now, now.Add(outboxClaimTTL), outboxBatchSize)
+    if err != nil {
+        return 0, err
+    }
+
+    var failure error
+    ids := make([]int64, 0, len(pending))
+    for _, event := range pending {
+        err := r.publisher.Publish(ctx, event)
+        if err == nil {
+            ids = append(ids, event.ID)
+            continue
+        }
+
+        attempt := event.Attempts + 1
+        dead := r.maxAttempts > 0 && attempt >= r.maxAttempts
+        if err := r.outboxRepo.RecordFailure(ctx, r.dbConn, event.ID, truncateError(err, maxOutboxError), time.Now().Add(outboxRetryDelay), dead); err != nil {
+            return 0, err
+        }
+        if dead {
+            utils.GetLogger().Errorf("Error: outbox event %d is dead after %d failed attempts: %v", event.ID, attempt, err)
+        }
+        if failure == nil {
+            failure = fmt.Errorf("failed to publish event %d, attempt %d: %w", event.ID, attempt, err)
+        }
+    }
+
+    if err := r.outboxRepo.MarkPublished(ctx, r.dbConn, ids); err != nil {
+        return 0, err
+    }
+    return len(ids), failure
+}
+
+// Run publishes the events of the outbox every interval until the context is cancelled. A full batch is followed by
+// the next one right away, so a backlog is worked off without waiting for the next tick.
+func (r *OutboxRelay) Run(ctx context.Context, interval time.Duration) {
+    runPeriodically(ctx, "outbox relay", interval, func(ctx context.Context) (int, error) {
+        total := 0
+        for {
+            published, err := r.RelayPending(ctx)
+            total += published
+            if err != nil || published < outboxBatchSize || ctx.Err() != nil {
+                return total, err
+            }
+        }
+    })
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+    "context"
+    "database/sql/driver"
+    "errors"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/events"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+)
+
+// outboxColumns are the columns of an outbox event, in the order the relay selects them
+var outboxColumns = []string{"id", "event_type", "aggregate_type", "aggregate_id", "payload", "attempts", "last_error", "created_at", "published_at"}
+
+// expectEvents expects the events of the given types to be written to the outbox, in order
+func expectEvents(mock sqlmock.Sqlmock, eventTypes ...string) {
+    args := make([]driver.Value, 0, 4*len(eventTypes))
+    for _, eventType := range eventTypes {
+        args = append(args, eventType, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg())
+    }
+    mock.ExpectExec("INSERT INTO outbox_events").
+        WithArgs(args...).
+        WillReturnResult(sqlmock.NewResult(0, int64(len(eventTypes))))
+}
+
+func TestRecordEvents(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    dbConn := sqlx.NewDb(db, "sqlmock")
+    outboxRepo := repository.NewOutboxRepository(dbConn)
+    wallet := &model.Wallet{UserID: 1, Currency: "USD", Balance: decimal.RequireFromString("100")}
+    txn := &model.Transaction{ID: 7, FromUserID: 1, Currency: "USD", TransactionType: "withdraw", TransactionStatus: model.TransactionStatusCompleted}
+
+    mock.ExpectExec("INSERT INTO outbox_events").
+        WithArgs("transaction.completed", "transaction", "7", sqlmock.AnyArg(),
+            "balance.changed", "wallet", "1:USD", `{"user_id":1,"currency":"USD","balance":"60","delta":"-40","transaction_id":7}`).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+
+    err = recordEvents(context.Background(), outboxRepo, dbConn, txn, balanceChange(wallet, decimal.RequireFromString("60")))
+    require.NoError(t, err)
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectClaim expects a batch of events to be claimed for the relay, returning the rows
+func expectClaim(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+    mock.ExpectQuery("UPDATE outbox_events SET claimed_until = \\$2 WHERE id IN \\( SELECT id FROM outbox_events WHERE published_at IS NULL AND dead_at IS NULL (.+) FOR UPDATE SKIP LOCKED \\) RETURNING").
+        WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), outboxBatchSize).
+        WillReturnRows(rows)
+}
+
+func TestOutboxRelay_RelayPending(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    publisher := events.NewMemoryPublisher()
+    relay := NewOutboxRelay(sqlx.NewDb(db, "sqlmock"), publisher, 10)
+
+    // The claim is returned out of order, and is published in ID order without a transaction open
+    expectClaim(mock, sqlmock.NewRows(outboxColumns).
+        AddRow(4, "balance.changed", "wallet", "1:USD", []byte(`{"user_id":1}`), 1, "timeout", time.Now(), nil).
+        AddRow(3, "transaction.completed", "transaction", "7", []byte(`{"id":7}`), 0, "", time.Now(), nil))
+    mock.ExpectExec("UPDATE outbox_events SET published_at = NOW\\(\\) WHERE id = ANY\\(\\$1\\)").
+        WithArgs("{3,4}").
+        WillReturnResult(sqlmock.NewResult(0, 2))
+
+    published, err := relay.RelayPending(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 2, published)
+
+    sent := publisher.Events()
+    require.Len(t, sent, 2)
+    require.Equal(t, "transaction.completed", sent[0].EventType)
+    require.Equal(t, "balance.changed", sent[1].EventType)
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// poisonPublisher fails to publish the events of the transaction aggregate, and publishes the others
+type poisonPublisher struct {
+    *events.MemoryPublisher
+}
+
+func (p poisonPublisher) Publish(ctx context.Context, event model.OutboxEvent) error {
+    if event.AggregateType == model.AggregateTransaction {
+        return errors.New("connection refused")
+    }
+    return p.MemoryPublisher.Publish(ctx, event)
+}
+
+// Test that an event failing to publish is retried later without holding back the events after it,
+// and that it is parked as dead after its last attempt
+func TestOutboxRelay_RelayPending_Failure(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    publisher := poisonPublisher{events.NewMemoryPublisher()}
+    relay := NewOutboxRelay(sqlx.NewDb(db, "sqlmock"), publisher, 3)
+
+    expectClaim(mock, sqlmock.NewRows(outboxColumns).
+        AddRow(3, "transaction.completed", "transaction", "7", []byte(`{"id":7}`), 0, "", time.Now(), nil).
+        AddRow(4, "balance.changed", "wallet", "1:USD", []byte(`{"user_id":1}`), 0, "", time.Now(), nil).
+        AddRow(5, "transaction.completed", "transaction", "8", []byte(`{"id":8}`), 2, "connection refused", time.Now(), nil))
+    mock.ExpectExec("UPDATE outbox_events SET attempts = attempts \\+ 1, last_error = \\$2, claimed_until = \\$3, dead_at = CASE WHEN \\$4 THEN NOW\\(\\) END WHERE id = \\$1").
+        WithArgs(3, "connection refused", sqlmock.AnyArg(), false).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE outbox_events SET attempts = attempts \\+ 1").
+        WithArgs(5, "connection refused", sqlmock.AnyArg(), true).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE outbox_events SET published_at = NOW\\(\\)").
+        WithArgs("{4}").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    published, err := relay.RelayPending(context.Background())
+    require.ErrorContains(t, err, "failed to publish event 3, attempt 1")
+    require.Equal(t, 1, published)
+    require.Len(t, publisher.Events(), 1)
+    require.NoError(t, mock.ExpectationsWereMet())
+}
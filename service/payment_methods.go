@@ -0,0 +1,200 @@
+package service
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/shopspring/decimal"
+)
+
+// ErrPaymentMethodUnavailable is returned when a deposit or withdrawal names a payment method that is unknown,
+// disabled, or not offered for the kind of movement.
+var ErrPaymentMethodUnavailable = errors.New("payment method is not available")
+
+// ErrPaymentMethodLimit is returned when the amount is outside the limits of the payment method.
+var ErrPaymentMethodLimit = errors.New("amount is outside the limits of the payment method")
+
+// ErrInvalidPaymentDetails is returned when the payment details of a deposit or withdrawal are malformed.
+var ErrInvalidPaymentDetails = errors.New("invalid payment details")
+
+// maxBankReferenceLength matches the longest bank transfer references accepted by payment providers.
+const maxBankReferenceLength = 64
+
+// PaymentLimit bounds the amount of a single deposit or withdrawal made with a payment method in one currency.
+type PaymentLimit struct {
+    Min decimal.Decimal  `json:"min"` // The smallest amount accepted, inclusive
+    Max *decimal.Decimal `json:"max"` // The largest amount accepted, inclusive, unbounded if nil
+}
+
+// PaymentMethodConfig is the registry entry of a payment method.
+type PaymentMethodConfig struct {
+    Code            string                  `json:"code"`             // The payment method, such as credit_card or bank_transfer
+    Enabled         bool                    `json:"enabled"`          // Whether the method can be used at all
+    Deposit         bool                    `json:"deposit"`          // Whether money can be deposited with the method
+    Withdraw        bool                    `json:"withdraw"`         // Whether money can be withdrawn with the method
+    Limits          map[string]PaymentLimit `json:"limits"`           // Limits by currency, currencies without a limit are unbounded
+    AsyncSettlement bool                    `json:"async_settlement"` // Whether withdrawals stay pending, with their funds held, until the payout settles
+}
+
+// Payment names the payment method of a deposit or withdrawal and the instrument used with it.
+// An empty method selects model.DefaultPaymentMethod.
+type Payment struct {
+    Method  string
+    Details PaymentDetails
+}
+
+// PaymentDetails are the optional details of the payment instrument sent by the client.
+type PaymentDetails struct {
+    CardNumber    string `json:"card_number"`    // The full card number, only its masked form is stored
+    BankReference string `json:"bank_reference"` // The reference of the bank transfer
+    PayPalEmail   string `json:"paypal_email"`   // The PayPal account
+}
+
+// authorizedPayment is a payment that passed the registry checks, ready to be recorded with the transaction.
+type authorizedPayment struct {
+    method   string
+    metadata *model.PaymentMetadata
+    async    bool // Whether a withdrawal with the method settles asynchronously
+}
+
+// PaymentMethodRegistry holds the payment methods deposits and withdrawals can be made with.
+type PaymentMethodRegistry struct {
+    methods map[string]PaymentMethodConfig
+}
+
+// NewPaymentMethodRegistry creates a PaymentMethodRegistry from the given method configurations.
+func NewPaymentMethodRegistry(methods []PaymentMethodConfig) (*PaymentMethodRegistry, error) {
+    registry := &PaymentMethodRegistry{methods: make(map[string]PaymentMethodConfig, len(methods))}
+    for _, method := range methods {
+        method.Code = strings.ToLower(strings.TrimSpace(method.Code))
+        if method.Code == "" || method.Code == model.PaymentMethodWallet {
+            return nil, fmt.Errorf("invalid payment method code %q", method.Code)
+        }
+        if _, ok := registry.methods[method.Code]; ok {
+            return nil, fmt.Errorf("payment method %s is configured twice", method.Code)
+        }
+
+        limits := make(map[string]PaymentLimit, len(method.Limits))
+        for currency, limit := range method.Limits {
+            currency = strings.ToUpper(strings.TrimSpace(currency))
+            if _, ok := model.CurrencyScale(currency); !ok {
+                return nil, fmt.Errorf("payment method %s: %w: %s", method.Code, ErrUnsupportedCurrency, currency)
+            }
+            if limit.Min.IsNegative() || (limit.Max != nil && limit.Max.LessThan(limit.Min)) {
+                return nil, fmt.Errorf("payment method %s: invalid %s limit", method.Code, currency)
+            }
+            limits[currency] = limit
+        }
+        method.Limits = limits
+        registry.methods[method.Code] = method
+    }
+    return registry, nil
+}
+
+// DefaultPaymentMethods returns the registry used when no payment methods file is configured:
+// cards, bank transfers and PayPal, enabled for deposits and withdrawals without limits.
+// Bank transfer payouts settle asynchronously, the others settle right away.
+func DefaultPaymentMethods() *PaymentMethodRegistry {
+    var methods []PaymentMethodConfig
+    for _, code := range []string{model.PaymentMethodCreditCard, model.PaymentMethodDebitCard, model.PaymentMethodBankTransfer, model.PaymentMethodPayPal} {
+        methods = append(methods, PaymentMethodConfig{Code: code, Enabled: true, Deposit: true, Withdraw: true, AsyncSettlement: code == model.PaymentMethodBankTransfer})
+    }
+    registry, _ := NewPaymentMethodRegistry(methods)
+    return registry
+}
+
+// LoadPaymentMethodRegistry reads a JSON array of payment method configurations into a PaymentMethodRegistry.
+func LoadPaymentMethodRegistry(path string) (*PaymentMethodRegistry, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read payment methods file: %w", err)
+    }
+
+    var methods []PaymentMethodConfig
+    if err := json.Unmarshal(data, &methods); err != nil {
+        return nil, fmt.Errorf("failed to parse payment methods file %s: %w", path, err)
+    }
+    return NewPaymentMethodRegistry(methods)
+}
+
+// authorize checks that the payment method can be used for the deposit or withdrawal of the amount,
+// and returns the normalized method together with the metadata to store with the transaction.
+func (r *PaymentMethodRegistry) authorize(txType string, payment Payment, currency string, amount decimal.Decimal) (authorizedPayment, error) {
+    code := strings.ToLower(strings.TrimSpace(payment.Method))
+    if code == "" {
+        code = model.DefaultPaymentMethod
+    }
+
+    method, ok := r.methods[code]
+    if !ok || !method.Enabled || (txType == "deposit" && !method.Deposit) || (txType == "withdraw" && !method.Withdraw) {
+        return authorizedPayment{}, fmt.Errorf("%w: %s cannot be used to %s", ErrPaymentMethodUnavailable, code, txType)
+    }
+
+    if limit, ok := method.Limits[currency]; ok {
+        if amount.LessThan(limit.Min) || (limit.Max != nil && amount.GreaterThan(*limit.Max)) {
+            return authorizedPayment{}, fmt.Errorf("%w: %s %s with %s", ErrPaymentMethodLimit, amount.String(), currency, code)
+        }
+    }
+
+    metadata, err := payment.Details.metadata()
+    if err != nil {
+        return authorizedPayment{}, err
+    }
+    return authorizedPayment{method: code, metadata: metadata, async: method.AsyncSettlement}, nil
+}
+
+// metadata validates the payment details and converts them into the metadata stored with the transaction,
+// masking the card number. It returns nil if no details were given.
+func (d PaymentDetails) metadata() (*model.PaymentMetadata, error) {
+    var metadata model.PaymentMetadata
+
+    if d.CardNumber != "" {
+        digits := strings.NewReplacer(" ", "", "-", "").Replace(d.CardNumber)
+        if !validCardNumber(digits) {
+            return nil, fmt.Errorf("%w: card number", ErrInvalidPaymentDetails)
+        }
+        metadata.MaskedCard = "**** " + digits[len(digits)-4:]
+    }
+
+    metadata.BankReference = strings.TrimSpace(d.BankReference)
+    if len(metadata.BankReference) > maxBankReferenceLength {
+        return nil, fmt.Errorf("%w: bank reference is longer than %d characters", ErrInvalidPaymentDetails, maxBankReferenceLength)
+    }
+
+    metadata.PayPalEmail = strings.TrimSpace(d.PayPalEmail)
+    if metadata.PayPalEmail != "" && !strings.Contains(metadata.PayPalEmail, "@") {
+        return nil, fmt.Errorf("%w: paypal email", ErrInvalidPaymentDetails)
+    }
+
+    if metadata == (model.PaymentMetadata{}) {
+        return nil, nil
+    }
+    return &metadata, nil
+}
+
+// validCardNumber checks the length and the Luhn checksum of a card number made of digits only.
+func validCardNumber(digits string) bool {
+    if len(digits) < 12 || len(digits) > 19 {
+        return false
+    }
+
+    sum := 0
+    for i := 0; i < len(digits); i++ {
+        c := digits[len(digits)-1-i]
+        if c < '0' || c > '9' {
+            return false
+        }
+        digit := int(c - '0')
+        if i%2 == 1 {
+            digit *= 2
+            if digit > 9 {
+                digit -= 9
+            }
+        }
+        sum += digit
+    }
+    return sum%10 == 0
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// testPaymentMethods offers cards without limits, bank transfers of at least 10 USD, and PayPal for deposits of up to 500 USD only
+func testPaymentMethods(t *testing.T) *PaymentMethodRegistry {
+    maxPayPal := decimal.NewFromInt(500)
+    methods, err := NewPaymentMethodRegistry([]PaymentMethodConfig{
+        {Code: "credit_card", Enabled: true, Deposit: true, Withdraw: true},
+        {Code: "debit_card", Enabled: false, Deposit: true, Withdraw: true},
+        {Code: "bank_transfer", Enabled: true, Deposit: true, Withdraw: true, Limits: map[string]PaymentLimit{"usd": {Min: decimal.NewFromInt(10)}}},
+        {Code: "PayPal", Enabled: true, Deposit: true, Limits: map[string]PaymentLimit{"USD": {Max: &maxPayPal}}},
+    })
+    require.NoError(t, err)
+    return methods
+}
+
+// Test that only enabled methods are accepted, in the directions and within the limits they are configured for
+func TestPaymentMethodRegistry_Authorize(t *testing.T) {
+    methods := testPaymentMethods(t)
+
+    tests := []struct {
+        txType, method, currency, amount string
+        expected                         error
+    }{
+        {"deposit", "", "USD", "100", nil},                                  // Defaults to credit_card
+        {"withdraw", "Credit_Card", "USD", "100", nil},
+        {"deposit", "debit_card", "USD", "100", ErrPaymentMethodUnavailable}, // Disabled
+        {"deposit", "crypto", "USD", "100", ErrPaymentMethodUnavailable},     // Unknown
+        {"withdraw", "paypal", "USD", "100", ErrPaymentMethodUnavailable},    // Deposits only
+        {"deposit", "paypal", "USD", "500", nil},
+        {"deposit", "paypal", "USD", "500.01", ErrPaymentMethodLimit},
+        {"deposit", "paypal", "EUR", "5000", nil},                           // No limit in EUR
+        {"withdraw", "bank_transfer", "USD", "9.99", ErrPaymentMethodLimit},
+        {"withdraw", "bank_transfer", "USD", "10", nil},
+    }
+
+    for _, tt := range tests {
+        _, err := methods.authorize(tt.txType, Payment{Method: tt.method}, tt.currency, decimal.RequireFromString(tt.amount))
+        if tt.expected == nil {
+            require.NoError(t, err, "%s of %s %s with %q", tt.txType, tt.amount, tt.currency, tt.method)
+        } else {
+            require.ErrorIs(t, err, tt.expected, "%s of %s %s with %q", tt.txType, tt.amount, tt.currency, tt.method)
+        }
+    }
+}
+
+// Test that card numbers are checked and masked, and that the other details are validated
+func TestPaymentDetails_Metadata(t *testing.T) {
+    metadata, err := PaymentDetails{}.metadata()
+    require.NoError(t, err)
+    require.Nil(t, metadata)
+
+    metadata, err = PaymentDetails{CardNumber: "4242 4242 4242 4242"}.metadata()
+    require.NoError(t, err)
+    require.Equal(t, "**** 4242", metadata.MaskedCard)
+
+    metadata, err = PaymentDetails{BankReference: " INV-2024-001 ", PayPalEmail: "payer@example.com"}.metadata()
+    require.NoError(t, err)
+    require.Equal(t, model.PaymentMetadata{BankReference: "INV-2024-001", PayPalEmail: "payer@example.com"}, *metadata)
+
+    invalid := []PaymentDetails{
+        {CardNumber: "4242 4242 4242 4241"},     // Fails the Luhn check
+        {CardNumber: "4242"},                    // Too short
+        {CardNumber: "4242-4242-4242-424a"},
+        {PayPalEmail: "payer"},
+        {BankReference: string(make([]byte, maxBankReferenceLength+1))},
+    }
+    for _, details := range invalid {
+        _, err := details.metadata()
+        require.ErrorIs(t, err, ErrInvalidPaymentDetails, "%+v", details)
+    }
+}
+
+// Test that the payment methods file is parsed and rejects invalid methods and limits
+func TestLoadPaymentMethodRegistry(t *testing.T) {
+    dir := t.TempDir()
+
+    path := filepath.Join(dir, "methods.json")
+    require.NoError(t, os.WriteFile(path, []byte(`[{"code": "bank_transfer", "enabled": true, "withdraw": true, "limits": {"JPY": {"min": "1000", "max": "1000000"}}}]`), 0o600))
+    methods, err := LoadPaymentMethodRegistry(path)
+    require.NoError(t, err)
+    _, err = methods.authorize("withdraw", Payment{Method: "bank_transfer"}, "JPY", decimal.NewFromInt(999))
+    require.ErrorIs(t, err, ErrPaymentMethodLimit)
+    _, err = methods.authorize("deposit", Payment{Method: "bank_transfer"}, "JPY", decimal.NewFromInt(5000))
+    require.ErrorIs(t, err, ErrPaymentMethodUnavailable)
+
+    invalid := []string{
+        `[{"code": ""}]`,
+        `[{"code": "wallet"}]`,
+        `[{"code": "paypal"}, {"code": "PAYPAL"}]`,
+        `[{"code": "paypal", "limits": {"XXX": {"min": "1"}}}]`,
+        `[{"code": "paypal", "limits": {"USD": {"min": "10", "max": "5"}}}]`,
+    }
+    for _, methods := range invalid {
+        require.NoError(t, os.WriteFile(path, []byte(methods), 0o600))
+        _, err := LoadPaymentMethodRegistry(path)
+        require.Error(t, err, methods)
+    }
+}
+
+// Test that a deposit is recorded with its payment method and the masked card, and priced by the fee rule of the method
+func TestDepositService_Deposit_PaymentMethod(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    fees, err := NewFeeSchedule([]FeeRule{{TransactionType: "deposit", PaymentMethod: "debit_card", Flat: decimal.NewFromInt(1)}})
+    require.NoError(t, err)
+    depositService := NewDepositService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, fees, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.Zero, "active")
+    mock.ExpectExec("UPDATE wallets SET balance").
+        WithArgs(decimal.NewFromInt(49), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "deposit", "completed", decimal.NewFromInt(1), "debit_card", nil, nil, nil, nil, nil, nil, nil,
+            []byte(`{"masked_card":"**** 4242"}`), nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 1, "deposit", "system:external_funding:USD", "user:1:USD", decimal.NewFromInt(50))
+    expectLedgerMovement(mock, 1, "fee", "user:1:USD", "system:fee_revenue:USD", decimal.NewFromInt(1))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, _, err := depositService.Deposit(1, "USD", decimal.NewFromInt(50), Payment{Method: "debit_card", Details: PaymentDetails{CardNumber: "4242424242424242"}}, "")
+    require.NoError(t, err)
+    require.Equal(t, "debit_card", txn.PaymentMethod)
+    require.Equal(t, "**** 4242", txn.PaymentMetadata.MaskedCard)
+
+    // An invalid card number is rejected before the wallet is touched
+    _, _, err = depositService.Deposit(1, "USD", decimal.NewFromInt(50), Payment{Method: "debit_card", Details: PaymentDetails{CardNumber: "1234"}}, "")
+    require.ErrorIs(t, err, ErrInvalidPaymentDetails)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,360 @@
+package service
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "strconv"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/go-redis/redis/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+)
+
+// ErrRefundNotAllowed is returned when a transaction cannot be refunded, because of its type or its status.
+var ErrRefundNotAllowed = errors.New("transaction cannot be refunded")
+
+// ErrRefundExceedsOriginal is returned when a refund would give back more than the original transaction moved.
+var ErrRefundExceedsOriginal = errors.New("refund exceeds the refundable amount")
+
+// ErrRefundLimitExceeded is returned when a refund is larger than the caller may issue.
+var ErrRefundLimitExceeded = errors.New("refund exceeds the caller's refund limit")
+
+// RefundPolicy decides what happens when the user paying a refund back no longer has the money.
+type RefundPolicy string
+
+const (
+    // RefundPolicyReject rejects the refund, it is recorded as failed with the insufficient_balance reason.
+    RefundPolicyReject RefundPolicy = "reject"
+    // RefundPolicyPartial refunds only what the available balance of the paying user covers.
+    RefundPolicyPartial RefundPolicy = "partial"
+    // RefundPolicyAllowNegative refunds the whole amount, leaving the paying user with a negative balance to settle later.
+    RefundPolicyAllowNegative RefundPolicy = "allow_negative"
+)
+
+// ParseRefundPolicy checks that a refund policy is one of the supported policies, an empty one selecting RefundPolicyReject.
+func ParseRefundPolicy(policy string) (RefundPolicy, error) {
+    switch RefundPolicy(policy) {
+    case "":
+        return RefundPolicyReject, nil
+    case RefundPolicyReject, RefundPolicyPartial, RefundPolicyAllowNegative:
+        return RefundPolicy(policy), nil
+    }
+    return "", fmt.Errorf("unknown refund policy %q", policy)
+}
+
+// refundPlan describes who pays a refund back and who gets the money, 0 standing for the outside world,
+// and how much of the original transaction can be refunded in total.
+type refundPlan struct {
+    payer      int
+    payee      int
+    from       ledgerAccount
+    to         ledgerAccount
+    refundable decimal.Decimal
+}
+
+// planRefund works out how a completed transaction is refunded:
+//   - a deposit is paid back out of the user's wallet, up to the amount credited after the fee;
+//   - a transfer is paid back by the recipient to the sender, up to the amount transferred;
+//   - a capture is credited back to the user's wallet, up to the amount captured.
+// Fees are not refunded. Withdrawals are reversed through settlement, and cross-currency transfers and refunds cannot be refunded.
+func planRefund(original *model.Transaction) (refundPlan, error) {
+    if original.TransactionStatus != model.TransactionStatusCompleted {
+        return refundPlan{}, fmt.Errorf("%w: transaction %d is %s", ErrRefundNotAllowed, original.ID, original.TransactionStatus)
+    }
+
+    currency := original.Currency
+    switch original.TransactionType {
+    case "deposit":
+        return refundPlan{
+            payer:      original.FromUserID,
+            from:       userLedgerAccount(original.FromUserID, currency),
+            to:         systemLedgerAccount(model.SystemAccountExternalFunding, currency),
+            refundable: original.Amount.Sub(original.TransactionFee),
+        }, nil
+    case "transfer":
+        if original.TargetCurrency != "" && original.TargetCurrency != currency {
+            return refundPlan{}, fmt.Errorf("%w: transaction %d is a cross-currency transfer", ErrRefundNotAllowed, original.ID)
+        }
+        return refundPlan{
+            payer:      original.ToUserID,
+            payee:      original.FromUserID,
+            from:       userLedgerAccount(original.ToUserID, currency),
+            to:         userLedgerAccount(original.FromUserID, currency),
+            refundable: original.Amount,
+        }, nil
+    case "capture":
+        return refundPlan{
+            payee:      original.FromUserID,
+            from:       systemLedgerAccount(model.SystemAccountExternalPayout, currency),
+            to:         userLedgerAccount(original.FromUserID, currency),
+            refundable: original.Amount,
+        }, nil
+    }
+    return refundPlan{}, fmt.Errorf("%w: transaction %d is a %s", ErrRefundNotAllowed, original.ID, original.TransactionType)
+}
+
+// users returns the users whose balances the refund changes.
+func (p refundPlan) users() []int {
+    users := make([]int, 0, 2)
+    for _, userID := range []int{p.payer, p.payee} {
+        if userID != 0 {
+            users = append(users, userID)
+        }
+    }
+    return users
+}
+
+// idempotencyKey returns the key a refund requested with the client's key is recorded and looked up under. Keys are
+// scoped by the paying user, but captures are refunded by nobody, so the keys of their refunds are scoped by the
+// capture instead: otherwise every capture refund would share one scope, and unrelated refunds reusing a common key
+// would conflict. The client's key is hashed so that the scoped key still fits the column.
+func (p refundPlan) idempotencyKey(originalID int, key string) string {
+    if key == "" || p.payer != 0 {
+        return key
+    }
+    sum := sha256.Sum256([]byte(key))
+    return fmt.Sprintf("%srefund:%d:%s", InternalIdempotencyKeyPrefix, originalID, hex.EncodeToString(sum[:]))
+}
+
+// RefundService gives back the money of completed transactions through linked refund transactions.
+type RefundService struct {
+    walletRepo      *repository.WalletRepository
+    transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+    outboxRepo      *repository.OutboxRepository
+    dbConn          *sqlx.DB
+    redisClient     *redis.Client
+    locker          lock.Locker
+    mode            ConcurrencyMode
+    policy          RefundPolicy
+    rates           FXRateProvider
+}
+
+// NewRefundService creates a new instance of RefundService.
+// It shares the locker and the concurrency mode of the money movement services, and applies the policy
+// when the user paying a refund back cannot cover it. The rates value refunds in other currencies against refund limits.
+func NewRefundService(dbConn *sqlx.DB, redisClient *redis.Client, locker lock.Locker, mode ConcurrencyMode, policy RefundPolicy, rates FXRateProvider) *RefundService {
+    return &RefundService{
+        walletRepo:      repository.NewWalletRepository(dbConn),
+        transactionRepo: repository.NewTransactionRepository(dbConn),
+        ledgerRepo:      repository.NewLedgerRepository(dbConn),
+        outboxRepo:      repository.NewOutboxRepository(dbConn),
+        dbConn:          dbConn,
+        redisClient:     redisClient,
+        locker:          locker,
+        mode:            mode,
+        policy:          policy,
+        rates:           rates,
+    }
+}
+
+// Refund refunds the amount of a completed transaction, or all that is left to refund when the amount is zero.
+// The refund is recorded as a refund transaction linked to the original through refund_of, in the original's currency
+// and payment method, and the original's refunded_amount keeps the total refunded so that refunds never exceed it.
+// When an idempotency key is given and a refund was already recorded with it, the original refund is returned
+// and the replayed flag is set instead of refunding again, also once the original has been refunded in full.
+// The key is matched against the amount as requested, zero for the rest, not against the amount that was refunded.
+// Keys are scoped by the user paying the refund back, and by the original transaction for refunds of captures.
+// A refund larger than the limit, unless it is nil, is rejected with ErrRefundLimitExceeded. The limit is in
+// model.DefaultCurrency, and refunds in other currencies are valued in it first; those that cannot be valued are rejected.
+func (s *RefundService) Refund(ctx context.Context, transactionID int, amount decimal.Decimal, idempotencyKey string, limit *decimal.Decimal) (*model.Transaction, bool, error) {
+    // Find the users of the original transaction, whose balance locks are needed before it is locked
+    original, err := s.transactionRepo.GetTransaction(ctx, s.dbConn, transactionID)
+    if err != nil {
+        return nil, false, err
+    }
+    plan, err := planRefund(original)
+    if err != nil {
+        return nil, false, err
+    }
+    idempotencyKey = plan.idempotencyKey(original.ID, idempotencyKey)
+
+    // Return the original refund if this request is a replay of an earlier one. This is checked before the rest of an
+    // amount-less refund is worked out, since that changes with every refund and is nothing once it has been refunded
+    fingerprint := requestFingerprint("refund", plan.payer, plan.payee, original.Currency, amount, strconv.Itoa(original.ID))
+    replay, err := findReplay(ctx, s.transactionRepo, s.dbConn, plan.payer, idempotencyKey, fingerprint)
+    if err != nil {
+        return nil, false, err
+    }
+    if replay != nil {
+        return replay, true, nil
+    }
+
+    // Refund whatever is left when no amount is given
+    if amount.IsZero() {
+        amount = plan.refundable.Sub(original.RefundedAmount)
+        if !amount.IsPositive() {
+            return nil, false, fmt.Errorf("%w: transaction %d has been refunded in full", ErrRefundExceedsOriginal, transactionID)
+        }
+    }
+    if _, err := validateMoney("Refund", amount, original.Currency); err != nil {
+        return nil, false, err
+    }
+    if limit != nil {
+        if err := s.checkRefundLimit(ctx, amount, original.Currency, *limit); err != nil {
+            return nil, false, err
+        }
+    }
+
+    locks, err := lockBalances(ctx, s.locker, plan.users()...)
+    if err != nil {
+        return nil, false, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    txn, replayed, err := withConcurrencyRetry(s.mode, func() (*model.Transaction, bool, error) {
+        return s.refund(ctx, locks, original, plan, amount, idempotencyKey, fingerprint)
+    })
+    if err != nil {
+        // The attempt has been rolled back by now, so a rejected refund is recorded on its own
+        recordRejection(ctx, s.transactionRepo, s.outboxRepo, s.dbConn, refundTransaction(original, plan, amount), err)
+        return nil, false, err
+    }
+    return txn, replayed, nil
+}
+
+// checkRefundLimit checks a refund against the refund limit of the caller, which is in model.DefaultCurrency.
+func (s *RefundService) checkRefundLimit(ctx context.Context, amount decimal.Decimal, currency string, limit decimal.Decimal) error {
+    value, err := baseAmount(ctx, s.rates, amount, currency)
+    if err != nil {
+        return fmt.Errorf("%w: %s refunds cannot be valued in %s: %v", ErrRefundLimitExceeded, currency, model.DefaultCurrency, err)
+    }
+    if value.GreaterThan(limit) {
+        if currency != model.DefaultCurrency {
+            return fmt.Errorf("%w: at most %s %s, the refund is worth %s %s", ErrRefundLimitExceeded, limit.String(), model.DefaultCurrency,
+                value.StringFixed(2), model.DefaultCurrency)
+        }
+        return fmt.Errorf("%w: at most %s %s", ErrRefundLimitExceeded, limit.String(), model.DefaultCurrency)
+    }
+    return nil
+}
+
+// refundTransaction builds the record of a refund of the original transaction.
+func refundTransaction(original *model.Transaction, plan refundPlan, amount decimal.Decimal) *model.Transaction {
+    return &model.Transaction{
+        FromUserID:      plan.payer,
+        ToUserID:        plan.payee,
+        Amount:          amount,
+        Currency:        original.Currency,
+        TransactionType: "refund",
+        PaymentMethod:   original.PaymentMethod,
+        PaymentMetadata: original.PaymentMetadata,
+        RefundOf:        &original.ID,
+    }
+}
+
+// refund runs a single attempt of the refund inside one database transaction, while the user locks are held.
+// The fingerprint is that of the refund as requested.
+func (s *RefundService) refund(ctx context.Context, locks []lock.Lock, original *model.Transaction, plan refundPlan, amount decimal.Decimal, idempotencyKey, fingerprint string) (*model.Transaction, bool, error) {
+    logger := utils.GetLogger()
+
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to start transaction: %w", err)
+    }
+
+    defer func() {
+        if rErr := tx.Rollback(); rErr != nil && err == nil {
+            logger.Warnf("rollback transaction: %v", rErr)
+        }
+    }()
+
+    // Check the key again under the locks, a concurrent request with the same key may have recorded the refund meanwhile
+    replayed, err := findReplay(ctx, s.transactionRepo, tx, plan.payer, idempotencyKey, fingerprint)
+    if err != nil {
+        return nil, false, err
+    }
+    if replayed != nil {
+        return replayed, true, nil
+    }
+
+    // Lock the original transaction, so that concurrent refunds cannot exceed it together
+    locked, err := s.transactionRepo.LockTransaction(ctx, tx, original.ID)
+    if err != nil {
+        return nil, false, err
+    }
+    remaining := plan.refundable.Sub(locked.RefundedAmount)
+    if amount.GreaterThan(remaining) {
+        return nil, false, fmt.Errorf("%w: %s %s left to refund on transaction %d", ErrRefundExceedsOriginal, remaining.String(), original.Currency, original.ID)
+    }
+
+    // Take the money back from the payer, applying the refund policy if the available balance does not cover it
+    var changes []model.BalanceChange
+    if plan.payer != 0 {
+        wallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, plan.payer, original.Currency)
+        if err != nil {
+            return nil, false, err
+        }
+        if err := checkFence(ctx, s.walletRepo, tx, locks, plan.payer); err != nil {
+            return nil, false, err
+        }
+
+        if available := wallet.Available(); available.LessThan(amount) {
+            switch s.policy {
+            case RefundPolicyAllowNegative:
+            case RefundPolicyPartial:
+                if !available.IsPositive() {
+                    return nil, false, reject(model.FailureReasonInsufficientBalance, ErrInsufficientBalance)
+                }
+                amount = available
+            default:
+                return nil, false, reject(model.FailureReasonInsufficientBalance, ErrInsufficientBalance)
+            }
+        }
+
+        if err := s.walletRepo.UpdateBalance(ctx, tx, wallet.ID, wallet.Balance.Sub(amount), wallet.Version); err != nil {
+            return nil, false, err
+        }
+        changes = append(changes, balanceChange(wallet, wallet.Balance.Sub(amount)))
+    }
+
+    // Give the money back to the payee
+    if plan.payee != 0 {
+        wallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, plan.payee, original.Currency)
+        if err != nil {
+            return nil, false, err
+        }
+        if err := checkFence(ctx, s.walletRepo, tx, locks, plan.payee); err != nil {
+            return nil, false, err
+        }
+        if err := s.walletRepo.UpdateBalance(ctx, tx, wallet.ID, wallet.Balance.Add(amount), wallet.Version); err != nil {
+            return nil, false, err
+        }
+        changes = append(changes, balanceChange(wallet, wallet.Balance.Add(amount)))
+    }
+
+    // Record the refund, linked to the original transaction, and add it to the total refunded
+    txn := refundTransaction(original, plan, amount)
+    txn.TransactionStatus = model.TransactionStatusCompleted
+    if idempotencyKey != "" {
+        txn.IdempotencyKey = idempotencyKey
+        txn.RequestHash = fingerprint
+    }
+    if err := recordTransaction(ctx, s.transactionRepo, tx, txn); err != nil {
+        return nil, false, err
+    }
+    if err := s.transactionRepo.AddRefund(ctx, tx, original.ID, amount); err != nil {
+        return nil, false, err
+    }
+
+    if err := postMovement(ctx, s.ledgerRepo, tx, txn.ID, "refund", plan.from, plan.to, amount); err != nil {
+        return nil, false, fmt.Errorf("failed to post refund to the ledger: %w", err)
+    }
+    if err := recordEvents(ctx, s.outboxRepo, tx, txn, changes...); err != nil {
+        return nil, false, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+
+    invalidateBalances(ctx, s.redisClient, plan.users()...)
+
+    return txn, false, nil
+}
@@ -0,0 +1,278 @@
+package service
+
+import (
+    "context"
+    "strings"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// refundColumns are the columns selected when the original transaction of a refund is read
+var refundColumns = []string{"id", "from_user_id", "to_user_id", "amount", "currency", "transaction_type", "transaction_status", "transaction_fee", "payment_method", "refunded_amount", "created_at", "updated_at"}
+
+// expectTransferRead expects a completed 100 USD transfer from user 1 to user 2 to be read, then locked
+func expectTransferRead(mock sqlmock.Sqlmock, transactionID int, refunded decimal.Decimal) {
+    row := func() *sqlmock.Rows {
+        return sqlmock.NewRows(refundColumns).
+            AddRow(transactionID, 1, 2, decimal.NewFromInt(100), "USD", "transfer", "completed", decimal.Zero, "wallet", refunded, time.Now(), time.Now())
+    }
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(transactionID).WillReturnRows(row())
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1 FOR UPDATE").WithArgs(transactionID).WillReturnRows(row())
+}
+
+// Test which transactions can be refunded, by whom and up to which amount
+func TestPlanRefund(t *testing.T) {
+    plan, err := planRefund(&model.Transaction{ID: 1, FromUserID: 1, Amount: decimal.NewFromInt(100), Currency: "USD", TransactionType: "deposit", TransactionStatus: "completed", TransactionFee: decimal.NewFromInt(2)})
+    require.NoError(t, err)
+    require.Equal(t, []int{1}, plan.users())
+    require.Equal(t, "98", plan.refundable.String())
+
+    plan, err = planRefund(&model.Transaction{ID: 2, FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(100), Currency: "USD", TransactionType: "transfer", TransactionStatus: "completed"})
+    require.NoError(t, err)
+    require.Equal(t, 2, plan.payer)
+    require.Equal(t, 1, plan.payee)
+
+    _, err = planRefund(&model.Transaction{ID: 3, FromUserID: 1, Currency: "USD", TransactionType: "withdraw", TransactionStatus: "completed"})
+    require.ErrorIs(t, err, ErrRefundNotAllowed)
+
+    _, err = planRefund(&model.Transaction{ID: 4, FromUserID: 1, ToUserID: 2, Currency: "USD", TransactionType: "transfer", TransactionStatus: "failed"})
+    require.ErrorIs(t, err, ErrRefundNotAllowed)
+
+    _, err = planRefund(&model.Transaction{ID: 5, FromUserID: 1, ToUserID: 2, Currency: "USD", TargetCurrency: "EUR", TransactionType: "transfer", TransactionStatus: "completed"})
+    require.ErrorIs(t, err, ErrRefundNotAllowed)
+}
+
+// Test that refunds of captures are keyed per capture, since nobody pays them back, and other refunds per paying user
+func TestRefundPlan_IdempotencyKey(t *testing.T) {
+    transfer, err := planRefund(&model.Transaction{ID: 2, FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(100), Currency: "USD", TransactionType: "transfer", TransactionStatus: "completed"})
+    require.NoError(t, err)
+    require.Equal(t, "refund-1", transfer.idempotencyKey(2, "refund-1"))
+
+    capture, err := planRefund(&model.Transaction{ID: 3, FromUserID: 1, Amount: decimal.NewFromInt(40), Currency: "USD", TransactionType: "capture", TransactionStatus: "completed"})
+    require.NoError(t, err)
+    key := capture.idempotencyKey(3, "refund-1")
+    require.True(t, strings.HasPrefix(key, InternalIdempotencyKeyPrefix+"refund:3:"))
+    require.Equal(t, key, capture.idempotencyKey(3, "refund-1"))
+    require.NotEqual(t, key, capture.idempotencyKey(4, "refund-1"))
+    require.LessOrEqual(t, len(capture.idempotencyKey(3, strings.Repeat("k", 255))), 255)
+    require.Empty(t, capture.idempotencyKey(3, ""))
+}
+
+// Test that a partial refund of a transfer moves the money back from the recipient and is linked to the transfer
+func TestRefundService_Refund_Partial(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:2").SetVal(1)
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    refundService := NewRefundService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, RefundPolicyReject, nil)
+
+    expectTransferRead(mock, 5, decimal.NewFromInt(50))
+    expectHeldWalletRead(mock, 2, "USD", decimal.NewFromInt(80), decimal.Zero)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(50), sqlmock.AnyArg(), 2, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(10), decimal.Zero)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(40), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(2, 1, decimal.NewFromInt(30), "USD", "refund", "completed", decimal.Zero, "wallet", nil, nil, nil, nil, nil, nil, nil, nil, 5).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(8, time.Now(), time.Now()))
+    mock.ExpectExec("UPDATE transactions SET refunded_amount = refunded_amount \\+ \\$2").
+        WithArgs(5, decimal.NewFromInt(30)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectLedgerMovement(mock, 8, "refund", "user:2:USD", "user:1:USD", decimal.NewFromInt(30))
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, replayed, err := refundService.Refund(context.Background(), 5, decimal.NewFromInt(30), "", nil)
+    require.NoError(t, err)
+    require.False(t, replayed)
+    require.Equal(t, "refund", txn.TransactionType)
+    require.Equal(t, 5, *txn.RefundOf)
+
+    // Only 20 of the transfer is left to refund now
+    expectTransferRead(mock, 5, decimal.NewFromInt(80))
+    mock.ExpectRollback()
+
+    _, _, err = refundService.Refund(context.Background(), 5, decimal.NewFromInt(30), "", nil)
+    require.ErrorIs(t, err, ErrRefundExceedsOriginal)
+
+    // Callers with a refund limit cannot refund more than it, whatever is left
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(5).
+        WillReturnRows(sqlmock.NewRows(refundColumns).
+            AddRow(5, 1, 2, decimal.NewFromInt(100), "USD", "transfer", "completed", decimal.Zero, "wallet", decimal.NewFromInt(80), time.Now(), time.Now()))
+    limit := decimal.NewFromInt(10)
+
+    _, _, err = refundService.Refund(context.Background(), 5, decimal.Zero, "", &limit)
+    require.ErrorIs(t, err, ErrRefundLimitExceeded)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that refunds in other currencies are valued in USD before they are checked against the refund limit
+func TestRefundService_Refund_LimitInOtherCurrency(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    rates := NewStaticRateProvider(map[string]decimal.Decimal{"USD/EUR": decimal.RequireFromString("0.92")})
+    refundService := NewRefundService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, RefundPolicyReject, rates)
+
+    // A 100 EUR transfer of which 5 EUR are left to refund
+    eurTransfer := func() *sqlmock.Rows {
+        return sqlmock.NewRows(refundColumns).
+            AddRow(5, 1, 2, decimal.NewFromInt(100), "EUR", "transfer", "completed", decimal.Zero, "wallet", decimal.NewFromInt(95), time.Now(), time.Now())
+    }
+    limit := decimal.NewFromInt(10)
+
+    // 9.50 EUR are worth 10.33 USD, more than the limit of 10 USD
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(5).WillReturnRows(eurTransfer())
+
+    _, _, err = refundService.Refund(context.Background(), 5, decimal.RequireFromString("9.50"), "", &limit)
+    require.ErrorIs(t, err, ErrRefundLimitExceeded)
+    require.Contains(t, err.Error(), "10.33 USD")
+
+    // 9 EUR are worth 9.78 USD and pass the limit, to be stopped by what is left to refund
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(5).WillReturnRows(eurTransfer())
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1 FOR UPDATE").WithArgs(5).WillReturnRows(eurTransfer())
+    mock.ExpectRollback()
+
+    _, _, err = refundService.Refund(context.Background(), 5, decimal.NewFromInt(9), "", &limit)
+    require.ErrorIs(t, err, ErrRefundExceedsOriginal)
+
+    // Refunds in a currency without a rate to USD cannot be checked, and are refused to limited callers
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(6).
+        WillReturnRows(sqlmock.NewRows(refundColumns).
+            AddRow(6, 1, 2, decimal.NewFromInt(1000), "JPY", "transfer", "completed", decimal.Zero, "wallet", decimal.Zero, time.Now(), time.Now()))
+
+    _, _, err = refundService.Refund(context.Background(), 6, decimal.NewFromInt(10), "", &limit)
+    require.ErrorIs(t, err, ErrRefundLimitExceeded)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test the refund policies when the recipient of a transfer no longer has the money
+func TestRefundService_Refund_InsufficientBalance(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    locker := lock.NewLocalLocker(lock.DefaultOptions())
+
+    // Rejected, and recorded as a failed refund of the whole amount
+    refundService := NewRefundService(sqlx.NewDb(db, "sqlmock"), redisClient, locker, PessimisticConcurrency, RefundPolicyReject, nil)
+
+    expectTransferRead(mock, 5, decimal.Zero)
+    expectHeldWalletRead(mock, 2, "USD", decimal.NewFromInt(25), decimal.Zero)
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(2, 1, decimal.NewFromInt(100), "USD", "refund", "failed", decimal.Zero, "wallet", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, 5).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(8, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = refundService.Refund(context.Background(), 5, decimal.Zero, "", nil)
+    require.ErrorIs(t, err, ErrInsufficientBalance)
+
+    // Refunded as far as the available balance goes
+    mockRedis.ExpectDel("balances:2").SetVal(1)
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    refundService = NewRefundService(sqlx.NewDb(db, "sqlmock"), redisClient, locker, PessimisticConcurrency, RefundPolicyPartial, nil)
+
+    expectTransferRead(mock, 5, decimal.Zero)
+    expectHeldWalletRead(mock, 2, "USD", decimal.NewFromInt(25), decimal.NewFromInt(5))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(5), sqlmock.AnyArg(), 2, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectHeldWalletRead(mock, 1, "USD", decimal.Zero, decimal.Zero)
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(20), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(2, 1, decimal.NewFromInt(20), "USD", "refund", "completed", decimal.Zero, "wallet", nil, nil, nil, nil, nil, nil, nil, nil, 5).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(9, time.Now(), time.Now()))
+    mock.ExpectExec("UPDATE transactions SET refunded_amount").
+        WithArgs(5, decimal.NewFromInt(20)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectLedgerMovement(mock, 9, "refund", "user:2:USD", "user:1:USD", decimal.NewFromInt(20))
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, _, err := refundService.Refund(context.Background(), 5, decimal.Zero, "", nil)
+    require.NoError(t, err)
+    require.Equal(t, "20", txn.Amount.String())
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that retrying a refund without an amount replays it, even once the transfer has been refunded in full,
+// and that the key cannot be reused for a refund of a given amount
+func TestRefundService_Refund_ReplayWithoutAmount(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    refundService := NewRefundService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, RefundPolicyReject, nil)
+
+    // The refund of the rest was recorded with the key, and the transfer is refunded in full since
+    fingerprint := requestFingerprint("refund", 2, 1, "USD", decimal.Zero, "5")
+    for i := 0; i < 2; i++ {
+        mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(5).
+            WillReturnRows(sqlmock.NewRows(refundColumns).
+                AddRow(5, 1, 2, decimal.NewFromInt(100), "USD", "transfer", "completed", decimal.Zero, "wallet", decimal.NewFromInt(100), time.Now(), time.Now()))
+        mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+            WithArgs(2, "refund-5").
+            WillReturnRows(sqlmock.NewRows(idempotencyColumns).AddRow(
+                8, 2, 1, decimal.NewFromInt(70), "refund", "completed", decimal.Zero, "wallet", "refund-5", fingerprint, time.Now(), time.Now(),
+            ))
+    }
+
+    txn, replayed, err := refundService.Refund(context.Background(), 5, decimal.Zero, "refund-5", nil)
+    require.NoError(t, err)
+    require.True(t, replayed)
+    require.Equal(t, 8, txn.ID)
+    require.Equal(t, "70", txn.Amount.String())
+
+    _, _, err = refundService.Refund(context.Background(), 5, decimal.NewFromInt(70), "refund-5", nil)
+    require.ErrorIs(t, err, ErrIdempotencyKeyConflict)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
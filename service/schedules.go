@@ -0,0 +1,279 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    "github.com/yaoweihua/wallet-service/cron"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/jmoiron/sqlx"
+)
+
+// ErrInvalidSchedule is returned when a transfer schedule cannot be created as requested.
+var ErrInvalidSchedule = errors.New("invalid transfer schedule")
+
+// ErrScheduleClosed is returned when cancelling a transfer schedule that has already completed or been cancelled.
+var ErrScheduleClosed = errors.New("transfer schedule is no longer active")
+
+const (
+    // minScheduleInterval is the shortest interval a transfer can repeat on, the resolution of cron expressions.
+    minScheduleInterval = time.Minute
+    // maxScheduleDescription is the longest description kept with a schedule.
+    maxScheduleDescription = 255
+    // maxScheduleError is the longest error message kept with a failed run.
+    maxScheduleError = 255
+    // scheduleRunsShown is the number of latest runs returned with a schedule.
+    scheduleRunsShown = 100
+    // scheduleBatchSize is the number of due schedules the schedule worker executes per run.
+    scheduleBatchSize = 100
+)
+
+// recurrence is how a transfer schedule repeats: every interval, whenever the cron expression matches on the wall
+// clock of loc, or not at all.
+type recurrence struct {
+    interval time.Duration
+    cron     *cron.Schedule
+    loc      *time.Location
+}
+
+// parseRecurrence reads the recurrence of the schedule.
+func parseRecurrence(schedule *model.TransferSchedule) (*recurrence, error) {
+    loc, err := time.LoadLocation(schedule.TimeZone)
+    if err != nil {
+        return nil, fmt.Errorf("%w: unknown time zone %q", ErrInvalidSchedule, schedule.TimeZone)
+    }
+    r := &recurrence{loc: loc}
+
+    switch {
+    case schedule.Interval != "" && schedule.Cron != "":
+        return nil, fmt.Errorf("%w: give either an interval or a cron expression", ErrInvalidSchedule)
+    case schedule.Interval != "":
+        if r.interval, err = time.ParseDuration(schedule.Interval); err != nil {
+            return nil, fmt.Errorf("%w: invalid interval %q", ErrInvalidSchedule, schedule.Interval)
+        }
+        if r.interval < minScheduleInterval {
+            return nil, fmt.Errorf("%w: the interval must be at least %s", ErrInvalidSchedule, minScheduleInterval)
+        }
+    case schedule.Cron != "":
+        if r.cron, err = cron.Parse(schedule.Cron); err != nil {
+            return nil, fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+        }
+    }
+    return r, nil
+}
+
+// first returns the first occurrence of the schedule, at or after its start.
+func (r *recurrence) first(start time.Time) time.Time {
+    if r.cron != nil {
+        return r.cron.Next(start.Add(-time.Second), r.loc)
+    }
+    return start
+}
+
+// next returns the occurrence of the schedule following the one executed, or nil if the schedule has ended.
+// Occurrences that passed while the schedule was not executed, such as while the service was down, are not made up:
+// the next occurrence is the first one after now.
+func (r *recurrence) next(schedule *model.TransferSchedule, executed, now time.Time) *time.Time {
+    var next time.Time
+    switch {
+    case r.interval > 0:
+        next = executed.Add(r.interval)
+        if !next.After(now) {
+            next = next.Add(r.interval * (now.Sub(next)/r.interval + 1))
+        }
+    case r.cron != nil:
+        after := executed
+        if now.After(after) {
+            after = now
+        }
+        next = r.cron.Next(after, r.loc)
+    }
+
+    if next.IsZero() || (schedule.EndAt != nil && next.After(*schedule.EndAt)) {
+        return nil
+    }
+    return &next
+}
+
+// ScheduleService manages scheduled and recurring transfers, and executes them when they fall due.
+type ScheduleService struct {
+    scheduleRepo *repository.ScheduleRepository
+    transfers    *TransferService
+    dbConn       *sqlx.DB
+}
+
+// NewScheduleService creates a new instance of ScheduleService making the scheduled transfers through the transfer service.
+func NewScheduleService(dbConn *sqlx.DB, transfers *TransferService) *ScheduleService {
+    return &ScheduleService{
+        scheduleRepo: repository.NewScheduleRepository(dbConn),
+        transfers:    transfers,
+        dbConn:       dbConn,
+    }
+}
+
+// CreateSchedule validates and stores a new transfer schedule, and fills in its first occurrence and generated fields.
+// The schedule starts now unless StartAt is later, and its cron expression, if any, is evaluated in TimeZone, UTC
+// when empty; an empty currency selects model.DefaultCurrency. The schedule must have an occurrence before its end.
+func (s *ScheduleService) CreateSchedule(ctx context.Context, schedule *model.TransferSchedule) error {
+    if schedule.FromUserID == schedule.ToUserID {
+        return fmt.Errorf("%w: cannot transfer to the same user", ErrInvalidSchedule)
+    }
+    currency, err := validateMoney("Transfer", schedule.Amount, schedule.Currency)
+    if err != nil {
+        return err
+    }
+    schedule.Currency = currency
+
+    schedule.Description = strings.TrimSpace(schedule.Description)
+    if len(schedule.Description) > maxScheduleDescription {
+        return fmt.Errorf("%w: the description is longer than %d bytes", ErrInvalidSchedule, maxScheduleDescription)
+    }
+    schedule.Interval = strings.TrimSpace(schedule.Interval)
+    schedule.Cron = strings.TrimSpace(schedule.Cron)
+    schedule.TimeZone = strings.TrimSpace(schedule.TimeZone)
+    if schedule.TimeZone == "" {
+        schedule.TimeZone = "UTC"
+    }
+    r, err := parseRecurrence(schedule)
+    if err != nil {
+        return err
+    }
+
+    now := time.Now()
+    if schedule.StartAt.Before(now) {
+        schedule.StartAt = now
+    }
+    first := r.first(schedule.StartAt)
+    if first.IsZero() {
+        return fmt.Errorf("%w: the cron expression %q never matches", ErrInvalidSchedule, schedule.Cron)
+    }
+    if schedule.EndAt != nil && first.After(*schedule.EndAt) {
+        return fmt.Errorf("%w: the schedule ends before its first transfer", ErrInvalidSchedule)
+    }
+
+    schedule.NextRunAt = &first
+    schedule.Status = model.ScheduleStatusActive
+    return s.scheduleRepo.CreateSchedule(ctx, s.dbConn, schedule)
+}
+
+// GetSchedule retrieves the transfer schedule with the given ID together with its latest runs, newest first.
+func (s *ScheduleService) GetSchedule(ctx context.Context, scheduleID int) (*model.TransferSchedule, []model.ScheduleRun, error) {
+    schedule, err := s.scheduleRepo.GetSchedule(ctx, s.dbConn, scheduleID)
+    if err != nil {
+        return nil, nil, err
+    }
+    runs, err := s.scheduleRepo.GetRuns(ctx, s.dbConn, scheduleID, scheduleRunsShown)
+    if err != nil {
+        return nil, nil, err
+    }
+    return schedule, runs, nil
+}
+
+// GetSchedules retrieves the transfer schedules paid by the user, newest first.
+func (s *ScheduleService) GetSchedules(ctx context.Context, userID int) ([]model.TransferSchedule, error) {
+    return s.scheduleRepo.GetSchedules(ctx, s.dbConn, userID)
+}
+
+// CancelSchedule cancels an active transfer schedule, so that no further transfers are made. A transfer of the
+// schedule that is being made while it is cancelled completes first.
+func (s *ScheduleService) CancelSchedule(ctx context.Context, scheduleID int) (*model.TransferSchedule, error) {
+    var schedule *model.TransferSchedule
+    err := withTx(s.dbConn, func(tx *sqlx.Tx) error {
+        var err error
+        schedule, err = s.scheduleRepo.LockSchedule(ctx, tx, scheduleID)
+        if err != nil {
+            return err
+        }
+        if schedule.Status != model.ScheduleStatusActive {
+            return fmt.Errorf("%w: schedule %d is %s", ErrScheduleClosed, scheduleID, schedule.Status)
+        }
+
+        schedule.Status = model.ScheduleStatusCancelled
+        schedule.NextRunAt = nil
+        return s.scheduleRepo.UpdateSchedule(ctx, tx, schedule)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return schedule, nil
+}
+
+// RunDue executes up to one batch of the transfer schedules that are due, and returns how many were executed.
+func (s *ScheduleService) RunDue(ctx context.Context) (int, error) {
+    executed := 0
+    for executed < scheduleBatchSize {
+        ran, err := s.runNext(ctx, time.Now())
+        if err != nil || !ran {
+            return executed, err
+        }
+        executed++
+    }
+    return executed, nil
+}
+
+// Run executes due transfer schedules every interval until the context is cancelled.
+func (s *ScheduleService) Run(ctx context.Context, interval time.Duration) {
+    runPeriodically(ctx, "schedule", interval, s.RunDue)
+}
+
+// runNext executes the occurrence of the schedule that has been due the longest, and reports whether one was due.
+// The schedule stays locked while its transfer is made, so it is executed by one instance of the service at a time and
+// cannot be cancelled halfway. The transfer is made with an idempotency key of the occurrence: if the service stops
+// before the run is recorded, the occurrence is executed again later and the transfer already made is found instead.
+func (s *ScheduleService) runNext(ctx context.Context, now time.Time) (bool, error) {
+    ran := false
+    err := withTx(s.dbConn, func(tx *sqlx.Tx) error {
+        schedule, err := s.scheduleRepo.LockDueSchedule(ctx, tx, now)
+        if err != nil || schedule == nil {
+            return err
+        }
+        ran = true
+
+        occurrence := *schedule.NextRunAt
+        run := s.transfer(schedule, occurrence)
+        if err := s.scheduleRepo.RecordRun(ctx, tx, run); err != nil {
+            return err
+        }
+
+        r, err := parseRecurrence(schedule)
+        if err != nil {
+            // Schedules are checked when they are created, so this is only a safeguard against running one forever
+            utils.GetLogger().Errorf("Error: transfer schedule %d cannot be repeated, ending it: %v", schedule.ID, err)
+            schedule.NextRunAt = nil
+        } else {
+            schedule.NextRunAt = r.next(schedule, occurrence, now)
+        }
+        if schedule.NextRunAt == nil {
+            schedule.Status = model.ScheduleStatusCompleted
+        }
+        schedule.LastRunAt = &now
+        schedule.RunCount++
+        return s.scheduleRepo.UpdateSchedule(ctx, tx, schedule)
+    })
+    return ran, err
+}
+
+// transfer makes the transfer of one occurrence of the schedule and returns the record of the run. A rejected or
+// failed transfer is recorded as a failed run with its reason, and the schedule goes on with the next occurrence.
+func (s *ScheduleService) transfer(schedule *model.TransferSchedule, occurrence time.Time) *model.ScheduleRun {
+    run := &model.ScheduleRun{ScheduleID: schedule.ID, ScheduledFor: occurrence}
+
+    // The key is out of client reach, so the payer cannot take it up with another transfer before the occurrence is due
+    idempotencyKey := fmt.Sprintf("%sschedule:%d:%d", InternalIdempotencyKeyPrefix, schedule.ID, occurrence.Unix())
+    txn, _, err := s.transfers.Transfer(schedule.FromUserID, schedule.ToUserID, schedule.Currency, schedule.Amount, idempotencyKey)
+    if err != nil {
+        utils.GetLogger().Warnf("Warning: scheduled transfer %d for %s failed: %v", schedule.ID, occurrence.Format(time.RFC3339), err)
+        run.Status = model.ScheduleRunFailed
+        run.Error = truncateError(err, maxScheduleError)
+        run.FailureReason = rejectionReason(err)
+        return run
+    }
+
+    run.Status = model.ScheduleRunSucceeded
+    run.TransactionID = &txn.ID
+    return run
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// scheduleColumns are the columns a transfer schedule is read from
+var scheduleColumns = []string{"id", "from_user_id", "to_user_id", "amount", "currency", "description", "repeat_interval", "cron_expression", "time_zone", "start_at", "end_at", "next_run_at", "last_run_at", "run_count", "status", "created_at", "updated_at"}
+
+// Test how schedules repeat, and that occurrences missed while the service was down are not made up
+func TestRecurrence_Next(t *testing.T) {
+    executed := time.Date(2024, 11, 12, 9, 0, 0, 0, time.UTC)
+
+    // Every 24 hours, on time and after missing two days
+    schedule := &model.TransferSchedule{Interval: "24h", TimeZone: "UTC"}
+    r, err := parseRecurrence(schedule)
+    require.NoError(t, err)
+    require.Equal(t, executed.Add(24*time.Hour), *r.next(schedule, executed, executed.Add(time.Minute)))
+    require.Equal(t, executed.Add(72*time.Hour), *r.next(schedule, executed, executed.Add(50*time.Hour)))
+
+    // Not after the end
+    end := executed.Add(36 * time.Hour)
+    schedule.EndAt = &end
+    require.NotNil(t, r.next(schedule, executed, executed))
+    require.Nil(t, r.next(schedule, executed.Add(24*time.Hour), executed.Add(24*time.Hour)))
+
+    // On the first of every month at 9:00 in Berlin, which is 8:00 UTC in winter
+    schedule = &model.TransferSchedule{Cron: "0 9 1 * *", TimeZone: "Europe/Berlin"}
+    r, err = parseRecurrence(schedule)
+    require.NoError(t, err)
+    require.Equal(t, time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC), r.first(executed).UTC())
+    require.Equal(t, time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC), r.next(schedule, time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC), time.Date(2024, 12, 1, 8, 0, 5, 0, time.UTC)).UTC())
+
+    // Once
+    schedule = &model.TransferSchedule{TimeZone: "UTC"}
+    r, err = parseRecurrence(schedule)
+    require.NoError(t, err)
+    require.Equal(t, executed, r.first(executed))
+    require.Nil(t, r.next(schedule, executed, executed))
+}
+
+// Test that schedules are validated and stored with their first occurrence
+func TestScheduleService_CreateSchedule(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    scheduleService := NewScheduleService(sqlx.NewDb(db, "sqlmock"), nil)
+
+    past := time.Now().Add(-time.Hour)
+    for _, schedule := range []model.TransferSchedule{
+        {FromUserID: 1, ToUserID: 1, Amount: decimal.NewFromInt(50)},
+        {FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(50), Interval: "24h", Cron: "0 9 * * *"},
+        {FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(50), Interval: "30s"},
+        {FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(50), Cron: "0 9 * *"},
+        {FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(50), Cron: "0 0 30 2 *"},
+        {FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(50), Cron: "0 9 * * *", TimeZone: "Mars/Olympus_Mons"},
+        {FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(50), Interval: "24h", EndAt: &past},
+    } {
+        err := scheduleService.CreateSchedule(context.Background(), &schedule)
+        require.ErrorIs(t, err, ErrInvalidSchedule, schedule)
+    }
+
+    mock.ExpectQuery("INSERT INTO transfer_schedules").
+        WithArgs(1, 2, decimal.NewFromInt(50), "USD", "Rent", "", "0 9 1 * *", "Europe/Berlin", sqlmock.AnyArg(), nil, sqlmock.AnyArg(), "active").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, time.Now(), time.Now()))
+
+    schedule := &model.TransferSchedule{FromUserID: 1, ToUserID: 2, Amount: decimal.NewFromInt(50), Currency: "usd", Description: " Rent ", Cron: "0 9 1 * *", TimeZone: "Europe/Berlin"}
+    err = scheduleService.CreateSchedule(context.Background(), schedule)
+    require.NoError(t, err)
+    require.Equal(t, 3, schedule.ID)
+    require.Equal(t, model.ScheduleStatusActive, schedule.Status)
+
+    berlin, err := time.LoadLocation("Europe/Berlin")
+    require.NoError(t, err)
+    next := schedule.NextRunAt.In(berlin)
+    require.True(t, next.After(time.Now()))
+    require.Equal(t, 1, next.Day())
+    require.Equal(t, 9, next.Hour())
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that due schedules are executed through the transfer service, and every run is recorded with its outcome
+func TestScheduleService_RunDue(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    dbConn := sqlx.NewDb(db, "sqlmock")
+    transferService := NewTransferService(dbConn, redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+    scheduleService := NewScheduleService(dbConn, transferService)
+
+    now := time.Now().Truncate(time.Second)
+    daily, once := now.Add(-time.Hour), now.Add(-2*time.Minute)
+
+    // A daily transfer of 100 succeeds, and falls due again a day later
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mockRedis.ExpectDel("balances:2").SetVal(1)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transfer_schedules WHERE status = 'active' AND next_run_at <= \\$1 (.+) FOR UPDATE SKIP LOCKED").
+        WillReturnRows(sqlmock.NewRows(scheduleColumns).
+            AddRow(3, 1, 2, decimal.NewFromInt(100), "USD", "", "24h", "", "UTC", now.Add(-49*time.Hour), nil, daily, nil, 2, "active", now, now))
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, fmt.Sprintf("internal:schedule:3:%d", daily.Unix())).
+        WillReturnRows(sqlmock.NewRows(idempotencyColumns))
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectWalletRead(mock, 2, "USD", decimal.NewFromInt(150), "active")
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1").
+        WithArgs(decimal.NewFromInt(250), sqlmock.AnyArg(), 2, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(100), "USD", "transfer", "completed", decimal.Zero, "wallet", fmt.Sprintf("internal:schedule:3:%d", daily.Unix()), sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(7, time.Now(), time.Now()))
+    expectLedgerMovement(mock, 7, "transfer", "user:1:USD", "user:2:USD", decimal.NewFromInt(100))
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
+    mock.ExpectCommit()
+    mock.ExpectQuery("INSERT INTO transfer_schedule_runs").
+        WithArgs(3, daily, "succeeded", 7, "", "").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+    mock.ExpectExec("UPDATE transfer_schedules").
+        WithArgs(3, "active", daily.Add(24*time.Hour), sqlmock.AnyArg(), 3).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    // A one-off transfer of 500 is rejected, which is recorded, and completes the schedule
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transfer_schedules (.+) FOR UPDATE SKIP LOCKED").
+        WillReturnRows(sqlmock.NewRows(scheduleColumns).
+            AddRow(4, 1, 2, decimal.NewFromInt(500), "USD", "", "", "", "UTC", once, nil, once, nil, 0, "active", now, now))
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE from_user_id = \\$1 AND idempotency_key = \\$2").
+        WithArgs(1, fmt.Sprintf("internal:schedule:4:%d", once.Unix())).
+        WillReturnRows(sqlmock.NewRows(idempotencyColumns))
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(100), "active")
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(500), "USD", "transfer", "failed", decimal.Zero, "wallet", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(8, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+    mock.ExpectQuery("INSERT INTO transfer_schedule_runs").
+        WithArgs(4, once, "failed", nil, "insufficient_balance", "Insufficient balance").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(2, time.Now()))
+    mock.ExpectExec("UPDATE transfer_schedules").
+        WithArgs(4, "completed", nil, sqlmock.AnyArg(), 1).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    // Nothing else is due
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transfer_schedules (.+) FOR UPDATE SKIP LOCKED").
+        WillReturnRows(sqlmock.NewRows(scheduleColumns))
+    mock.ExpectCommit()
+
+    executed, err := scheduleService.RunDue(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 2, executed)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that an active schedule can be cancelled once
+func TestScheduleService_CancelSchedule(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    scheduleService := NewScheduleService(sqlx.NewDb(db, "sqlmock"), nil)
+
+    now := time.Now()
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transfer_schedules WHERE id = \\$1 FOR UPDATE").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows(scheduleColumns).
+            AddRow(3, 1, 2, decimal.NewFromInt(100), "USD", "", "24h", "", "UTC", now, nil, now.Add(time.Hour), nil, 0, "active", now, now))
+    mock.ExpectExec("UPDATE transfer_schedules").
+        WithArgs(3, "cancelled", nil, nil, 0).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    schedule, err := scheduleService.CancelSchedule(context.Background(), 3)
+    require.NoError(t, err)
+    require.Equal(t, model.ScheduleStatusCancelled, schedule.Status)
+    require.Nil(t, schedule.NextRunAt)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transfer_schedules WHERE id = \\$1 FOR UPDATE").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows(scheduleColumns).
+            AddRow(3, 1, 2, decimal.NewFromInt(100), "USD", "", "24h", "", "UTC", now, nil, nil, nil, 0, "cancelled", now, now))
+    mock.ExpectRollback()
+
+    _, err = scheduleService.CancelSchedule(context.Background(), 3)
+    require.ErrorIs(t, err, ErrScheduleClosed)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
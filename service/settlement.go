@@ -0,0 +1,257 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/go-redis/redis/v8"
+    "github.com/jmoiron/sqlx"
+)
+
+// ErrInvalidTransition is returned when a transaction cannot move from its current status to the requested one.
+var ErrInvalidTransition = errors.New("invalid transaction status transition")
+
+// maxFailureReasonLength is the size of the transactions.failure_reason column.
+const maxFailureReasonLength = 50
+
+// settlementTransitions is the state machine of withdrawals, listing the statuses each status can move to.
+// Completed withdrawals can only be reversed, and failed, reversed and cancelled ones are final.
+var settlementTransitions = map[string][]string{
+    model.TransactionStatusPending:    {model.TransactionStatusProcessing, model.TransactionStatusCompleted, model.TransactionStatusFailed, model.TransactionStatusCancelled},
+    model.TransactionStatusProcessing: {model.TransactionStatusCompleted, model.TransactionStatusFailed},
+    model.TransactionStatusCompleted:  {model.TransactionStatusReversed},
+}
+
+// canTransition reports whether a withdrawal can move from one status to another.
+func canTransition(from, to string) bool {
+    for _, status := range settlementTransitions[from] {
+        if status == to {
+            return true
+        }
+    }
+    return false
+}
+
+// SettlementService moves withdrawals through their settlement states, and the held funds with them.
+type SettlementService struct {
+    walletRepo      *repository.WalletRepository
+    transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+    outboxRepo      *repository.OutboxRepository
+    dbConn          *sqlx.DB
+    redisClient     *redis.Client
+    locker          lock.Locker
+    mode            ConcurrencyMode
+}
+
+// NewSettlementService creates a new instance of SettlementService.
+// It shares the locker and the concurrency mode of the money movement services, so settlements serialise with them.
+func NewSettlementService(dbConn *sqlx.DB, redisClient *redis.Client, locker lock.Locker, mode ConcurrencyMode) *SettlementService {
+    return &SettlementService{
+        walletRepo:      repository.NewWalletRepository(dbConn),
+        transactionRepo: repository.NewTransactionRepository(dbConn),
+        ledgerRepo:      repository.NewLedgerRepository(dbConn),
+        outboxRepo:      repository.NewOutboxRepository(dbConn),
+        dbConn:          dbConn,
+        redisClient:     redisClient,
+        locker:          locker,
+        mode:            mode,
+    }
+}
+
+// Settle moves a withdrawal to the given status, following the settlement state machine:
+//   - processing leaves the funds held;
+//   - completed debits the held funds from the balance and posts the payout and its fee to the ledger;
+//   - failed and cancelled release the held funds, failed is recorded with the settlement_failed reason unless another one is given;
+//   - reversed credits a completed payout and its fee back to the wallet, and reverses them in the ledger.
+// It returns repository.ErrTransactionNotFound for an unknown transaction and ErrInvalidTransition if the move is not allowed.
+func (s *SettlementService) Settle(ctx context.Context, transactionID int, status, failureReason string) (*model.Transaction, error) {
+    if len(failureReason) > maxFailureReasonLength {
+        return nil, fmt.Errorf("%w: the failure reason is longer than %d characters", ErrInvalidTransition, maxFailureReasonLength)
+    }
+
+    // Find the owner of the withdrawal, whose balance lock is needed before the transaction is locked
+    txn, err := s.transactionRepo.GetTransaction(ctx, s.dbConn, transactionID)
+    if err != nil {
+        return nil, err
+    }
+    if txn.TransactionType != "withdraw" {
+        return nil, fmt.Errorf("%w: only withdrawals are settled, transaction %d is a %s", ErrInvalidTransition, transactionID, txn.TransactionType)
+    }
+
+    locks, err := lockBalances(ctx, s.locker, txn.FromUserID)
+    if err != nil {
+        return nil, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    txn, _, err = withConcurrencyRetry(s.mode, func() (*model.Transaction, bool, error) {
+        settled, err := s.settle(ctx, locks, transactionID, status, failureReason)
+        return settled, false, err
+    })
+    return txn, err
+}
+
+// settle runs a single attempt of the settlement inside one database transaction, while the user lock is held.
+func (s *SettlementService) settle(ctx context.Context, locks []lock.Lock, transactionID int, status, failureReason string) (*model.Transaction, error) {
+    logger := utils.GetLogger()
+
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start transaction: %w", err)
+    }
+
+    defer func() {
+        if rErr := tx.Rollback(); rErr != nil && err == nil {
+            logger.Warnf("rollback transaction: %v", rErr)
+        }
+    }()
+
+    // Lock the withdrawal, so its status is the one the transition is checked against
+    txn, err := s.transactionRepo.LockTransaction(ctx, tx, transactionID)
+    if err != nil {
+        return nil, err
+    }
+    if !canTransition(txn.TransactionStatus, status) {
+        return nil, fmt.Errorf("%w: transaction %d cannot move from %s to %q", ErrInvalidTransition, transactionID, txn.TransactionStatus, status)
+    }
+
+    wallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, txn.FromUserID, txn.Currency)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkFence(ctx, s.walletRepo, tx, locks, txn.FromUserID); err != nil {
+        return nil, err
+    }
+
+    // Move the funds of the withdrawal, the amount and the fee debited together
+    debit := txn.Amount.Add(txn.TransactionFee)
+    var changes []model.BalanceChange
+    switch status {
+    case model.TransactionStatusCompleted:
+        if err := s.walletRepo.UpdateFunds(ctx, tx, wallet.ID, wallet.Balance.Sub(debit), wallet.Held.Sub(debit), wallet.Version); err != nil {
+            return nil, err
+        }
+        changes = append(changes, balanceChange(wallet, wallet.Balance.Sub(debit)))
+        if err := postPayout(ctx, s.ledgerRepo, tx, txn); err != nil {
+            return nil, err
+        }
+    case model.TransactionStatusFailed, model.TransactionStatusCancelled:
+        if err := s.walletRepo.UpdateFunds(ctx, tx, wallet.ID, wallet.Balance, wallet.Held.Sub(debit), wallet.Version); err != nil {
+            return nil, err
+        }
+        if status == model.TransactionStatusFailed && failureReason == "" {
+            failureReason = model.FailureReasonSettlementFailed
+        }
+    case model.TransactionStatusReversed:
+        if err := s.walletRepo.UpdateBalance(ctx, tx, wallet.ID, wallet.Balance.Add(debit), wallet.Version); err != nil {
+            return nil, err
+        }
+        changes = append(changes, balanceChange(wallet, wallet.Balance.Add(debit)))
+        if err := postPayoutReversal(ctx, s.ledgerRepo, tx, txn); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := s.transactionRepo.UpdateStatus(ctx, tx, txn.ID, txn.TransactionStatus, status, failureReason); err != nil {
+        return nil, err
+    }
+    txn.TransactionStatus = status
+    txn.FailureReason = failureReason
+
+    // Raise the event of the new status, and of the balance if it changed
+    if err := recordEvents(ctx, s.outboxRepo, tx, txn, changes...); err != nil {
+        return nil, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+
+    invalidateBalances(ctx, s.redisClient, txn.FromUserID)
+
+    return txn, nil
+}
+
+// SettlementProvider reports how the asynchronous payouts handed to a bank or payment service provider are doing.
+type SettlementProvider interface {
+    // Status returns the status the payout has reached, with a failure reason if it failed.
+    // Returning the current status of the transaction leaves it unchanged.
+    Status(ctx context.Context, txn *model.Transaction) (status, failureReason string, err error)
+}
+
+// DelayedSettlementProvider stands in for a real payment provider: it completes every payout once it is older than Delay.
+type DelayedSettlementProvider struct {
+    Delay time.Duration
+}
+
+// Status completes the payout once its delay has passed, and leaves it unchanged before.
+func (p DelayedSettlementProvider) Status(ctx context.Context, txn *model.Transaction) (string, string, error) {
+    if time.Since(txn.CreatedAt) < p.Delay {
+        return txn.TransactionStatus, "", nil
+    }
+    return model.TransactionStatusCompleted, "", nil
+}
+
+// settlementBatchSize is the number of unsettled payouts the settlement worker looks at per run.
+const settlementBatchSize = 100
+
+// SettlementWorker periodically asks the settlement provider about the pending and processing withdrawals,
+// and settles those whose status has changed.
+type SettlementWorker struct {
+    settlement      *SettlementService
+    transactionRepo *repository.TransactionRepository
+    provider        SettlementProvider
+    interval        time.Duration
+}
+
+// NewSettlementWorker creates a SettlementWorker checking the unsettled withdrawals with the provider every interval.
+func NewSettlementWorker(settlement *SettlementService, provider SettlementProvider, interval time.Duration) *SettlementWorker {
+    return &SettlementWorker{
+        settlement:      settlement,
+        transactionRepo: settlement.transactionRepo,
+        provider:        provider,
+        interval:        interval,
+    }
+}
+
+// Run settles withdrawals every interval until the context is cancelled.
+func (w *SettlementWorker) Run(ctx context.Context) {
+    runPeriodically(ctx, "settlement", w.interval, w.RunOnce)
+}
+
+// RunOnce checks one batch of unsettled withdrawals with the provider and returns how many changed status.
+// A withdrawal that cannot be settled is logged and left for the next run.
+func (w *SettlementWorker) RunOnce(ctx context.Context) (int, error) {
+    logger := utils.GetLogger()
+
+    transactions, err := w.transactionRepo.GetUnsettled(ctx, w.settlement.dbConn, settlementBatchSize)
+    if err != nil {
+        return 0, err
+    }
+
+    settled := 0
+    for i := range transactions {
+        txn := &transactions[i]
+        status, failureReason, err := w.provider.Status(ctx, txn)
+        if err != nil {
+            logger.Warnf("Warning: failed to get the settlement status of transaction %d: %v", txn.ID, err)
+            continue
+        }
+        if status == txn.TransactionStatus {
+            continue
+        }
+
+        if _, err := w.settlement.Settle(ctx, txn.ID, status, failureReason); err != nil {
+            logger.Warnf("Warning: failed to settle transaction %d as %s: %v", txn.ID, status, err)
+            continue
+        }
+        settled++
+    }
+    return settled, nil
+}
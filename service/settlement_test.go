@@ -0,0 +1,272 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+)
+
+// settlementColumns are the columns selected when a transaction is read for settlement
+var settlementColumns = []string{"id", "from_user_id", "to_user_id", "amount", "currency", "transaction_type", "transaction_status", "transaction_fee", "payment_method", "created_at", "updated_at"}
+
+// expectWithdrawalRead expects a 100 USD withdrawal of user 1 with a fee of 1 to be read, then locked
+func expectWithdrawalRead(mock sqlmock.Sqlmock, transactionID int, txType, status string) {
+    row := func() *sqlmock.Rows {
+        return sqlmock.NewRows(settlementColumns).
+            AddRow(transactionID, 1, 0, decimal.NewFromInt(100), "USD", txType, status, decimal.NewFromInt(1), "bank_transfer", time.Now(), time.Now())
+    }
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(transactionID).WillReturnRows(row())
+    if txType != "withdraw" {
+        return
+    }
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1 FOR UPDATE").WithArgs(transactionID).WillReturnRows(row())
+}
+
+// expectHeldWalletRead expects the user's wallet to be read with a row lock, with part of its balance held
+func expectHeldWalletRead(mock sqlmock.Sqlmock, userID int, currency string, balance, held decimal.Decimal) {
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(userID, currency).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u (.+) FOR UPDATE OF w FOR SHARE OF u").
+        WithArgs(userID, currency).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance", "held", "version", "user_status", "created_at", "updated_at"}).
+            AddRow(userID, userID, currency, balance, held, 0, "active", time.Now(), time.Now()))
+}
+
+// Test that the settlement state machine only allows the documented transitions
+func TestCanTransition(t *testing.T) {
+    require.True(t, canTransition(model.TransactionStatusPending, model.TransactionStatusProcessing))
+    require.True(t, canTransition(model.TransactionStatusPending, model.TransactionStatusCancelled))
+    require.True(t, canTransition(model.TransactionStatusProcessing, model.TransactionStatusFailed))
+    require.True(t, canTransition(model.TransactionStatusCompleted, model.TransactionStatusReversed))
+
+    require.False(t, canTransition(model.TransactionStatusProcessing, model.TransactionStatusCancelled))
+    require.False(t, canTransition(model.TransactionStatusProcessing, model.TransactionStatusPending))
+    require.False(t, canTransition(model.TransactionStatusCompleted, model.TransactionStatusFailed))
+    require.False(t, canTransition(model.TransactionStatusFailed, model.TransactionStatusCompleted))
+    require.False(t, canTransition(model.TransactionStatusCancelled, model.TransactionStatusPending))
+    require.False(t, canTransition(model.TransactionStatusPending, "settled"))
+}
+
+// Test that a bank transfer withdrawal is recorded as pending and only holds the amount and the fee
+func TestWithdrawService_Withdraw_Pending(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    fees, err := NewFeeSchedule([]FeeRule{{TransactionType: "withdraw", Flat: decimal.NewFromInt(1)}})
+    require.NoError(t, err)
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, fees, nil, nil)
+
+    mock.ExpectBegin()
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(150), decimal.NewFromInt(20))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(150), decimal.NewFromInt(121), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(100), "USD", "withdraw", "pending", decimal.NewFromInt(1), "bank_transfer", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.pending")
+    mock.ExpectCommit()
+
+    txn, _, err := withdrawService.Withdraw(1, "USD", decimal.NewFromInt(100), Payment{Method: "bank_transfer"}, "")
+    require.NoError(t, err)
+    require.Equal(t, model.TransactionStatusPending, txn.TransactionStatus)
+
+    // Held funds cannot be spent again: 150 with 121 held leaves 29 available
+    mock.ExpectBegin()
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(150), decimal.NewFromInt(121))
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(30), "USD", "withdraw", "failed", decimal.NewFromInt(1), "credit_card", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(2, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(30), Payment{}, "")
+    require.ErrorIs(t, err, ErrInsufficientBalance)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that settling a pending withdrawal as completed debits the held funds and posts the payout to the ledger
+func TestSettlementService_Settle_Completed(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    settlementService := NewSettlementService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency)
+
+    expectWithdrawalRead(mock, 7, "withdraw", "pending")
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(150), decimal.NewFromInt(101))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(49), decimal.Zero, sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectLedgerMovement(mock, 7, "withdraw", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(100))
+    expectLedgerMovement(mock, 7, "fee", "user:1:USD", "system:fee_revenue:USD", decimal.NewFromInt(1))
+    mock.ExpectExec("UPDATE transactions SET transaction_status = \\$3").
+        WithArgs(7, "pending", "completed", nil).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    txn, err := settlementService.Settle(context.Background(), 7, "completed", "")
+    require.NoError(t, err)
+    require.Equal(t, model.TransactionStatusCompleted, txn.TransactionStatus)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that a failed payout releases the held funds, and that a completed payout is credited back when reversed
+func TestSettlementService_Settle_FailedAndReversed(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    settlementService := NewSettlementService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency)
+
+    expectWithdrawalRead(mock, 7, "withdraw", "processing")
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(150), decimal.NewFromInt(101))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(150), decimal.Zero, sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE transactions SET transaction_status = \\$3").
+        WithArgs(7, "processing", "failed", "settlement_failed").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    txn, err := settlementService.Settle(context.Background(), 7, "failed", "")
+    require.NoError(t, err)
+    require.Equal(t, model.FailureReasonSettlementFailed, txn.FailureReason)
+
+    expectWithdrawalRead(mock, 8, "withdraw", "completed")
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(49), "active")
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version").
+        WithArgs(decimal.NewFromInt(150), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectLedgerMovement(mock, 8, "withdraw reversal", "system:external_payout:USD", "user:1:USD", decimal.NewFromInt(100))
+    expectLedgerMovement(mock, 8, "fee reversal", "system:fee_revenue:USD", "user:1:USD", decimal.NewFromInt(1))
+    mock.ExpectExec("UPDATE transactions SET transaction_status = \\$3").
+        WithArgs(8, "completed", "reversed", "payout_returned").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectEvents(mock, "transaction.reversed", "balance.changed")
+    mock.ExpectCommit()
+
+    _, err = settlementService.Settle(context.Background(), 8, "reversed", "payout_returned")
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that transitions outside the state machine, and transactions other than withdrawals, are rejected without moving funds
+func TestSettlementService_Settle_Invalid(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    settlementService := NewSettlementService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency)
+
+    expectWithdrawalRead(mock, 7, "withdraw", "cancelled")
+    mock.ExpectRollback()
+
+    _, err = settlementService.Settle(context.Background(), 7, "completed", "")
+    require.ErrorIs(t, err, ErrInvalidTransition)
+
+    expectWithdrawalRead(mock, 8, "deposit", "completed")
+
+    _, err = settlementService.Settle(context.Background(), 8, "reversed", "")
+    require.ErrorIs(t, err, ErrInvalidTransition)
+
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id = \\$1$").WithArgs(9).WillReturnRows(sqlmock.NewRows(settlementColumns))
+
+    _, err = settlementService.Settle(context.Background(), 9, "completed", "")
+    require.ErrorIs(t, err, repository.ErrTransactionNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that the worker settles the payouts the provider reports as completed, and leaves the others alone
+func TestSettlementWorker_RunOnce(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+
+    settlementService := NewSettlementService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency)
+    worker := NewSettlementWorker(settlementService, DelayedSettlementProvider{Delay: time.Minute}, time.Second)
+
+    mock.ExpectQuery("SELECT (.+) FROM transactions WHERE transaction_status IN \\('pending', 'processing'\\)").
+        WithArgs(settlementBatchSize).
+        WillReturnRows(sqlmock.NewRows(settlementColumns).
+            AddRow(7, 1, 0, decimal.NewFromInt(100), "USD", "withdraw", "pending", decimal.NewFromInt(1), "bank_transfer", time.Now().Add(-time.Hour), time.Now()).
+            AddRow(8, 1, 0, decimal.NewFromInt(100), "USD", "withdraw", "pending", decimal.NewFromInt(1), "bank_transfer", time.Now(), time.Now()))
+    expectWithdrawalRead(mock, 7, "withdraw", "pending")
+    expectHeldWalletRead(mock, 1, "USD", decimal.NewFromInt(202), decimal.NewFromInt(202))
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, held = \\$2").
+        WithArgs(decimal.NewFromInt(101), decimal.NewFromInt(101), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectLedgerMovement(mock, 7, "withdraw", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(100))
+    expectLedgerMovement(mock, 7, "fee", "user:1:USD", "system:fee_revenue:USD", decimal.NewFromInt(1))
+    mock.ExpectExec("UPDATE transactions SET transaction_status = \\$3").
+        WithArgs(7, "pending", "completed", nil).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectEvents(mock, "transaction.completed", "balance.changed")
+    mock.ExpectCommit()
+
+    settled, err := worker.RunOnce(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 1, settled)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+    "bufio"
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "time"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+)
+
+// ErrInvalidStatement is returned when the format, the currency or the period of a statement request is invalid.
+var ErrInvalidStatement = errors.New("invalid statement request")
+
+// Statement formats.
+const (
+    StatementFormatCSV   = "csv"   // Comma-separated values with a header row, the default
+    StatementFormatJSONL = "jsonl" // One JSON object per line
+    StatementFormatText  = "txt"   // A plain text table for reading or printing
+)
+
+// statementFlushEvery is the number of lines written between flushes, so that long statements reach the client as they are read.
+const statementFlushEvery = 100
+
+// StatementRequest selects the wallet and the period of a statement, and its format. Zero values select the defaults.
+type StatementRequest struct {
+    Currency string     // The currency of the wallet, model.DefaultCurrency when empty
+    Format   string     // One of the StatementFormat constants, StatementFormatCSV when empty
+    From     *time.Time // The start of the period, inclusive, the start of the current month (UTC) when nil
+    To       *time.Time // The end of the period, exclusive, now when nil
+}
+
+// StatementService produces account statements of user wallets from the ledger.
+type StatementService struct {
+    transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+}
+
+// NewStatementService creates a new instance of StatementService.
+func NewStatementService(dbConn *sqlx.DB) *StatementService {
+    return &StatementService{
+        transactionRepo: repository.NewTransactionRepository(dbConn),
+        ledgerRepo:      repository.NewLedgerRepository(dbConn),
+    }
+}
+
+// StatementContentType returns the media type of a statement in the format, which must have been validated.
+func StatementContentType(format string) string {
+    switch format {
+    case StatementFormatJSONL:
+        return "application/x-ndjson"
+    case StatementFormatText:
+        return "text/plain; charset=utf-8"
+    }
+    return "text/csv; charset=utf-8"
+}
+
+// Validate checks the statement request and fills in its defaults.
+// It returns ErrInvalidStatement for an unknown format, an unsupported currency or an empty period.
+func (r StatementRequest) Validate(now time.Time) (StatementRequest, error) {
+    switch r.Format {
+    case "":
+        r.Format = StatementFormatCSV
+    case StatementFormatCSV, StatementFormatJSONL, StatementFormatText:
+    default:
+        return r, fmt.Errorf("%w: format must be csv, jsonl or txt", ErrInvalidStatement)
+    }
+
+    currency, err := normalizeCurrency(r.Currency)
+    if err != nil {
+        return r, fmt.Errorf("%w: %v", ErrInvalidStatement, err)
+    }
+    r.Currency = currency
+
+    if r.To == nil {
+        to := now.UTC()
+        r.To = &to
+    }
+    if r.From == nil {
+        from := time.Date(r.To.Year(), r.To.Month(), 1, 0, 0, 0, 0, time.UTC)
+        r.From = &from
+    }
+    if !r.From.Before(*r.To) {
+        return r, fmt.Errorf("%w: from is not before to", ErrInvalidStatement)
+    }
+    return r, nil
+}
+
+// WriteStatement writes the statement of the user's wallet to w: the balance at the start of the period,
+// every change of the balance during the period with the running balance after it, and the balance at the end.
+// The lines are streamed from the repository as they are read, so statements of any length are written without
+// holding them in memory. Nothing is written to w if the request is invalid or the opening balance cannot be read.
+func (s *StatementService) WriteStatement(ctx context.Context, userID int, req StatementRequest, w io.Writer) error {
+    req, err := req.Validate(time.Now())
+    if err != nil {
+        return err
+    }
+
+    code := model.UserAccountCode(userID, req.Currency)
+    opening, err := s.ledgerRepo.GetAccountBalanceAt(ctx, code, *req.From)
+    if err != nil {
+        return fmt.Errorf("failed to get the opening balance: %w", err)
+    }
+
+    out := newStatementWriter(req.Format, w)
+    if err := out.open(userID, req, opening); err != nil {
+        return err
+    }
+
+    balance := opening
+    written := 0
+    err = s.transactionRepo.StreamStatement(ctx, userID, req.Currency, *req.From, *req.To, func(line *model.StatementLine) error {
+        balance = balance.Add(line.Amount)
+        line.Balance = balance
+        if err := out.line(line); err != nil {
+            return err
+        }
+        written++
+        if written%statementFlushEvery == 0 {
+            return out.flush()
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    if err := out.close(req, balance); err != nil {
+        return err
+    }
+    return out.flush()
+}
+
+// statementWriter writes a statement in one of the formats.
+type statementWriter interface {
+    open(userID int, req StatementRequest, opening decimal.Decimal) error
+    line(line *model.StatementLine) error
+    close(req StatementRequest, closing decimal.Decimal) error
+    flush() error
+}
+
+// newStatementWriter returns the writer of the format, which must have been validated.
+func newStatementWriter(format string, w io.Writer) statementWriter {
+    switch format {
+    case StatementFormatJSONL:
+        return &jsonlStatementWriter{w: bufio.NewWriter(w)}
+    case StatementFormatText:
+        return &textStatementWriter{w: bufio.NewWriter(w)}
+    }
+    return &csvStatementWriter{w: csv.NewWriter(w)}
+}
+
+// statementTransactionID formats the transaction of a line, empty for entries without one.
+func statementTransactionID(line *model.StatementLine) string {
+    if line.TransactionID == nil {
+        return ""
+    }
+    return strconv.Itoa(*line.TransactionID)
+}
+
+// csvStatementWriter writes a header row, then one row per line, the opening and closing balances as rows of their own.
+type csvStatementWriter struct {
+    w *csv.Writer
+}
+
+func (s *csvStatementWriter) open(_ int, req StatementRequest, opening decimal.Decimal) error {
+    if err := s.w.Write([]string{"date", "entry_id", "transaction_id", "type", "description", "amount", "balance"}); err != nil {
+        return err
+    }
+    return s.w.Write([]string{req.From.UTC().Format(time.RFC3339), "", "", "", "opening balance", "", opening.String()})
+}
+
+func (s *csvStatementWriter) line(line *model.StatementLine) error {
+    return s.w.Write([]string{
+        line.CreatedAt.UTC().Format(time.RFC3339), strconv.Itoa(line.EntryID), statementTransactionID(line),
+        line.TransactionType, line.Description, line.Amount.String(), line.Balance.String(),
+    })
+}
+
+func (s *csvStatementWriter) close(req StatementRequest, closing decimal.Decimal) error {
+    return s.w.Write([]string{req.To.UTC().Format(time.RFC3339), "", "", "", "closing balance", "", closing.String()})
+}
+
+func (s *csvStatementWriter) flush() error {
+    s.w.Flush()
+    return s.w.Error()
+}
+
+// statementBalanceRecord is the opening_balance or closing_balance record of a JSON Lines statement.
+type statementBalanceRecord struct {
+    Record   string          `json:"record"`
+    UserID   int             `json:"user_id"`
+    Currency string          `json:"currency"`
+    At       time.Time       `json:"at"`
+    Balance  decimal.Decimal `json:"balance"`
+}
+
+// statementEntryRecord is an entry record of a JSON Lines statement, one per line.
+type statementEntryRecord struct {
+    Record string `json:"record"`
+    *model.StatementLine
+}
+
+// jsonlStatementWriter writes an opening_balance record, one entry record per line and a closing_balance record.
+type jsonlStatementWriter struct {
+    w      *bufio.Writer
+    userID int
+}
+
+func (s *jsonlStatementWriter) write(record interface{}) error {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    if _, err := s.w.Write(append(data, '\n')); err != nil {
+        return err
+    }
+    return nil
+}
+
+func (s *jsonlStatementWriter) open(userID int, req StatementRequest, opening decimal.Decimal) error {
+    s.userID = userID
+    return s.write(statementBalanceRecord{Record: "opening_balance", UserID: userID, Currency: req.Currency, At: req.From.UTC(), Balance: opening})
+}
+
+func (s *jsonlStatementWriter) line(line *model.StatementLine) error {
+    return s.write(statementEntryRecord{Record: "entry", StatementLine: line})
+}
+
+func (s *jsonlStatementWriter) close(req StatementRequest, closing decimal.Decimal) error {
+    return s.write(statementBalanceRecord{Record: "closing_balance", UserID: s.userID, Currency: req.Currency, At: req.To.UTC(), Balance: closing})
+}
+
+func (s *jsonlStatementWriter) flush() error {
+    return s.w.Flush()
+}
+
+// textStatementWriter writes a fixed-width table between a heading with the opening balance and a footer with the closing balance.
+type textStatementWriter struct {
+    w *bufio.Writer
+}
+
+// textStatementRow is the layout of the rows of a plain text statement.
+const textStatementRow = "%-20s  %-10s  %-14s  %-10s  %-24s  %16s  %16s\n"
+
+func (s *textStatementWriter) open(userID int, req StatementRequest, opening decimal.Decimal) error {
+    _, err := fmt.Fprintf(s.w, "Statement of user %d, %s wallet\nPeriod: %s to %s\nOpening balance: %s\n\n"+textStatementRow,
+        userID, req.Currency, req.From.UTC().Format(time.RFC3339), req.To.UTC().Format(time.RFC3339), opening.String(),
+        "Date", "Entry", "Transaction", "Type", "Description", "Amount", "Balance")
+    return err
+}
+
+func (s *textStatementWriter) line(line *model.StatementLine) error {
+    _, err := fmt.Fprintf(s.w, textStatementRow,
+        line.CreatedAt.UTC().Format(time.RFC3339), strconv.Itoa(line.EntryID), statementTransactionID(line),
+        line.TransactionType, line.Description, line.Amount.String(), line.Balance.String())
+    return err
+}
+
+func (s *textStatementWriter) close(_ StatementRequest, closing decimal.Decimal) error {
+    _, err := fmt.Fprintf(s.w, "\nClosing balance: %s\n", closing.String())
+    return err
+}
+
+func (s *textStatementWriter) flush() error {
+    return s.w.Flush()
+}
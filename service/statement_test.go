@@ -0,0 +1,88 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "strings"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+)
+
+// statementColumns are the columns selected for the lines of a statement
+var statementColumns = []string{"entry_id", "transaction_id", "transaction_type", "description", "amount", "created_at"}
+
+// expectStatement expects the statement of user 1's USD wallet over the period to be read, opening at 100
+// with a deposit of 50 and a transfer of 30 to another user
+func expectStatement(mock sqlmock.Sqlmock, from, to time.Time) {
+    mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\) (.+) WHERE a.code = \\$1 AND je.created_at < \\$2").
+        WithArgs("user:1:USD", from).
+        WillReturnRows(sqlmock.NewRows([]string{"coalesce"}).AddRow(decimal.NewFromInt(100)))
+    mock.ExpectQuery("SELECT (.+) FROM postings p (.+) WHERE a.code = \\$1 AND je.created_at >= \\$2 AND je.created_at < \\$3 (.+) ORDER BY je.created_at, je.id").
+        WithArgs("user:1:USD", from, to).
+        WillReturnRows(sqlmock.NewRows(statementColumns).
+            AddRow(11, 4, "deposit", "deposit", decimal.NewFromInt(50), from.Add(time.Hour)).
+            AddRow(12, 5, "transfer", "transfer", decimal.NewFromInt(-30), from.Add(2*time.Hour)))
+}
+
+// Test that a statement carries the opening balance, the running balance of every line and the closing balance
+func TestStatementService_WriteStatement(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    statementService := NewStatementService(sqlx.NewDb(db, "sqlmock"))
+    from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    to := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+    expectStatement(mock, from, to)
+    var out bytes.Buffer
+    err = statementService.WriteStatement(context.Background(), 1, StatementRequest{From: &from, To: &to}, &out)
+    require.NoError(t, err)
+    require.Equal(t, strings.Join([]string{
+        "date,entry_id,transaction_id,type,description,amount,balance",
+        "2024-01-01T00:00:00Z,,,,opening balance,,100",
+        "2024-01-01T01:00:00Z,11,4,deposit,deposit,50,150",
+        "2024-01-01T02:00:00Z,12,5,transfer,transfer,-30,120",
+        "2024-02-01T00:00:00Z,,,,closing balance,,120",
+        "",
+    }, "\n"), out.String())
+
+    expectStatement(mock, from, to)
+    out.Reset()
+    err = statementService.WriteStatement(context.Background(), 1, StatementRequest{Format: StatementFormatJSONL, From: &from, To: &to}, &out)
+    require.NoError(t, err)
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    require.Len(t, lines, 4)
+    require.JSONEq(t, `{"record":"opening_balance","user_id":1,"currency":"USD","at":"2024-01-01T00:00:00Z","balance":"100"}`, lines[0])
+    require.Contains(t, lines[2], `"amount":"-30","balance":"120"`)
+    require.JSONEq(t, `{"record":"closing_balance","user_id":1,"currency":"USD","at":"2024-02-01T00:00:00Z","balance":"120"}`, lines[3])
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that invalid statement requests are rejected before anything is read or written
+func TestStatementRequest_Validate(t *testing.T) {
+    now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+
+    req, err := StatementRequest{}.Validate(now)
+    require.NoError(t, err)
+    require.Equal(t, StatementFormatCSV, req.Format)
+    require.Equal(t, "USD", req.Currency)
+    require.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), *req.From)
+    require.Equal(t, now, *req.To)
+
+    _, err = StatementRequest{Format: "pdf"}.Validate(now)
+    require.ErrorIs(t, err, ErrInvalidStatement)
+
+    _, err = StatementRequest{Currency: "XYZ"}.Validate(now)
+    require.ErrorIs(t, err, ErrInvalidStatement)
+
+    from := now.Add(time.Hour)
+    _, err = StatementRequest{From: &from}.Validate(now)
+    require.ErrorIs(t, err, ErrInvalidStatement)
+}
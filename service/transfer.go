@@ -2,81 +2,189 @@ package service
 
 import (
     "context"
+    "errors"
     "fmt"
-    "sync"
+    "time"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/repository"
     "github.com/yaoweihua/wallet-service/utils"
     "github.com/shopspring/decimal"
     "github.com/jmoiron/sqlx"
     "github.com/go-redis/redis/v8"
-    "time"
 )
 
 // TransferService handles fund transfers, including balance updates and transaction records.
 type TransferService struct {
     walletRepo      *repository.WalletRepository
     transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+    outboxRepo      *repository.OutboxRepository
+    fxRepo          *repository.FXRepository
+    limitRepo       *repository.LimitRepository
     dbConn          *sqlx.DB
     redisClient     *redis.Client
+    locker          lock.Locker
+    mode            ConcurrencyMode
+    fees            *FeeSchedule
+    limits          *LimitSchedule
 }
 
 // NewTransferService initializes and returns a TransferService instance with
-// the required repositories and database/Redis clients.
-func NewTransferService(dbConn *sqlx.DB, redisClient *redis.Client) *TransferService {
+// the required repositories, database/Redis clients, the locker guarding user balances
+// the concurrency mode protecting balance updates in the database, the fee schedule pricing transfers
+// and the transaction limits of the senders, nil for none.
+func NewTransferService(dbConn *sqlx.DB, redisClient *redis.Client, locker lock.Locker, mode ConcurrencyMode, fees *FeeSchedule, limits *LimitSchedule) *TransferService {
     walletRepo := repository.NewWalletRepository(dbConn)
     transactionRepo := repository.NewTransactionRepository(dbConn)
+    ledgerRepo := repository.NewLedgerRepository(dbConn)
 
     return &TransferService{
         walletRepo:      walletRepo,
         transactionRepo: transactionRepo,
+        ledgerRepo:      ledgerRepo,
+        outboxRepo:      repository.NewOutboxRepository(dbConn),
+        fxRepo:          repository.NewFXRepository(dbConn),
+        limitRepo:       repository.NewLimitRepository(dbConn),
         dbConn:          dbConn,
         redisClient:     redisClient,
+        locker:          locker,
+        mode:            mode,
+        fees:            fees,
+        limits:          limits,
     }
 }
 
-// Transfer handles the transfer logic
-func (s *TransferService) Transfer(fromUserID, toUserID int, amount decimal.Decimal) error {
+// Transfer handles the transfer logic, moving the amount between both users' wallets in the given currency.
+// Transfers between currencies go through an FX quote, see TransferQuoted. The sender pays the transfer fee on top of the amount,
+// and the transfer must stay within the transaction limits of the sender, see LimitSchedule.
+// The recipient's wallet is opened if they do not hold the currency yet; an empty currency selects model.DefaultCurrency.
+// When an idempotency key is given and a transfer was already recorded with it, the original
+// transaction is returned and the replayed flag is set instead of moving the money again.
+func (s *TransferService) Transfer(fromUserID, toUserID int, currency string, amount decimal.Decimal, idempotencyKey string) (*model.Transaction, bool, error) {
     if fromUserID == toUserID {
-        return fmt.Errorf("cannot transfer to the same user")
+        return nil, false, fmt.Errorf("cannot transfer to the same user")
     }
 
-    // Acquire the locks for the transferring-out and receiving users. Lock them in the order of user IDs to avoid deadlocks
-    lockFrom, _ := transferLocks.LoadOrStore(fromUserID, &sync.Mutex{})
-    lockTo, _ := transferLocks.LoadOrStore(toUserID, &sync.Mutex{})
+    // Acquire the locks for the transferring-out and receiving users. They are locked in a fixed key order to avoid deadlocks
+    ctx := context.Background()
+    locks, err := lockBalances(ctx, s.locker, fromUserID, toUserID)
+    if err != nil {
+        return nil, false, err
+    }
+    defer unlockBalances(ctx, locks)
 
-    // Lock in the order of user IDs to avoid deadlocks
-    if fromUserID < toUserID {
-        lockFrom.(*sync.Mutex).Lock()
-        lockTo.(*sync.Mutex).Lock()
-    } else {
-        lockTo.(*sync.Mutex).Lock()
-        lockFrom.(*sync.Mutex).Lock()
+    // Check whether the transfer amount is reasonable and fits the currency
+    currency, err = validateMoney("Transfer", amount, currency)
+    if err != nil {
+        return nil, false, err
+    }
+
+    return s.execute(ctx, locks, fromUserID, toUserID, transferLegs{
+        sourceCurrency: currency,
+        sourceAmount:   amount,
+        targetCurrency: currency,
+        targetAmount:   amount,
+        fee:            s.fees.Calculate("transfer", model.PaymentMethodWallet, currency, amount),
+    }, idempotencyKey)
+}
+
+// TransferQuoted executes an FX quote, debiting the quoted source amount from the sender's wallet in the source currency
+// and crediting the quoted target amount to the recipient's wallet in the target currency. A quote can only be executed
+// once, by the user it was issued to and before it expires. The fee is charged in the source currency. Replaying the
+// idempotency key of an executed quote returns the original transaction even after the quote has expired.
+func (s *TransferService) TransferQuoted(fromUserID, toUserID, quoteID int, idempotencyKey string) (*model.Transaction, bool, error) {
+    if fromUserID == toUserID {
+        return nil, false, fmt.Errorf("cannot transfer to the same user")
     }
-    defer lockFrom.(*sync.Mutex).Unlock()
-    defer lockTo.(*sync.Mutex).Unlock()
 
-    // Check whether the deposit amount is reasonable
-    if amount.LessThanOrEqual(decimal.Zero) {
-        return fmt.Errorf("Transfer amount must be greater than zero")
+    ctx := context.Background()
+    quote, err := s.fxRepo.GetQuote(ctx, s.dbConn, quoteID)
+    if err != nil {
+        return nil, false, err
+    }
+    // Quotes issued to other users are treated as unknown, so their existence is not revealed
+    if quote.UserID != fromUserID {
+        return nil, false, fmt.Errorf("%w: %d", repository.ErrQuoteNotFound, quoteID)
     }
 
-    // Call the transferAmount function to handle balance checking, update, and transaction recording
-    if err := s.transferAmount(fromUserID, toUserID, amount, "completed"); err != nil {
-        return err
+    locks, err := lockBalances(ctx, s.locker, fromUserID, toUserID)
+    if err != nil {
+        return nil, false, err
+    }
+    defer unlockBalances(ctx, locks)
+
+    return s.execute(ctx, locks, fromUserID, toUserID, transferLegs{
+        sourceCurrency: quote.SourceCurrency,
+        sourceAmount:   quote.SourceAmount,
+        targetCurrency: quote.TargetCurrency,
+        targetAmount:   quote.TargetAmount,
+        fee:            s.fees.Calculate("transfer", model.PaymentMethodWallet, quote.SourceCurrency, quote.SourceAmount),
+        quote:          quote,
+    }, idempotencyKey)
+}
+
+// transferLegs describes what a transfer debits from the sender and credits to the recipient.
+// Both legs are equal for a transfer within one currency, a cross-currency transfer converts at the rate of its quote.
+type transferLegs struct {
+    sourceCurrency string
+    sourceAmount   decimal.Decimal
+    targetCurrency string
+    targetAmount   decimal.Decimal
+    fee            decimal.Decimal // Charged to the sender in the source currency, on top of the source amount
+    quote          *model.FXQuote // The executed FX quote, nil for a transfer within one currency
+}
+
+// fingerprint builds the idempotency fingerprint of the transfer. A quoted transfer is identified by its quote.
+func (l transferLegs) fingerprint(fromUserID, toUserID int) string {
+    if l.quote != nil {
+        return requestFingerprint(fmt.Sprintf("transfer:quote:%d", l.quote.ID), fromUserID, toUserID, l.sourceCurrency, l.sourceAmount)
+    }
+    return requestFingerprint("transfer", fromUserID, toUserID, l.sourceCurrency, l.sourceAmount)
+}
+
+// transaction builds the transaction record of the transfer, paid from the sender's wallet and carrying the target leg and the rate of a quoted transfer.
+func (l transferLegs) transaction(fromUserID, toUserID int) *model.Transaction {
+    txn := &model.Transaction{
+        FromUserID:      fromUserID,
+        ToUserID:        toUserID,
+        Amount:          l.sourceAmount,
+        Currency:        l.sourceCurrency,
+        TransactionType: "transfer",
+        TransactionFee:  l.fee,
+        PaymentMethod:   model.PaymentMethodWallet,
     }
+    if l.quote != nil {
+        txn.TargetAmount = &l.quote.TargetAmount
+        txn.TargetCurrency = l.quote.TargetCurrency
+        txn.FXRate = &l.quote.Rate
+        txn.FXQuoteID = &l.quote.ID
+    }
+    return txn
+}
 
-    return nil
+// execute runs the transfer attempts and records the transfer as failed if it was rejected.
+func (s *TransferService) execute(ctx context.Context, locks []lock.Lock, fromUserID, toUserID int, legs transferLegs, idempotencyKey string) (*model.Transaction, bool, error) {
+    // Call the transferAmount function to handle balance checking, update, and transaction recording
+    txn, replayed, err := withConcurrencyRetry(s.mode, func() (*model.Transaction, bool, error) {
+        return s.transferAmount(ctx, locks, fromUserID, toUserID, legs, model.TransactionStatusCompleted, idempotencyKey)
+    })
+    if err != nil {
+        // The attempt has been rolled back by now, so a rejected transfer is recorded on its own
+        recordRejection(ctx, s.transactionRepo, s.outboxRepo, s.dbConn, legs.transaction(fromUserID, toUserID), err)
+        return nil, false, err
+    }
+    return txn, replayed, nil
 }
 
 // transferAmount handles the core operations of transferring an amount, including balance check, balance update, and transaction recording.
-func (s *TransferService) transferAmount(fromUserID, toUserID int, amount decimal.Decimal, status string) error {
+func (s *TransferService) transferAmount(ctx context.Context, locks []lock.Lock, fromUserID, toUserID int, legs transferLegs, status string, idempotencyKey string) (*model.Transaction, bool, error) {
     // Begin the database transaction
     logger := utils.GetLogger()
     conn := s.dbConn
-    ctx := context.Background()
     tx, err := conn.Beginx()
     if err != nil {
-        return fmt.Errorf("failed to start transaction: %w", err)
+        return nil, false, fmt.Errorf("failed to start transaction: %w", err)
     }
 
     defer func() {
@@ -86,61 +194,128 @@ func (s *TransferService) transferAmount(fromUserID, toUserID int, amount decima
         }
     }()
 
-    // Retrieve the balance of the transferring-out user
-    fromUser, err := s.walletRepo.GetUserBalance(ctx, fromUserID)
+    // Return the original transfer if this request is a replay of an earlier one
+    fingerprint := legs.fingerprint(fromUserID, toUserID)
+    replayed, err := findReplay(ctx, s.transactionRepo, tx, fromUserID, idempotencyKey, fingerprint)
     if err != nil {
-        _ = s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", "failed")
-        return fmt.Errorf("failed to get balance for user %d: %w", fromUserID, err)
+        return nil, false, err
+    }
+    if replayed != nil {
+        return replayed, true, nil
+    }
+
+    // A quote can only be executed once and only before it expires
+    if legs.quote != nil {
+        if legs.quote.UsedAt != nil {
+            return nil, false, fmt.Errorf("%w: %d", repository.ErrQuoteUsed, legs.quote.ID)
+        }
+        if legs.quote.Expired(time.Now()) {
+            return nil, false, fmt.Errorf("%w: %d", ErrQuoteExpired, legs.quote.ID)
+        }
+    }
+
+    // Retrieve the balance of the transferring-out user's wallet
+    fromWallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, fromUserID, legs.sourceCurrency)
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to get balance for user %d: %w", fromUserID, err)
     }
 
-    // Check whether the balance is sufficient
-    if fromUser.Balance.LessThan(amount) {
-        _ = s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", "failed")
-        return fmt.Errorf("Insufficient balance")
+    // Suspended accounts cannot send money
+    if err := checkCanSend(fromWallet); err != nil {
+        return nil, false, err
+    }
+
+    // Check whether the part of the balance not held for pending withdrawals covers the amount and the fee
+    debit := legs.sourceAmount.Add(legs.fee)
+    if fromWallet.Available().LessThan(debit) {
+        return nil, false, reject(model.FailureReasonInsufficientBalance, ErrInsufficientBalance)
+    }
+
+    // Ensure that the transfer stays within the limits of the sender's KYC tier, and count it towards them
+    if err := s.limits.enforce(ctx, s.limitRepo, tx, fromWallet, "transfer", legs.sourceAmount, time.Now()); err != nil {
+        return nil, false, err
+    }
+
+    // Make sure the balance locks have not been taken over by another request in the meantime
+    if err := checkFence(ctx, s.walletRepo, tx, locks, fromUserID); err != nil {
+        return nil, false, err
     }
 
     // Deduct the balance of the transferring-out user
-    newFromBalance := fromUser.Balance.Sub(amount)
-    if err := s.walletRepo.UpdateBalance(ctx, tx, fromUserID, newFromBalance); err != nil {
-        _ = s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", "failed")
-        return fmt.Errorf("failed to update balance for user %d: %w", fromUserID, err)
+    newFromBalance := fromWallet.Balance.Sub(debit)
+    if err := s.walletRepo.UpdateBalance(ctx, tx, fromWallet.ID, newFromBalance, fromWallet.Version); err != nil {
+        return nil, false, fmt.Errorf("failed to update balance for user %d: %w", fromUserID, err)
     }
 
-    // Retrieve the balance of the receiving user
-    toUser, err := s.walletRepo.GetUserBalance(ctx, toUserID)
+    // Retrieve the balance of the receiving user's wallet
+    toWallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, toUserID, legs.targetCurrency)
     if err != nil {
-        _ = s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", "failed")
-        return fmt.Errorf("failed to get balance for user %d: %w", toUserID, err)
+        err = fmt.Errorf("failed to get balance for user %d: %w", toUserID, err)
+        if errors.Is(err, repository.ErrUserNotFound) {
+            return nil, false, reject(model.FailureReasonUnknownRecipient, err)
+        }
+        return nil, false, err
+    }
+
+    // Inactive accounts cannot receive money
+    if err := checkCanReceive(toWallet); err != nil {
+        return nil, false, err
+    }
+
+    if err := checkFence(ctx, s.walletRepo, tx, locks, toUserID); err != nil {
+        return nil, false, err
     }
 
     // Increase the balance of the receiving user
-    newToBalance := toUser.Balance.Add(amount)
-    if err := s.walletRepo.UpdateBalance(ctx, tx, toUserID, newToBalance); err != nil {
-        _ = s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", "failed")
-        return fmt.Errorf("failed to update balance for user %d: %w", toUserID, err)
+    newToBalance := toWallet.Balance.Add(legs.targetAmount)
+    if err := s.walletRepo.UpdateBalance(ctx, tx, toWallet.ID, newToBalance, toWallet.Version); err != nil {
+        return nil, false, fmt.Errorf("failed to update balance for user %d: %w", toUserID, err)
     }
 
     // Record the transaction between the transferring-out user and the receiving user
-    if err := s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", status); err != nil {
-        _ = s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", "failed")
-        return fmt.Errorf("failed to record transaction for user %d: %w", fromUserID, err)
+    txn := legs.transaction(fromUserID, toUserID)
+    txn.TransactionStatus = status
+    if idempotencyKey != "" {
+        txn.IdempotencyKey = idempotencyKey
+        txn.RequestHash = fingerprint
+    }
+    if err := recordTransaction(ctx, s.transactionRepo, tx, txn); err != nil {
+        if errors.Is(err, ErrIdempotencyKeyConflict) {
+            return nil, false, err
+        }
+        return nil, false, fmt.Errorf("failed to record transaction for user %d: %w", fromUserID, err)
     }
 
-    // Commit the transaction if everything went fine
-    if err := tx.Commit(); err != nil {
-        _ = s.transactionRepo.RecordTransaction(ctx, tx, fromUserID, toUserID, amount, "transfer", "failed")
-        return fmt.Errorf("failed to commit transaction: %w", err)
+    // Post the transfer to the ledger, moving the amount between both users' accounts.
+    // A quoted transfer is consumed in the same transaction and posts both legs through the FX clearing accounts
+    from, to := userLedgerAccount(fromUserID, legs.sourceCurrency), userLedgerAccount(toUserID, legs.targetCurrency)
+    if legs.quote != nil {
+        if err := s.fxRepo.MarkQuoteUsed(ctx, tx, legs.quote.ID, txn.ID); err != nil {
+            return nil, false, err
+        }
+        err = postConversion(ctx, s.ledgerRepo, tx, txn.ID, "fx transfer", from, to, legs.sourceAmount, legs.targetAmount)
+    } else {
+        err = postMovement(ctx, s.ledgerRepo, tx, txn.ID, "transfer", from, to, legs.sourceAmount)
+    }
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to post transfer to the ledger: %w", err)
+    }
+    if err := postFee(ctx, s.ledgerRepo, tx, txn.ID, fromUserID, legs.sourceCurrency, legs.fee); err != nil {
+        return nil, false, fmt.Errorf("failed to post transfer fee to the ledger: %w", err)
     }
 
-    // Update the Redis cache
-    cacheFrom := fmt.Sprintf("balance:%d", fromUserID)
-    cacheTo := fmt.Sprintf("balance:%d", toUserID)
-    if err := s.redisClient.Set(ctx, cacheFrom, newFromBalance.String(), time.Second*3600); err != nil {
-        logger.Warnf("Warning: failed to cache balance for user %d: %v", fromUserID, err)
+    // Raise the events of the transfer and of both balances for downstream systems
+    if err := recordEvents(ctx, s.outboxRepo, tx, txn, balanceChange(fromWallet, newFromBalance), balanceChange(toWallet, newToBalance)); err != nil {
+        return nil, false, err
     }
-    if err := s.redisClient.Set(ctx, cacheTo, newToBalance.String(), time.Second*3600); err != nil {
-        logger.Warnf("Warning: failed to cache balance for user %d: %v", toUserID, err)
+
+    // Commit the transaction if everything went fine
+    if err := tx.Commit(); err != nil {
+        return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
     }
 
-    return nil
+    // Evict the cached balances of both users, they are read from the database again on the next request
+    invalidateBalances(ctx, s.redisClient, fromUserID, toUserID)
+
+    return txn, false, nil
 }
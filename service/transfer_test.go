@@ -8,6 +8,9 @@ import (
     "github.com/jmoiron/sqlx"
     "github.com/DATA-DOG/go-sqlmock"
     redismock "github.com/go-redis/redismock/v8"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/lib/pq"
     "time"
 )
 
@@ -20,43 +23,43 @@ func TestTransferService_Transfer_Success(t *testing.T) {
     defer redisClient.Close() // nolint:errcheck
 
     // Set the expectations for the Redis update operation: update the balances of the two users
-    mockRedis.ExpectSet("balance:1", "100", time.Second*3600).SetVal("")
-    mockRedis.ExpectSet("balance:2", "250", time.Second*3600).SetVal("")
+    mockRedis.ExpectDel("balances:1").SetVal(1)
+    mockRedis.ExpectDel("balances:2").SetVal(1)
 
     // Create an instance of TransferService, passing in the mock DB and Redis client
-    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
 
     mock.ExpectBegin()
 
     // Query the balance of User 1 (the one initiating the transfer)
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1").
-        WithArgs(1).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(1, decimal.NewFromInt(200)))
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
 
     // Update the balance of User 1 (the one who initiates the transfer)
-    mock.ExpectExec("UPDATE users SET balance = \\$1, updated_at = \\$2 WHERE id = \\$3").
-        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1).
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(0)).
         WillReturnResult(sqlmock.NewResult(1, 1))
 
     // Query the balance of User 2 (the one receiving the transfer)
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1").
-        WithArgs(2).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(2, decimal.NewFromInt(150)))
+    expectWalletRead(mock, 2, "USD", decimal.NewFromInt(150), "active")
 
     // Update the balance of User 2 (the one receiving the transfer)
-    mock.ExpectExec("UPDATE users SET balance = \\$1, updated_at = \\$2 WHERE id = \\$3").
-        WithArgs(decimal.NewFromInt(250), sqlmock.AnyArg(), 2).
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(250), sqlmock.AnyArg(), 2, int64(0)).
         WillReturnResult(sqlmock.NewResult(1, 1))
 
     // The expectation of inserting a transaction record
-    mock.ExpectExec("INSERT INTO transactions").
-        WithArgs(1, 2, decimal.NewFromInt(100), "transfer", "completed", decimal.NewFromFloat(0.0), "credit_card").
-        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(100), "USD", "transfer", "completed", decimal.NewFromFloat(0.0), "wallet", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+
+    // The expectations of posting the movement to the ledger
+    expectLedgerMovement(mock, 1, "transfer", "user:1:USD", "user:2:USD", decimal.NewFromInt(100))
 
+    expectEvents(mock, "transaction.completed", "balance.changed", "balance.changed")
     mock.ExpectCommit()
 
     // Call the transfer method
-    err = transferService.Transfer(1, 2, decimal.NewFromInt(100))
+    _, _, err = transferService.Transfer(1, 2, "USD", decimal.NewFromInt(100), "")
     require.NoError(t, err)
 
     // Check whether all the expectations are met
@@ -77,29 +80,32 @@ func TestTransferService_Transfer_InsufficientBalance(t *testing.T) {
     defer redisClient.Close() // nolint:errcheck
 
     // 创建 TransferService 实例，传入 mock DB 和 mock Redis 客户端
-    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
 
     // Set the database expectations
     mock.ExpectBegin()
 
     // Set the expectation for querying the balance of the transferring-out user (insufficient balance)
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1").
-        WithArgs(1).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(1, decimal.NewFromInt(30)))
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(30), "active")
 
-    // The expectation of inserting a transaction record
-    // mock.ExpectExec("INSERT INTO transactions").
-    //     WithArgs(1, 2, decimal.NewFromInt(100), "transfer", "failed", decimal.NewFromFloat(0.0), "credit_card").
-    //     WillReturnResult(sqlmock.NewResult(1, 1))
+    // The attempt is rolled back, and the failed transfer is recorded outside of it
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 2, decimal.NewFromInt(100), "USD", "transfer", "failed", decimal.NewFromFloat(0.0), "wallet", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
 
     // Call the transfer method (with insufficient balance for transfer)
-    err = transferService.Transfer(1, 2, decimal.NewFromInt(100))
+    _, _, err = transferService.Transfer(1, 2, "USD", decimal.NewFromInt(100), "")
 
     // Verify the returned error message
     require.Error(t, err)
     require.Equal(t, "Insufficient balance", err.Error())
+    require.ErrorIs(t, err, ErrInsufficientBalance)
 
-    // Ensure that no database operations have been carried out (no balance updates or transaction record insertions)
+    // Ensure that no balance was updated and only the failed transfer was recorded
     err = mock.ExpectationsWereMet()
     require.NoError(t, err)
 
@@ -108,6 +114,45 @@ func TestTransferService_Transfer_InsufficientBalance(t *testing.T) {
     require.NoError(t, err)
 }
 
+func TestTransferService_Transfer_UnknownRecipient(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
+
+    mock.ExpectBegin()
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(200), "active")
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(0)).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    // The receiving user does not exist, so no wallet can be opened for them
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(99, "USD").
+        WillReturnError(&pq.Error{Code: "23503"})
+
+    // The debit is rolled back, and the failed transfer is recorded outside of the transaction
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 99, decimal.NewFromInt(100), "USD", "transfer", "failed", decimal.NewFromFloat(0.0), "wallet", nil, nil, "unknown_recipient", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
+
+    _, _, err = transferService.Transfer(1, 99, "USD", decimal.NewFromInt(100), "")
+    require.ErrorIs(t, err, repository.ErrUserNotFound)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
 
 func TestTransferService_Transfer_ToSameUser(t *testing.T) {
     db, mock, err := sqlmock.New()
@@ -118,10 +163,10 @@ func TestTransferService_Transfer_ToSameUser(t *testing.T) {
     defer redisClient.Close() // nolint:errcheck
 
     // Create an instance of TransferService, passing in the mock DB and mock Redis client
-    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
 
     // Call the transfer method (transferring to the same user)
-    err = transferService.Transfer(1, 1, decimal.NewFromInt(50))
+    _, _, err = transferService.Transfer(1, 1, "USD", decimal.NewFromInt(50), "")
 
     // Verify the returned error message
     require.Error(t, err)
@@ -144,7 +189,7 @@ func TestTransferService_Transfer_InvalidAmount(t *testing.T) {
     redisClient, mockRedis := redismock.NewClientMock()
     defer redisClient.Close() // nolint:errcheck
 
-    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    transferService := NewTransferService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil)
 
     // Invalid amount test
     invalidAmounts := []decimal.Decimal{
@@ -155,7 +200,7 @@ func TestTransferService_Transfer_InvalidAmount(t *testing.T) {
     for _, amount := range invalidAmounts {
         t.Run(fmt.Sprintf("transfer amount: %s", amount.String()), func(t *testing.T) {
             // Call the transfer method
-            err := transferService.Transfer(2, 1, amount)
+            _, _, err := transferService.Transfer(2, 1, "USD", amount, "")
 
             // Verify whether an error has been returned
             require.Error(t, err)
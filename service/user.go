@@ -0,0 +1,264 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/go-redis/redis/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "net/mail"
+    "regexp"
+    "strings"
+)
+
+// ErrInvalidUser is returned when the details of a user account fail validation.
+var ErrInvalidUser = errors.New("invalid user details")
+
+// ErrUserHasBalance is returned when a user account that still holds money is deleted.
+var ErrUserHasBalance = errors.New("user balance must be zero before the account can be deleted")
+
+// ErrInvalidStatusChange is returned when a status change names an unknown status or lacks a reason.
+var ErrInvalidStatusChange = errors.New("invalid status change")
+
+// ErrInvalidKYCTier is returned when a user is moved to an unknown KYC tier.
+var ErrInvalidKYCTier = errors.New("invalid KYC tier")
+
+// phonePattern accepts phone numbers of digits with an optional leading +, fitting the users.phone column.
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{6,19}$`)
+
+// maxUserNameLength is the length of the users.name column.
+const maxUserNameLength = 255
+
+// UserUpdate holds the fields of a partial user update. Fields left nil are not changed.
+type UserUpdate struct {
+    Name  *string
+    Email *string
+    Phone *string
+}
+
+// UserService provides user account management: signing up, looking up, updating and deleting users.
+type UserService struct {
+    userRepo    *repository.UserRepository
+    walletRepo  *repository.WalletRepository
+    ledgerRepo  *repository.LedgerRepository
+    dbConn      *sqlx.DB
+    redisClient *redis.Client
+}
+
+// NewUserService creates a new instance of UserService with the provided database connection and Redis client.
+func NewUserService(dbConn *sqlx.DB, redisClient *redis.Client) *UserService {
+    return &UserService{
+        userRepo:    repository.NewUserRepository(dbConn),
+        walletRepo:  repository.NewWalletRepository(dbConn),
+        ledgerRepo:  repository.NewLedgerRepository(dbConn),
+        dbConn:      dbConn,
+        redisClient: redisClient,
+    }
+}
+
+// CreateUser signs up a new active user and opens their wallet in model.DefaultCurrency: the user starts with a zero balance,
+// and the ledger account holding the balance is created in the same database transaction. Wallets in other currencies are
+// opened by the first deposit or transfer in that currency.
+func (s *UserService) CreateUser(ctx context.Context, name, email, phone string) (*model.User, error) {
+    user := &model.User{
+        Name:   strings.TrimSpace(name),
+        Email:  normalizeEmail(email),
+        Phone:  strings.TrimSpace(phone),
+        Status: model.UserStatusActive,
+        // New users start at the basic tier, the default of the users.kyc_tier column
+        KYCTier: model.KYCTierBasic,
+    }
+    if err := validateUser(user); err != nil {
+        return nil, err
+    }
+
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    if err := s.userRepo.CreateUser(ctx, tx, user); err != nil {
+        return nil, err
+    }
+
+    // Open the wallet, so that the user's balance is backed by a ledger account from the start
+    if err := s.walletRepo.EnsureWallet(ctx, tx, user.ID, model.DefaultCurrency); err != nil {
+        return nil, err
+    }
+    code := model.UserAccountCode(user.ID, model.DefaultCurrency)
+    if _, err := s.ledgerRepo.GetOrCreateAccount(ctx, tx, code, user.ID, model.AccountTypeUser, model.DefaultCurrency); err != nil {
+        return nil, fmt.Errorf("failed to open wallet for user %d: %w", user.ID, err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+
+    return user, nil
+}
+
+// GetUser retrieves an open user account.
+func (s *UserService) GetUser(ctx context.Context, userID int) (*model.User, error) {
+    return s.userRepo.GetUser(ctx, s.dbConn, userID)
+}
+
+// UpdateUser applies a partial update to the name, email and phone of a user account and returns the updated user.
+func (s *UserService) UpdateUser(ctx context.Context, userID int, update UserUpdate) (*model.User, error) {
+    user, err := s.userRepo.GetUser(ctx, s.dbConn, userID)
+    if err != nil {
+        return nil, err
+    }
+
+    if update.Name != nil {
+        user.Name = strings.TrimSpace(*update.Name)
+    }
+    if update.Email != nil {
+        user.Email = normalizeEmail(*update.Email)
+    }
+    if update.Phone != nil {
+        user.Phone = strings.TrimSpace(*update.Phone)
+    }
+    if err := validateUser(user); err != nil {
+        return nil, err
+    }
+
+    if err := s.userRepo.UpdateUser(ctx, s.dbConn, user); err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+// DeleteUser soft deletes a user account. The wallet rows are locked while they are checked, so that
+// an account is only closed once all its wallets are empty and no money can move into them in the meantime.
+func (s *UserService) DeleteUser(ctx context.Context, userID int) error {
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    wallets, err := s.walletRepo.LockWallets(ctx, tx, userID)
+    if err != nil {
+        return err
+    }
+    for _, wallet := range wallets {
+        if !wallet.Balance.IsZero() {
+            return fmt.Errorf("%w: %s %s left", ErrUserHasBalance, wallet.Balance.String(), wallet.Currency)
+        }
+    }
+
+    if err := s.userRepo.DeleteUser(ctx, tx, userID); err != nil {
+        return err
+    }
+
+    // Make in-flight optimistic balance updates retry and find the account closed
+    if err := s.walletRepo.BumpWalletVersions(ctx, tx, userID); err != nil {
+        return err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("failed to commit transaction: %w", err)
+    }
+
+    // The cached balances of a deleted user must not be served anymore
+    invalidateBalances(ctx, s.redisClient, userID)
+    return nil
+}
+
+// ChangeStatus sets the status of a user account on behalf of an administrator, and records the change
+// with its reason in the audit trail within the same database transaction.
+func (s *UserService) ChangeStatus(ctx context.Context, userID int, status, reason, changedBy string) (*model.StatusChange, error) {
+    if !isValidStatus(status) {
+        return nil, fmt.Errorf("%w: status must be one of active, inactive or suspended", ErrInvalidStatusChange)
+    }
+    reason = strings.TrimSpace(reason)
+    if reason == "" {
+        return nil, fmt.Errorf("%w: a reason is required", ErrInvalidStatusChange)
+    }
+
+    tx, err := s.dbConn.Beginx()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start transaction: %w", err)
+    }
+    defer tx.Rollback() // nolint:errcheck
+
+    oldStatus, err := s.userRepo.UpdateStatus(ctx, tx, userID, status)
+    if err != nil {
+        return nil, err
+    }
+
+    // Make in-flight optimistic balance updates retry against the new status
+    if err := s.walletRepo.BumpWalletVersions(ctx, tx, userID); err != nil {
+        return nil, err
+    }
+
+    change := &model.StatusChange{
+        UserID:    userID,
+        OldStatus: oldStatus,
+        NewStatus: status,
+        Reason:    reason,
+        ChangedBy: strings.TrimSpace(changedBy),
+    }
+    if err := s.userRepo.RecordStatusChange(ctx, tx, change); err != nil {
+        return nil, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction: %w", err)
+    }
+    return change, nil
+}
+
+// GetStatusChanges retrieves the audit trail of status changes of a user, newest first.
+func (s *UserService) GetStatusChanges(ctx context.Context, userID int) ([]model.StatusChange, error) {
+    return s.userRepo.GetStatusChanges(ctx, userID)
+}
+
+// SetKYCTier moves a user account to another KYC tier, selecting the transaction limits that apply to the user's
+// next withdrawals and transfers, and returns the updated user.
+func (s *UserService) SetKYCTier(ctx context.Context, userID int, tier string) (*model.User, error) {
+    switch tier {
+    case model.KYCTierBasic, model.KYCTierVerified, model.KYCTierPremium:
+    default:
+        return nil, fmt.Errorf("%w: tier must be one of basic, verified or premium", ErrInvalidKYCTier)
+    }
+
+    if err := s.userRepo.UpdateKYCTier(ctx, s.dbConn, userID, tier); err != nil {
+        return nil, err
+    }
+    return s.userRepo.GetUser(ctx, s.dbConn, userID)
+}
+
+// isValidStatus reports whether status is one of the statuses allowed by the users.status column.
+func isValidStatus(status string) bool {
+    switch status {
+    case model.UserStatusActive, model.UserStatusInactive, model.UserStatusSuspended:
+        return true
+    }
+    return false
+}
+
+// normalizeEmail trims the email and lower-cases it, so that uniqueness does not depend on letter case.
+func normalizeEmail(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateUser checks the name, email and phone of a user account.
+func validateUser(user *model.User) error {
+    if user.Name == "" || len(user.Name) > maxUserNameLength {
+        return fmt.Errorf("%w: name must be between 1 and %d characters", ErrInvalidUser, maxUserNameLength)
+    }
+
+    addr, err := mail.ParseAddress(user.Email)
+    if err != nil || addr.Address != user.Email || len(user.Email) > 255 {
+        return fmt.Errorf("%w: email is not a valid address", ErrInvalidUser)
+    }
+
+    if !phonePattern.MatchString(user.Phone) {
+        return fmt.Errorf("%w: phone must be 6 to 19 digits with an optional leading +", ErrInvalidUser)
+    }
+    return nil
+}
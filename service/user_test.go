@@ -0,0 +1,170 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    redismock "github.com/go-redis/redismock/v8"
+    "github.com/jmoiron/sqlx"
+    "github.com/shopspring/decimal"
+    "github.com/stretchr/testify/require"
+)
+
+// Test that signing up creates the user and opens the wallet in one transaction
+func TestUserService_CreateUser_Success(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    userService := NewUserService(sqlx.NewDb(db, "sqlmock"), redisClient)
+
+    now := time.Now()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO users").
+        WithArgs("Dave", "dave@example.com", "+8613300000004", "active").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(4, now, now))
+    mock.ExpectExec("INSERT INTO wallets").
+        WithArgs(4, "USD").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("INSERT INTO ledger_accounts").
+        WithArgs("user:4:USD", 4, "user", "USD").
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(14))
+    mock.ExpectCommit()
+
+    user, err := userService.CreateUser(context.Background(), " Dave ", "Dave@Example.com", "+8613300000004")
+    require.NoError(t, err)
+    require.Equal(t, 4, user.ID)
+    require.Equal(t, "dave@example.com", user.Email)
+    require.Equal(t, "active", user.Status)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+func TestUserService_CreateUser_Invalid(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    userService := NewUserService(sqlx.NewDb(db, "sqlmock"), redisClient)
+
+    cases := []struct {
+        name, email, phone string
+    }{
+        {"", "dave@example.com", "13300000004"},
+        {"Dave", "not-an-email", "13300000004"},
+        {"Dave", "Dave <dave@example.com>", "13300000004"},
+        {"Dave", "dave@example.com", "133-0000"},
+    }
+
+    for _, tc := range cases {
+        _, err := userService.CreateUser(context.Background(), tc.name, tc.email, tc.phone)
+        require.ErrorIs(t, err, ErrInvalidUser)
+    }
+
+    // Nothing reaches the database
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that only the given fields are changed by a partial update
+func TestUserService_UpdateUser(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    userService := NewUserService(sqlx.NewDb(db, "sqlmock"), redisClient)
+
+    now := time.Now()
+    mock.ExpectQuery("SELECT id, name, email, phone, status, kyc_tier, created_at, updated_at FROM users").
+        WithArgs(2).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "phone", "status", "kyc_tier", "created_at", "updated_at"}).
+            AddRow(2, "Bob", "bob@example.com", "13300000002", "active", "basic", now, now))
+    mock.ExpectQuery("UPDATE users SET name").
+        WithArgs("Bob", "robert@example.com", "13300000002", 2).
+        WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(now))
+
+    email := "robert@example.com"
+    user, err := userService.UpdateUser(context.Background(), 2, UserUpdate{Email: &email})
+    require.NoError(t, err)
+    require.Equal(t, "Bob", user.Name)
+    require.Equal(t, "robert@example.com", user.Email)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// expectLockWallets expects the EUR and USD wallets of the user to be locked before the account is deleted
+func expectLockWallets(mock sqlmock.Sqlmock, userID int, eurBalance, usdBalance decimal.Decimal) {
+    mock.ExpectQuery("SELECT (.+) FROM wallets w JOIN users u (.+) ORDER BY w.currency FOR UPDATE OF w").
+        WithArgs(userID).
+        WillReturnRows(sqlmock.NewRows(walletColumns).
+            AddRow(userID*10, userID, "EUR", eurBalance, 0, "active", time.Now(), time.Now()).
+            AddRow(userID*10+1, userID, "USD", usdBalance, 0, "active", time.Now(), time.Now()))
+}
+
+func TestUserService_DeleteUser(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, mockRedis := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    mockRedis.ExpectDel("balances:4").SetVal(1)
+
+    userService := NewUserService(sqlx.NewDb(db, "sqlmock"), redisClient)
+
+    mock.ExpectBegin()
+    expectLockWallets(mock, 4, decimal.Zero, decimal.Zero)
+    mock.ExpectExec("UPDATE users SET status = 'inactive'").
+        WithArgs(4).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE wallets SET version = version \\+ 1 WHERE user_id = \\$1").
+        WithArgs(4).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectCommit()
+
+    err = userService.DeleteUser(context.Background(), 4)
+    require.NoError(t, err)
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+
+    err = mockRedis.ExpectationsWereMet()
+    require.NoError(t, err)
+}
+
+// Test that an account still holding money cannot be deleted
+func TestUserService_DeleteUser_NonZeroBalance(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    defer db.Close() // nolint:errcheck
+
+    redisClient, _ := redismock.NewClientMock()
+    defer redisClient.Close() // nolint:errcheck
+
+    userService := NewUserService(sqlx.NewDb(db, "sqlmock"), redisClient)
+
+    mock.ExpectBegin()
+    // The USD wallet is empty, but money is left in the EUR wallet
+    expectLockWallets(mock, 1, decimal.RequireFromString("12.50"), decimal.Zero)
+    mock.ExpectRollback()
+
+    err = userService.DeleteUser(context.Background(), 1)
+    require.ErrorIs(t, err, ErrUserHasBalance)
+    require.Contains(t, err.Error(), "12.5 EUR left")
+
+    err = mock.ExpectationsWereMet()
+    require.NoError(t, err)
+}
@@ -0,0 +1,445 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+    "github.com/yaoweihua/wallet-service/auth"
+    "github.com/yaoweihua/wallet-service/events"
+    "github.com/yaoweihua/wallet-service/model"
+    "github.com/yaoweihua/wallet-service/repository"
+    "github.com/yaoweihua/wallet-service/utils"
+    "github.com/jmoiron/sqlx"
+)
+
+// ErrInvalidWebhook is returned when a webhook endpoint is registered with a malformed URL or unknown event types.
+var ErrInvalidWebhook = errors.New("invalid webhook endpoint")
+
+// ErrWebhookEndpointDisabled is returned when a webhook endpoint is disabled again.
+var ErrWebhookEndpointDisabled = errors.New("webhook endpoint is disabled")
+
+// ErrWebhookDeliveryNotDead is returned when a webhook delivery that is not dead is retried by hand.
+var ErrWebhookDeliveryNotDead = errors.New("only dead webhook deliveries can be retried")
+
+// Headers of the requests posting events to webhook endpoints, next to events.EventIDHeader and events.EventTypeHeader.
+const (
+    WebhookDeliveryHeader  = "X-Webhook-Delivery"  // The ID of the delivery, the same on every attempt
+    WebhookTimestampHeader = "X-Webhook-Timestamp" // The Unix time the request was signed at
+    WebhookSignatureHeader = "X-Webhook-Signature" // The hex HMAC-SHA256 signature of the request, see auth.SignWebhook
+)
+
+// Sizes of the delivery log of a webhook endpoint.
+const (
+    DefaultWebhookDeliveries = 50  // The number of deliveries listed when no limit is given
+    MaxWebhookDeliveries     = 200 // The largest number of deliveries listed at once
+)
+
+const (
+    // webhookBatchSize is the number of deliveries the delivery worker attempts per run.
+    webhookBatchSize = 100
+    // maxWebhookURL is the longest URL a webhook endpoint can have.
+    maxWebhookURL = 2048
+    // maxWebhookError is the longest error message kept with a failed attempt.
+    maxWebhookError = 255
+    // webhookClaimMargin is how much longer than the timeout a delivery is left to the instance attempting it, before
+    // another instance may claim it.
+    webhookClaimMargin = time.Minute
+)
+
+// WebhookOptions configures how webhook deliveries are attempted and retried.
+type WebhookOptions struct {
+    Timeout     time.Duration // How long an endpoint has to answer an attempt
+    MaxAttempts int           // How many attempts are made before a delivery is dead
+    RetryBase   time.Duration // The delay after the first failed attempt, doubling after every further one
+    RetryMax    time.Duration // The longest delay between two attempts
+}
+
+// DefaultWebhookOptions returns the options used when none are configured: eight attempts over about an hour.
+func DefaultWebhookOptions() WebhookOptions {
+    return WebhookOptions{
+        Timeout:     10 * time.Second,
+        MaxAttempts: 8,
+        RetryBase:   30 * time.Second,
+        RetryMax:    time.Hour,
+    }
+}
+
+// WebhookService registers the webhook endpoints of users and delivers the events of their wallets to them. It is a
+// publisher of the outbox relay: every event an endpoint subscribed to becomes a delivery, which the delivery worker
+// posts to the endpoint, signed with its secret, until it is acknowledged or dead.
+type WebhookService struct {
+    webhookRepo *repository.WebhookRepository
+    dbConn      *sqlx.DB
+    client      *http.Client
+    opts        WebhookOptions
+    // lookupIP resolves the host of an endpoint when it is registered
+    lookupIP func(ctx context.Context, host string) ([]net.IPAddr, error)
+    // allowPrivateAddresses lets deliveries reach addresses that are not public, for tests posting to a local server
+    allowPrivateAddresses bool
+}
+
+// NewWebhookService creates a new instance of WebhookService attempting deliveries with the options.
+// Deliveries are only posted to public addresses and redirects are not followed, so an endpoint cannot be used to
+// reach the internal network of the service.
+func NewWebhookService(dbConn *sqlx.DB, opts WebhookOptions) *WebhookService {
+    s := &WebhookService{
+        webhookRepo: repository.NewWebhookRepository(dbConn),
+        dbConn:      dbConn,
+        opts:        opts,
+        lookupIP:    net.DefaultResolver.LookupIPAddr,
+    }
+
+    // The address is checked once the host is resolved, right before connecting, so a host resolving to another
+    // address than when it was registered is refused too
+    dialer := &net.Dialer{
+        Timeout: opts.Timeout,
+        Control: func(network, address string, _ syscall.RawConn) error {
+            host, _, err := net.SplitHostPort(address)
+            if err != nil {
+                return err
+            }
+            return s.checkAddress(net.ParseIP(host))
+        },
+    }
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = nil // A proxy would connect to the endpoint on behalf of the service, past the address check
+    transport.DialContext = dialer.DialContext
+    s.client = &http.Client{
+        Timeout:   opts.Timeout,
+        Transport: transport,
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    return s
+}
+
+// RegisterEndpoint registers a webhook endpoint receiving the events of the types at the https URL, every type of
+// model.WebhookEventTypes when none is given. The host of the URL must resolve to public addresses only. It returns
+// the endpoint with its signing secret, which is not returned again.
+func (s *WebhookService) RegisterEndpoint(ctx context.Context, userID int, endpointURL string, eventTypes []string) (*model.WebhookEndpoint, string, error) {
+    endpointURL = strings.TrimSpace(endpointURL)
+    if len(endpointURL) > maxWebhookURL {
+        return nil, "", fmt.Errorf("%w: the URL is longer than %d bytes", ErrInvalidWebhook, maxWebhookURL)
+    }
+    parsed, err := url.Parse(endpointURL)
+    if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+        return nil, "", fmt.Errorf("%w: %q is not an https URL", ErrInvalidWebhook, endpointURL)
+    }
+    addrs, err := s.lookupIP(ctx, parsed.Hostname())
+    if err != nil || len(addrs) == 0 {
+        return nil, "", fmt.Errorf("%w: the host %q cannot be resolved", ErrInvalidWebhook, parsed.Hostname())
+    }
+    for _, addr := range addrs {
+        if err := s.checkAddress(addr.IP); err != nil {
+            return nil, "", err
+        }
+    }
+
+    if len(eventTypes) == 0 {
+        eventTypes = model.WebhookEventTypes
+    }
+    for _, eventType := range eventTypes {
+        if !contains(model.WebhookEventTypes, eventType) {
+            return nil, "", fmt.Errorf("%w: unknown event type %q", ErrInvalidWebhook, eventType)
+        }
+    }
+    // Keep every type once, in a fixed order
+    subscribed := make([]string, 0, len(eventTypes))
+    for _, eventType := range model.WebhookEventTypes {
+        if contains(eventTypes, eventType) {
+            subscribed = append(subscribed, eventType)
+        }
+    }
+
+    secret, err := auth.GenerateWebhookSecret()
+    if err != nil {
+        return nil, "", err
+    }
+    endpoint := &model.WebhookEndpoint{
+        UserID:     userID,
+        URL:        endpointURL,
+        Secret:     secret,
+        EventTypes: subscribed,
+        Status:     model.WebhookEndpointActive,
+    }
+    if err := s.webhookRepo.CreateEndpoint(ctx, s.dbConn, endpoint); err != nil {
+        return nil, "", err
+    }
+    return endpoint, secret, nil
+}
+
+// sharedAddressSpace is the range carrier-grade NATs use, which is not reachable from the internet either.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// checkAddress returns ErrInvalidWebhook unless the address is public: not loopback, private, link-local, multicast,
+// unspecified or shared by a carrier-grade NAT.
+func (s *WebhookService) checkAddress(ip net.IP) error {
+    if s.allowPrivateAddresses {
+        return nil
+    }
+    if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+        ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+        return fmt.Errorf("%w: %s is not a public address", ErrInvalidWebhook, ip)
+    }
+    return nil
+}
+
+// GetEndpoint retrieves the webhook endpoint with the given ID.
+func (s *WebhookService) GetEndpoint(ctx context.Context, endpointID int) (*model.WebhookEndpoint, error) {
+    return s.webhookRepo.GetEndpoint(ctx, s.dbConn, endpointID)
+}
+
+// GetEndpoints retrieves the webhook endpoints of the user, newest first.
+func (s *WebhookService) GetEndpoints(ctx context.Context, userID int) ([]model.WebhookEndpoint, error) {
+    return s.webhookRepo.GetEndpoints(ctx, s.dbConn, userID)
+}
+
+// DisableEndpoint stops posting events to the webhook endpoint. Deliveries still pending are dead-lettered when they
+// fall due, so they can be told apart in the delivery log.
+func (s *WebhookService) DisableEndpoint(ctx context.Context, endpointID int) (*model.WebhookEndpoint, error) {
+    endpoint, err := s.webhookRepo.GetEndpoint(ctx, s.dbConn, endpointID)
+    if err != nil {
+        return nil, err
+    }
+    if endpoint.Status == model.WebhookEndpointDisabled {
+        return nil, fmt.Errorf("%w: %d", ErrWebhookEndpointDisabled, endpointID)
+    }
+
+    endpoint.Status = model.WebhookEndpointDisabled
+    if err := s.webhookRepo.UpdateEndpointStatus(ctx, s.dbConn, endpoint); err != nil {
+        return nil, err
+    }
+    return endpoint, nil
+}
+
+// GetDeliveries retrieves the delivery log of the webhook endpoint: up to limit of its latest deliveries, newest first,
+// only those with the given status unless it is empty. A limit of 0 selects DefaultWebhookDeliveries, and the limit
+// is capped at MaxWebhookDeliveries.
+func (s *WebhookService) GetDeliveries(ctx context.Context, endpointID int, status string, limit int) ([]model.WebhookDelivery, error) {
+    if status != "" && status != model.WebhookDeliveryPending && status != model.WebhookDeliverySucceeded && status != model.WebhookDeliveryDead {
+        return nil, fmt.Errorf("%w: unknown delivery status %q", ErrInvalidWebhook, status)
+    }
+    if limit <= 0 {
+        limit = DefaultWebhookDeliveries
+    }
+    if limit > MaxWebhookDeliveries {
+        limit = MaxWebhookDeliveries
+    }
+    return s.webhookRepo.GetDeliveries(ctx, s.dbConn, endpointID, status, limit)
+}
+
+// GetDelivery retrieves the webhook delivery with the given ID.
+func (s *WebhookService) GetDelivery(ctx context.Context, deliveryID int64) (*model.WebhookDelivery, error) {
+    return s.webhookRepo.GetDelivery(ctx, s.dbConn, deliveryID)
+}
+
+// RetryDelivery takes a dead delivery out of the dead letters, such as once its endpoint has been fixed. It is due
+// right away and gets a fresh set of attempts.
+func (s *WebhookService) RetryDelivery(ctx context.Context, deliveryID int64) (*model.WebhookDelivery, error) {
+    var delivery *model.WebhookDelivery
+    err := withTx(s.dbConn, func(tx *sqlx.Tx) error {
+        var err error
+        delivery, err = s.webhookRepo.LockDelivery(ctx, tx, deliveryID)
+        if err != nil {
+            return err
+        }
+        if delivery.Status != model.WebhookDeliveryDead {
+            return fmt.Errorf("%w: delivery %d is %s", ErrWebhookDeliveryNotDead, deliveryID, delivery.Status)
+        }
+
+        now := time.Now()
+        delivery.Status = model.WebhookDeliveryPending
+        delivery.Attempts = 0
+        delivery.NextAttemptAt = &now
+        return s.webhookRepo.UpdateDelivery(ctx, tx, delivery)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return delivery, nil
+}
+
+// Publish turns an event of the outbox into a delivery to every active endpoint subscribed to it: those of the sender
+// and the recipient of a transaction, or of the owner of a wallet whose balance changed. It implements events.Publisher.
+func (s *WebhookService) Publish(ctx context.Context, event model.OutboxEvent) error {
+    if !contains(model.WebhookEventTypes, event.EventType) {
+        return nil
+    }
+    userIDs, err := eventUserIDs(event)
+    if err != nil {
+        return err
+    }
+    endpoints, err := s.webhookRepo.GetSubscribedEndpoints(ctx, s.dbConn, userIDs, event.EventType)
+    if err != nil || len(endpoints) == 0 {
+        return err
+    }
+
+    body, err := json.Marshal(event)
+    if err != nil {
+        return fmt.Errorf("failed to encode event %d: %w", event.ID, err)
+    }
+    deliveries := make([]model.WebhookDelivery, 0, len(endpoints))
+    for _, endpoint := range endpoints {
+        deliveries = append(deliveries, model.WebhookDelivery{
+            EndpointID: endpoint.ID,
+            EventID:    event.ID,
+            EventType:  event.EventType,
+            Payload:    body,
+        })
+    }
+    return s.webhookRepo.AddDeliveries(ctx, s.dbConn, deliveries)
+}
+
+// eventUserIDs returns the users whose webhook endpoints may receive the event.
+func eventUserIDs(event model.OutboxEvent) ([]int, error) {
+    if event.EventType == model.EventBalanceChanged {
+        var change model.BalanceChange
+        if err := json.Unmarshal(event.Payload, &change); err != nil {
+            return nil, fmt.Errorf("failed to decode balance change of event %d: %w", event.ID, err)
+        }
+        return []int{change.UserID}, nil
+    }
+
+    var txn model.Transaction
+    if err := json.Unmarshal(event.Payload, &txn); err != nil {
+        return nil, fmt.Errorf("failed to decode transaction of event %d: %w", event.ID, err)
+    }
+    if txn.ToUserID == 0 || txn.ToUserID == txn.FromUserID {
+        return []int{txn.FromUserID}, nil
+    }
+    return []int{txn.FromUserID, txn.ToUserID}, nil
+}
+
+// DeliverDue attempts up to one batch of the webhook deliveries that are due, and returns how many were attempted.
+func (s *WebhookService) DeliverDue(ctx context.Context) (int, error) {
+    attempted := 0
+    for attempted < webhookBatchSize {
+        delivered, err := s.deliverNext(ctx, time.Now())
+        if err != nil || !delivered {
+            return attempted, err
+        }
+        attempted++
+    }
+    return attempted, nil
+}
+
+// Run attempts due webhook deliveries every interval until the context is cancelled.
+func (s *WebhookService) Run(ctx context.Context, interval time.Duration) {
+    runPeriodically(ctx, "webhook delivery", interval, s.DeliverDue)
+}
+
+// deliverNext attempts the delivery that has been due the longest, and reports whether one was due. The delivery is
+// claimed first, so it is attempted by one instance of the service at a time, and posted with no transaction open.
+func (s *WebhookService) deliverNext(ctx context.Context, now time.Time) (bool, error) {
+    delivery, err := s.webhookRepo.ClaimDueDelivery(ctx, s.dbConn, now, now.Add(s.opts.Timeout+webhookClaimMargin))
+    if err != nil || delivery == nil {
+        return false, err
+    }
+    claimedUntil := *delivery.NextAttemptAt
+
+    endpoint, err := s.webhookRepo.GetEndpoint(ctx, s.dbConn, delivery.EndpointID)
+    if err != nil {
+        return true, err
+    }
+    if endpoint.Status != model.WebhookEndpointActive {
+        delivery.Status = model.WebhookDeliveryDead
+        delivery.NextAttemptAt = nil
+        delivery.LastError = "webhook endpoint is disabled"
+    } else {
+        s.attempt(ctx, endpoint, delivery, now)
+    }
+    return true, s.recordAttempt(ctx, delivery, claimedUntil)
+}
+
+// recordAttempt stores the outcome of the attempt of a delivery claimed until the given time. The outcome is dropped
+// if the claim expired meanwhile and the delivery was claimed again or retried, the later attempt records its own.
+func (s *WebhookService) recordAttempt(ctx context.Context, delivery *model.WebhookDelivery, claimedUntil time.Time) error {
+    return withTx(s.dbConn, func(tx *sqlx.Tx) error {
+        current, err := s.webhookRepo.LockDelivery(ctx, tx, delivery.ID)
+        if err != nil {
+            return err
+        }
+        if current.Status != model.WebhookDeliveryPending || current.NextAttemptAt == nil || !current.NextAttemptAt.Equal(claimedUntil) {
+            utils.GetLogger().Warnf("Warning: webhook delivery %d was claimed again before its attempt was recorded", delivery.ID)
+            return nil
+        }
+        return s.webhookRepo.UpdateDelivery(ctx, tx, delivery)
+    })
+}
+
+// attempt posts the delivery to its endpoint once and records the outcome in the delivery: acknowledged, pending with
+// the time of its next attempt, or dead once the attempts have run out.
+func (s *WebhookService) attempt(ctx context.Context, endpoint *model.WebhookEndpoint, delivery *model.WebhookDelivery, now time.Time) {
+    delivery.Attempts++
+    statusCode, err := s.post(ctx, endpoint, delivery)
+    delivery.LastStatusCode = statusCode
+    if err == nil {
+        delivery.Status = model.WebhookDeliverySucceeded
+        delivery.NextAttemptAt = nil
+        delivery.LastError = ""
+        delivery.DeliveredAt = &now
+        return
+    }
+
+    delivery.LastError = truncateError(err, maxWebhookError)
+    if delivery.Attempts >= s.opts.MaxAttempts {
+        delivery.Status = model.WebhookDeliveryDead
+        delivery.NextAttemptAt = nil
+        return
+    }
+    next := now.Add(webhookBackoff(s.opts, delivery.Attempts))
+    delivery.NextAttemptAt = &next
+}
+
+// webhookBackoff returns how long to wait after the given number of failed attempts: the base delay, doubled after
+// every attempt but the first, up to the longest delay.
+func webhookBackoff(opts WebhookOptions, attempts int) time.Duration {
+    delay := opts.RetryBase
+    for i := 1; i < attempts && delay < opts.RetryMax; i++ {
+        delay *= 2
+    }
+    if delay > opts.RetryMax {
+        return opts.RetryMax
+    }
+    return delay
+}
+
+// post signs the payload of the delivery with the secret of the endpoint and posts it, returning the status code of
+// the response, nil if there was none. Any 2xx response acknowledges the event, a redirect is not followed.
+func (s *WebhookService) post(ctx context.Context, endpoint *model.WebhookEndpoint, delivery *model.WebhookDelivery) (*int, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+    if err != nil {
+        return nil, fmt.Errorf("failed to build request: %w", err)
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+    req.Header.Set(events.EventIDHeader, strconv.FormatInt(delivery.EventID, 10))
+    req.Header.Set(events.EventTypeHeader, delivery.EventType)
+    req.Header.Set(WebhookTimestampHeader, timestamp)
+    req.Header.Set(WebhookSignatureHeader, auth.SignWebhook(endpoint.Secret, timestamp, delivery.Payload))
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("failed to post event: %w", err)
+    }
+    defer resp.Body.Close() // nolint:errcheck
+    _, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+    statusCode := resp.StatusCode
+    if statusCode < 200 || statusCode > 299 {
+        return &statusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+    }
+    return &statusCode, nil
+}
@@ -0,0 +1,351 @@
+package service
+
+import (
+    "context"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/jmoiron/sqlx"
+    "github.com/stretchr/testify/require"
+    "github.com/yaoweihua/wallet-service/auth"
+    "github.com/yaoweihua/wallet-service/events"
+    "github.com/yaoweihua/wallet-service/model"
+)
+
+// Columns of webhook endpoints and deliveries, in the order the repository selects them
+var (
+    webhookEndpointColumns = []string{"id", "user_id", "url", "secret", "event_types", "status", "created_at", "updated_at"}
+    webhookDeliveryColumns = []string{"id", "endpoint_id", "event_id", "event_type", "payload", "status", "attempts", "next_attempt_at", "last_status_code", "last_error", "delivered_at", "created_at", "updated_at"}
+)
+
+// testWebhookPayload is the body posted for the deliveries of the tests
+const testWebhookPayload = `{"id":9,"type":"balance.changed","aggregate_type":"wallet","aggregate_id":"1:USD","payload":{"user_id":1},"created_at":"2024-11-12T18:35:41Z"}`
+
+func newTestWebhookService(t *testing.T) (*WebhookService, sqlmock.Sqlmock) {
+    db, mock, err := sqlmock.New()
+    require.NoError(t, err)
+    t.Cleanup(func() { db.Close() }) // nolint:errcheck
+
+    opts := DefaultWebhookOptions()
+    opts.Timeout = time.Second
+    webhookService := NewWebhookService(sqlx.NewDb(db, "sqlmock"), opts)
+    webhookService.lookupIP = lookupTestHost
+    return webhookService, mock
+}
+
+// lookupTestHost resolves the hosts of the tests without a DNS server
+func lookupTestHost(_ context.Context, host string) ([]net.IPAddr, error) {
+    hosts := map[string][]string{
+        "shop.example.com":     {"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"},
+        "localhost":            {"127.0.0.1", "::1"},
+        "internal.example.com": {"93.184.216.34", "10.0.0.5"},
+        "metadata.example.com": {"169.254.169.254"},
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        return []net.IPAddr{{IP: ip}}, nil
+    }
+    addrs, ok := hosts[host]
+    if !ok {
+        return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+    }
+    var ips []net.IPAddr
+    for _, addr := range addrs {
+        ips = append(ips, net.IPAddr{IP: net.ParseIP(addr)})
+    }
+    return ips, nil
+}
+
+// testWebhookClaim is the time due deliveries are claimed until in the tests
+var testWebhookClaim = time.Date(2024, 11, 12, 18, 36, 41, 0, time.UTC)
+
+// expectDueDelivery expects the pending delivery that has been due the longest to be claimed, followed by its endpoint
+func expectDueDelivery(mock sqlmock.Sqlmock, deliveryID int64, attempts int, endpointURL, status string) {
+    mock.ExpectQuery("UPDATE webhook_deliveries SET next_attempt_at = \\$2, updated_at = NOW\\(\\) WHERE id = \\( SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= \\$1 ORDER BY next_attempt_at, id LIMIT 1 FOR UPDATE SKIP LOCKED \\) RETURNING").
+        WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+            AddRow(deliveryID, 3, 9, "balance.changed", []byte(testWebhookPayload), "pending", attempts, testWebhookClaim, nil, "", nil, time.Now(), time.Now()))
+    mock.ExpectQuery("SELECT (.+) FROM webhook_endpoints WHERE id = \\$1").
+        WithArgs(3).
+        WillReturnRows(sqlmock.NewRows(webhookEndpointColumns).
+            AddRow(3, 1, endpointURL, "whsec_test", "{balance.changed}", status, time.Now(), time.Now()))
+}
+
+// expectNoDueDelivery expects no delivery to be due
+func expectNoDueDelivery(mock sqlmock.Sqlmock) {
+    mock.ExpectQuery("UPDATE webhook_deliveries SET next_attempt_at").
+        WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns))
+}
+
+// expectClaimedDelivery expects the transaction recording the outcome of an attempt to lock the delivery, which is
+// still claimed until the given time
+func expectClaimedDelivery(mock sqlmock.Sqlmock, deliveryID int64, attempts int, claimedUntil time.Time) {
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM webhook_deliveries WHERE id = \\$1 FOR UPDATE").
+        WithArgs(deliveryID).
+        WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+            AddRow(deliveryID, 3, 9, "balance.changed", []byte(testWebhookPayload), "pending", attempts, claimedUntil, nil, "", nil, time.Now(), time.Now()))
+}
+
+// expectDeliveryUpdate expects the outcome of an attempt to be stored
+func expectDeliveryUpdate(mock sqlmock.Sqlmock, deliveryID int64, status string, attempts int, nextAttempt, statusCode, lastError, deliveredAt interface{}) {
+    mock.ExpectQuery("UPDATE webhook_deliveries").
+        WithArgs(deliveryID, status, attempts, nextAttempt, statusCode, lastError, deliveredAt).
+        WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(time.Now()))
+}
+
+func TestWebhookService_RegisterEndpoint(t *testing.T) {
+    webhookService, mock := newTestWebhookService(t)
+
+    mock.ExpectQuery("INSERT INTO webhook_endpoints").
+        WithArgs(1, "https://shop.example.com/hooks", sqlmock.AnyArg(), `{"transaction.completed","balance.changed"}`, "active").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, time.Now(), time.Now()))
+
+    endpoint, secret, err := webhookService.RegisterEndpoint(context.Background(), 1, " https://shop.example.com/hooks ",
+        []string{"balance.changed", "transaction.completed", "balance.changed"})
+    require.NoError(t, err)
+    require.Equal(t, 3, endpoint.ID)
+    require.Equal(t, endpoint.Secret, secret)
+    require.Contains(t, secret, auth.WebhookSecretPrefix)
+
+    _, _, err = webhookService.RegisterEndpoint(context.Background(), 1, "ftp://shop.example.com/hooks", nil)
+    require.ErrorIs(t, err, ErrInvalidWebhook)
+
+    _, _, err = webhookService.RegisterEndpoint(context.Background(), 1, "http://shop.example.com/hooks", nil)
+    require.ErrorIs(t, err, ErrInvalidWebhook)
+
+    _, _, err = webhookService.RegisterEndpoint(context.Background(), 1, "https://shop.example.com/hooks", []string{"transaction.pending"})
+    require.ErrorIs(t, err, ErrInvalidWebhook)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that endpoints whose host does not resolve, or resolves to any address that is not public, are refused
+func TestWebhookService_RegisterEndpoint_PrivateAddresses(t *testing.T) {
+    webhookService, mock := newTestWebhookService(t)
+
+    for _, endpointURL := range []string{
+        "https://localhost/hooks",
+        "https://127.0.0.1:8443/hooks",
+        "https://[::1]/hooks",
+        "https://10.1.2.3/hooks",
+        "https://192.168.0.1/hooks",
+        "https://169.254.169.254/latest/meta-data",
+        "https://100.64.0.1/hooks",
+        "https://0.0.0.0/hooks",
+        "https://internal.example.com/hooks",
+        "https://metadata.example.com/hooks",
+        "https://unknown.example.com/hooks",
+    } {
+        _, _, err := webhookService.RegisterEndpoint(context.Background(), 1, endpointURL, nil)
+        require.ErrorIs(t, err, ErrInvalidWebhook, endpointURL)
+    }
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that an event becomes a delivery to the endpoints of both users of a transfer, and other events are ignored
+func TestWebhookService_Publish(t *testing.T) {
+    webhookService, mock := newTestWebhookService(t)
+    var publisher events.Publisher = webhookService
+
+    event := model.OutboxEvent{
+        ID:            9,
+        EventType:     "transaction.completed",
+        AggregateType: model.AggregateTransaction,
+        AggregateID:   "14",
+        Payload:       []byte(`{"id":14,"from_user_id":1,"to_user_id":2,"amount":"50"}`),
+        CreatedAt:     time.Now(),
+    }
+
+    mock.ExpectQuery("SELECT (.+) FROM webhook_endpoints WHERE user_id = ANY\\(\\$1\\) AND status = 'active' AND \\$2 = ANY\\(event_types\\)").
+        WithArgs("{1,2}", "transaction.completed").
+        WillReturnRows(sqlmock.NewRows(webhookEndpointColumns).
+            AddRow(3, 1, "https://shop.example.com/hooks", "whsec_a", "{transaction.completed}", "active", time.Now(), time.Now()).
+            AddRow(4, 2, "https://other.example.com/hooks", "whsec_b", "{transaction.completed,transaction.failed}", "active", time.Now(), time.Now()))
+    mock.ExpectExec("INSERT INTO webhook_deliveries (.+) ON CONFLICT \\(endpoint_id, event_id\\) DO NOTHING").
+        WithArgs(3, 9, "transaction.completed", sqlmock.AnyArg(), 4, 9, "transaction.completed", sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+
+    require.NoError(t, publisher.Publish(context.Background(), event))
+
+    event.EventType = "transaction.pending"
+    require.NoError(t, publisher.Publish(context.Background(), event))
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that a delivery is posted with a signature the endpoint can verify, and acknowledged by its 2xx response
+func TestWebhookService_DeliverDue(t *testing.T) {
+    var received *http.Request
+    var body []byte
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        received = r
+        body, _ = io.ReadAll(r.Body)
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    defer server.Close()
+
+    webhookService, mock := newTestWebhookService(t)
+    webhookService.allowPrivateAddresses = true
+
+    expectDueDelivery(mock, 5, 0, server.URL, "active")
+    expectClaimedDelivery(mock, 5, 0, testWebhookClaim)
+    expectDeliveryUpdate(mock, 5, "succeeded", 1, nil, http.StatusNoContent, "", sqlmock.AnyArg())
+    mock.ExpectCommit()
+    expectNoDueDelivery(mock)
+
+    attempted, err := webhookService.DeliverDue(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 1, attempted)
+
+    require.NotNil(t, received)
+    require.JSONEq(t, testWebhookPayload, string(body))
+    require.Equal(t, "5", received.Header.Get(WebhookDeliveryHeader))
+    require.Equal(t, "9", received.Header.Get(events.EventIDHeader))
+    require.Equal(t, "balance.changed", received.Header.Get(events.EventTypeHeader))
+    err = auth.VerifyWebhookSignature("whsec_test", received.Header.Get(WebhookTimestampHeader), body,
+        received.Header.Get(WebhookSignatureHeader), time.Now(), time.Minute)
+    require.NoError(t, err)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that a failed attempt is retried later, that the last attempt dead-letters the delivery, and that deliveries
+// of a disabled endpoint are dead-lettered without being posted
+func TestWebhookService_DeliverDue_Failures(t *testing.T) {
+    posted := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        posted++
+        w.WriteHeader(http.StatusInternalServerError)
+    }))
+    defer server.Close()
+
+    webhookService, mock := newTestWebhookService(t)
+    webhookService.allowPrivateAddresses = true
+
+    expectDueDelivery(mock, 5, 0, server.URL, "active")
+    expectClaimedDelivery(mock, 5, 0, testWebhookClaim)
+    expectDeliveryUpdate(mock, 5, "pending", 1, sqlmock.AnyArg(), http.StatusInternalServerError, "endpoint answered 500 Internal Server Error", nil)
+    mock.ExpectCommit()
+    expectDueDelivery(mock, 6, 7, server.URL, "active")
+    expectClaimedDelivery(mock, 6, 7, testWebhookClaim)
+    expectDeliveryUpdate(mock, 6, "dead", 8, nil, http.StatusInternalServerError, "endpoint answered 500 Internal Server Error", nil)
+    mock.ExpectCommit()
+    expectDueDelivery(mock, 7, 2, server.URL, "disabled")
+    expectClaimedDelivery(mock, 7, 2, testWebhookClaim)
+    expectDeliveryUpdate(mock, 7, "dead", 2, nil, nil, "webhook endpoint is disabled", nil)
+    mock.ExpectCommit()
+    expectNoDueDelivery(mock)
+
+    attempted, err := webhookService.DeliverDue(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 3, attempted)
+    require.Equal(t, 2, posted)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that the outcome of an attempt is dropped once the delivery has been claimed again by another instance
+func TestWebhookService_DeliverDue_ClaimExpired(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    defer server.Close()
+
+    webhookService, mock := newTestWebhookService(t)
+    webhookService.allowPrivateAddresses = true
+
+    expectDueDelivery(mock, 5, 0, server.URL, "active")
+    expectClaimedDelivery(mock, 5, 0, testWebhookClaim.Add(time.Minute))
+    mock.ExpectCommit()
+    expectNoDueDelivery(mock)
+
+    attempted, err := webhookService.DeliverDue(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 1, attempted)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that a delivery is not posted to an address that is not public, even if its host resolved to a public one when
+// the endpoint was registered, and that redirects are not followed
+func TestWebhookService_DeliverDue_PrivateAddress(t *testing.T) {
+    posted := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        posted++
+        http.Redirect(w, r, "/elsewhere", http.StatusTemporaryRedirect)
+    }))
+    defer server.Close()
+
+    webhookService, mock := newTestWebhookService(t)
+
+    expectDueDelivery(mock, 5, 0, server.URL, "active")
+    expectClaimedDelivery(mock, 5, 0, testWebhookClaim)
+    mock.ExpectQuery("UPDATE webhook_deliveries").
+        WithArgs(5, "pending", 1, sqlmock.AnyArg(), nil, sqlmock.AnyArg(), nil).
+        WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(time.Now()))
+    mock.ExpectCommit()
+    expectNoDueDelivery(mock)
+
+    _, err := webhookService.DeliverDue(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 0, posted)
+
+    webhookService.allowPrivateAddresses = true
+    expectDueDelivery(mock, 6, 0, server.URL, "active")
+    expectClaimedDelivery(mock, 6, 0, testWebhookClaim)
+    expectDeliveryUpdate(mock, 6, "pending", 1, sqlmock.AnyArg(), http.StatusTemporaryRedirect, "endpoint answered 307 Temporary Redirect", nil)
+    mock.ExpectCommit()
+    expectNoDueDelivery(mock)
+
+    _, err = webhookService.DeliverDue(context.Background())
+    require.NoError(t, err)
+    require.Equal(t, 1, posted)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// Test that the delay between attempts doubles from the base delay up to the longest delay
+func TestWebhookBackoff(t *testing.T) {
+    opts := DefaultWebhookOptions()
+
+    require.Equal(t, 30*time.Second, webhookBackoff(opts, 1))
+    require.Equal(t, time.Minute, webhookBackoff(opts, 2))
+    require.Equal(t, 4*time.Minute, webhookBackoff(opts, 4))
+    require.Equal(t, 32*time.Minute, webhookBackoff(opts, 7))
+    require.Equal(t, time.Hour, webhookBackoff(opts, 8))
+    require.Equal(t, time.Hour, webhookBackoff(opts, 100))
+}
+
+// Test that only a dead delivery can be retried, getting a fresh set of attempts
+func TestWebhookService_RetryDelivery(t *testing.T) {
+    webhookService, mock := newTestWebhookService(t)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM webhook_deliveries WHERE id = \\$1 FOR UPDATE").
+        WithArgs(5).
+        WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+            AddRow(5, 3, 9, "balance.changed", []byte(testWebhookPayload), "dead", 8, nil, 500, "endpoint answered 500 Internal Server Error", nil, time.Now(), time.Now()))
+    expectDeliveryUpdate(mock, 5, "pending", 0, sqlmock.AnyArg(), 500, "endpoint answered 500 Internal Server Error", nil)
+    mock.ExpectCommit()
+
+    delivery, err := webhookService.RetryDelivery(context.Background(), 5)
+    require.NoError(t, err)
+    require.Equal(t, model.WebhookDeliveryPending, delivery.Status)
+    require.Equal(t, 0, delivery.Attempts)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery("SELECT (.+) FROM webhook_deliveries WHERE id = \\$1 FOR UPDATE").
+        WithArgs(6).
+        WillReturnRows(sqlmock.NewRows(webhookDeliveryColumns).
+            AddRow(6, 3, 9, "balance.changed", []byte(testWebhookPayload), "succeeded", 1, nil, 200, "", time.Now(), time.Now(), time.Now()))
+    mock.ExpectRollback()
+
+    _, err = webhookService.RetryDelivery(context.Background(), 6)
+    require.ErrorIs(t, err, ErrWebhookDeliveryNotDead)
+
+    require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -3,13 +3,14 @@ package service
 import (
     "context"
     "fmt"
-    "sync"
+    "time"
+    "github.com/yaoweihua/wallet-service/lock"
+    "github.com/yaoweihua/wallet-service/model"
     "github.com/yaoweihua/wallet-service/repository"
     "github.com/yaoweihua/wallet-service/utils"
     "github.com/shopspring/decimal"
     "github.com/jmoiron/sqlx"
     "github.com/go-redis/redis/v8"
-    "time"
 )
 
 // WithdrawService provides methods for handling withdrawal operations.
@@ -17,53 +18,106 @@ import (
 type WithdrawService struct {
     walletRepo      *repository.WalletRepository
     transactionRepo *repository.TransactionRepository
+    ledgerRepo      *repository.LedgerRepository
+    outboxRepo      *repository.OutboxRepository
+    limitRepo       *repository.LimitRepository
     dbConn          *sqlx.DB
     redisClient     *redis.Client
+    locker          lock.Locker
+    mode            ConcurrencyMode
+    fees            *FeeSchedule
+    methods         *PaymentMethodRegistry
+    limits          *LimitSchedule
 }
 
 // NewWithdrawService creates a new instance of WithdrawService.
-// It initializes the service with the provided database connection and Redis client,
+// It initializes the service with the provided database connection, Redis client, the locker guarding user balances
+// the concurrency mode protecting balance updates in the database, the fee schedule pricing withdrawals
+// the registry of payment methods, nil selecting DefaultPaymentMethods, and the transaction limits, nil for none,
 // and sets up the necessary repositories for wallet and transaction management.
-func NewWithdrawService(dbConn *sqlx.DB, redisClient *redis.Client) *WithdrawService {
+func NewWithdrawService(dbConn *sqlx.DB, redisClient *redis.Client, locker lock.Locker, mode ConcurrencyMode, fees *FeeSchedule, methods *PaymentMethodRegistry, limits *LimitSchedule) *WithdrawService {
     walletRepo := repository.NewWalletRepository(dbConn)
     transactionRepo := repository.NewTransactionRepository(dbConn)
+    ledgerRepo := repository.NewLedgerRepository(dbConn)
+    if methods == nil {
+        methods = DefaultPaymentMethods()
+    }
 
     return &WithdrawService{
         walletRepo:      walletRepo,
         transactionRepo: transactionRepo,
+        ledgerRepo:      ledgerRepo,
+        outboxRepo:      repository.NewOutboxRepository(dbConn),
+        limitRepo:       repository.NewLimitRepository(dbConn),
         dbConn:          dbConn,
         redisClient:     redisClient,
+        locker:          locker,
+        mode:            mode,
+        fees:            fees,
+        methods:         methods,
+        limits:          limits,
     }
 }
 
-// Withdraw function handles the logic of withdrawing money
-func (s *WithdrawService) Withdraw(userID int, amount decimal.Decimal) error {
-    // Acquire the user lock to prevent concurrent conflicts
-    logger := utils.GetLogger()
-    lock, ok := userLocks.LoadOrStore(userID, &sync.Mutex{})
-    if !ok {
-        logger.Warnf("Lock for user %d was newly created", userID)
+// Withdraw function handles the logic of withdrawing money from the user's wallet in the given currency.
+// An empty currency selects model.DefaultCurrency. The payment must use a method of the registry enabled for withdrawals,
+// within its limits, the withdrawal must stay within the transaction limits of the user, see LimitSchedule, and the withdrawal fee, which may depend on the method, is debited on top of the amount.
+// A withdrawal through a method that settles asynchronously is recorded as pending and only holds the funds,
+// see SettlementService.
+// When an idempotency key is given and a withdrawal was already recorded with it, the original
+// transaction is returned and the replayed flag is set instead of withdrawing the money again.
+func (s *WithdrawService) Withdraw(userID int, currency string, amount decimal.Decimal, payment Payment, idempotencyKey string) (*model.Transaction, bool, error) {
+    // Acquire the user lock to prevent concurrent conflicts, across all instances of the service
+    ctx := context.Background()
+    locks, err := lockBalances(ctx, s.locker, userID)
+    if err != nil {
+        return nil, false, err
     }
+    defer unlockBalances(ctx, locks)
 
-    userLock, ok := lock.(*sync.Mutex)
-    if !ok {
-        return fmt.Errorf("failed to assert lock as *sync.Mutex for user %d", userID)
+    // Check whether the withdrawal amount is reasonable and fits the currency
+    currency, err = validateMoney("Withdraw", amount, currency)
+    if err != nil {
+        return nil, false, err
     }
 
-    userLock.Lock()
-    defer userLock.Unlock()
+    // Check that the payment method is enabled for the withdrawal of the amount, and mask its details
+    authorized, err := s.methods.authorize("withdraw", payment, currency, amount)
+    if err != nil {
+        return nil, false, err
+    }
 
-    // Check whether the deposit amount is reasonable
-    if amount.LessThanOrEqual(decimal.Zero) {
-        return fmt.Errorf("Withdraw amount must be greater than zero")
+    fee := s.fees.Calculate("withdraw", authorized.method, currency, amount)
+
+    txn, replayed, err := withConcurrencyRetry(s.mode, func() (*model.Transaction, bool, error) {
+        return s.withdraw(ctx, locks, userID, currency, amount, fee, authorized, idempotencyKey)
+    })
+    if err != nil {
+        // The attempt has been rolled back by now, so a rejected withdrawal is recorded on its own
+        recordRejection(ctx, s.transactionRepo, s.outboxRepo, s.dbConn, &model.Transaction{
+            FromUserID:      userID,
+            ToUserID:        0,
+            Amount:          amount,
+            Currency:        currency,
+            TransactionType: "withdraw",
+            TransactionFee:  fee,
+            PaymentMethod:   authorized.method,
+            PaymentMetadata: authorized.metadata,
+        }, err)
+        return nil, false, err
     }
+    return txn, replayed, nil
+}
+
+// withdraw runs a single attempt of the withdrawal inside one database transaction, while the user lock is held.
+func (s *WithdrawService) withdraw(ctx context.Context, locks []lock.Lock, userID int, currency string, amount, fee decimal.Decimal, payment authorizedPayment, idempotencyKey string) (*model.Transaction, bool, error) {
+    logger := utils.GetLogger()
 
     // Begin the database transaction
     conn := s.dbConn
-    ctx := context.Background()
     tx, err := conn.Beginx()
     if err != nil {
-        return fmt.Errorf("failed to start transaction: %w", err)
+        return nil, false, fmt.Errorf("failed to start transaction: %w", err)
     }
 
     defer func() {
@@ -73,40 +127,96 @@ func (s *WithdrawService) Withdraw(userID int, amount decimal.Decimal) error {
         }
     }()
 
-    // Query the current balance of the user, using row-level locking to ensure balance consistency
-    user, err := s.walletRepo.GetUserBalance(ctx, userID)
+    // Return the original withdrawal if this request is a replay of an earlier one
+    fingerprint := requestFingerprint("withdraw", userID, 0, currency, amount, payment.method)
+    replayed, err := findReplay(ctx, s.transactionRepo, tx, userID, idempotencyKey, fingerprint)
+    if err != nil {
+        return nil, false, err
+    }
+    if replayed != nil {
+        return replayed, true, nil
+    }
+
+    // Query the current balance of the user's wallet inside the transaction, using a row-level lock unless running in optimistic mode
+    wallet, err := readWallet(ctx, s.walletRepo, tx, s.mode, userID, currency)
     if err != nil {
-        return err
+        return nil, false, err
     }
 
-    // Ensure that the balance is sufficient
-    if user.Balance.LessThan(amount) {
-        return fmt.Errorf("Insufficient balance")
+    // Suspended accounts cannot send money
+    if err := checkCanSend(wallet); err != nil {
+        return nil, false, err
     }
 
-    // Calculate the new balance
-    newBalance := user.Balance.Sub(amount)
+    // Make sure the balance lock has not been taken over by another request in the meantime
+    if err := checkFence(ctx, s.walletRepo, tx, locks, userID); err != nil {
+        return nil, false, err
+    }
+
+    // Ensure that the part of the balance not held for pending withdrawals covers the amount and the fee
+    debit := amount.Add(fee)
+    if wallet.Available().LessThan(debit) {
+        return nil, false, reject(model.FailureReasonInsufficientBalance, ErrInsufficientBalance)
+    }
 
-    // Update the user's balance
-    if err := s.walletRepo.UpdateBalance(ctx, tx, userID, newBalance); err != nil {
-        return err
+    // Ensure that the withdrawal stays within the limits of the user's KYC tier, and count it towards them
+    if err := s.limits.enforce(ctx, s.limitRepo, tx, wallet, "withdraw", amount, time.Now()); err != nil {
+        return nil, false, err
+    }
+
+    // A payout that settles asynchronously only holds the funds until it is settled, the others debit them right away
+    status := model.TransactionStatusCompleted
+    var changes []model.BalanceChange
+    if payment.async {
+        status = model.TransactionStatusPending
+        err = s.walletRepo.UpdateFunds(ctx, tx, wallet.ID, wallet.Balance, wallet.Held.Add(debit), wallet.Version)
+    } else {
+        err = s.walletRepo.UpdateBalance(ctx, tx, wallet.ID, wallet.Balance.Sub(debit), wallet.Version)
+        changes = append(changes, balanceChange(wallet, wallet.Balance.Sub(debit)))
+    }
+    if err != nil {
+        return nil, false, err
     }
 
     // Record the withdrawal transaction
-    if err := s.transactionRepo.RecordTransaction(ctx, tx, userID, 0, amount, "withdraw", "completed"); err != nil { // ToUserID = 0
-        return err
+    txn := &model.Transaction{
+        FromUserID:        userID,
+        ToUserID:          0,
+        Amount:            amount,
+        Currency:          currency,
+        TransactionType:   "withdraw",
+        TransactionStatus: status,
+        TransactionFee:    fee,
+        PaymentMethod:     payment.method,
+        PaymentMetadata:   payment.metadata,
+    }
+    if idempotencyKey != "" {
+        txn.IdempotencyKey = idempotencyKey
+        txn.RequestHash = fingerprint
+    }
+    if err := recordTransaction(ctx, s.transactionRepo, tx, txn); err != nil {
+        return nil, false, err
+    }
+
+    // Post a completed withdrawal to the ledger, a pending one is posted when it settles
+    if status == model.TransactionStatusCompleted {
+        if err := postPayout(ctx, s.ledgerRepo, tx, txn); err != nil {
+            return nil, false, err
+        }
+    }
+
+    // Raise the events of the withdrawal, a held payout changes the balance when it settles
+    if err := recordEvents(ctx, s.outboxRepo, tx, txn, changes...); err != nil {
+        return nil, false, err
     }
 
     // Commit the transaction
     if err := tx.Commit(); err != nil {
-        return fmt.Errorf("failed to commit transaction: %w", err)
+        return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
     }
 
-    // Update the Redis cache
-    cacheKey := fmt.Sprintf("balance:%d", userID)
-    if err := s.redisClient.Set(ctx, cacheKey, newBalance.String(), time.Second*3600); err != nil {
-        logger.Warnf("Warning: failed to cache balance: %v", err)
-    }
+    // Evict the cached balances, they are read from the database again on the next request
+    invalidateBalances(ctx, s.redisClient, userID)
 
-    return nil
+    return txn, false, nil
 }
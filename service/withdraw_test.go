@@ -7,6 +7,7 @@ import (
     "github.com/stretchr/testify/require"
     "github.com/jmoiron/sqlx"
     redismock "github.com/go-redis/redismock/v8"
+    "github.com/yaoweihua/wallet-service/lock"
     "fmt"
     "time"
 )
@@ -20,31 +21,33 @@ func TestWithdrawService_Withdraw_Success(t *testing.T) {
     defer redisClient.Close() // nolint:errcheck
 
     // Set the Redis operation expectations
-    mockRedis.ExpectSet("balance:1", "100", time.Second*3600).SetVal("")
+    mockRedis.ExpectDel("balances:1").SetVal(1)
 
     // Create an instance of the withdrawal service and pass in the mock Redis client
-    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil, nil)
 
     mock.ExpectBegin()
 
     // The expectation of querying the current balance
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1").
-        WithArgs(1).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(1, decimal.NewFromInt(150)))
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(150), "active")
 
     // The expectation of updating the balance
-    mock.ExpectExec("UPDATE users SET balance = \\$1, updated_at = \\$2 WHERE id = \\$3").
-        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1).
+    mock.ExpectExec("UPDATE wallets SET balance = \\$1, version = version \\+ 1, updated_at = \\$2 WHERE id = \\$3 AND version = \\$4").
+        WithArgs(decimal.NewFromInt(100), sqlmock.AnyArg(), 1, int64(0)).
         WillReturnResult(sqlmock.NewResult(1, 1))
 
     // The expectation of inserting the transaction record
-    mock.ExpectExec("INSERT INTO transactions").
-        WithArgs(1, 0, decimal.NewFromInt(50), "withdraw", "completed", decimal.NewFromFloat(0.0), "credit_card").
-        WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "withdraw", "completed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, nil, nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+
+    // The expectations of posting the movement to the ledger
+    expectLedgerMovement(mock, 1, "withdraw", "user:1:USD", "system:external_payout:USD", decimal.NewFromInt(50))
 
+    expectEvents(mock, "transaction.completed", "balance.changed")
     mock.ExpectCommit()
 
-    err = withdrawService.Withdraw(1, decimal.NewFromInt(50))
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(50), Payment{}, "")
     require.NoError(t, err)
 
     // Check whether all the expectations are fully matched
@@ -64,17 +67,24 @@ func TestWithdrawService_Withdraw_InsufficientBalance(t *testing.T) {
     redisClient, mockRedis := redismock.NewClientMock()
     defer redisClient.Close() // nolint:errcheck
 
-    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil, nil)
 
     mock.ExpectBegin()
 
     // The expectation of querying the current balance (with insufficient balance)
-    mock.ExpectQuery("SELECT id, balance FROM users WHERE id = \\$1").
-        WithArgs(1).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(1, decimal.NewFromInt(30)))
+    expectWalletRead(mock, 1, "USD", decimal.NewFromInt(30), "active")
+
+    // The attempt is rolled back, and the failed withdrawal is recorded outside of it
+    mock.ExpectRollback()
+    mock.ExpectBegin()
+    mock.ExpectQuery("INSERT INTO transactions").
+        WithArgs(1, 0, decimal.NewFromInt(50), "USD", "withdraw", "failed", decimal.NewFromFloat(0.0), "credit_card", nil, nil, "insufficient_balance", nil, nil, nil, nil, nil, nil).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+    expectEvents(mock, "transaction.failed")
+    mock.ExpectCommit()
 
     // The withdrawal amount is greater than the current balance
-    err = withdrawService.Withdraw(1, decimal.NewFromInt(50))
+    _, _, err = withdrawService.Withdraw(1, "USD", decimal.NewFromInt(50), Payment{}, "")
 
     require.Error(t, err)
     require.Equal(t, "Insufficient balance", err.Error())
@@ -96,7 +106,7 @@ func TestWithdrawService_Withdraw_InvalidAmount(t *testing.T) {
     redisClient, mockRedis := redismock.NewClientMock()
     defer redisClient.Close() // nolint:errcheck
 
-    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient)
+    withdrawService := NewWithdrawService(sqlx.NewDb(db, "sqlmock"), redisClient, lock.NewLocalLocker(lock.DefaultOptions()), PessimisticConcurrency, nil, nil, nil)
 
     // Invalid amount test
     invalidAmounts := []decimal.Decimal{
@@ -106,7 +116,7 @@ func TestWithdrawService_Withdraw_InvalidAmount(t *testing.T) {
 
     for _, amount := range invalidAmounts {
         t.Run(fmt.Sprintf("withdraw amount: %s", amount.String()), func(t *testing.T) {
-            err := withdrawService.Withdraw(1, amount)
+            _, _, err := withdrawService.Withdraw(1, "USD", amount, Payment{}, "")
 
             require.Error(t, err)
             require.Equal(t, "Withdraw amount must be greater than zero", err.Error())
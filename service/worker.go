@@ -0,0 +1,25 @@
+package service
+
+import (
+    "context"
+    "time"
+    "github.com/yaoweihua/wallet-service/utils"
+)
+
+// runPeriodically calls run every interval until the context is cancelled. Errors are logged under the
+// worker's name and the next run goes ahead regardless, so a temporary failure does not stop the worker.
+func runPeriodically(ctx context.Context, name string, interval time.Duration, run func(ctx context.Context) (int, error)) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if _, err := run(ctx); err != nil {
+                utils.GetLogger().Errorf("Error: %s run failed: %v", name, err)
+            }
+        }
+    }
+}